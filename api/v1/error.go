@@ -2,10 +2,12 @@ package log_v1
 
 import (
 	"fmt"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	codes "google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // 恐らく、GRPCStatus()と、Error()を継承した構造体は、error型であるとされる。
@@ -37,3 +39,115 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrBackpressureは、コミット待ちの書き込みが上限に達したときに返す。時間をおいて再送すればよい
+type ErrBackpressure struct {
+	// 上限に達したコミット待ちの数
+	Pending int
+}
+
+// 再送まで待ってほしい時間(秒)
+const BackpressureRetryAfterSeconds = 1
+
+func (e ErrBackpressure) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("too many pending commits: %d", e.Pending),
+	)
+	d := &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(BackpressureRetryAfterSeconds * time.Second),
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrBackpressure) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordTooLargeは、エンコードしたレコードの大きさが上限を超えていて書き込めないときに返す
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d bytes exceeds the limit of %d", e.Size, e.Max),
+	)
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrSegmentFullは、segmentのindexにエントリを書き込む余地が無いときに返す。
+// ログは新しいsegmentに切り替えて書き込むので、普通はクライアントまでは届かない
+type ErrSegmentFull struct{}
+
+func (e ErrSegmentFull) GRPCStatus() *status.Status {
+	return status.New(codes.ResourceExhausted, "segment is full")
+}
+
+func (e ErrSegmentFull) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStaleSequenceは、producerがすでに確認応答を受けたシーケンス番号より古いレコードを書き込もうとしたときに返す。
+// 直前のシーケンス番号の再送であれば、エラーにせずに書き込み済みのオフセットを返す
+type ErrStaleSequence struct {
+	ProducerID string
+	Sequence   uint64
+	// そのproducerが最後に書き込んだシーケンス番号
+	Last uint64
+}
+
+func (e ErrStaleSequence) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("stale sequence %d for producer %q: last written is %d", e.Sequence, e.ProducerID, e.Last),
+	)
+}
+
+func (e ErrStaleSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordRejectedは、AppendHookがレコードの書き込みを断ったときや、ログが付けるフィールドを持つレコードを書き込もうとしたときに返す
+type ErrRecordRejected struct {
+	Reason string
+}
+
+func (e ErrRecordRejected) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record rejected: %s", e.Reason),
+	)
+}
+
+func (e ErrRecordRejected) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrQuotaExceededは、クォータの上限に達したトピックに書き込もうとしたときに返す
+type ErrQuotaExceeded struct {
+	Topic string
+	// トピックの今の合計バイト数
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	return status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("topic %q exceeds its quota: %d bytes of %d", e.Topic, e.Size, e.Max),
+	)
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	pllog "proglog/internal/log"
+)
+
+// ログのディレクトリを直接読み書きする。
+//
+//	logtool -data-dir data export > records.jsonl
+//	logtool -data-dir data import < records.jsonl
+//
+// exportは読み取り専用で開くので、サーバーが書き込んでいる最中のログも読める。
+// importはログをロックするので、サーバーを止めてから使う
+func main() {
+	dataDir := flag.String("data-dir", "data", "directory the log is stored in")
+	flag.Parse()
+
+	switch cmd := flag.Arg(0); cmd {
+	case "export":
+		commitLog, err := pllog.OpenReadOnly(*dataDir, pllog.Config{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer commitLog.Close()
+		if err := commitLog.Export(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "import":
+		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		commitLog, err := pllog.NewLog(*dataDir, pllog.Config{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := commitLog.Import(os.Stdin)
+		if closeErr := commitLog.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "imported %d records\n", n)
+	default:
+		log.Fatalf("unknown command %q: want export or import", cmd)
+	}
+}
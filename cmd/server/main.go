@@ -1,11 +1,185 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"proglog/internal/config"
+	pllog "proglog/internal/log"
 	"proglog/internal/server"
 )
 
 func main() {
-	srv := server.NetHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	transport := flag.String("transport", "http", "serve the log over http or grpc")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dataDir := flag.String("data-dir", "data", "directory to store the log in")
+	certFile := flag.String("tls-cert", "", "server certificate for tls; required unless -insecure")
+	keyFile := flag.String("tls-key", "", "server private key for tls; required unless -insecure")
+	caFile := flag.String("tls-ca", "", "CA to verify client certificates with; http clients need no certificate if empty, grpc requires it")
+	insecure := flag.Bool("insecure", false, "serve in plaintext without tls, for local development")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+	topicsDir := flag.String("topics-dir", "", "directory to store named topics in; topics are disabled if empty (grpc only)")
+	maxTopics := flag.Int("max-topics", 0, "how many topics produce requests may create; 0 for no limit")
+	topicPartitions := flag.Int("topic-partitions", 1, "number of partitions for topics created by produce requests")
+	flag.Parse()
+
+	// 証明書の誤りで抜けるときに、ログを開いたままにしないよう先に読む
+	tlsConfig, err := serverTLSConfig(*transport, *certFile, *keyFile, *caFile, *insecure)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	commitLog, err := pllog.NewLog(*dataDir, pllog.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var topics *pllog.LogManager
+	if *topicsDir != "" {
+		if *transport != "grpc" {
+			log.Fatal("-topics-dir needs -transport grpc")
+		}
+		topics, err = pllog.NewLogManager(*topicsDir, pllog.Config{}, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		topics.MaxTopics = *maxTopics
+		topics.Partitions = *topicPartitions
+	}
+
+	// indexは閉じるときに実際のサイズへ切り詰められるので、終了時には必ずログを閉じる。
+	// サーバーが失敗したときもlog.Fatalで抜けず、errcで知らせてからログを閉じる
+	var shutdown func(ctx context.Context)
+	errc := make(chan error, 1)
+	switch *transport {
+	case "http":
+		srv := server.NetHTTPServer(*addr, commitLog, nil)
+		srv.TLSConfig = tlsConfig
+		shutdown = func(ctx context.Context) {
+			// 期限までに終わらなかったリクエストは、接続を切って打ち切る
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("failed to drain http requests: %v", err)
+				srv.Close()
+			}
+		}
+		go func() {
+			serve := srv.ListenAndServe
+			if srv.TLSConfig != nil {
+				serve = func() error { return srv.ListenAndServeTLS("", "") }
+			}
+			if err := serve(); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	case "grpc":
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		serverConfig := &server.Config{
+			CommitLog:  commitLog,
+			Authorizer: allowAll{},
+		}
+		if topics != nil {
+			serverConfig.Topics = topics
+		}
+		srv, err := server.NewGRPCServer(serverConfig, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shutdown = func(ctx context.Context) {
+			drained := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+			case <-ctx.Done():
+				log.Printf("failed to drain grpc requests: %v", ctx.Err())
+				srv.Stop()
+			}
+		}
+		go func() {
+			if err := srv.Serve(ln); err != nil {
+				errc <- err
+			}
+		}()
+	default:
+		log.Fatalf("unknown transport %q", *transport)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	var serveErr error
+	select {
+	case sig := <-sigc:
+		log.Printf("received %v, shutting down", sig)
+	case serveErr = <-errc:
+		log.Printf("server failed: %v", serveErr)
+	}
+	// 新しい接続の受け付けをやめ、処理中のリクエストを期限まで待つ
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	shutdown(ctx)
+	cancel()
+	// 書き込み終えたレコードをディスクへ書き出してから閉じる
+	if err := commitLog.Sync(); err != nil {
+		log.Printf("failed to sync log: %v", err)
+	}
+	if err := commitLog.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if topics != nil {
+		if err := topics.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// サーバーのTLSの設定を作る。insecureならnil。
+// 証明書はSetupTLSConfigのGetCertificateから読むので、ListenAndServeTLSにはパスを渡さない
+func serverTLSConfig(transport, certFile, keyFile, caFile string, insecure bool) (*tls.Config, error) {
+	if insecure {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls needs -tls-cert and -tls-key; pass -insecure to serve in plaintext")
+	}
+	// gRPCではクライアント証明書を必ず検証し、そのCNを認可の主体にする
+	if transport == "grpc" && caFile == "" {
+		return nil, errors.New("grpc over tls needs -tls-ca to verify client certificates")
+	}
+	return config.SetupTLSConfig(config.TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+		Server:   true,
+	})
+}
+
+// 単体のサーバーにはACLが無いので、すべての操作を許可する
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"proglog/internal/config"
+	pllog "proglog/internal/log"
+	"proglog/internal/server"
+)
+
+// TLSの設定で、HTTPSでもinsecureの平文でも書き込んで読めることを確認
+func TestServe(t *testing.T) {
+	for scenario, insecure := range map[string]bool{
+		"https":    false,
+		"insecure": true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			tlsConfig, err := serverTLSConfig("http", config.ServerCertFile, config.ServerKeyFile, "", insecure)
+			require.NoError(t, err)
+			require.Equal(t, insecure, tlsConfig == nil)
+
+			dir, err := os.MkdirTemp("", "server-main-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			commitLog, err := pllog.NewLog(dir, pllog.Config{})
+			require.NoError(t, err)
+			defer commitLog.Close()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			srv := server.NetHTTPServer(ln.Addr().String(), commitLog, nil)
+			srv.TLSConfig = tlsConfig
+			scheme := "http"
+			client := http.DefaultClient
+			if tlsConfig != nil {
+				scheme = "https"
+				go srv.ServeTLS(ln, "", "")
+				clientTLS, err := config.SetupTLSConfig(config.TLSConfig{
+					CAFile:        config.CAFile,
+					ServerAddress: "127.0.0.1",
+				})
+				require.NoError(t, err)
+				client = &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			} else {
+				go srv.Serve(ln)
+			}
+			defer srv.Close()
+
+			res, err := client.Post(scheme+"://"+ln.Addr().String()+"/", "application/json",
+				bytes.NewReader([]byte(`{"record":{"value":"aGVsbG8="}}`)))
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			record, err := commitLog.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello"), record.Value)
+		})
+	}
+}
+
+// 証明書が無ければ、ログを開く前にエラーにすることを確認
+func TestServerTLSConfigErrors(t *testing.T) {
+	_, err := serverTLSConfig("http", "", "", "", false)
+	require.Error(t, err)
+	_, err = serverTLSConfig("http", "missing.pem", "missing-key.pem", "", false)
+	require.Error(t, err)
+	_, err = serverTLSConfig("grpc", config.ServerCertFile, config.ServerKeyFile, "", false)
+	require.Error(t, err)
+	_, err = serverTLSConfig("grpc", config.ServerCertFile, config.ServerKeyFile, config.CAFile, false)
+	require.NoError(t, err)
+}
@@ -48,6 +48,12 @@ type Config struct {
 	ACLModelFile    string
 	ACLPolicyFile   string
 	Bootstrap       bool
+	// trueなら、元のログとは別に名前の付いたトピックを使えるようにし、raftで複製する
+	Topics bool
+	// Topicsのとき、作れるトピックの数の上限。0なら制限しない
+	MaxTopics int
+	// Topicsのとき、書き込みで作るトピックのパーティション数。0なら1
+	TopicPartitions int
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -117,6 +123,9 @@ func (a *Agent) setupLog() error {
 	)
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.Topics = a.Config.Topics
+	logConfig.Raft.MaxTopics = a.Config.MaxTopics
+	logConfig.Raft.TopicPartitions = a.Config.TopicPartitions
 	logConfig.Raft.CommitTimeout = 1000 * time.Millisecond
 	var err error
 	a.log, err = log.NewDistributedLog(
@@ -142,6 +151,9 @@ func (a *Agent) setupServer() error {
 		Authorizer:  authorizer,
 		GetServerer: a.log,
 	}
+	if a.Config.Topics {
+		serverConfig.Topics = a.log
+	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
 		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
@@ -68,6 +68,7 @@ func TestAgent(t *testing.T) {
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
 			Bootstrap:       i == 0,
+			Topics:          true,
 		})
 		require.NoError(t, err)
 
@@ -94,6 +95,16 @@ func TestAgent(t *testing.T) {
 		},
 	)
 	require.NoError(t, err)
+	topicResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("order"),
+			},
+			Topic: "orders",
+		},
+	)
+	require.NoError(t, err)
 
 	// レプリケーションが完了するまで待つ
 	time.Sleep(3 * time.Second)
@@ -117,6 +128,17 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
 
+	// トピックもraftでフォロワーに複製される
+	consumeResponse, err = followerClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset: topicResponse.Offset,
+			Topic:  "orders",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("order"))
+
 	consumeResponse, err = leaderClient.Consume(
 		context.Background(),
 		&api.ConsumeRequest{
@@ -5,6 +5,8 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 )
 
 // tlsパッケージを使えるように、各種セットアップ
@@ -13,13 +15,22 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	var err error
 	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS13}
 	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(
-			cfg.CertFile,
-			cfg.KeyFile,
-		)
-		if err != nil {
-			return nil, err
+		if cfg.Server {
+			// サーバー証明書はローテーションされるので、ハンドシェイクのたびに更新を確認して読み込み直す
+			reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.GetCertificate = reloader.GetCertificate
+		} else {
+			tlsConfig.Certificates = make([]tls.Certificate, 1)
+			tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(
+				cfg.CertFile,
+				cfg.KeyFile,
+			)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 	if cfg.CAFile != "" {
@@ -53,3 +64,64 @@ type TLSConfig struct {
 	ServerAddress string
 	Server        bool
 }
+
+// 証明書と秘密鍵のファイルの更新時刻を見て、変わっていれば読み込み直す。
+// 新しい証明書は以降のハンドシェイクから使われ、既存のコネクションは古い証明書のまま継続する
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		// 書き換えの途中などで読み込めない場合は、これまでの証明書を使い続ける
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	return r.cert, nil
+}
+
+// ファイルの更新時刻が変わっていれば証明書を読み込み直す
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil &&
+		certInfo.ModTime().Equal(r.certMod) &&
+		keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
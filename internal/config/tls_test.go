@@ -0,0 +1,92 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 証明書ファイルを書き換えると、以降のハンドシェイクで新しい証明書が使われることを確認
+func TestServerCertReload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls-reload-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	writeCert(t, certFile, keyFile, 1)
+
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), handshake(t, serverConfig))
+
+	writeCert(t, certFile, keyFile, 2)
+	// 更新時刻の分解能に左右されないよう、明示的に更新時刻を進める
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	require.Equal(t, int64(2), handshake(t, serverConfig))
+}
+
+// ハンドシェイクを行い、サーバーが提示した証明書のシリアル番号を返す
+func handshake(t *testing.T, serverConfig *tls.Config) int64 {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		_ = tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	client := tls.Client(clientConn, &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, client.Handshake())
+	return client.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(
+		certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0600,
+	))
+	require.NoError(t, os.WriteFile(
+		keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600,
+	))
+}
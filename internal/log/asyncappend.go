@@ -0,0 +1,139 @@
+package log
+
+import (
+	api "proglog/api/v1"
+)
+
+// AppendAsyncは、レコードをキューに入れてすぐに戻り、書き込みが済んだらコールバックを呼ぶ。
+// バックグラウンドのゴルーチンが、キューに溜まったレコードをまとめて一度のバッチで書き込むので、
+// GroupCommitでもfsyncはバッチごとに一度で済み、fsyncしている間に次のバッチが溜まる。
+// コールバックはそのゴルーチンから、キューに入れた順に呼ぶ。コールバックの中では時間のかかる処理をせず、キューが一杯のときに待つことになるAppendAsyncも呼ばないこと
+
+// AppendAsyncのキューの大きさの既定値
+const defaultAsyncQueueSize = 1024
+
+// キューに入れた書き込み
+type asyncAppend struct {
+	record *api.Record
+	done   func(offset uint64, err error)
+}
+
+// recordをキューに入れ、書き込んだらそのオフセットでdoneを呼ぶ。書き込めなければエラーを渡して呼ぶ。
+// キューが一杯なら空くまで待つ。Closeの後や、Closeまでに書き込まれなかったレコードにはErrClosedを渡す
+func (l *Log) AppendAsync(record *api.Record, done func(offset uint64, err error)) {
+	if l.Config.readOnly {
+		done(0, ErrReadOnly)
+		return
+	}
+	// doneはasyncMuを放してから呼ぶ
+	if !l.enqueueAsync(asyncAppend{record: record, done: done}) {
+		done(0, ErrClosed)
+	}
+}
+
+// reqをキューに入れる。閉じていて入れられなければfalse
+func (l *Log) enqueueAsync(req asyncAppend) bool {
+	l.asyncMu.RLock()
+	defer l.asyncMu.RUnlock()
+	if l.asyncClosed {
+		return false
+	}
+	select {
+	case l.async <- req:
+		return true
+	case <-l.closing:
+		return false
+	}
+}
+
+// キューに入れた書き込みを処理するゴルーチンを始める。Closeで止まる
+func (l *Log) startAsyncAppender() {
+	size := l.Config.AsyncQueueSize
+	if size <= 0 {
+		size = defaultAsyncQueueSize
+	}
+	l.asyncMu.Lock()
+	l.async = make(chan asyncAppend, size)
+	l.asyncClosed = false
+	l.asyncMu.Unlock()
+
+	queue, closing := l.async, l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		for {
+			select {
+			case <-closing:
+				l.failAsync(queue)
+				return
+			case req := <-queue:
+				batch := []asyncAppend{req}
+			drain:
+				for len(batch) < size {
+					select {
+					case req := <-queue:
+						batch = append(batch, req)
+					default:
+						break drain
+					}
+				}
+				l.appendAsync(batch)
+			}
+		}
+	}()
+}
+
+// キューに溜まった書き込みを書き込み、それぞれのコールバックを呼ぶ
+func (l *Log) appendAsync(batch []asyncAppend) {
+	var pending []asyncAppend
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		records := make([]*api.Record, len(pending))
+		for i, req := range pending {
+			records[i] = req.record
+		}
+		_, _, err := l.appendRecordsChecked(records, false)
+		for i, req := range pending {
+			if err != nil {
+				req.done(0, err)
+				continue
+			}
+			req.done(records[i].Offset, nil)
+		}
+		pending = pending[:0]
+	}
+	for _, req := range batch {
+		// フックが断ったレコードや大きすぎるレコードは、同じバッチの他のレコードを巻き込まないよう先に断る。
+		// フックはここで一度だけ通し、書き込むときには通さない
+		if err := checkRecord(req.record, l.Config); err != nil {
+			req.done(0, err)
+			continue
+		}
+		// 古いシーケンス番号で断られたレコードが同じバッチの他のレコードを巻き込まないよう、producerのレコードは一つずつ書き込む
+		if req.record.ProducerId != "" {
+			flush()
+			req.done(l.appendChecked(req.record))
+			continue
+		}
+		pending = append(pending, req)
+	}
+	flush()
+}
+
+// 新しい書き込みを受け付けないようにし、キューに残った書き込みにErrClosedを渡す
+func (l *Log) failAsync(queue chan asyncAppend) {
+	// キューに入れようとしているAppendAsyncが、closingを見て戻るのを待つ
+	l.asyncMu.Lock()
+	l.asyncClosed = true
+	l.asyncMu.Unlock()
+	for {
+		select {
+		case req := <-queue:
+			req.done(0, ErrClosed)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// AppendAsyncで入れたレコードが、入れた順のオフセットで書き込まれ、fsyncがバッチごとにまとめられることを確認
+func TestLogAppendAsync(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-append-async-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var syncs int32
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Segment.MaxRecordBytes = 64
+	c.Segment.Flush.GroupCommit = true
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil || filepath.Ext(name) != ".store" {
+			return f, err
+		}
+		return &slowSyncFile{File: f, syncs: &syncs}, nil
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	const records = 100
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var offsets []uint64
+	for i := 0; i < records; i++ {
+		wg.Add(1)
+		log.AppendAsync(&api.Record{Value: []byte("hello world")}, func(off uint64, err error) {
+			defer wg.Done()
+			require.NoError(t, err)
+			mu.Lock()
+			offsets = append(offsets, off)
+			mu.Unlock()
+		})
+	}
+	// 大きすぎるレコードは、そのレコードだけが断られる
+	wg.Add(1)
+	log.AppendAsync(&api.Record{Value: make([]byte, 128)}, func(_ uint64, err error) {
+		defer wg.Done()
+		require.ErrorAs(t, err, &api.ErrRecordTooLarge{})
+	})
+	wg.Wait()
+
+	// コールバックは入れた順に呼ばれる
+	for i, off := range offsets {
+		require.Equal(t, uint64(i), off)
+	}
+	require.Len(t, offsets, records)
+	require.Less(t, atomic.LoadInt32(&syncs), int32(records/2))
+	got, err := log.Read(records - 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+
+	// 閉じた後に入れたレコードにはErrClosedを渡す
+	require.NoError(t, log.Close())
+	var closedErr error
+	log.AppendAsync(&api.Record{Value: []byte("hello world")}, func(_ uint64, err error) {
+		closedErr = err
+	})
+	require.Equal(t, ErrClosed, closedErr)
+}
+
+// AppendAsyncで入れたレコードも、フックを一度だけ通ることを確認
+func TestLogAppendAsyncHooksOnce(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-append-async-hook-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.AppendHooks = []AppendHook{func(record *api.Record) error {
+		atomic.AddInt32(&calls, 1)
+		// 二度通すと値が二重に書き換わる
+		record.Value = append(record.Value, '!')
+		return nil
+	}}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var wg sync.WaitGroup
+	for _, record := range []*api.Record{
+		{Value: []byte("hello")},
+		{Value: []byte("world"), ProducerId: "p", Sequence: 1},
+	} {
+		wg.Add(1)
+		log.AppendAsync(record, func(_ uint64, err error) {
+			defer wg.Done()
+			require.NoError(t, err)
+		})
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	for off, want := range []string{"hello!", "world!"} {
+		got, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), got.Value)
+	}
+}
@@ -0,0 +1,282 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync/atomic"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 封印済みのsegmentごとに、レコードのキーのブルームフィルタを.bloomファイルに持つ。
+// キーでレコードを探すときやコンパクションで、キーを確実に持たないsegmentを読まずに飛ばす。
+// ファイルは4バイトのハッシュ関数の数と、ビット列が並ぶ。ハッシュ関数の数の上位8ビットには、コンパクションで書き出したsegmentの印を置く。
+// 封印するときに作り、アクティブなsegmentには無い
+
+// Config.Segment.KeyBloomFalsePositiveRateが0のときの偽陽性率
+const defaultBloomFalsePositiveRate = 0.01
+
+// ReadKeyでキーのレコードが無いときに返す
+var ErrKeyNotFound = errors.New("key not found")
+
+// .bloomに置くsegmentの印。どちらも、すべてのレコードがキーを持ち、キーが重複せず、トゥームストーンもttlを持つレコードも無いsegmentに限る
+const (
+	// DedupeExactのコンパクションで書き出し、どのレコードも同じキーの直前のレコードと異なる
+	bloomDeduped uint32 = 1 << 24
+	// LastWriteWinsのコンパクションで書き出し、どのレコードもキーの最新のレコードだった。bloomDedupedも満たす
+	bloomLatest   uint32 = 1 << 25
+	bloomFlagMask uint32 = 0xff << 24
+)
+
+type bloomFilter struct {
+	k     uint32
+	flags uint32
+	bits  []byte
+}
+
+// n個のキーを、偽陽性率pで入れられる大きさのフィルタを作る
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 8 {
+		m = 8
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{k: k, bits: make([]byte, (m+7)/8)}
+}
+
+// 二つのハッシュからk個の位置を作る
+func bloomHashes(key []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write(key)
+	h2 := fnv.New64()
+	h2.Write(key)
+	// 0だと同じ位置ばかりになるので奇数にする
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (b *bloomFilter) add(key []byte) {
+	h1, h2 := bloomHashes(key)
+	m := uint64(len(b.bits)) * 8
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// falseなら、keyは確実に入っていない
+func (b *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := bloomHashes(key)
+	m := uint64(len(b.bits)) * 8
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) marshal() []byte {
+	p := make([]byte, 4, 4+len(b.bits))
+	enc.PutUint32(p, b.k|b.flags)
+	return append(p, b.bits...)
+}
+
+func unmarshalBloomFilter(p []byte) (*bloomFilter, error) {
+	if len(p) <= 4 {
+		return nil, fmt.Errorf("bloom filter is %d bytes", len(p))
+	}
+	v := enc.Uint32(p)
+	b := &bloomFilter{k: v &^ bloomFlagMask, flags: v & bloomFlagMask, bits: p[4:]}
+	if b.k == 0 {
+		return nil, fmt.Errorf("bloom filter has no hash functions")
+	}
+	return b, nil
+}
+
+// keyのレコードを持ちうるかどうか。アクティブなsegmentは、常に持ちうるとする
+func (s *segment) mayContainKey(key []byte) (bool, error) {
+	if !s.sealed {
+		return true, nil
+	}
+	s.openMu.Lock()
+	bloom, err := s.loadBloom()
+	s.openMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if bloom == nil {
+		// フィルタが無かった頃のsegmentや、開かずにいたsegmentなので、storeから作る
+		if err := s.open(); err != nil {
+			return false, err
+		}
+		s.openMu.Lock()
+		bloom, err = s.buildBloom()
+		s.openMu.Unlock()
+		if err != nil {
+			return false, err
+		}
+	}
+	return bloom.mayContain(key), nil
+}
+
+// .bloomに置いたsegmentの印を返す。フィルタが無ければ0
+func (s *segment) bloomFlags() (uint32, error) {
+	if !s.sealed {
+		return 0, nil
+	}
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	bloom, err := s.loadBloom()
+	if err != nil || bloom == nil {
+		return 0, err
+	}
+	return bloom.flags, nil
+}
+
+// 作ってあるフィルタか、.bloomファイルのフィルタを返す。ファイルが無ければnil。openMuを取っておくこと
+func (s *segment) loadBloom() (*bloomFilter, error) {
+	if s.bloom != nil {
+		return s.bloom, nil
+	}
+	p, err := os.ReadFile(s.path(".bloom"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if s.bloom, err = unmarshalBloomFilter(p); err != nil {
+		return nil, fmt.Errorf("load bloom filter of segment %d: %w", s.baseOffset, err)
+	}
+	return s.bloom, nil
+}
+
+// storeのレコードのキーからフィルタを作り、.bloomファイルに書く。openMuを取り、ファイルを開いておくこと
+func (s *segment) buildBloom() (*bloomFilter, error) {
+	var keys [][]byte
+	// 印を付けられないレコードがあればfalse
+	distinct := true
+	seen := make(map[string]struct{})
+	if err := s.walk(s.store.start, func(_ uint64, p []byte, _ uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if _, ok := seen[string(record.Key)]; ok || len(record.Key) == 0 || record.Tombstone || record.Ttl > 0 {
+			distinct = false
+		}
+		if len(record.Key) > 0 {
+			keys = append(keys, record.Key)
+			seen[string(record.Key)] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	rate := s.config.Segment.KeyBloomFalsePositiveRate
+	if rate <= 0 || rate >= 1 {
+		rate = defaultBloomFalsePositiveRate
+	}
+	bloom := newBloomFilter(len(keys), rate)
+	for _, key := range keys {
+		bloom.add(key)
+	}
+	if distinct {
+		bloom.flags = s.compacted
+	}
+	// 読み取り専用のログでは、書き出さずにメモリにだけ置く
+	if !s.config.readOnly {
+		if err := writeFileAtomic(s.path(".bloom"), bytes.NewReader(bloom.marshal()), s.config.fileMode()); err != nil {
+			return nil, err
+		}
+	}
+	s.bloom = bloom
+	return bloom, nil
+}
+
+// keyの最新のレコードを返す。最新のレコードがトゥームストーンであるか、レコードが無ければErrKeyNotFoundを返す。
+// 新しいsegmentから順に探し、ブルームフィルタでキーを持たないとわかるsegmentは読まない。
+// 封印済みのsegmentは閉じられないよう固定してから、書き込みを待たせないようLogのロックを放して読む
+func (l *Log) ReadKey(key []byte) (*api.Record, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("lookup requires a key")
+	}
+	defer l.trimCache()
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	start, visible := l.startOffset, l.visibleOffset()
+	// アクティブなsegmentは書き込みと競合するので、ロックを取ったまま読む
+	latest, err := l.activeSegment.latestKeyRecord(key, start, visible)
+	if err != nil || latest != nil {
+		l.mu.RUnlock()
+		return l.keyResult(latest, err)
+	}
+	sealed := make([]*segment, 0, len(l.segments))
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			s.pins.RLock()
+			sealed = append(sealed, s)
+		}
+	}
+	l.mu.RUnlock()
+	// 読み終えたsegmentから固定を外す
+	defer func() {
+		for _, s := range sealed {
+			s.pins.RUnlock()
+		}
+	}()
+	for len(sealed) > 0 {
+		s := sealed[len(sealed)-1]
+		ok, err := s.mayContainKey(key)
+		if err == nil && ok {
+			latest, err = s.latestKeyRecord(key, start, visible)
+		}
+		if err != nil || latest != nil {
+			return l.keyResult(latest, err)
+		}
+		sealed = sealed[:len(sealed)-1]
+		s.pins.RUnlock()
+	}
+	return nil, ErrKeyNotFound
+}
+
+// ReadKeyで見つけたレコードを返す
+func (l *Log) keyResult(latest *api.Record, err error) (*api.Record, error) {
+	if err != nil {
+		return nil, err
+	}
+	if latest.Tombstone {
+		return nil, ErrKeyNotFound
+	}
+	atomic.AddUint64(&l.stats.reads, 1)
+	return latest, nil
+}
+
+// segmentにあるkeyのレコードのうち、startからvisibleの手前までで最新のものを返す。無ければnil
+func (s *segment) latestKeyRecord(key []byte, start, visible uint64) (*api.Record, error) {
+	var latest *api.Record
+	if err := s.scan(func(record *api.Record, _ uint64) error {
+		if bytes.Equal(record.Key, key) && record.Offset >= start && record.Offset < visible {
+			latest = record
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return latest, nil
+}
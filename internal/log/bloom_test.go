@@ -0,0 +1,149 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 入れたキーは必ずあると判定され、入れていないキーの偽陽性率が指定に近いことを確認
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		b.add([]byte(fmt.Sprintf("key %d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		require.True(t, b.mayContain([]byte(fmt.Sprintf("key %d", i))))
+	}
+	var positives int
+	for i := 0; i < 10000; i++ {
+		if b.mayContain([]byte(fmt.Sprintf("other %d", i))) {
+			positives++
+		}
+	}
+	require.Less(t, positives, 300)
+
+	got, err := unmarshalBloomFilter(b.marshal())
+	require.NoError(t, err)
+	require.Equal(t, b, got)
+	_, err = unmarshalBloomFilter([]byte{0, 0, 0, 1})
+	require.Error(t, err)
+}
+
+// 封印したsegmentにフィルタが作られ、ReadKeyがキーを持たないsegmentを飛ばして最新のレコードを返すことを確認
+func TestLogReadKey(t *testing.T) {
+	dir, err := os.MkdirTemp("", "read-key-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}, {"d", "1"}} {
+		_, err := log.Append(&api.Record{Key: []byte(kv[0]), Value: []byte(kv[1])})
+		require.NoError(t, err)
+	}
+	_, err = log.Delete([]byte("c"))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, "0.bloom"))
+	require.FileExists(t, filepath.Join(dir, "2.bloom"))
+	require.NoFileExists(t, filepath.Join(dir, "4.bloom"))
+
+	check := func(log *Log) {
+		got, err := log.ReadKey([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), got.Offset)
+		got, err = log.ReadKey([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), got.Value)
+		_, err = log.ReadKey([]byte("c"))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = log.ReadKey([]byte("missing"))
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	check(log)
+	ok, err := log.segments[0].mayContainKey([]byte("c"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = log.segments[1].mayContainKey([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, log.Close())
+
+	// フィルタが無くなっていても、開き直せば作り直す
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.bloom")))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.FileExists(t, filepath.Join(dir, "0.bloom"))
+	check(log)
+
+	// コンパクションで書き直したsegmentのフィルタも、書き直した内容で作り直す
+	_, err = log.Compact()
+	require.NoError(t, err)
+	check(log)
+	ok, err = log.segments[0].mayContainKey([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// 読み込みを止められるstoreのファイル
+type blockingReadFile struct {
+	File
+	block   *int32
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.CompareAndSwapInt32(f.block, 1, 0) {
+		close(f.blocked)
+		<-f.release
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// ReadKeyが封印済みのsegmentを読んでいる間も、書き込みは待たされないことを確認
+func TestLogReadKeyDoesNotBlockAppend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "read-key-append-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var block int32
+	blocked, release := make(chan struct{}), make(chan struct{})
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil || filepath.Base(name) != "0.store" {
+			return f, err
+		}
+		return &blockingReadFile{File: f, block: &block, blocked: blocked, release: release}, nil
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte("1")})
+		require.NoError(t, err)
+	}
+
+	atomic.StoreInt32(&block, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := log.ReadKey([]byte("a"))
+		done <- err
+	}()
+	<-blocked
+	_, err = log.Append(&api.Record{Key: []byte("d"), Value: []byte("1")})
+	require.NoError(t, err)
+	close(release)
+	require.NoError(t, <-done)
+}
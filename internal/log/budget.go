@@ -0,0 +1,113 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RetentionBudgetは、同じディスクを共有する複数のLogの合計サイズを上限以下に保つ。
+// 各Logには重みに応じた取り分があり、上限を超えた場合は取り分を最も超過しているLogから
+// 古いsegmentを削除していく。これにより、一つのLogが他のLogのディスクを奪うことを防ぐ。
+// 合計はLogが大きさを変えるたびに差分を足して数えるので、上限を超えていなければ書き込みのたびの確認はロックを取らずに済む
+
+type RetentionBudget struct {
+	// 登録したLogの合計バイト数。32bit環境でのアトミック操作のため先頭に置く
+	used     uint64
+	mu       sync.Mutex
+	maxBytes uint64
+	logs     []*budgetedLog
+}
+
+type budgetedLog struct {
+	log    *Log
+	weight uint64
+}
+
+func NewRetentionBudget(maxBytes uint64) *RetentionBudget {
+	return &RetentionBudget{maxBytes: maxBytes}
+}
+
+// Logを予算の管理対象に加える。重みが0の場合は1として扱う(均等割り)
+func (b *RetentionBudget) Register(l *Log, weight uint64) {
+	if weight == 0 {
+		weight = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logs = append(b.logs, &budgetedLog{log: l, weight: weight})
+
+	// ほかの予算にも登録されていれば、そのまま両方に従う
+	l.mu.Lock()
+	l.budgets = append(l.budgets, b)
+	b.add(0, atomic.LoadUint64(&l.bytes))
+	l.mu.Unlock()
+}
+
+// 登録したLogの合計バイト数がoldからnewに変わった
+func (b *RetentionBudget) add(old, new uint64) {
+	atomic.AddUint64(&b.used, new-old)
+}
+
+// 合計サイズが上限を超えている限り、取り分を最も超過しているLogの最古のsegmentを削除する
+func (b *RetentionBudget) Enforce() error {
+	if atomic.LoadUint64(&b.used) <= b.maxBytes {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var totalWeight uint64
+	for _, bl := range b.logs {
+		totalWeight += bl.weight
+	}
+
+	exhausted := make(map[*budgetedLog]bool)
+	for {
+		var total uint64
+		sizes := make([]uint64, len(b.logs))
+		for i, bl := range b.logs {
+			sizes[i] = bl.log.Size()
+			total += sizes[i]
+		}
+		if total <= b.maxBytes {
+			return nil
+		}
+
+		// 取り分からの超過量が最も大きいLogを探す
+		var victim *budgetedLog
+		var maxExcess uint64
+		for i, bl := range b.logs {
+			share := b.maxBytes * bl.weight / totalWeight
+			if exhausted[bl] || sizes[i] <= share {
+				continue
+			}
+			if excess := sizes[i] - share; excess > maxExcess {
+				victim, maxExcess = bl, excess
+			}
+		}
+		if victim == nil {
+			return nil
+		}
+		removed, err := victim.log.removeOldestSegment()
+		if err != nil {
+			return err
+		}
+		if !removed {
+			// アクティブなsegmentしか残っていないので、このLogはこれ以上削れない
+			exhausted[victim] = true
+		}
+	}
+}
+
+// lを登録したすべての予算を調整する。l.muを取らずに呼ぶこと
+func (l *Log) enforceBudgets() error {
+	l.mu.RLock()
+	budgets := l.budgets
+	l.mu.RUnlock()
+	for _, b := range budgets {
+		if err := b.Enforce(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
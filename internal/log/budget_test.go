@@ -0,0 +1,63 @@
+package log
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 大量に書き込むLogだけが古いsegmentを削除され、静かなLogのデータは残ることを確認
+func TestRetentionBudget(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+
+	newTenant := func() *Log {
+		dir, err := os.MkdirTemp("", "budget-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		return l
+	}
+	heavy, quiet := newTenant(), newTenant()
+	defer heavy.Close()
+	defer quiet.Close()
+
+	budget := NewRetentionBudget(400)
+	budget.Register(heavy, 1)
+	budget.Register(quiet, 1)
+	// 上限の緩い予算にも登録して、先の予算が外れないことを確かめる
+	NewRetentionBudget(1<<20).Register(heavy, 1)
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := quiet.Append(record)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err := heavy.Append(record)
+		require.NoError(t, err)
+	}
+
+	require.LessOrEqual(t, heavy.Size()+quiet.Size(), uint64(400))
+	// 書き込みと削除のたびに足していった合計は、各Logの大きさの合計と一致する
+	require.Equal(t, heavy.Size()+quiet.Size(), atomic.LoadUint64(&budget.used))
+
+	// 大量に書き込んだLogは古いオフセットが削除されている
+	_, err := heavy.Read(0)
+	require.Error(t, err)
+	off, err := heavy.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, off, uint64(0))
+
+	// 静かなLogはすべてのデータが残っている
+	for i := uint64(0); i < 3; i++ {
+		got, err := quiet.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+	}
+}
@@ -0,0 +1,732 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+)
+
+// コンパクションは、Config.Compaction.Strategyに従って封印済み(アクティブでない)segmentから古いレコードを取り除く。
+// LastWriteWinsでは同じキーを持つレコードのうち最新のもの以外を取り除き、キーを持たないレコードは常に残す。
+// DedupeExactでは同じキーの直前のレコードとキーも値も同じレコードを取り除き、連続した重複のうち最初のものだけを残す。どちらも残ったレコードのオフセットは変わらない。
+// どちらでも、キーのトゥームストーンより前にある同じキーのレコードは取り除き、
+// トゥームストーン自体もConfig.Compaction.TombstoneRetentionより古くなれば取り除く。
+// また、ttlを持つレコードはその期間を過ぎたら、segmentの他のレコードが新しくても取り除く。
+// キーの最新のレコードが期限を過ぎて取り除かれても、同じキーの古いレコードは残らない。
+
+// Config.Compaction.Intervalごとに、バックグラウンドでコンパクションと小さなsegmentのマージを行う。Closeで止まる
+func (l *Log) startCompaction() {
+	interval := l.Config.Compaction.Interval
+	if interval <= 0 {
+		return
+	}
+	closing := l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+				if _, err := l.Compact(); err != nil {
+					zap.L().Named("compaction").Error(
+						"failed to compact log",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+				if _, err := l.Merge(); err != nil {
+					zap.L().Named("compaction").Error(
+						"failed to merge segments",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// コンパクションの走査結果
+type compactionPlan struct {
+	// 取り除かれるレコードのオフセット
+	drop map[uint64]struct{}
+	// 取り除かれるレコードが占めているstoreとindexのバイト数
+	reclaimableBytes uint64
+	// 古いレコードが取り除かれるキーの数。DedupeExactでは重複していたキーと値の組の数
+	duplicateKeys int
+	// 書き出すsegmentのフィルタに付ける印
+	flags uint32
+}
+
+// コンパクションのために走査したレコード
+type compactionEntry struct {
+	offset uint64
+	key    string
+	size   uint64
+	// 封印済みのsegmentにある
+	sealed bool
+	// ttlを過ぎている
+	expired   bool
+	tombstone bool
+	// 保持期限を過ぎたトゥームストーン
+	tombstoneExpired bool
+	// キーと値のハッシュ。DedupeExactでだけ求める
+	digest [sha256.Size]byte
+}
+
+// 全segmentを走査して、封印済みsegmentのうち取り除けるレコードを洗い出す。
+// 呼び出し側でロックを取っておくこと
+func (l *Log) planCompaction() (*compactionPlan, error) {
+	if l.Config.Compaction.Strategy == CompactionDedupeExact {
+		return l.planDedupeExact()
+	}
+	return l.planLastWriteWins()
+}
+
+// segmentごとのレコードを、古いsegmentから順に返す。
+// フィルタにskipの印があるsegmentは、読んだ他のsegmentのキーがフィルタに当たるまで読まずにおき、nilとする。
+// 印のあるsegmentのレコードは、読んだsegmentのキーと重ならない限り取り除かれず、他のレコードを取り除かせることも無い
+func (l *Log) scanForCompaction(skip uint32, digests bool) ([][]compactionEntry, error) {
+	now := time.Now()
+	entries := make([][]compactionEntry, len(l.segments))
+	keys := make(map[string]struct{})
+	read := func(i int) error {
+		s := l.segments[i]
+		sealed := s != l.activeSegment
+		return s.scan(func(record *api.Record, size uint64) error {
+			e := compactionEntry{
+				offset:           record.Offset,
+				key:              string(record.Key),
+				size:             size,
+				sealed:           sealed,
+				expired:          sealed && recordExpired(record, now),
+				tombstone:        record.Tombstone,
+				tombstoneExpired: l.tombstoneExpired(record),
+			}
+			if digests {
+				e.digest = recordDigest(record)
+			}
+			entries[i] = append(entries[i], e)
+			// 印のあるsegmentには、キーの無いレコードは無い
+			if e.key != "" {
+				keys[e.key] = struct{}{}
+			}
+			return nil
+		})
+	}
+	var skipped []int
+	for i, s := range l.segments {
+		flags, err := s.bloomFlags()
+		if err != nil {
+			return nil, err
+		}
+		if flags&skip != 0 {
+			skipped = append(skipped, i)
+			continue
+		}
+		if err := read(i); err != nil {
+			return nil, err
+		}
+	}
+	// 読んだsegmentのキーを持ちうるsegmentを読み、読んだキーが増えたらまた確かめる
+	for changed := true; changed; {
+		changed = false
+		for j := 0; j < len(skipped); j++ {
+			s := l.segments[skipped[j]]
+			s.openMu.Lock()
+			bloom := s.bloom
+			s.openMu.Unlock()
+			hit := bloom == nil
+			for key := range keys {
+				if bloom.mayContain([]byte(key)) {
+					hit = true
+					break
+				}
+			}
+			if !hit {
+				continue
+			}
+			if err := read(skipped[j]); err != nil {
+				return nil, err
+			}
+			skipped = append(skipped[:j], skipped[j+1:]...)
+			j--
+			changed = true
+		}
+	}
+	return entries, nil
+}
+
+// キーごとの最新オフセットを求め、それより古いレコードを取り除く
+func (l *Log) planLastWriteWins() (*compactionPlan, error) {
+	plan := &compactionPlan{drop: make(map[uint64]struct{}), flags: bloomLatest | bloomDeduped}
+	segments, err := l.scanForCompaction(bloomLatest, false)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]uint64)
+	var sealed []compactionEntry
+	for _, entries := range segments {
+		for _, e := range entries {
+			if e.expired {
+				plan.drop[e.offset] = struct{}{}
+				plan.reclaimableBytes += e.size
+			}
+			if len(e.key) == 0 {
+				continue
+			}
+			latest[e.key] = e.offset
+			if e.sealed && !e.expired {
+				sealed = append(sealed, e)
+			}
+		}
+	}
+
+	keys := make(map[string]struct{})
+	for _, e := range sealed {
+		if latest[e.key] == e.offset && !e.tombstoneExpired {
+			continue
+		}
+		plan.drop[e.offset] = struct{}{}
+		plan.reclaimableBytes += e.size
+		keys[e.key] = struct{}{}
+	}
+	plan.duplicateKeys = len(keys)
+	return plan, nil
+}
+
+// キーと値のハッシュを取り、同じキーの直前のレコードと同じレコードを取り除く。
+// 間に別の値が書き込まれていれば、前と同じ値に戻したレコードも残すので、キーの最新の値は変わらない
+func (l *Log) planDedupeExact() (*compactionPlan, error) {
+	plan := &compactionPlan{drop: make(map[uint64]struct{}), flags: bloomDeduped}
+	segments, err := l.scanForCompaction(bloomDeduped, true)
+	if err != nil {
+		return nil, err
+	}
+	// キーごとの最後のトゥームストーンのオフセット。印のあるsegmentにトゥームストーンは無い
+	deleted := make(map[string]uint64)
+	for _, entries := range segments {
+		for _, e := range entries {
+			if e.tombstone && len(e.key) > 0 {
+				deleted[e.key] = e.offset
+			}
+		}
+	}
+	// キーごとの直前のレコードのハッシュと、重複として数えたキーと値の組
+	prev := make(map[string][sha256.Size]byte)
+	counted := make(map[[sha256.Size]byte]bool)
+	for _, entries := range segments {
+		for _, e := range entries {
+			// 期限を過ぎたレコードは直前のレコードにしないので、後から書き込んだ同じキーと値のレコードは残る
+			if e.expired {
+				plan.drop[e.offset] = struct{}{}
+				plan.reclaimableBytes += e.size
+				delete(prev, e.key)
+				continue
+			}
+			if tombstone, ok := deleted[e.key]; ok && e.offset <= tombstone {
+				// 削除されたレコードは直前のレコードにしないので、削除の後に同じキーと値を書き込んでも重複にならない
+				if e.sealed && (e.offset < tombstone || e.tombstoneExpired) {
+					plan.drop[e.offset] = struct{}{}
+					plan.reclaimableBytes += e.size
+				}
+				delete(prev, e.key)
+				continue
+			}
+			if last, ok := prev[e.key]; !ok || last != e.digest {
+				prev[e.key] = e.digest
+				continue
+			}
+			if !e.sealed {
+				continue
+			}
+			plan.drop[e.offset] = struct{}{}
+			plan.reclaimableBytes += e.size
+			if !counted[e.digest] {
+				counted[e.digest] = true
+				plan.duplicateKeys++
+			}
+		}
+	}
+	return plan, nil
+}
+
+// recordが、保持期限を過ぎたトゥームストーンかどうか
+func (l *Log) tombstoneExpired(record *api.Record) bool {
+	return record.Tombstone &&
+		time.Since(time.Unix(0, record.Timestamp)) >= l.Config.Compaction.TombstoneRetention
+}
+
+// recordが、nowまでにttlを過ぎているかどうか
+func recordExpired(record *api.Record, now time.Time) bool {
+	return record.Ttl > 0 && now.UnixNano()-record.Timestamp >= record.Ttl
+}
+
+// キーと値のハッシュ。キーの長さを含めて、キーと値の境目が違う組が同じにならないようにする
+func recordDigest(record *api.Record) [sha256.Size]byte {
+	h := sha256.New()
+	b := make([]byte, 8)
+	enc.PutUint64(b, uint64(len(record.Key)))
+	h.Write(b)
+	h.Write(record.Key)
+	h.Write(record.Value)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// コンパクションを実際には行わずに、どれだけの容量を削減できるかを見積もる。
+// reclaimableBytesは取り除かれるレコードのstoreとindexのバイト数、duplicateKeysは古いレコードが取り除かれるキーの数
+func (l *Log) CompactionEstimate() (reclaimableBytes uint64, duplicateKeys int, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	plan, err := l.planCompaction()
+	if err != nil {
+		return 0, 0, err
+	}
+	return plan.reclaimableBytes, plan.duplicateKeys, nil
+}
+
+// 新しいsegmentを組み立てる、Logのディレクトリ内のディレクトリ
+const compactDir = "compact"
+
+// コンパクションで書き出すsegmentのディレクトリと、そのindexを置くディレクトリ。
+// Config.Segment.IndexDirがあれば、その中の同じ名前のディレクトリにindexを置き、リネームで移せるようにする
+func (l *Log) compactDirs() (dir, indexDir string) {
+	dir = filepath.Join(l.Dir, compactDir)
+	if l.Config.Segment.IndexDir == "" {
+		return dir, dir
+	}
+	return dir, filepath.Join(l.Config.Segment.IndexDir, compactDir)
+}
+
+// 置き換え後に古いsegmentのファイルを削除する。Log.removeFileがあれば、そちらで削除する
+func (l *Log) remove(name string) error {
+	if l.removeFile != nil {
+		return l.removeFile(name)
+	}
+	return os.Remove(name)
+}
+
+// 封印済みsegmentから古いレコードを取り除き、削減したバイト数を返す。
+// 取り除いたオフセットは読み込めなくなり、ErrOffsetOutOfRangeを返す
+func (l *Log) Compact() (reclaimed uint64, err error) {
+	if l.Config.readOnly {
+		return 0, ErrReadOnly
+	}
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	plan, err := l.planCompaction()
+	var sealed []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			sealed = append(sealed, s)
+		}
+	}
+	l.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, old := range sealed {
+		if !plan.dropsFrom(old) {
+			continue
+		}
+		if l.Config.Compaction.PunchHoles {
+			punched, err := l.punchSegment(old, plan.drop, plan.flags)
+			if err == nil {
+				reclaimed += punched
+				continue
+			}
+			if err != errCannotPunch {
+				return reclaimed, err
+			}
+		}
+		// 組み立てている間も読み込みは続けられ、Truncateなどでoldが消されないように読み込みロックを取る
+		l.mu.RLock()
+		before := old.size()
+		compacted, err := l.compactSegment(old, plan.drop, plan.flags)
+		l.mu.RUnlock()
+		if err != nil {
+			return reclaimed, err
+		}
+		after := compacted.size()
+		if err := l.replaceSegments([]*segment{old}, compacted); err != nil {
+			if errors.Is(err, errRemoveReplaced) {
+				// 置き換え自体は済んでいる
+				reclaimed += before - after
+			}
+			return reclaimed, err
+		}
+		reclaimed += before - after
+	}
+	return reclaimed, nil
+}
+
+// segmentの範囲に、取り除くレコードがあるかどうか
+func (p *compactionPlan) dropsFrom(s *segment) bool {
+	for off := range p.drop {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// oldのうちdropに含まれないレコードだけを、コンパクション用のディレクトリに新しいsegmentとして書き出す
+func (l *Log) compactSegment(old *segment, drop map[uint64]struct{}, flags uint32) (*segment, error) {
+	return l.rewriteSegments([]*segment{old}, func(record *api.Record) bool {
+		_, ok := drop[record.Offset]
+		return !ok
+	}, flags)
+}
+
+// 連続するoldsのレコードのうちkeepがtrueを返すものを、オフセットを変えずにコンパクション用のディレクトリに
+// 新しい一つのsegmentとして書き出す。新しいsegmentのbaseOffsetは先頭のoldと同じで、フィルタにはflagsの印を付ける
+func (l *Log) rewriteSegments(olds []*segment, keep func(record *api.Record) bool, flags uint32) (*segment, error) {
+	first, last := olds[0], olds[len(olds)-1]
+	dir, indexDir := l.compactDirs()
+	if err := os.MkdirAll(dir, l.Config.dirMode()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(indexDir, l.Config.dirMode()); err != nil {
+		return nil, err
+	}
+	// 途中で失敗したコンパクションの残りがあれば消しておく
+	for _, ext := range []string{".store", ".index", ".timeindex", ".key", ".bloom", ".crc"} {
+		name := segmentPath(dir, indexDir, first.baseOffset, ext)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	rewritten, err := newSegmentIn(dir, indexDir, first.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	rewritten.compacted = flags
+	for _, old := range olds {
+		if err = old.scan(func(record *api.Record, _ uint64) error {
+			if !keep(record) {
+				return nil
+			}
+			// バッチの一部を取り除くこともあるので、印は残さない
+			record.BatchRemaining = 0
+			_, err := rewritten.write(record)
+			return err
+		}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rewritten.store.flush()
+	}
+	if err == nil {
+		err = rewritten.timeIndex.flush()
+	}
+	if err == nil {
+		err = rewritten.seal()
+	}
+	if err == nil {
+		// 保持期限はレコードを書き込んだ時刻で決まるので、書き出した時刻にしない
+		rewritten.modTime = last.modTime
+		err = os.Chtimes(rewritten.path(".store"), last.modTime, last.modTime)
+	}
+	if err != nil {
+		rewritten.Remove()
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+// 置き換えには成功したが、古いsegmentのファイルを削除できなかったことを表す
+var errRemoveReplaced = errors.New("failed to remove replaced segment")
+
+// segmentによっては無いファイルの拡張子
+func optionalExt(ext string) bool {
+	return ext == ".key" || ext == ".bloom" || ext == ".crc"
+}
+
+// replaceSegmentsで入れ替えるファイルの拡張子
+var replaceExts = []string{".store", ".index", ".timeindex", ".key", ".bloom", ".crc"}
+
+// replaceSegmentsの途中で落ちたときに、開くときにそろえるための記録のファイル名
+const replaceJournalFile = "replace.journal"
+
+// replaceSegmentsで行う差し替え
+type replaceJournal struct {
+	// newのbaseOffset。同じbaseOffsetのoldのファイルは.bakに退避してから上書きする
+	Base uint64 `json:"base"`
+	// 退避したoldのファイルと、移すnewのファイルの拡張子
+	Backups []string `json:"backups"`
+	Moved   []string `json:"moved"`
+	// 差し替えた後に消す、他のoldのbaseOffset
+	Removed []uint64 `json:"removed"`
+	// newのファイルをすべて移し終えたかどうか
+	Committed bool `json:"committed"`
+}
+
+func (l *Log) replaceJournalPath() string {
+	return filepath.Join(l.Dir, replaceJournalFile)
+}
+
+func (l *Log) writeReplaceJournal(j replaceJournal) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.replaceJournalPath(), bytes.NewReader(b), l.Config.fileMode())
+}
+
+// replaceSegmentsの途中で落ちていれば、移し終えていればnewに、そうでなければoldsにそろえる。
+// 記録を書く前に落ちていれば元のファイルはそのままなので、退避したリンクだけを消す
+func (l *Log) recoverReplace() error {
+	indexDir := indexDirFor(l.Dir, l.Config)
+	changed := false
+	b, err := os.ReadFile(l.replaceJournalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var j replaceJournal
+		if err := json.Unmarshal(b, &j); err != nil {
+			return fmt.Errorf("decode %s: %w", replaceJournalFile, err)
+		}
+		path := func(base uint64, ext string) string {
+			return segmentPath(l.Dir, indexDir, base, ext)
+		}
+		contains := func(exts []string, ext string) bool {
+			for _, e := range exts {
+				if e == ext {
+					return true
+				}
+			}
+			return false
+		}
+		changed = true
+		var removes []string
+		if j.Committed {
+			for _, base := range j.Removed {
+				for _, ext := range replaceExts {
+					removes = append(removes, path(base, ext))
+				}
+			}
+		} else {
+			for _, ext := range replaceExts {
+				if contains(j.Backups, ext) {
+					if err := os.Rename(path(j.Base, ext)+".bak", path(j.Base, ext)); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				} else if contains(j.Moved, ext) {
+					// oldには無かったnewのファイル
+					removes = append(removes, path(j.Base, ext))
+				}
+			}
+		}
+		for _, name := range removes {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for _, dir := range []string{l.Dir, indexDir} {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.IsDir() && strings.HasSuffix(file.Name(), ".bak") {
+				if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := os.Remove(l.replaceJournalPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+	if indexDir != l.Dir {
+		return syncDir(indexDir)
+	}
+	return nil
+}
+
+// Logのロックを取ったうえで、連続する封印済みのsegmentのoldsをnewに置き換える。newはoldsと同じかその一部のオフセット範囲を持つ、
+// Logのディレクトリの外で作ったsegmentで、そのファイルをLogのディレクトリに移してから差し替える。
+// 読み込みはロックで待たされるので、必ずoldsかnewのどちらかが見える。
+// ファイルの移動に失敗した場合はoldsに戻し、oldsのファイルは差し替えが済んでから削除する。
+// 移す前に差し替えの内容をreplace.journalに書き出すので、途中で落ちても開くときにoldsかnewにそろう。
+// 削除に失敗した場合はerrRemoveReplacedを返すが、newへの置き換えはそのまま有効
+func (l *Log) replaceSegments(olds []*segment, new *segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first, last := olds[0], olds[len(olds)-1]
+	i := -1
+	for j, s := range l.segments {
+		if s == first {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("segment %d is not in the log", first.baseOffset)
+	}
+	for k, old := range olds {
+		if i+k >= len(l.segments) || l.segments[i+k] != old {
+			return fmt.Errorf("segment %d is not next to segment %d", old.baseOffset, first.baseOffset)
+		}
+		if old == l.activeSegment {
+			return fmt.Errorf("cannot replace the active segment %d", old.baseOffset)
+		}
+	}
+	if new.baseOffset < first.baseOffset || new.nextOffset > last.nextOffset {
+		return fmt.Errorf(
+			"segment [%d, %d) is not within [%d, %d)",
+			new.baseOffset, new.nextOffset, first.baseOffset, last.nextOffset,
+		)
+	}
+
+	// newと同じbaseOffsetのoldがあれば、そのファイルをハードリンクで退避しておき、newのファイルをリネームで移す。
+	// リネームによってアトミックにoldのファイルと入れ替わる。.keyは暗号化しているsegmentにしか無く、
+	// .bloomは一度も封印していないか、フィルタが無かった頃のsegmentには無い
+	exts := replaceExts
+	var overwritten *segment
+	for _, old := range olds {
+		if old.baseOffset == new.baseOffset {
+			overwritten = old
+		}
+	}
+	var backups, moved []string
+	dir, indexDir := new.dir, new.indexDir
+	staged := func(ext string) string {
+		return segmentPath(dir, indexDir, new.baseOffset, ext)
+	}
+	rollback := func() {
+		for _, ext := range moved {
+			os.Rename(new.path(ext), staged(ext))
+		}
+		new.dir, new.indexDir = dir, indexDir
+		for _, b := range backups {
+			os.Rename(b, strings.TrimSuffix(b, ".bak"))
+		}
+		os.Remove(l.replaceJournalPath())
+	}
+	journal := replaceJournal{Base: new.baseOffset}
+	if overwritten != nil {
+		for _, ext := range exts {
+			if err := os.Link(overwritten.path(ext), overwritten.path(ext)+".bak"); err != nil {
+				if optionalExt(ext) && os.IsNotExist(err) {
+					continue
+				}
+				rollback()
+				return err
+			}
+			backups = append(backups, overwritten.path(ext)+".bak")
+			journal.Backups = append(journal.Backups, ext)
+		}
+	}
+	// 移し始める前に差し替えの内容を書き出し、途中で落ちても開くときにoldsかnewのどちらかにそろえられるようにする
+	for _, ext := range exts {
+		if _, err := os.Stat(staged(ext)); err == nil {
+			journal.Moved = append(journal.Moved, ext)
+		}
+	}
+	for _, old := range olds {
+		if old != overwritten {
+			journal.Removed = append(journal.Removed, old.baseOffset)
+		}
+	}
+	if err := l.writeReplaceJournal(journal); err != nil {
+		rollback()
+		return err
+	}
+	new.dir, new.indexDir = l.Dir, indexDirFor(l.Dir, l.Config)
+	for _, ext := range exts {
+		if err := os.Rename(staged(ext), new.path(ext)); err != nil {
+			if optionalExt(ext) && os.IsNotExist(err) {
+				// newは暗号化していないので、oldの.keyが残っていると暗号化したsegmentとして開いてしまう。
+				// oldの.bloomが残っていると、newにあるキーを無いと判定してしまう
+				if err := os.Remove(new.path(ext)); err == nil || os.IsNotExist(err) {
+					continue
+				}
+			}
+			rollback()
+			return err
+		}
+		moved = append(moved, ext)
+	}
+	// ここで置き換えが決まる。この後に落ちても、開くときに残りの削除を終える
+	journal.Committed = true
+	err := new.syncDirs()
+	if err == nil {
+		err = l.writeReplaceJournal(journal)
+	}
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	segments := make([]*segment, 0, len(l.segments)-len(olds)+1)
+	segments = append(segments, l.segments[:i]...)
+	segments = append(segments, new)
+	l.segments = append(segments, l.segments[i+len(olds):]...)
+	l.resetSize()
+	// 取り除いたレコードを、キャッシュから読めないようにする
+	if l.records != nil {
+		l.records.removeRange(first.baseOffset, last.nextOffset)
+	}
+
+	// ここから先で失敗しても、置き換えは有効なまま
+	remove := backups
+	for _, old := range olds {
+		if err := old.Close(); err != nil {
+			return fmt.Errorf("%w: %v", errRemoveReplaced, err)
+		}
+		if old != overwritten {
+			for _, ext := range exts {
+				remove = append(remove, old.path(ext))
+			}
+		}
+	}
+	for _, name := range remove {
+		if err := l.remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v", errRemoveReplaced, err)
+		}
+	}
+	if err := os.Remove(l.replaceJournalPath()); err != nil {
+		return fmt.Errorf("%w: %v", errRemoveReplaced, err)
+	}
+	// ObjectStoreに置いたoldのファイルも消す。newはまだ移していないので、古くなればまた移す
+	for _, old := range olds {
+		if !old.tiered {
+			continue
+		}
+		if err := old.removeTiered(); err != nil {
+			return fmt.Errorf("%w: %v", errRemoveReplaced, err)
+		}
+	}
+	return nil
+}
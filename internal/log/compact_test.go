@@ -0,0 +1,474 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// 見積もりが、封印済みsegmentにある古いレコードのバイト数と一致することを確認
+func TestCompactionEstimate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-estimate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a3")},
+		{Key: []byte("b"), Value: []byte("b2")},
+	}
+	var want uint64
+	for i, record := range records {
+		off, err := log.Append(record)
+		require.NoError(t, err)
+		// a1、b1、a2が、より新しいレコードによって取り除かれる
+		if i == 0 || i == 1 || i == 2 {
+			record.Offset = off
+			p, err := proto.Marshal(record)
+			require.NoError(t, err)
+			want += frameWidth + uint64(len(p)) + entWidth
+		}
+	}
+
+	reclaimable, duplicateKeys, err := log.CompactionEstimate()
+	require.NoError(t, err)
+	require.Equal(t, want, reclaimable)
+	require.Equal(t, 2, duplicateKeys)
+
+	// 見積もりでは何も書き換えない
+	for i := range records {
+		_, err := log.Read(uint64(i))
+		require.NoError(t, err)
+	}
+}
+
+// コンパクションで書き出したsegmentは、他のsegmentのキーがフィルタに当たるまで読まずに飛ばすことを確認
+func TestCompactSkipsCompactedSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-skip-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}, {"d", "1"}, {"e", "1"}, {"f", "1"}} {
+		_, err := log.Append(&api.Record{Key: []byte(kv[0]), Value: []byte(kv[1])})
+		require.NoError(t, err)
+	}
+	_, err = log.Compact()
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// 書き直したsegmentには印が付き、読んだsegmentのキーと重ならなければ読まない
+	flags, err := log.segments[0].bloomFlags()
+	require.NoError(t, err)
+	require.Equal(t, bloomLatest|bloomDeduped, flags)
+	flags, err = log.segments[1].bloomFlags()
+	require.NoError(t, err)
+	require.Zero(t, flags)
+	entries, err := log.scanForCompaction(bloomLatest, false)
+	require.NoError(t, err)
+	require.Nil(t, entries[0])
+	require.Len(t, entries[1], 2)
+
+	// 新しいレコードのキーがフィルタに当たれば読み、古いレコードを取り除く
+	_, err = log.Append(&api.Record{Key: []byte("b"), Value: []byte("2")})
+	require.NoError(t, err)
+	entries, err = log.scanForCompaction(bloomLatest, false)
+	require.NoError(t, err)
+	require.Len(t, entries[0], 1)
+	_, err = log.Compact()
+	require.NoError(t, err)
+	_, err = log.Read(1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	got, err := log.ReadKey([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), got.Value)
+	for _, off := range []uint64{2, 3, 4, 5, 6} {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+func newCompactionTestLog(t *testing.T, dir string) (*Log, []*api.Record) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a3")},
+		{Key: []byte("b"), Value: []byte("b2")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	return log, records
+}
+
+// コンパクションで実際に削減されたバイト数が見積もりと一致し、残ったレコードは再起動後も読めることを確認
+func TestCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, records := newCompactionTestLog(t, dir)
+	estimate, _, err := log.CompactionEstimate()
+	require.NoError(t, err)
+	sizeBefore := log.Size()
+
+	reclaimed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, estimate, reclaimed)
+	require.Equal(t, sizeBefore-reclaimed, log.Size())
+
+	check := func(log *Log) {
+		for i, record := range records {
+			got, err := log.Read(uint64(i))
+			if i <= 2 {
+				// a1、b1、a2は取り除かれている
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(i)}, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, record.Value, got.Value)
+			require.Equal(t, uint64(i), got.Offset)
+		}
+	}
+	check(log)
+
+	// 2回目は取り除くものがない
+	reclaimed, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), reclaimed)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(records)), off)
+}
+
+// 置き換えたあとで古いファイルの削除に失敗しても、新しいsegmentから読めることを確認
+func TestReplaceSegmentRemoveFailure(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replace-segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, records := newCompactionTestLog(t, dir)
+
+	log.removeFile = func(string) error { return errors.New("remove failed") }
+
+	_, err = log.Compact()
+	require.True(t, errors.Is(err, errRemoveReplaced))
+
+	check := func(log *Log) {
+		for i := 3; i < len(records); i++ {
+			got, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, records[i].Value, got.Value)
+		}
+		_, err = log.Read(0)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	}
+	check(log)
+	require.FileExists(t, filepath.Join(dir, "0.store.bak"))
+	require.NoError(t, log.Close())
+
+	// 開き直すと、残っていた退避のリンクと記録を消す
+	log, err = NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	require.NoFileExists(t, filepath.Join(dir, "0.store.bak"))
+	require.NoFileExists(t, filepath.Join(dir, replaceJournalFile))
+}
+
+// newのファイルを移している途中で落ちたログを開くと、退避したoldのファイルに戻すことを確認
+func TestReplaceSegmentsRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replace-segment-recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, records := newCompactionTestLog(t, dir)
+	require.NoError(t, log.Close())
+
+	// storeだけを移し終えたところで落ちた状態を作る
+	journal := replaceJournal{Base: 0, Moved: []string{".store", ".index", ".timeindex"}}
+	for _, ext := range replaceExts {
+		name := filepath.Join(dir, "0"+ext)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+		require.NoError(t, os.Link(name, name+".bak"))
+		journal.Backups = append(journal.Backups, ext)
+	}
+	require.NoError(t, log.writeReplaceJournal(journal))
+	garbage := filepath.Join(dir, "garbage")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a store"), 0600))
+	require.NoError(t, os.Rename(garbage, filepath.Join(dir, "0.store")))
+
+	log, err = NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	for i, record := range records {
+		got, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+	}
+	require.NoFileExists(t, filepath.Join(dir, "0.store.bak"))
+	require.NoFileExists(t, filepath.Join(dir, replaceJournalFile))
+}
+
+// DedupeExactでは、同じキーで続いたキーと値が同じレコードは最初のものだけが残り、
+// 値が違えば同じキーでも残り、間に別の値を挟んで戻した値も残ることを確認
+func TestCompactDedupeExact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-dedupe-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Compaction.Strategy = CompactionDedupeExact
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("2")},
+		{Value: []byte("retry")},
+		{Value: []byte("retry")},
+		{Key: []byte("a"), Value: []byte("1")},
+		// アクティブなsegment
+		{Key: []byte("b"), Value: []byte("1")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	estimate, duplicates, err := log.CompactionEstimate()
+	require.NoError(t, err)
+	require.Equal(t, 2, duplicates)
+	reclaimed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, estimate, reclaimed)
+
+	for off, wantKept := range []bool{true, false, true, true, false, true, true} {
+		got, err := log.Read(uint64(off))
+		if !wantKept {
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(off)}, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, records[off].Value, got.Value)
+	}
+}
+
+// トゥームストーンより前の同じキーのレコードが取り除かれ、トゥームストーンは保持期限を過ぎてから取り除かれることを確認
+func TestCompactTombstone(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		strategy  CompactionStrategy
+		retention time.Duration
+		dropped   []uint64
+	}{
+		"last write wins": {
+			strategy: CompactionLastWriteWins,
+			dropped:  []uint64{0, 1, 2},
+		},
+		"last write wins with retention": {
+			strategy:  CompactionLastWriteWins,
+			retention: time.Hour,
+			dropped:   []uint64{0, 1},
+		},
+		"dedupe exact": {
+			strategy: CompactionDedupeExact,
+			dropped:  []uint64{0, 2},
+		},
+		"dedupe exact with retention": {
+			strategy:  CompactionDedupeExact,
+			retention: time.Hour,
+			dropped:   []uint64{0},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compact-tombstone-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			c.Compaction.Strategy = tc.strategy
+			c.Compaction.TombstoneRetention = tc.retention
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			_, err = log.Delete(nil)
+			require.Error(t, err)
+
+			records := []*api.Record{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("b"), Value: []byte("1")},
+				{Key: []byte("a"), Tombstone: true},
+				{Key: []byte("b"), Value: []byte("2")},
+				{Key: []byte("c"), Value: []byte("1")},
+				{Key: []byte("e"), Value: []byte("1")},
+				// アクティブなsegment
+				{Key: []byte("d"), Value: []byte("1")},
+			}
+			for _, record := range records {
+				var err error
+				if record.Tombstone {
+					_, err = log.Delete(record.Key)
+				} else {
+					_, err = log.Append(record)
+				}
+				require.NoError(t, err)
+			}
+			got, err := log.Read(2)
+			require.NoError(t, err)
+			require.True(t, got.Tombstone)
+			require.Empty(t, got.Value)
+
+			_, err = log.Compact()
+			require.NoError(t, err)
+
+			dropped := make(map[uint64]bool)
+			for _, off := range tc.dropped {
+				dropped[off] = true
+			}
+			for off, record := range records {
+				got, err := log.Read(uint64(off))
+				if dropped[uint64(off)] {
+					require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(off)}, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, record.Tombstone, got.Tombstone)
+				require.Equal(t, record.Value, got.Value)
+			}
+		})
+	}
+}
+
+// ttlを過ぎたレコードは、segmentの他のレコードが新しくても取り除かれることを確認
+func TestCompactTTL(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		strategy CompactionStrategy
+		dropped  []uint64
+	}{
+		"last write wins": {
+			strategy: CompactionLastWriteWins,
+			// キーの最新のレコードが期限切れなら、古いレコードも残らない
+			dropped: []uint64{0, 1, 2, 4},
+		},
+		"dedupe exact": {
+			strategy: CompactionDedupeExact,
+			dropped:  []uint64{1, 2, 4},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compact-ttl-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			c.Compaction.Strategy = tc.strategy
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			old := time.Now().Add(-2 * time.Hour).UnixNano()
+			ttl := int64(time.Hour)
+			records := []*api.Record{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("a"), Value: []byte("2"), Timestamp: old, Ttl: ttl},
+				{Value: []byte("token"), Timestamp: old, Ttl: ttl},
+				{Value: []byte("token"), Ttl: ttl},
+				{Key: []byte("b"), Value: []byte("1"), Timestamp: old, Ttl: ttl},
+				{Key: []byte("b"), Value: []byte("1")},
+				// アクティブなsegmentのレコードは、期限を過ぎていても取り除かない
+				{Value: []byte("token"), Timestamp: old, Ttl: ttl},
+			}
+			for _, record := range records {
+				_, err := log.Append(record)
+				require.NoError(t, err)
+			}
+			_, err = log.Compact()
+			require.NoError(t, err)
+
+			dropped := make(map[uint64]bool)
+			for _, off := range tc.dropped {
+				dropped[off] = true
+			}
+			for off, record := range records {
+				got, err := log.Read(uint64(off))
+				if dropped[uint64(off)] {
+					require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(off)}, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, record.Value, got.Value)
+				require.Equal(t, record.Ttl, got.Ttl)
+			}
+		})
+	}
+}
+
+// Intervalを設定すると、Compactを呼ばなくてもバックグラウンドで古いキーが取り除かれることを確認
+func TestCompactInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-interval-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Compaction.Interval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		_, err := log.Append(&api.Record{Key: []byte("k"), Value: []byte(v)})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := log.Read(0)
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	got, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), got.Value)
+}
@@ -0,0 +1,157 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	api "proglog/api/v1"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codecは、レコードの値を圧縮・展開する。IDはレコードのCodecに記録され、読み込むときに同じIDのCodecで展開する。
+// 0は圧縮していないことを表すので、IDには使えない
+type Codec interface {
+	ID() uint32
+	Encode(p []byte) ([]byte, error)
+	Decode(p []byte) ([]byte, error)
+}
+
+// 組み込みのCodecのID
+const (
+	CodecGzip uint32 = iota + 1
+	CodecSnappy
+	CodecZstd
+)
+
+var (
+	GzipCodec   Codec = gzipCodec{}
+	SnappyCodec Codec = snappyCodec{}
+	ZstdCodec   Codec = &zstdCodec{}
+)
+
+var codecs = map[uint32]Codec{
+	CodecGzip:   GzipCodec,
+	CodecSnappy: SnappyCodec,
+	CodecZstd:   ZstdCodec,
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint32 { return CodecGzip }
+
+func (gzipCodec) Encode(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() uint32 { return CodecSnappy }
+
+func (snappyCodec) Encode(p []byte) ([]byte, error) {
+	return snappy.Encode(nil, p), nil
+}
+
+func (snappyCodec) Decode(p []byte) ([]byte, error) {
+	return snappy.Decode(nil, p)
+}
+
+// EncodeAllとDecodeAllは並行に呼んでよいので、エンコーダーとデコーダーは一つずつを使い回す。
+// 作るとゴルーチンが起動するので、最初に使うときに作る
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		if c.encoder, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) ID() uint32 { return CodecZstd }
+
+func (c *zstdCodec) Encode(p []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(p, nil), nil
+}
+
+func (c *zstdCodec) Decode(p []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(p, nil)
+}
+
+// Config.Compressionに従ってrecordの値を圧縮した、storeに書き込むためのレコードを返す。
+// AppendRawやコンパクションでstoreから読んだ圧縮済みのレコードや、圧縮しても小さくならない値は、そのまま返す
+func compressRecord(record *api.Record, c Config) (*api.Record, error) {
+	codec := c.Compression.Codec
+	if codec == nil || record.Codec != 0 || len(record.Value) < c.Compression.MinBytes {
+		return record, nil
+	}
+	value, err := codec.Encode(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) >= len(record.Value) {
+		return record, nil
+	}
+	// 呼び出し側のレコードの値は書き換えない
+	compressed := proto.Clone(record).(*api.Record)
+	compressed.Value = value
+	compressed.Codec = codec.ID()
+	return compressed, nil
+}
+
+// storeから読んだレコードの値が圧縮されていれば展開する。
+// 組み込みのCodecか、Config.Compression.Codecと同じIDのCodecで展開する
+func decompressRecord(record *api.Record, c Config) error {
+	if record.Codec == 0 {
+		return nil
+	}
+	codec := codecs[record.Codec]
+	if custom := c.Compression.Codec; custom != nil && custom.ID() == record.Codec {
+		codec = custom
+	}
+	if codec == nil {
+		return fmt.Errorf("unknown codec %d at offset %d", record.Codec, record.Offset)
+	}
+	value, err := codec.Decode(record.Value)
+	if err != nil {
+		return err
+	}
+	record.Value = value
+	record.Codec = 0
+	return nil
+}
@@ -0,0 +1,159 @@
+package log
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// どのCodecでも、圧縮して書き込んだ値を透過的に読み出せ、圧縮しない設定で開き直しても読めることを確認
+func TestCompression(t *testing.T) {
+	for scenario, codec := range map[string]Codec{
+		"gzip":   GzipCodec,
+		"snappy": SnappyCodec,
+		"zstd":   ZstdCodec,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "compression-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Compression.Codec = codec
+			c.Compression.MinBytes = 64
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			large := bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`), 100)
+			small := []byte(`{"msg":"hi"}`)
+			for _, value := range [][]byte{large, small} {
+				record := &api.Record{Value: value}
+				_, err := log.Append(record)
+				require.NoError(t, err)
+				// 呼び出し側のレコードは書き換えない
+				require.Equal(t, value, record.Value)
+				require.Zero(t, record.Codec)
+			}
+			require.Less(t, log.activeSegment.store.size, uint64(len(large)))
+
+			check := func(log *Log) {
+				for off, want := range [][]byte{large, small} {
+					got, err := log.Read(uint64(off))
+					require.NoError(t, err)
+					require.Equal(t, want, got.Value)
+					require.Zero(t, got.Codec)
+				}
+			}
+			check(log)
+
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, Config{})
+			require.NoError(t, err)
+			defer log.Close()
+			check(log)
+		})
+	}
+}
+
+// クライアントがCodecを付けたレコードは、展開できない値を書き込まないよう断ることを確認
+func TestCompressionRejectsProducerCodec(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("not gzip"), Codec: CodecGzip})
+	require.IsType(t, api.ErrRecordRejected{}, err)
+	_, _, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("plain")},
+		{Value: []byte("not zstd"), Codec: CodecZstd},
+	})
+	require.IsType(t, api.ErrRecordRejected{}, err)
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), next)
+}
+
+type trimCodec struct{}
+
+func (trimCodec) ID() uint32 { return 100 }
+
+func (trimCodec) Encode(p []byte) ([]byte, error) {
+	// 先頭の繰り返しを一つにまとめるだけの、テスト用の圧縮
+	q := bytes.TrimLeft(p, "a")
+	return append([]byte{byte(len(p) - len(q))}, q...), nil
+}
+
+func (trimCodec) Decode(p []byte) ([]byte, error) {
+	return append(bytes.Repeat([]byte("a"), int(p[0])), p[1:]...), nil
+}
+
+// 組み込み以外のCodecも使え、そのCodecが無ければ読み込めないことを確認
+func TestCompressionCustomCodec(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-custom-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Compression.Codec = trimCodec{}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	value := append(bytes.Repeat([]byte("a"), 100), "bc"...)
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, value, got.Value)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(0)
+	require.EqualError(t, err, "unknown codec 100 at offset 0")
+}
+
+// Statが、圧縮したレコードの展開した大きさとstoreに書き込んだ大きさ、時刻、チェックサムを返すことを確認
+func TestCompressionStat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compression-stat-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Compression.Codec = SnappyCodec
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{
+		Value:     bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`), 100),
+		Timestamp: time.Unix(0, 1234).UnixNano(),
+	}
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	record.Offset = off
+
+	stat, err := log.Stat(off)
+	require.NoError(t, err)
+	require.Equal(t, off, stat.Offset)
+	require.Equal(t, uint64(proto.Size(record)), stat.Size)
+	require.Less(t, stat.StoredSize, stat.Size)
+	require.Equal(t, frameWidth+stat.StoredSize+entWidth, stat.DiskSize)
+	require.Equal(t, time.Unix(0, 1234), stat.Timestamp)
+
+	p, _, err := log.activeSegment.store.readRecord(stat.Position)
+	require.NoError(t, err)
+	require.Equal(t, crc32.Checksum(p, castagnoli), stat.Checksum)
+	require.Equal(t, uint64(len(p)), stat.StoredSize)
+}
@@ -1,16 +1,222 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
 		raft.Config
 		StreamLayer *StreamLayer
 		Bootstrap   bool
+		// trueなら、dataDir/topicsにトピックを置き、トピックの作成と書き込みもraftで複製する
+		Topics bool
+		// Topicsのとき、作れるトピックの数の上限。0なら制限しない
+		MaxTopics int
+		// Topicsのとき、作成時にパーティション数を指定しなかったトピックのパーティション数。0なら1
+		TopicPartitions int
 	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// 大きさの上限に達していなくても、segmentに最初のレコードを書き込んだ時刻とは別の区間に入ったら新しいsegmentに移る。
+		// 区間はUNIXエポックからこの長さで区切るので、1時間なら毎時0分に切り替わる。0なら時刻では切り替えない
+		RollInterval time.Duration
+		// indexとtimeindexを置くディレクトリ。storeとは別のディスクに置き、indexのメモリマップとstoreの書き込みが競合しないようにする。
+		// 空ならstoreと同じディレクトリ。ログごとに別のディレクトリにすること
+		IndexDir string
+		// indexが指すレコードのオフセットが要求と異なる場合に、storeを探してindexを修復する
+		ReadRepair bool
+		// indexのファイルとメモリマップを、開くときにMaxIndexBytesまで広げずに、この大きさずつ広げる。
+		// ページの大きさの倍数にするとよい。0なら開くときにMaxIndexBytesまで広げる
+		IndexGrowBytes uint64
+		// indexを閉じる際のメモリマップの同期方法
+		IndexSyncMode IndexSyncMode
+		// 新しく作るindexのエントリの形式。既存のindexは、作ったときの形式のまま読み書きする
+		IndexLayout IndexLayout
+		// 新しく作るsegmentを、小さなレコード向けの形式にする。storeはフレームの長さをuvarintで書く版3にし、
+		// indexはIndexLayoutを指定していなければ、エントリの幅をMaxStoreBytesに収まる最小のバイト数にする。
+		// 既存のsegmentは、作ったときの形式のまま読み書きする
+		CompactFormat bool
+		// storeのバッファをファイルへ書き出す頻度。どちらも0なら、読み込みとClose、Syncのときだけ書き出す
+		Flush FlushConfig
+		// コミットされていない(storeをfsyncしていない)レコードを、ReadやScan、Subscribeなどの読み手から隠し、
+		// CommittedOffsetより前のレコードだけを読ませる。Flushでfsyncしていなければ、SyncかsegmentのロールまでCommittedOffsetは進まない
+		HideUncommitted bool
+		// エンコードしたレコード1件の大きさの上限。超えた書き込みはstoreに書き込む前にErrRecordTooLargeを返す。0なら制限しない
+		MaxRecordBytes uint64
+		// コミット待ちにできる書き込みの数。超えた書き込みはErrBackpressureを返す。0なら制限しない。
+		// Logでは、Flush.GroupCommitでfsyncを待つ書き込みだけを数える
+		MaxPendingCommits int
+		// 封印済みのsegmentごとに作る、キーのブルームフィルタの偽陽性率。0なら1%
+		KeyBloomFalsePositiveRate float64
+		// segmentを作るときに、storeのディスクの領域をMaxStoreBytesまでfallocateで確保しておく。
+		// 断片化を防ぎ、書き込みの途中で容量が尽きないようにする。封印するときに使わなかった領域を解放する
+		PreallocateStore bool
+		// 封印済みのsegmentのstoreから読んだ分を、POSIX_FADV_DONTNEEDでページキャッシュから落とし、
+		// 古いレコードを大量に読んでも他のプロセスのページキャッシュを追い出さないようにする。
+		// storeはレコードの境界がブロックに揃っていないのでO_DIRECTは使わない。MmapSealedのstoreには効かない
+		DropCacheAfterRead bool
+		// 今より古い形式のstoreやindexを開く前に呼ぶ。pathはファイルのパス、versionはファイルの形式の版で、
+		// ヘッダーの無い最初の形式は0で、ヘッダーは無いがレコードのCRC32Cを持つstoreは1。形式を変えたときに、古いファイルを書き換えるのに使う。
+		// nilなら、読める形式のファイルはそのまま開く。CRC32Cを持たない版0のstoreは読めないので、書き換えること
+		MigrateFormat func(path string, version byte) error
+		// 封印済みのsegmentのstoreをメモリマップし、読み込みでのシステムコールとコピーを省く
+		MmapSealed bool
+		// 封印済みのsegmentを開くときに、storeを読み直して.crcファイルのCRC32Cとレコードの数を確かめる。
+		// falseなら大きさだけを確かめる。一致しなければErrChecksumMismatchで開かない
+		VerifyChecksums bool
+		// indexのエントリを間引く間隔。どちらも0なら、すべてのレコードのエントリを書き込む。
+		// エントリの無いレコードは、手前のエントリの位置からstoreを読み進めて探す
+		SparseIndex struct {
+			// この数のレコードごとにエントリを書き込む
+			EveryRecords int
+			// 前回のエントリの位置からstoreがこれだけ進んだら、エントリを書き込む
+			EveryBytes uint64
+		}
+	}
+	Metrics struct {
+		// レコードサイズのヒストグラムのバケツの上限(昇順)。nilならヒストグラムを記録しない
+		RecordSizeBuckets []uint64
+	}
+	Retention RetentionConfig
+	// 封印済みのsegmentを外部のストレージへ移し、ローカルには新しいsegmentだけを置く
+	Tiering struct {
+		// segmentのファイルを置くストレージ。nilなら、すべてのsegmentをローカルに置く
+		Store ObjectStore
+		// 最後に書き込んでからこれだけ経った封印済みのsegmentを移す
+		MinAge time.Duration
+		// 移すsegmentを探す間隔。0ならMinAgeの10分の1
+		CheckInterval time.Duration
+		// オブジェクトの名前の前に付ける文字列。複数のログで同じStoreを使うときに、ログごとに分ける
+		Prefix string
+		// 読み込みのために取ってきたsegmentをローカルに置いておく合計バイト数。
+		// 超えたら最も長く読まれていないsegmentからローカルのファイルを消す。0なら、次の確認でMinAgeを過ぎたものから消す
+		CacheBytes uint64
+	}
+	// レコードの値の圧縮。Codecがnilなら圧縮しない。読み込むときは、圧縮したCodecのIDを見て展開する
+	Compression CompressionConfig
+	// storeの暗号化。Keysがnilなら暗号化しない。新しいsegmentはその時点の鍵で暗号化するので、
+	// 鍵をローテーションしても、古い鍵をKeysから引ける間は古いsegmentを読める
+	Encryption struct {
+		Keys KeyProvider
+	}
+	Compaction struct {
+		// 取り除くレコードの選び方
+		Strategy CompactionStrategy
+		// バックグラウンドでコンパクションとマージを行う間隔。0ならCompactやMergeを呼んだときだけ行う
+		Interval time.Duration
+		// storeとindexの合計がこれより小さい、隣り合う封印済みのsegmentを、まとめた後もこれを超えない範囲で一つにまとめる。
+		// 0ならまとめない
+		MergeBelowBytes uint64
+		// トゥームストーンを、キーのそれまでのレコードを取り除いた後も残しておく期間。
+		// 読み手が削除を知るための猶予で、0なら最初のコンパクションで取り除く
+		TombstoneRetention time.Duration
+		// trueなら、封印済みのsegmentを書き直さずに、取り除くレコードの領域に穴を開けてディスクから解放する。
+		// 穴を開けられないファイルシステムや、ヘッダーの無い元の形式のsegmentでは書き直す
+		PunchHoles bool
 	}
+	// 封印済みのsegmentを読み直して、ディスクの中で壊れたレコードを探す
+	Scrub struct {
+		// 読み直す間隔。0なら読み直さない
+		Interval time.Duration
+		// 読む速さの上限(バイト毎秒)。0なら制限しない
+		BytesPerSecond uint64
+		// 壊れたレコードを見つけたsegmentごとに、見つかった問題を渡して呼ぶ。nilならログに書くだけ
+		OnCorrupt func(problems []Problem)
+	}
+	// 起動時にすぐ開くsegmentの数。これより古いsegmentは最初に読み込まれるときに開く。0なら全て開く
+	MaxRecoverySegments int
+	// 起動時にsegmentを並行して開くゴルーチンの数。0ならGOMAXPROCS
+	OpenConcurrency int
+	// 最近読んだレコードをメモリに置いておく量の上限(バイト)。0ならキャッシュしない
+	RecordCacheBytes uint64
+	// 書き込むレコードを、storeに書き込む前に順に通すフック。AppendRawで書き込むフレームには呼ばない
+	AppendHooks []AppendHook
+	// 冪等な書き込みのために状態を覚えておくproducerの数。超えたら最も長く書き込んでいないproducerを忘れる。0なら10000
+	MaxProducers int
+	// AppendAsyncで書き込み待ちにできるレコードの数。一杯になるとAppendAsyncは空くまで待つ。0なら1024
+	AsyncQueueSize int
+	// Closeが、購読者が残りのレコードを受け取り終えるのを待つ時間。過ぎたら配信を打ち切る。0なら5秒
+	CloseTimeout time.Duration
+	// ログが作るファイルとディレクトリのパーミッション
+	Permissions struct {
+		// 0なら0600
+		File os.FileMode
+		// 0なら0755
+		Dir os.FileMode
+	}
+	// segmentのファイルを開く関数。nilならos.OpenFileを使う
+	FileOpener func(name string, flag int, perm os.FileMode) (File, error)
+
+	// OpenReadOnlyで開いたログ。ファイルを作ったり書き換えたりしない
+	readOnly bool
+}
+
+// storeのバッファをファイルへ書き出す頻度
+type FlushConfig struct {
+	// この数のレコードを書き込むごとに書き出す。1なら毎回
+	EveryRecords int
+	// 前回の書き出しからこれだけ経った後の書き込みで書き出す。
+	// 書き込みが途絶えても残らないよう、バックグラウンドでもこの間隔ごとに書き出す
+	Interval time.Duration
+	// 書き出すたびにfsyncもする
+	Fsync bool
+	// 書き込みを、fsyncしてから返す。並行する書き込みは一度のfsyncにまとめる。
+	// 封印するsegmentも書き出すときにfsyncする
+	GroupCommit bool
+	// バックグラウンドでこの間隔ごとに、アクティブなsegmentのstoreを書き出してfsyncする。
+	// 次の読み書きを待たずに永続化される。0ならバックグラウンドでは書き出さない
+	Background time.Duration
 }
+
+// 古いsegmentを削除する条件
+type RetentionConfig struct {
+	// 最新のレコードがこれより古くなったsegmentを削除する。0なら削除しない
+	MaxAge time.Duration
+	// 古いsegmentを確認する間隔。0ならMaxAgeの10分の1
+	CheckInterval time.Duration
+	// storeの合計サイズがこれを超えたら、古いsegmentから削除する。0なら削除しない
+	MaxBytes uint64
+}
+
+// レコードの値の圧縮
+type CompressionConfig struct {
+	Codec Codec
+	// これより小さい値は圧縮しない
+	MinBytes int
+}
+
+// indexを閉じる際に、メモリマップの内容をどうファイルへ書き戻すか
+type IndexSyncMode int
+
+const (
+	// 書き戻しとfsyncが終わるまで待つ(MS_SYNC)。Closeから戻った時点でindexはディスク上で永続化されている
+	IndexSyncModeSync IndexSyncMode = iota
+	// 書き戻しを予約するだけで待たない(MS_ASYNC)。fsyncも行わないため、segmentのロールは速くなるが、
+	// 閉じた直後にOSがクラッシュするとindexの末尾が失われることがある。プロセスのクラッシュであればOSが書き戻すので失われない
+	IndexSyncModeAsync
+)
+
+// indexのエントリの、相対オフセットとstoreのポジションのバイト数。どちらも1から8で、0なら元の形式と同じ4と8。
+// オフセットの幅はsegmentに書き込めるレコードの数を、ポジションの幅はstoreの大きさを制限し、
+// 届いたsegmentは上限に達したものとして次のsegmentに移る。元の形式以外にすると、indexの先頭に8バイトのヘッダーを置く
+type IndexLayout struct {
+	OffsetWidth   uint64
+	PositionWidth uint64
+}
+
+// コンパクションでどのレコードを取り除くか
+type CompactionStrategy int
+
+const (
+	// 同じキーを持つレコードのうち、最新のものだけを残す。キーを持たないレコードは残す
+	CompactionLastWriteWins CompactionStrategy = iota
+	// 同じキーの直前のレコードとキーも値も同じレコードを取り除き、連続した重複のうち最初のものだけを残す。
+	// 再送による重複を取り除く、追記のみのログ向け
+	CompactionDedupeExact
+)
@@ -0,0 +1,189 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// 封印したsegmentには、storeの全体のCRC32Cとレコードの数を書いた.crcファイルを置く。
+// 封印済みのsegmentを開くときにstoreの大きさを、Config.Segment.VerifyChecksumsであればCRC32Cとレコードの数も確かめ、
+// ObjectStoreへ送る前にもstoreを読み直して確かめる。レコードごとのCRC32Cでは気づけない、ファイルの欠けや入れ替わりを安く見つける。
+// storeを書き換えたときは.crcも書き直すか消す。.crcの無い封印済みのsegmentは、開いたときに作る
+
+const (
+	crcMagic        = "PLCR"
+	crcVersion byte = 1
+	// ヘッダーの後に、storeの大きさ、レコードの数、CRC32Cが並ぶ
+	crcFileWidth = formatHeaderWidth + 8 + 8 + 4
+)
+
+// ErrChecksumMismatchは、封印済みのsegmentのstoreが.crcファイルと一致しなかったときに返す
+type ErrChecksumMismatch struct {
+	BaseOffset uint64
+	Detail     string
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("segment %d does not match its checksum file: %s", e.BaseOffset, e.Detail)
+}
+
+// .crcファイルの中身
+type segmentChecksum struct {
+	// ヘッダーを含めたstoreのバイト数
+	size uint64
+	// 穴を除いたレコードの数
+	records uint64
+	// ヘッダーより後ろのstoreのCRC32C
+	sum uint32
+}
+
+func (c segmentChecksum) marshal() []byte {
+	b := make([]byte, crcFileWidth)
+	copy(b, formatHeader(crcMagic, crcVersion))
+	enc.PutUint64(b[formatHeaderWidth:], c.size)
+	enc.PutUint64(b[formatHeaderWidth+8:], c.records)
+	enc.PutUint32(b[formatHeaderWidth+16:], c.sum)
+	return b
+}
+
+func unmarshalSegmentChecksum(b []byte) (segmentChecksum, error) {
+	if uint64(len(b)) != crcFileWidth || string(b[:len(crcMagic)]) != crcMagic {
+		return segmentChecksum{}, errors.New("malformed checksum file")
+	}
+	if v := b[len(crcMagic)]; v != crcVersion {
+		return segmentChecksum{}, fmt.Errorf("unsupported checksum file version %d", v)
+	}
+	return segmentChecksum{
+		size:    enc.Uint64(b[formatHeaderWidth:]),
+		records: enc.Uint64(b[formatHeaderWidth+8:]),
+		sum:     enc.Uint32(b[formatHeaderWidth+16:]),
+	}, nil
+}
+
+// ヘッダーより後ろのstoreの中身rを読み、CRC32Cとレコードの数を求める。startはヘッダーの幅、varintは版3のstoreかどうか
+func sumStore(r io.Reader, start uint64, varint bool) (segmentChecksum, error) {
+	sum := crc32.New(castagnoli)
+	br := bufio.NewReaderSize(io.TeeReader(r, sum), 64<<10)
+	c := segmentChecksum{size: start}
+	for {
+		h, err := readFrameHeader(br, varint)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return c, err
+		}
+		if _, err := br.Discard(int(h.n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return c, err
+		}
+		c.size += h.width + h.n
+		if !h.hole {
+			c.records++
+		}
+	}
+	c.sum = sum.Sum32()
+	return c, nil
+}
+
+// wantと一致するか確かめる
+func (c segmentChecksum) check(baseOffset uint64, want segmentChecksum) error {
+	switch {
+	case c.size != want.size:
+		return ErrChecksumMismatch{BaseOffset: baseOffset, Detail: fmt.Sprintf("store is %d bytes, want %d", c.size, want.size)}
+	case c.records != want.records:
+		return ErrChecksumMismatch{BaseOffset: baseOffset, Detail: fmt.Sprintf("store has %d records, want %d", c.records, want.records)}
+	case c.sum != want.sum:
+		return ErrChecksumMismatch{BaseOffset: baseOffset, Detail: fmt.Sprintf("crc32c %08x, want %08x", c.sum, want.sum)}
+	}
+	return nil
+}
+
+// .crcファイルを読む。無ければfalse
+func (s *segment) readChecksumFile() (segmentChecksum, bool, error) {
+	b, err := os.ReadFile(s.path(".crc"))
+	if os.IsNotExist(err) {
+		return segmentChecksum{}, false, nil
+	}
+	if err != nil {
+		return segmentChecksum{}, false, err
+	}
+	c, err := unmarshalSegmentChecksum(b)
+	if err != nil {
+		return segmentChecksum{}, false, fmt.Errorf("read checksum file of segment %d: %w", s.baseOffset, err)
+	}
+	return c, true, nil
+}
+
+// 開いているstoreを読み、CRC32Cとレコードの数を求める。求めたCRC32Cはchecksumでも使う
+func (s *segment) sumStore() (segmentChecksum, error) {
+	c, err := sumStore(io.NewSectionReader(s.store, int64(s.store.start), int64(s.store.size-s.store.start)), s.store.start, s.store.varint)
+	if err != nil {
+		return c, err
+	}
+	s.sumMu.Lock()
+	s.sum, s.summed = c.sum, true
+	s.sumMu.Unlock()
+	return c, nil
+}
+
+// storeから.crcファイルを書く。segmentは開いておくこと
+func (s *segment) writeChecksumFile() error {
+	c, err := s.sumStore()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(".crc"), bytes.NewReader(c.marshal()), s.config.fileMode())
+}
+
+// 封印済みのsegmentのstoreを、.crcファイルと比べる。.crcが無ければ書く。segmentは開いておくこと
+func (s *segment) checkChecksumFile() error {
+	want, ok, err := s.readChecksumFile()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if s.config.readOnly {
+			return nil
+		}
+		return s.writeChecksumFile()
+	}
+	if s.store.size != want.size {
+		return ErrChecksumMismatch{
+			BaseOffset: s.baseOffset,
+			Detail:     fmt.Sprintf("store is %d bytes, want %d", s.store.size, want.size),
+		}
+	}
+	if !s.config.Segment.VerifyChecksums {
+		return nil
+	}
+	got, err := s.sumStore()
+	if err != nil {
+		return err
+	}
+	return got.check(s.baseOffset, want)
+}
+
+// ObjectStoreへ送るstoreのファイルを読み直し、.crcファイルと比べる
+func verifyStoreFile(f *os.File, baseOffset uint64, want segmentChecksum) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	version, start, err := readStoreFormat(f, size)
+	if err != nil {
+		return err
+	}
+	got, err := sumStore(io.NewSectionReader(f, int64(start), int64(size-start)), start, version >= storeVarintVersion)
+	if err != nil {
+		return err
+	}
+	return got.check(baseOffset, want)
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newChecksumTestLog(t *testing.T, dir string, c Config) *Log {
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	return log
+}
+
+// 封印したsegmentに、storeの大きさとレコードの数、CRC32Cを書いた.crcファイルができることを確認
+func TestChecksumFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "checksum-file-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := newChecksumTestLog(t, dir, Config{})
+	defer log.Close()
+	require.FileExists(t, filepath.Join(dir, "0.crc"))
+	// アクティブなsegmentには作らない
+	require.NoFileExists(t, filepath.Join(dir, "3.crc"))
+
+	s := log.segments[0]
+	c, ok, err := s.readChecksumFile()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, s.store.size, c.size)
+	require.Equal(t, uint64(3), c.records)
+	sum, err := s.checksum()
+	require.NoError(t, err)
+	require.Equal(t, sum, c.sum)
+}
+
+// storeが.crcファイルと一致しない封印済みのsegmentは開かないことを確認
+func TestChecksumFileMismatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "checksum-mismatch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	log := newChecksumTestLog(t, dir, c)
+	require.NoError(t, log.Close())
+
+	// 大きさの変わらない書き換えは、VerifyChecksumsのときだけ見つける。
+	// レコードのCRC32Cも合わせて書き換え、レコードごとには気づけないようにする
+	path := filepath.Join(dir, "0.store")
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	at := formatHeaderWidth
+	n := enc.Uint64(b[at:])
+	p := b[at+frameWidth : at+frameWidth+n]
+	p[len(p)-1] = '9'
+	enc.PutUint32(b[at+lenWidth:], crc32.Checksum(p, castagnoli))
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	c.Segment.VerifyChecksums = true
+	_, err = NewLog(dir, c)
+	var mismatch ErrChecksumMismatch
+	require.True(t, errors.As(err, &mismatch), "%v", err)
+	require.Equal(t, uint64(0), mismatch.BaseOffset)
+
+	// .crcが無ければ、開いたときに作り直す
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.crc")))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, "0.crc"))
+	require.NoError(t, log.Close())
+}
+
+// ObjectStoreへ送る前に、storeが.crcファイルと一致するか確かめることを確認
+func TestChecksumFileBeforeOffload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "checksum-offload-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := os.MkdirTemp("", "checksum-offload-remote-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+
+	c := Config{}
+	c.Tiering.Store = DirObjectStore{Dir: remote}
+	c.Tiering.CheckInterval = time.Hour
+	log := newChecksumTestLog(t, dir, c)
+	defer log.Close()
+
+	// 封印した後でディスクの中で壊れた
+	path := filepath.Join(dir, "0.store")
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[formatHeaderWidth+frameWidth+4] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0600))
+
+	_, err = log.Offload()
+	var mismatch ErrChecksumMismatch
+	require.True(t, errors.As(err, &mismatch), "%v", err)
+	require.NoFileExists(t, filepath.Join(remote, "0.store"))
+	require.FileExists(t, path)
+
+	// 直せば送れて、.crcも一緒に送る
+	b[formatHeaderWidth+frameWidth+4] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	evicted, err := log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 1, evicted)
+	require.FileExists(t, filepath.Join(remote, "0.crc"))
+
+	// 取ってきたsegmentも、.crcと比べてから読む
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), got.Value)
+}
@@ -120,3 +120,114 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+// HideUncommittedでも、raftのログとFSMのログは書いたレコードを隠さず、書き込んだレコードを読めることを確認
+func TestDistributedHideUncommitted(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-hide-uncommitted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := log.Config{}
+	config.Segment.HideUncommitted = true
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+	config.Raft.ElectionTimeout = 100 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	for i := 0; i < 3; i++ {
+		off, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		got, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+}
+
+// トピックの作成と書き込みと削除がフォロワーに複製され、作成の上限はリーダーで確かめることを確認
+func TestDistributedTopics(t *testing.T) {
+	var logs []*log.DistributedLog
+	ports := dynaport.Get(2)
+	for i := 0; i < 2; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-topics-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		config.Raft.ElectionTimeout = 100 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		config.Raft.Topics = true
+		config.Raft.MaxTopics = 1
+		config.Raft.TopicPartitions = 2
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+
+	topic, err := logs[0].Create("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, topic.Partitions())
+	_, err = logs[0].Create("payments", 0)
+	require.ErrorIs(t, err, log.ErrTooManyTopics)
+	_, err = logs[1].Create("events", 1)
+	require.Error(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, _, err := topic.Append(&api.Record{
+			Key:   []byte(fmt.Sprintf("key %d", i)),
+			Value: []byte(fmt.Sprintf("order %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	p, err := topic.Partition(0)
+	require.NoError(t, err)
+	next, err := p.NextOffset()
+	require.NoError(t, err)
+	require.Greater(t, next, uint64(0))
+	lowest, err := topic.DeleteRecords(0, next)
+	require.NoError(t, err)
+	require.Equal(t, next, lowest)
+
+	require.Eventually(t, func() bool {
+		replica, err := logs[1].Get("orders")
+		if err != nil || replica.Partitions() != 2 {
+			return false
+		}
+		for i := 0; i < 2; i++ {
+			want, err := topic.Partition(i)
+			require.NoError(t, err)
+			got, err := replica.Partition(i)
+			require.NoError(t, err)
+			wantNext, _ := want.NextOffset()
+			gotNext, _ := got.NextOffset()
+			wantLowest, _ := want.LowestOffset()
+			gotLowest, _ := got.LowestOffset()
+			if gotNext != wantNext || gotLowest != wantLowest {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 50*time.Millisecond)
+	require.Equal(t, []string{"orders"}, logs[1].Topics())
+}
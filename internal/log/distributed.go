@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	raftboltdb "github.com/hashicorp/raft-boltdb"
@@ -23,10 +25,17 @@ import (
 // リーダーは、フォロワーのログの複製を行う。この複製は、gRPCによって行う
 
 type DistributedLog struct {
+	// raftでのコミットを待っている書き込みの数。32bit環境でのアトミック操作のため先頭に置く
+	pending int64
+
 	config  Config
 	log     *Log
 	raftLog *logStore
 	raft    *raft.Raft
+	// Config.Raft.Topicsでなければnil
+	topics *LogManager
+	// トピックの作成を一つずつ行う
+	createMu sync.Mutex
 }
 
 func NewDistributedLog(dataDir string, config Config) (
@@ -39,6 +48,9 @@ func NewDistributedLog(dataDir string, config Config) (
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
 	}
+	if err := l.setupTopics(dataDir); err != nil {
+		return nil, err
+	}
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
@@ -47,27 +59,54 @@ func NewDistributedLog(dataDir string, config Config) (
 
 func (l *DistributedLog) setupLog(dataDir string) error {
 	logDir := filepath.Join(dataDir, "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
+	if err := os.MkdirAll(logDir, l.config.dirMode()); err != nil {
 		return err
 	}
+	// コミット待ちの制限はraftに渡す前にかける。FSMで書き込みを断るとノード間でログが食い違ってしまう
+	logConfig := replicaConfig(l.config)
+	if logConfig.Segment.IndexDir != "" {
+		logConfig.Segment.IndexDir = filepath.Join(logConfig.Segment.IndexDir, "log")
+	}
 	var err error
-	l.log, err = NewLog(logDir, l.config)
+	l.log, err = NewLog(logDir, logConfig)
 	return err
 }
 
+// FSMが書き込むログの設定。元のログとトピックのパーティションで使う
+func replicaConfig(c Config) Config {
+	// コミット待ちの制限はraftに渡す前にかける。FSMで書き込みを断るとノード間でログが食い違ってしまう
+	c.Segment.MaxPendingCommits = 0
+	// フックはリーダーで通してあるので、レプリカで書き換えたり断ったりしない
+	c.AppendHooks = nil
+	// FSMに届いたレコードはraftでコミット済みなので、fsyncを待たずに読ませる
+	c.Segment.HideUncommitted = false
+	return c
+}
+
 // raftを立ち上げる
 // raftは、サーバーの状態や投票結果など、メタデータを保持する
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	var err error
 
-	fsm := &fsm{log: l.log}
+	fsm := &fsm{log: l.log, topics: l.topics}
 
 	logDir := filepath.Join(dataDir, "raft", "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
+	if err := os.MkdirAll(logDir, l.config.dirMode()); err != nil {
 		return err
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	logConfig.Segment.MaxPendingCommits = 0
+	// raftのログはraft自身がスナップショットの後に削除するので、保持期限は設けない
+	logConfig.Retention.MaxAge = 0
+	logConfig.Retention.MaxBytes = 0
+	// raftのエントリは利用者のレコードではないので、フックを通さない
+	logConfig.AppendHooks = nil
+	// raftはStoreLogsの直後にGetLogで読むので、書いたエントリを隠さない
+	logConfig.Segment.HideUncommitted = false
+	if logConfig.Segment.IndexDir != "" {
+		logConfig.Segment.IndexDir = filepath.Join(logConfig.Segment.IndexDir, "raft", "log")
+	}
 	l.raftLog, err = newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
@@ -146,6 +185,19 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 }
 
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	// raftのログに入ってからでは拒否できないので、フックもリーダーで通す
+	if err := checkRecord(record, l.config); err != nil {
+		return 0, err
+	}
+	release, err := acquirePending(&l.pending, l.config.Segment.MaxPendingCommits)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	// 時刻はリーダーで決めておき、すべてのレプリカで同じ値になるようにする
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	res, err := l.apply(
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
@@ -156,6 +208,18 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
+// すべてのレプリカで、オフセットがbeforeより小さいレコードを削除する
+func (l *DistributedLog) DeleteRecords(before uint64) (uint64, error) {
+	res, err := l.apply(
+		DeleteRecordsRequestType,
+		&api.DeleteRecordsRequest{Offset: before},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.DeleteRecordsResponse).Lowest, nil
+}
+
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
 	error,
@@ -185,10 +249,47 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	return res, nil
 }
 
+// ローカルのログを購読する。フォロワーでも、複製されたレコードが届く
+func (l *DistributedLog) Subscribe(off uint64, buffer int) (*Subscription, error) {
+	return l.log.Subscribe(off, buffer)
+}
+
+// ローカルのログのレコードを、fromから書き込まれるたびに届ける
+func (l *DistributedLog) Watch(from uint64) (<-chan *api.Record, func()) {
+	return l.log.Watch(from)
+}
+
 func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
+// ローカルのログのfromからtoまでを、storeのフレームのまま読む
+func (l *DistributedLog) ReadRaw(from, to uint64) (io.ReadCloser, error) {
+	return l.log.ReadRaw(from, to)
+}
+
+// ローカルのログのメトリクスを書き出す
+func (l *DistributedLog) WriteMetrics(w io.Writer) error {
+	return l.log.WriteMetrics(w)
+}
+
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+func (l *DistributedLog) NextOffset() (uint64, error) {
+	return l.log.NextOffset()
+}
+
+// FSMはraftでコミットされたエントリだけを書き込むので、レプリカに届いていないレコードはこのノードのログに無い
+func (l *DistributedLog) CommittedOffset() (uint64, error) {
+	return l.log.CommittedOffset()
+}
+
 func (l *DistributedLog) Join(id, addr string) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
@@ -245,6 +346,11 @@ func (l *DistributedLog) Close() error {
 	if err := l.raftLog.Log.Close(); err != nil {
 		return err
 	}
+	if l.topics != nil {
+		if err := l.topics.Close(); err != nil {
+			return err
+		}
+	}
 	return l.log.Close()
 }
 
@@ -268,12 +374,17 @@ var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
 	log *Log
+	// トピックを複製しないならnil
+	topics *LogManager
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType        RequestType = 0
+	DeleteRecordsRequestType RequestType = 1
+	CreateTopicRequestType   RequestType = 2
+	TopicAppendRequestType   RequestType = 3
 )
 
 func (l *fsm) Apply(record *raft.Log) interface{} {
@@ -282,6 +393,12 @@ func (l *fsm) Apply(record *raft.Log) interface{} {
 	switch reqType {
 	case AppendRequestType:
 		return l.applyAppend(buf[1:])
+	case DeleteRecordsRequestType:
+		return l.applyDeleteRecords(buf[1:])
+	case CreateTopicRequestType:
+		return l.applyCreateTopic(buf[1:])
+	case TopicAppendRequestType:
+		return l.applyTopicAppend(buf[1:])
 	}
 	return nil
 }
@@ -299,56 +416,107 @@ func (l *fsm) applyAppend(b []byte) interface{} {
 	return &api.ProduceResponse{Offset: offset}
 }
 
+func (l *fsm) applyDeleteRecords(b []byte) interface{} {
+	var req api.DeleteRecordsRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	target := l.log
+	if req.Topic != "" {
+		p, err := l.partition(req.Topic, int(req.Partition))
+		if err != nil {
+			return err
+		}
+		target = p
+	}
+	lowest, err := target.DeleteRecords(req.Offset)
+	if err != nil {
+		return err
+	}
+	return &api.DeleteRecordsResponse{Lowest: lowest}
+}
+
+// 書き出す間に保持期間やコンパクションでsegmentが消されないよう、ReadRawで読む。
+// 開始オフセットより前のレコードは含めない。トピックを複製していれば、トピックのパーティションも含める
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	r, err := readAllRaw(f.log)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{reader: r}
+	if f.topics != nil {
+		if s.topics, err = f.snapshotTopics(); err != nil {
+			r.Close()
+			return nil, err
+		}
+		s.withTopics = true
+	}
+	return s, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
-	reader io.Reader
+	reader     io.ReadCloser
+	withTopics bool
+	topics     []topicSnapshot
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	var err error
+	if s.withTopics {
+		err = s.persistTopics(sink)
+	} else {
+		_, err = io.Copy(sink, s.reader)
+	}
+	if err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
-func (s *snapshot) Release() {}
+func (s *snapshot) Release() {
+	s.reader.Close()
+	for _, t := range s.topics {
+		for _, r := range t.partitions {
+			r.Close()
+		}
+	}
+}
 
+// トピックを含むスナップショットは先頭のtopicSnapshotMagicで見分け、そうでなければ元のログのフレームだけとして読む
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
-	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	br := bufio.NewReader(r)
+	if head, err := br.Peek(len(topicSnapshotMagic)); err == nil && bytes.Equal(head, topicSnapshotMagic) {
+		if _, err := br.Discard(len(topicSnapshotMagic)); err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
-			return err
-		}
-		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
-			return err
-		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
-				return err
-			}
-		}
-		if _, err = f.log.Append(record); err != nil {
-			return err
-		}
-		buf.Reset()
+		return f.restoreTopics(br)
 	}
-	return nil
+	return restoreLog(f.log, br)
+}
+
+// 最初のレコードのオフセットからlを作り直し、残りのフレームはオフセットを変えずにAppendRawで書き込む
+func restoreLog(l *Log, r io.Reader) error {
+	p, err := readFrame(r)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return err
+	}
+	l.Config.Segment.InitialOffset = record.Offset
+	if err := l.Reset(); err != nil {
+		return err
+	}
+	if _, err := l.appendRaw(record); err != nil {
+		return err
+	}
+	_, err = l.AppendRaw(r)
+	return err
 }
 
 var _ raft.LogStore = (*logStore)(nil)
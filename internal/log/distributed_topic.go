@@ -0,0 +1,382 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	api "proglog/api/v1"
+)
+
+// DistributedLogのトピック。作成と書き込みはリーダーでraftに渡し、FSMがすべてのノードのLogManagerに適用する。
+// 読み込みは、元のログと同じく各ノードのパーティションのLogから行う
+
+var errTopicsDisabled = errors.New("topics are not enabled")
+
+// dataDir/topicsにトピックを開く。Config.Raft.Topicsでなければ何もしない
+func (l *DistributedLog) setupTopics(dataDir string) error {
+	if !l.config.Raft.Topics {
+		return nil
+	}
+	c := replicaConfig(l.config)
+	if c.Segment.IndexDir != "" {
+		c.Segment.IndexDir = filepath.Join(c.Segment.IndexDir, "topics")
+	}
+	m, err := NewLogManager(filepath.Join(dataDir, "topics"), c, nil)
+	if err != nil {
+		return err
+	}
+	m.Partitions = l.config.Raft.TopicPartitions
+	m.MaxTopics = l.config.Raft.MaxTopics
+	m.setReplicator(l)
+	l.topics = m
+	return nil
+}
+
+// 既存のトピックを返す。無ければErrTopicNotFound
+func (l *DistributedLog) Get(topic string) (*Topic, error) {
+	if l.topics == nil {
+		return nil, errTopicsDisabled
+	}
+	return l.topics.Get(topic)
+}
+
+// トピックを返す。無ければすべてのノードにpartitions個のパーティションで作る。0ならConfig.Raft.TopicPartitions。
+// 作成はリーダーでしかできず、Config.Raft.MaxTopicsに達していればErrTooManyTopics
+func (l *DistributedLog) Create(topic string, partitions int) (*Topic, error) {
+	if l.topics == nil {
+		return nil, errTopicsDisabled
+	}
+	// 上限を確かめてからコミットされるまでに、ほかの作成が割り込まないようにする
+	l.createMu.Lock()
+	defer l.createMu.Unlock()
+	if t, err := l.topics.Get(topic); err == nil {
+		return t, nil
+	}
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	// 上限はリーダーで確かめる。FSMで断ると、ノードごとの設定の違いでトピックが食い違ってしまう
+	if max := l.topics.MaxTopics; max > 0 && len(l.topics.Topics()) >= max {
+		return nil, fmt.Errorf("%w: %d", ErrTooManyTopics, max)
+	}
+	if partitions == 0 {
+		partitions = l.topics.Partitions
+	}
+	if partitions <= 0 {
+		partitions = 1
+	}
+	if _, err := l.apply(
+		CreateTopicRequestType,
+		&api.CreateTopicRequest{Topic: topic, Partitions: uint32(partitions)},
+	); err != nil {
+		return nil, err
+	}
+	return l.topics.Get(topic)
+}
+
+// トピックの名前を昇順で返す
+func (l *DistributedLog) Topics() []string {
+	if l.topics == nil {
+		return nil
+	}
+	return l.topics.Topics()
+}
+
+// Topic.Appendから呼ばれ、パーティションを決めた書き込みをraftでコミットする
+func (l *DistributedLog) appendTopic(topic string, partition int, record *api.Record) (uint64, error) {
+	if err := checkRecord(record, l.config); err != nil {
+		return 0, err
+	}
+	release, err := acquirePending(&l.pending, l.config.Segment.MaxPendingCommits)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	res, err := l.apply(
+		TopicAppendRequestType,
+		&api.TopicAppendRequest{Topic: topic, Partition: uint32(partition), Record: record},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// Topic.DeleteRecordsから呼ばれ、すべてのレプリカでパーティションのレコードを削除する
+func (l *DistributedLog) deleteTopicRecords(topic string, partition int, before uint64) (uint64, error) {
+	res, err := l.apply(
+		DeleteRecordsRequestType,
+		&api.DeleteRecordsRequest{Topic: topic, Partition: uint32(partition), Offset: before},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.DeleteRecordsResponse).Lowest, nil
+}
+
+func (f *fsm) applyCreateTopic(b []byte) interface{} {
+	var req api.CreateTopicRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if f.topics == nil {
+		return errTopicsDisabled
+	}
+	// 上限はリーダーで確かめてあるので、コミットされた作成はノードの設定によらず行う
+	if _, err := f.topics.create(req.Topic, int(req.Partitions), false); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fsm) applyTopicAppend(b []byte) interface{} {
+	var req api.TopicAppendRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	p, err := f.partition(req.Topic, int(req.Partition))
+	if err != nil {
+		return err
+	}
+	offset, err := p.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset, Partition: req.Partition}
+}
+
+func (f *fsm) partition(topic string, partition int) (*Log, error) {
+	if f.topics == nil {
+		return nil, errTopicsDisabled
+	}
+	t, err := f.topics.Get(topic)
+	if err != nil {
+		return nil, err
+	}
+	return t.Partition(partition)
+}
+
+// トピックを含むスナップショットの先頭に置く。元のログだけのスナップショットはフレームから始まるので、
+// フレームのヘッダーとしてはあり得ない値にしておく
+var topicSnapshotMagic = []byte{0xff, 'p', 'l', 't', 'o', 'p', 'i', 'c'}
+
+// スナップショットに書き出す、トピックのパーティションごとのフレーム
+type topicSnapshot struct {
+	name       string
+	partitions []io.ReadCloser
+}
+
+// すべてのトピックのパーティションを、ReadRawで開始オフセットから末尾まで読む
+func (f *fsm) snapshotTopics() ([]topicSnapshot, error) {
+	var topics []topicSnapshot
+	closeAll := func() {
+		for _, t := range topics {
+			for _, r := range t.partitions {
+				r.Close()
+			}
+		}
+	}
+	for _, name := range f.topics.Topics() {
+		t, err := f.topics.Get(name)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		ts := topicSnapshot{name: name}
+		for _, p := range t.partitions {
+			r, err := readAllRaw(p)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			ts.partitions = append(ts.partitions, r)
+		}
+		topics = append(topics, ts)
+	}
+	return topics, nil
+}
+
+// lの開始オフセットから末尾までのフレームを読む
+func readAllRaw(l *Log) (io.ReadCloser, error) {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := l.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	if next <= lowest {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return l.ReadRaw(lowest, next-1)
+}
+
+// 元のログのフレーム、トピックの数、トピックごとの名前とパーティション数とパーティションごとのフレームの順に書く。
+// フレームの並びは長さが分からないので、チャンクに分けて書く
+func (s *snapshot) persistTopics(w io.Writer) error {
+	if _, err := w.Write(topicSnapshotMagic); err != nil {
+		return err
+	}
+	if err := writeChunks(w, s.reader); err != nil {
+		return err
+	}
+	if err := writeUint32(w, uint32(len(s.topics))); err != nil {
+		return err
+	}
+	for _, t := range s.topics {
+		if err := writeUint32(w, uint32(len(t.name))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, t.name); err != nil {
+			return err
+		}
+		if err := writeUint32(w, uint32(len(t.partitions))); err != nil {
+			return err
+		}
+		for _, r := range t.partitions {
+			if err := writeChunks(w, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// persistTopicsで書いたスナップショットから、元のログとトピックを作り直す。ノードにあった他のトピックは削除する
+func (f *fsm) restoreTopics(r *bufio.Reader) error {
+	if err := restoreChunks(f.log, r); err != nil {
+		return err
+	}
+	if f.topics == nil {
+		return errTopicsDisabled
+	}
+	for _, name := range f.topics.Topics() {
+		if err := f.topics.Delete(name); err != nil {
+			return err
+		}
+	}
+	n, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		size, err := readUint32(r)
+		if err != nil {
+			return err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		partitions, err := readUint32(r)
+		if err != nil {
+			return err
+		}
+		t, err := f.topics.create(string(name), int(partitions), false)
+		if err != nil {
+			return err
+		}
+		for _, p := range t.partitions {
+			if err := restoreChunks(p, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// チャンクに分けたフレームの並びからlを作り直す。lが読み残したチャンクも読み飛ばす
+func restoreChunks(l *Log, r io.Reader) error {
+	chunks := &chunkReader{r: r}
+	if err := restoreLog(l, chunks); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, chunks)
+	return err
+}
+
+// 一度に書くチャンクのバイト数
+const snapshotChunk = 64 << 10
+
+// rの中身を、長さを前に付けたチャンクに分けて書く。最後に長さ0のチャンクを書く
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, snapshotChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := writeUint32(w, uint32(n)); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return writeUint32(w, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeChunksで書いたチャンクを、元のバイト列として読む。長さ0のチャンクでEOFになる
+type chunkReader struct {
+	r    io.Reader
+	left uint32
+	done bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := readUint32(c.r)
+		if err != nil {
+			return 0, err
+		}
+		c.left, c.done = n, n == 0
+	}
+	if uint32(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= uint32(n)
+	if err == io.EOF {
+		if c.left > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	var b [4]byte
+	enc.PutUint32(b[:], v)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return enc.Uint32(b[:]), nil
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProviderは、storeを暗号化する鍵を返す。鍵は16、24、32バイトのいずれかで、それぞれAES-128、192、256になる
+type KeyProvider interface {
+	// 新しく作るsegmentの暗号化に使う鍵のIDと鍵
+	CurrentKey() (id string, key []byte, err error)
+	// IDの鍵。鍵をローテーションした後も、古い鍵で暗号化したsegmentを読むのに使う
+	Key(id string) ([]byte, error)
+}
+
+// 鍵をメモリに持つKeyProvider。Currentの鍵で暗号化し、Keysにあるどの鍵でも復号できる
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+var errDecrypt = errors.New("failed to decrypt record")
+
+// .keyファイルの2行目。あれば、暗号文をsegmentのベースオフセットとstoreの中での位置に結び付けてあり、
+// フレームを別のsegmentや別の位置へ移すと復号できない。2行目の無い.keyファイルは結び付ける前に書いたもので、そのまま読む
+const keyFileAAD = "aad: segment position"
+
+// segmentのstoreを暗号化する鍵と、暗号文に結び付ける追加データの先頭を決める。鍵のIDはsegmentごとに.keyファイルに書いておく。
+// 空のstoreは今の鍵で暗号化し、.keyファイルの無い既存のstoreは暗号化されていないものとして扱う
+func (s *segment) openCipher() (cipher.AEAD, []byte, error) {
+	keys := s.config.Encryption.Keys
+	b, err := os.ReadFile(s.path(".key"))
+	if os.IsNotExist(err) {
+		if keys == nil || s.store.size > s.store.start {
+			return nil, nil, nil
+		}
+		current, key, err := keys.CurrentKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.Contains(current, "\n") {
+			return nil, nil, fmt.Errorf("key id %q contains a newline", current)
+		}
+		content := current + "\n" + keyFileAAD
+		if err := writeFileAtomic(s.path(".key"), strings.NewReader(content), s.config.fileMode()); err != nil {
+			return nil, nil, err
+		}
+		aead, err := newAEAD(key)
+		return aead, s.aadPrefix(), err
+	} else if err != nil {
+		return nil, nil, err
+	}
+	id, rest, bound := strings.Cut(string(b), "\n")
+	if bound && rest != keyFileAAD {
+		return nil, nil, fmt.Errorf("segment %d has an unknown key file format", s.baseOffset)
+	}
+	if keys == nil {
+		return nil, nil, fmt.Errorf(
+			"segment %d is encrypted with key %q but no key provider is configured",
+			s.baseOffset, id,
+		)
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil || !bound {
+		return aead, nil, err
+	}
+	return aead, s.aadPrefix(), nil
+}
+
+// 暗号文に結び付ける追加データの先頭。segmentのベースオフセット
+func (s *segment) aadPrefix() []byte {
+	var b [8]byte
+	enc.PutUint64(b[:], s.baseOffset)
+	return b[:]
+}
+
+// prefixの後にstoreの中での位置を付けた追加データ。prefixがnilなら結び付けない
+func additionalData(prefix []byte, pos uint64) []byte {
+	if prefix == nil {
+		return nil
+	}
+	var b [8]byte
+	enc.PutUint64(b[:], pos)
+	ad := make([]byte, 0, len(prefix)+len(b))
+	return append(append(ad, prefix...), b[:]...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pをadに結び付けて暗号化し、ランダムなnonceを前に付けて返す
+func seal(aead cipher.AEAD, p, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, ad), nil
+}
+
+// sealで暗号化したpを復号する。adは暗号化したときと同じでなければならない
+func unseal(aead cipher.AEAD, p, ad []byte) ([]byte, error) {
+	if len(p) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, p[:n], p[n:], ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
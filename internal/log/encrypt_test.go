@@ -0,0 +1,158 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// storeが平文で書き込まれず、鍵をローテーションしても古いsegmentを読めることを確認。
+// 暗号化する前からあるsegmentは、平文のまま読める
+func TestEncryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	appendRecords := func(log *Log, from, to int) {
+		for i := from; i < to; i++ {
+			off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("secret %d", i))})
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+	}
+	readRecords := func(log *Log, to int) {
+		for i := 0; i < to; i++ {
+			got, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("secret %d", i)), got.Value)
+		}
+	}
+	keys := StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(log, 0, 2)
+	require.NoError(t, log.Close())
+
+	c.Encryption.Keys = keys
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(log, 2, 6)
+	require.NoError(t, log.Close())
+
+	keys.Current = "k2"
+	c.Encryption.Keys = keys
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(log, 6, 8)
+	readRecords(log, 8)
+
+	for off, want := range map[uint64]string{2: "k1", 4: "k1", 6: "k2"} {
+		id, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.key", off)))
+		require.NoError(t, err)
+		require.Equal(t, want+"\n"+keyFileAAD, string(id))
+	}
+	_, err = os.Stat(filepath.Join(dir, "0.key"))
+	require.True(t, os.IsNotExist(err))
+
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	for _, name := range stores {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		if filepath.Base(name) == "0.store" {
+			require.Contains(t, string(b), "secret 0")
+			continue
+		}
+		require.NotContains(t, string(b), "secret")
+	}
+
+	// Readerは復号したレコードを返す
+	r := log.Reader()
+	for i := 0; i < 8; i++ {
+		p, err := readFrame(r)
+		require.NoError(t, err)
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(p, record))
+		require.Equal(t, []byte(fmt.Sprintf("secret %d", i)), record.Value)
+	}
+	_, err = readFrame(r)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, log.Close())
+
+	// 古い鍵が無ければ、そのsegmentは読めない
+	delete(keys.Keys, "k1")
+	c.Encryption.Keys = keys
+	c.MaxRecoverySegments = 1
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(2)
+	require.EqualError(t, err, `unknown key "k1"`)
+	_, err = log.Read(6)
+	require.NoError(t, err)
+}
+
+// 暗号文はsegmentと位置に結び付くので、同じ鍵で暗号化したフレームを入れ替えると読めないことを確認
+func TestEncryptionBindsPosition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "encryption-aad-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Encryption.Keys = StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// オフセットの0は書き込まれないので、その分だけ値を長くしてフレームの長さを揃える
+	for _, value := range []string{"secret 0..", "secret 1", "secret 2"} {
+		_, err := log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	s := log.segments[0]
+	_, first, err := s.index.Read(0)
+	require.NoError(t, err)
+	_, second, err := s.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// 同じ長さのフレームを入れ替える
+	name := filepath.Join(dir, "0.store")
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	size := second - first
+	require.Equal(t, uint64(len(b))-second, size)
+	swapped := append([]byte{}, b[:first]...)
+	swapped = append(swapped, b[second:]...)
+	swapped = append(swapped, b[first:second]...)
+	require.NoError(t, os.WriteFile(name, swapped, 0600))
+	// 鍵を持たないCRC32Cのファイルは書き換えられるものとして、消しておく
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.crc")))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(0); off < 2; off++ {
+		_, err := log.Read(off)
+		require.Error(t, err)
+	}
+	got, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret 2"), got.Value)
+}
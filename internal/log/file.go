@@ -0,0 +1,42 @@
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// storeとindexが使うファイルの最小限のインターフェース。
+// テストで障害を起こすファイルに差し替えられるよう、*os.Fileを直接使わずにこれを介する
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Close() error
+	Name() string
+	Fd() uintptr
+}
+
+func (c Config) fileMode() os.FileMode {
+	if c.Permissions.File == 0 {
+		return 0600
+	}
+	return c.Permissions.File
+}
+
+func (c Config) dirMode() os.FileMode {
+	if c.Permissions.Dir == 0 {
+		return 0755
+	}
+	return c.Permissions.Dir
+}
+
+// ConfigにFileOpenerが設定されていればそれを、無ければos.OpenFileを使ってファイルを開く
+func (c Config) openFile(name string, flag int, perm os.FileMode) (File, error) {
+	if c.FileOpener != nil {
+		return c.FileOpener(name, flag, perm)
+	}
+	return os.OpenFile(name, flag, perm)
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package log
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ファイルにflockで排他ロックをかける。他のファイルディスクリプタがロックしていれば、待たずにerrLockedを返す
+func lockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
+
+// ディレクトリをfsyncし、作ったり消したりしたファイルのエントリを永続化する
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ファイルのページをページキャッシュから落とすようカーネルに伝える。書き出し済みのページだけが落ちる
+func dropPageCache(f File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// ファイルの大きさを変えずに、offからnバイトの領域をディスクから解放する。解放した範囲は0として読める
+func punchHole(f File, off, n int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		return errPunchUnsupported
+	}
+	return err
+}
+
+// ファイルの大きさを変えずに、sizeバイトまでのディスクの領域を確保する。
+// ファイルシステムが対応していなければ何もしない
+func preallocate(f File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// flockが無い環境ではロックしない
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// posix_fadviseが無い環境では何もしない
+func dropPageCache(f File) error {
+	return nil
+}
+
+// ディレクトリをfsyncできない環境では何もしない
+func syncDir(dir string) error {
+	return nil
+}
+
+// fallocateが無い環境では穴を開けられない
+func punchHole(f File, off, n int64) error {
+	return errPunchUnsupported
+}
+
+// fallocateが無い環境では何もしない
+func preallocate(f File, size int64) error {
+	return nil
+}
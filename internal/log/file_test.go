@@ -0,0 +1,202 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 指定した箇所で障害を起こすファイル。ディスクフルや短い書き込み、fsyncの失敗を再現するために使う
+type faultyFile struct {
+	File
+
+	mu sync.Mutex
+	// 書き込める残りのバイト数。負なら無制限。使い切るとENOSPCを返す
+	writeLimit   int
+	failSync     bool
+	failTruncate bool
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writeLimit < 0 {
+		return f.File.Write(p)
+	}
+	if len(p) > f.writeLimit {
+		n, err := f.File.Write(p[:f.writeLimit])
+		f.writeLimit -= n
+		if err != nil {
+			return n, err
+		}
+		return n, syscall.ENOSPC
+	}
+	n, err := f.File.Write(p)
+	f.writeLimit -= n
+	return n, err
+}
+
+func (f *faultyFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failSync {
+		return syscall.EIO
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failTruncate {
+		return syscall.EIO
+	}
+	return f.File.Truncate(size)
+}
+
+// 開いたファイルをfaultyFileで包むFileOpenerを返す。
+// configureで、ファイルごとにどこで障害を起こすかを設定する
+func faultyOpener(
+	configure func(name string, f *faultyFile),
+) func(string, int, os.FileMode) (File, error) {
+	return func(name string, flag int, perm os.FileMode) (File, error) {
+		file, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		f := &faultyFile{File: file, writeLimit: -1}
+		if configure != nil {
+			configure(name, f)
+		}
+		return f, nil
+	}
+}
+
+func TestFaultyFile(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"short write on a full disk fails append": testDiskFull,
+		"fsync failure fails close":               testSyncFailure,
+		"truncate failure fails open":             testTruncateFailure,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "faulty-file-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir)
+		})
+	}
+}
+
+func testDiskFull(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1024
+	c.FileOpener = faultyOpener(func(name string, f *faultyFile) {
+		if filepath.Ext(name) == ".store" {
+			f.writeLimit = 100
+		}
+	})
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// バッファより大きなレコードは直接書き込まれるので、すぐに失敗する
+	_, err = s.Append(&api.Record{Value: make([]byte, 8192)})
+	require.ErrorIs(t, err, syscall.ENOSPC)
+}
+
+func testSyncFailure(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.FileOpener = faultyOpener(func(name string, f *faultyFile) {
+		if filepath.Ext(name) == ".index" {
+			f.failSync = true
+		}
+	})
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.ErrorIs(t, s.Close(), syscall.EIO)
+}
+
+func testTruncateFailure(t *testing.T, dir string) {
+	c := Config{}
+	c.FileOpener = faultyOpener(func(name string, f *faultyFile) {
+		f.failTruncate = true
+	})
+	_, err := NewLog(dir, c)
+	require.ErrorIs(t, err, syscall.EIO)
+}
+
+// PreallocateStoreでは、作ったsegmentのstoreにディスクの領域が確保されても大きさは変わらず、封印すると解放されることを確認
+func TestSegmentPreallocateStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "preallocate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.PreallocateStore = true
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	fi, err := os.Stat(s.path(".store"))
+	require.NoError(t, err)
+	// 確保した領域は大きさに含まれず、ヘッダーだけが書かれている
+	require.Equal(t, int64(formatHeaderWidth), fi.Size())
+	require.Equal(t, formatHeaderWidth, s.store.size)
+
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.seal())
+	got, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+	fi, err = os.Stat(s.path(".store"))
+	require.NoError(t, err)
+	require.Equal(t, int64(s.store.size), fi.Size())
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		// 512バイト単位のブロック数。1MiBを確保したままなら2048になる
+		require.Less(t, st.Blocks, int64(2048))
+	}
+}
+
+// Config.Permissionsのパーミッションでsegmentのファイルとディレクトリを作ることを確認
+func TestLogPermissions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "permissions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexDir = filepath.Join(dir, "index")
+	c.Permissions.File = 0640
+	c.Permissions.Dir = 0750
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	fi, err := os.Stat(c.Segment.IndexDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+	for _, path := range []string{
+		filepath.Join(dir, "0.store"),
+		filepath.Join(c.Segment.IndexDir, "0.index"),
+		filepath.Join(c.Segment.IndexDir, "0.timeindex"),
+	} {
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), fi.Mode().Perm(), path)
+	}
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// storeとindexのファイルは、先頭に8バイトのヘッダーを置いて形式を書いておく。
+// ヘッダーは4バイトのマジックナンバー、1バイトの形式の版、残りの3バイトはファイルの種類ごとに使う。
+// ヘッダーの無い最初の形式は版を0とし、indexはそのまま読む。storeの版0はレコードごとのCRC32Cを持たないので開かず、MigrateFormatで書き換えさせる。
+// ヘッダーは無いがCRC32Cを持つstoreは、版1として読む。今より新しい版のファイルは、読み違えないよう開かない。
+// 形式を変えたときは版を上げ、Config.Segment.MigrateFormatで古い版のファイルを書き換えられる
+
+const formatHeaderWidth uint64 = 8
+
+const (
+	storeMagic = "PLST"
+	// 版1で、フレームにレコードのCRC32Cを加えた
+	storeChecksumVersion byte = 1
+	// 版2で、コンパクションで取り除いたレコードの穴を加えた
+	storeVersion byte = 2
+	// 版3は、フレームの長さをuvarintで書く。Config.Segment.CompactFormatのときだけ作る
+	storeVarintVersion byte = 3
+)
+
+// 新しく作るstoreの版
+func (c Config) storeFormatVersion() byte {
+	if c.Segment.CompactFormat {
+		return storeVarintVersion
+	}
+	return storeVersion
+}
+
+func formatHeader(magic string, version byte) []byte {
+	b := make([]byte, formatHeaderWidth)
+	copy(b, magic)
+	b[len(magic)] = version
+	return b
+}
+
+// ファイルの先頭のヘッダーから形式の版を読む。ヘッダーが無ければ0
+func readFormatVersion(f File, size uint64, magic string) (byte, error) {
+	if size < formatHeaderWidth {
+		return 0, nil
+	}
+	b := make([]byte, formatHeaderWidth)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return 0, err
+	}
+	// 元の形式のstoreはレコードの長さから、indexは最初のエントリから始まるので、マジックナンバーとは一致しない。
+	// 元の形式のindexの最初のエントリはポジションが0なので、版の位置が0ならヘッダーではない
+	if string(b[:len(magic)]) != magic || b[len(magic)] == 0 {
+		return 0, nil
+	}
+	return b[len(magic)], nil
+}
+
+// storeの形式の版と、最初のレコードの位置を読む。
+// ヘッダーの無いstoreは、最初のフレームのCRC32Cがレコードと一致するかどうかで、元の形式(版0)と版1を見分ける
+func readStoreFormat(f File, size uint64) (version byte, start uint64, err error) {
+	if version, err = readFormatVersion(f, size, storeMagic); err != nil || version > 0 {
+		return version, formatHeaderWidth, err
+	}
+	if size < frameWidth {
+		return 0, 0, nil
+	}
+	header := make([]byte, frameWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+	// ヘッダーの無いstoreには穴も無いので、長さはそのまま読める
+	n := enc.Uint64(header)
+	if n > size-frameWidth {
+		return 0, 0, nil
+	}
+	p := make([]byte, n)
+	if _, err := f.ReadAt(p, int64(frameWidth)); err != nil {
+		return 0, 0, err
+	}
+	if crc32.Checksum(p, castagnoli) == enc.Uint32(header[lenWidth:]) {
+		return storeChecksumVersion, 0, nil
+	}
+	return 0, 0, nil
+}
+
+// segmentのファイルが今より古い形式であれば、開く前にConfig.Segment.MigrateFormatを呼んで書き換えさせる
+func (s *segment) migrate(ext, magic string, current byte) error {
+	migrate := s.config.Segment.MigrateFormat
+	if migrate == nil || s.config.readOnly {
+		return nil
+	}
+	path := s.path(ext)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var version byte
+	if ext == ".store" {
+		version, _, err = readStoreFormat(f, uint64(fi.Size()))
+	} else {
+		version, err = readFormatVersion(f, uint64(fi.Size()), magic)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	// 空のファイルは、これから今の形式で書き込む
+	if fi.Size() == 0 || version >= current {
+		return nil
+	}
+	if err := migrate(path, version); err != nil {
+		return fmt.Errorf("migrate %s from version %d: %w", path, version, err)
+	}
+	// 書き換えたstoreに合うよう、.crcは開いた後で作り直す
+	if ext == ".store" {
+		if err := os.Remove(s.path(".crc")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "proglog/api/v1"
+)
+
+// 新しく作ったstoreとindexの先頭には、形式のヘッダーが書かれていることを確認
+func TestFormatHeader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "format-header-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	b, err := os.ReadFile(s.path(".store"))
+	require.NoError(t, err)
+	require.Equal(t, formatHeader(storeMagic, storeVersion), b[:formatHeaderWidth])
+	b, err = os.ReadFile(s.path(".index"))
+	require.NoError(t, err)
+	require.Equal(t, indexMagic, string(b[:len(indexMagic)]))
+	require.Equal(t, indexVersion, b[len(indexMagic)])
+}
+
+// ヘッダーの無い形式のsegmentもそのまま読み書きでき、MigrateFormatにはCRC32Cを持つstoreは版1、indexは版0で渡されることを確認
+func TestFormatLegacy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "format-legacy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// ヘッダーの無いstoreとindexを直接書く
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	st, err := newStore(f)
+	require.NoError(t, err)
+	var entries []byte
+	for i := uint64(0); i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: i})
+		require.NoError(t, err)
+		_, pos, err := st.Append(p)
+		require.NoError(t, err)
+		ent := make([]byte, entWidth)
+		enc.PutUint32(ent, uint32(i))
+		enc.PutUint64(ent[offWidth:], pos)
+		entries = append(entries, ent...)
+	}
+	require.NoError(t, st.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.index"), entries, 0600))
+
+	migrated := make(map[string]byte)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MigrateFormat = func(path string, version byte) error {
+		migrated[filepath.Base(path)] = version
+		return nil
+	}
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, map[string]byte{"0.store": storeChecksumVersion, "0.index": 0}, migrated)
+	require.Zero(t, s.store.start)
+	require.Zero(t, s.index.start)
+	require.Equal(t, uint64(3), s.nextOffset)
+
+	off, err := s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for off := uint64(0); off < 4; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+// CRC32Cを持たない元の形式のstoreは、MigrateFormatに版0で渡し、書き換えなければ開かないことを確認
+func TestFormatPreChecksum(t *testing.T) {
+	dir, err := os.MkdirTemp("", "format-pre-checksum-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 長さとレコードだけを並べた、元の形式のstoreを直接書く
+	var legacy, entries []byte
+	var payloads [][]byte
+	for i := uint64(0); i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: i})
+		require.NoError(t, err)
+		ent := make([]byte, entWidth)
+		enc.PutUint32(ent, uint32(i))
+		enc.PutUint64(ent[offWidth:], uint64(len(legacy)))
+		entries = append(entries, ent...)
+		frame := make([]byte, lenWidth)
+		enc.PutUint64(frame, uint64(len(p)))
+		legacy = append(append(legacy, frame...), p...)
+		payloads = append(payloads, p)
+	}
+	storePath := filepath.Join(dir, "0.store")
+	require.NoError(t, os.WriteFile(storePath, legacy, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.index"), entries, 0600))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	_, err = newSegment(dir, 0, c)
+	require.Error(t, err)
+
+	// MigrateFormatで、CRC32Cを持つフレームに書き換える
+	var versions []byte
+	c.Segment.MigrateFormat = func(path string, version byte) error {
+		versions = append(versions, version)
+		if filepath.Ext(path) != ".store" {
+			return nil
+		}
+		require.NoError(t, os.Truncate(path, 0))
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		st, err := newStore(f)
+		if err != nil {
+			return err
+		}
+		var rewritten []byte
+		for _, p := range payloads {
+			_, pos, err := st.Append(p)
+			if err != nil {
+				return err
+			}
+			ent := make([]byte, entWidth)
+			enc.PutUint32(ent, uint32(len(rewritten)/int(entWidth)))
+			enc.PutUint64(ent[offWidth:], pos)
+			rewritten = append(rewritten, ent...)
+		}
+		if err := st.Close(); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "0.index"), rewritten, 0600)
+	}
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []byte{0, 0}, versions)
+	for off := uint64(0); off < 3; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+}
+
+// 今より新しい版のstoreは開かないことを確認
+func TestFormatNewerVersion(t *testing.T) {
+	dir, err := os.MkdirTemp("", "format-newer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "0.store"),
+		formatHeader(storeMagic, storeVarintVersion+1),
+		0600,
+	))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	_, err = newSegment(dir, 0, c)
+	require.Error(t, err)
+}
+
+// CompactFormatでは、storeのフレームの長さをuvarintで書き、indexのエントリを上限に収まる幅に縮めることを確認
+func TestFormatCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "format-compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.CompactFormat = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	want := formatHeaderWidth
+	for i := 0; i < 40; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	s := log.segments[0]
+	require.Equal(t, storeVarintVersion, s.store.version)
+	require.Equal(t, uint64(2), s.index.offWidth)
+	require.Equal(t, uint64(2), s.index.posWidth)
+	// 小さなレコードのヘッダーは、長さの1バイトとCRC32Cの4バイト
+	require.NoError(t, s.walk(s.store.start, func(_ uint64, p []byte, size uint64) error {
+		require.Equal(t, uint64(len(p))+1+crcWidth, size)
+		want += size
+		return nil
+	}))
+	require.Equal(t, want, s.store.size)
+
+	check := func(log *Log) {
+		for off := uint64(0); off < 40; off++ {
+			got, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+			require.Equal(t, []byte("hello world"), got.Value)
+		}
+		problems, err := log.Verify()
+		require.NoError(t, err)
+		require.Empty(t, problems)
+	}
+	check(log)
+
+	// ReadRawで流すフレームは元の形式なので、元の形式のログにそのまま書き込める
+	other, err := os.MkdirTemp("", "format-compact-other-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+	plain, err := NewLog(other, Config{})
+	require.NoError(t, err)
+	defer plain.Close()
+	r, err := log.ReadRaw(0, 39)
+	require.NoError(t, err)
+	n, err := plain.AppendRaw(r)
+	require.NoError(t, err)
+	require.Equal(t, 40, n)
+	require.NoError(t, r.Close())
+	got, err := plain.Read(39)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+}
@@ -0,0 +1,201 @@
+package log
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// storeのフレームは、レコードの長さとCRC32Cのヘッダーの後にレコードが続く。
+// 版2までのstoreは長さを8バイトで書き、穴は長さの最上位のビットで表す。
+// 版3のstoreは長さを2倍して穴なら1を足した値をuvarintで書き、小さなレコードのヘッダーを5バイトに縮める。
+// どちらの形式かはstoreのヘッダーの版でわかる。Log.ReaderやReadRawで流すフレームは、常に8バイトの長さで書く
+
+// 版3のフレームのヘッダーの最大の幅
+const maxFrameWidth = binary.MaxVarintLen64 + crcWidth
+
+type frameHeader struct {
+	// レコードのバイト数
+	n    uint64
+	hole bool
+	crc  uint32
+	// ヘッダーのバイト数
+	width uint64
+}
+
+// フレームのヘッダーの幅
+func frameHeaderWidth(varint bool, n uint64) uint64 {
+	if !varint {
+		return frameWidth
+	}
+	var b [binary.MaxVarintLen64]byte
+	return uint64(binary.PutUvarint(b[:], n<<1)) + crcWidth
+}
+
+// bにヘッダーを足して返す
+func appendFrameHeader(b []byte, varint bool, h frameHeader) []byte {
+	var header [maxFrameWidth]byte
+	var w int
+	if varint {
+		v := h.n << 1
+		if h.hole {
+			v |= 1
+		}
+		w = binary.PutUvarint(header[:], v)
+	} else {
+		v := h.n
+		if h.hole {
+			v |= holeFlag
+		}
+		enc.PutUint64(header[:], v)
+		w = lenWidth
+	}
+	enc.PutUint32(header[w:], h.crc)
+	return append(b, header[:w+crcWidth]...)
+}
+
+// bの先頭からヘッダーを読む。bに収まっていなければfalse
+func parseFrameHeader(b []byte, varint bool) (frameHeader, bool) {
+	if !varint {
+		if len(b) < int(frameWidth) {
+			return frameHeader{}, false
+		}
+		n, hole := frameLen(b)
+		return frameHeader{n: n, hole: hole, crc: enc.Uint32(b[lenWidth:frameWidth]), width: frameWidth}, true
+	}
+	v, w := binary.Uvarint(b)
+	if w <= 0 || len(b) < w+crcWidth {
+		return frameHeader{}, false
+	}
+	return frameHeader{
+		n:     v >> 1,
+		hole:  v&1 != 0,
+		crc:   enc.Uint32(b[w : w+crcWidth]),
+		width: uint64(w + crcWidth),
+	}, true
+}
+
+// rからヘッダーを一つ読む。これ以上フレームが無ければio.EOF、ヘッダーが途中で切れていればio.ErrUnexpectedEOFを返す
+func readFrameHeader(r *bufio.Reader, varint bool) (frameHeader, error) {
+	if !varint {
+		b := make([]byte, frameWidth)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return frameHeader{}, err
+		}
+		h, _ := parseFrameHeader(b, false)
+		return h, nil
+	}
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return frameHeader{}, err
+	}
+	var crc [crcWidth]byte
+	if _, err := io.ReadFull(r, crc[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frameHeader{}, err
+	}
+	var b [binary.MaxVarintLen64]byte
+	return frameHeader{
+		n:     v >> 1,
+		hole:  v&1 != 0,
+		crc:   enc.Uint32(crc[:]),
+		width: uint64(binary.PutUvarint(b[:], v)) + crcWidth,
+	}, nil
+}
+
+// ちょうどsizeバイトを占める穴のフレームのヘッダーを返す。版3では、uvarintを必要なら冗長な長さで書いて幅を合わせる
+func holeHeader(varint bool, size uint64) []byte {
+	if !varint {
+		return appendFrameHeader(nil, false, frameHeader{n: size - frameWidth, hole: true})
+	}
+	for w := uint64(1); w <= binary.MaxVarintLen64; w++ {
+		if size < w+crcWidth {
+			break
+		}
+		v := (size-w-crcWidth)<<1 | 1
+		var b [binary.MaxVarintLen64]byte
+		if uint64(binary.PutUvarint(b[:], v)) > w {
+			continue
+		}
+		header := make([]byte, w+crcWidth)
+		for i := uint64(0); i < w-1; i++ {
+			header[i] = byte(v) | 0x80
+			v >>= 7
+		}
+		header[w-1] = byte(v)
+		return header
+	}
+	return nil
+}
+
+// storeの中身を読むrから、レコードを一つ読み出してCRC32Cを確かめる。穴は読み飛ばす。
+// *posはrから次に読む位置で、読んだ分だけ進め、読み出したフレームの位置を返す。
+// これ以上レコードが無ければio.EOFを返す
+func readStoreFrame(r *bufio.Reader, varint bool, pos *uint64) ([]byte, uint64, error) {
+	for {
+		h, err := readFrameHeader(r, varint)
+		if err != nil {
+			return nil, 0, err
+		}
+		at := *pos
+		*pos += h.width + h.n
+		if h.hole {
+			if _, err := r.Discard(int(h.n)); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, 0, err
+			}
+			continue
+		}
+		p := make([]byte, h.n)
+		if _, err := io.ReadFull(r, p); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, err
+		}
+		if err := verifyFrame(h, p, at); err != nil {
+			return nil, 0, err
+		}
+		return p, at, nil
+	}
+}
+
+// storeの中身を読み、8バイトの長さのフレームに書き直して返す。
+// 暗号化したstoreであれば復号し、版3のstoreであれば長さを書き直す
+type frameReader struct {
+	r      *bufio.Reader
+	varint bool
+	aead   cipher.AEAD
+	aad    []byte
+	// rから次に読むフレームのstoreの中での位置
+	pos uint64
+	buf []byte
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		frame, at, err := readStoreFrame(f.r, f.varint, &f.pos)
+		if err != nil {
+			return 0, err
+		}
+		if f.aead != nil {
+			if frame, err = unseal(f.aead, frame, additionalData(f.aad, at)); err != nil {
+				return 0, err
+			}
+		}
+		f.buf = appendFrameHeader(make([]byte, 0, frameWidth+len(frame)), false, frameHeader{
+			n:   uint64(len(frame)),
+			crc: crc32.Checksum(frame, castagnoli),
+		})
+		f.buf = append(f.buf, frame...)
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,53 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// どちらの形式のヘッダーも、書いたとおりに読めることを確認
+func TestFrameHeader(t *testing.T) {
+	for _, varint := range []bool{false, true} {
+		for _, h := range []frameHeader{
+			{n: 0, crc: 1},
+			{n: 63, crc: 2},
+			{n: 64, crc: 3, hole: true},
+			{n: 1 << 40, crc: 4},
+		} {
+			b := appendFrameHeader(nil, varint, h)
+			h.width = frameHeaderWidth(varint, h.n)
+			require.Equal(t, int(h.width), len(b))
+
+			got, ok := parseFrameHeader(b, varint)
+			require.True(t, ok)
+			require.Equal(t, h, got)
+			_, ok = parseFrameHeader(b[:len(b)-1], varint)
+			require.False(t, ok)
+
+			got, err := readFrameHeader(bufio.NewReader(bytes.NewReader(b)), varint)
+			require.NoError(t, err)
+			require.Equal(t, h, got)
+		}
+	}
+}
+
+// 穴のヘッダーが、uvarintの幅の境目でもちょうど指定した大きさを占めることを確認
+func TestHoleHeader(t *testing.T) {
+	for _, varint := range []bool{false, true} {
+		min := uint64(frameWidth)
+		if varint {
+			min = 1 + crcWidth
+		}
+		for size := min; size < 1<<15; size++ {
+			b := holeHeader(varint, size)
+			h, ok := parseFrameHeader(b, varint)
+			require.True(t, ok)
+			require.True(t, h.hole)
+			require.Equal(t, uint64(len(b)), h.width)
+			require.Equal(t, size, h.width+h.n)
+		}
+	}
+}
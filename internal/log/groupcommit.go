@@ -0,0 +1,109 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// グループコミットでは、Config.Segment.Flush.GroupCommitのとき、書き込みはfsyncを済ませてから戻る。
+// 最初に待ち始めた書き込みがリーダーになってfsyncし、その間に書き込んだものは次のリーダーのfsyncを待つ。
+// fsyncはLogのロックを放してから行うので、リーダーがfsyncしている間も書き込みは続けられ、
+// 並行する書き込みがいくつあっても、fsyncはリーダーの数だけで済む
+
+type groupCommit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// fsyncを済ませたオフセットの次。これより前のオフセットは永続化されている
+	synced uint64
+	// リーダーがfsyncしている
+	syncing bool
+	// syncedを戻した回数。戻す前に始めたfsyncの結果で、syncedを進め直さないようにする
+	rewinds uint64
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// ログを作り直したときに、前のオフセットを忘れる
+func (g *groupCommit) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.synced = 0
+	g.rewinds++
+}
+
+// TruncateAfterで末尾を捨てたときに、fsyncを済ませたオフセットをnextまで戻す
+func (g *groupCommit) rewind(next uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.synced > next {
+		g.synced = next
+	}
+	g.rewinds++
+}
+
+// nextより前のオフセットがfsyncされるまで待つ。誰もfsyncしていなければ、自分がリーダーになる
+func (l *Log) waitCommit(next uint64) error {
+	g := l.commits
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < next {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		rewinds := g.rewinds
+		g.mu.Unlock()
+		synced, err := l.syncCommitted()
+		g.mu.Lock()
+		g.syncing = false
+		if err == nil && rewinds == g.rewinds && synced > g.synced {
+			g.synced = synced
+		}
+		// 失敗しても待っている書き込みを起こし、次のリーダーにやり直させる
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// アクティブなsegmentのバッファを書き出してからロックを放してfsyncし、fsyncしたオフセットの次を返す
+func (l *Log) syncCommitted() (uint64, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return 0, ErrClosed
+	}
+	s := l.activeSegment
+	next := s.nextOffset
+	if err := s.store.flush(); err != nil {
+		l.mu.Unlock()
+		return 0, err
+	}
+	f := s.store.File
+	l.mu.Unlock()
+
+	if err := f.Sync(); err != nil {
+		if !errors.Is(err, os.ErrClosed) {
+			return 0, err
+		}
+		// 封印するときにfsyncしているので、閉じられていたのがLogを閉じたためでなければ永続化されている
+		l.mu.RLock()
+		closed := l.closed
+		l.mu.RUnlock()
+		if closed {
+			return 0, ErrClosed
+		}
+	}
+	s.markSynced(next)
+	atomic.AddUint64(&l.stats.groupCommits, 1)
+	return next, nil
+}
@@ -0,0 +1,123 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fsyncに時間がかかるファイル。storeのfsyncの回数を数える
+type slowSyncFile struct {
+	File
+	syncs *int32
+}
+
+func (f *slowSyncFile) Sync() error {
+	atomic.AddInt32(f.syncs, 1)
+	time.Sleep(10 * time.Millisecond)
+	return f.File.Sync()
+}
+
+// 並行する書き込みが、それぞれfsyncを済ませてから戻り、fsyncがまとめられることを確認
+func TestLogGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var syncs int32
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Segment.Flush.GroupCommit = true
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil || filepath.Ext(name) != ".store" {
+			return f, err
+		}
+		return &slowSyncFile{File: f, syncs: &syncs}, nil
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// 一つずつ書き込めば、書き込みごとにfsyncする
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&syncs))
+	require.Equal(t, uint64(3), log.Stats().GroupCommits)
+
+	const writers = 20
+	offsets := make(chan uint64, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			off, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			offsets <- off
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+	seen := make(map[uint64]bool)
+	for off := range offsets {
+		require.False(t, seen[off])
+		seen[off] = true
+	}
+	require.Len(t, seen, writers)
+	// リーダーがfsyncしている間の書き込みは、次のfsyncにまとめられる
+	require.Less(t, atomic.LoadInt32(&syncs), int32(3+writers/2))
+	require.Equal(t, uint64(atomic.LoadInt32(&syncs)), log.Stats().GroupCommits)
+	// 戻った書き込みは、すべてファイルに書き出されている
+	fi, err := os.Stat(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), fi.Size())
+}
+
+// TruncateAfterで捨てたオフセットに書き込み直したレコードも、fsyncを済ませてから戻ることを確認
+func TestLogGroupCommitTruncate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-group-commit-truncate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var syncs int32
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Segment.Flush.GroupCommit = true
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil || filepath.Ext(name) != ".store" {
+			return f, err
+		}
+		return &slowSyncFile{File: f, syncs: &syncs}, nil
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.TruncateAfter(1))
+
+	before := atomic.LoadInt32(&syncs)
+	off, err := log.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Equal(t, before+1, atomic.LoadInt32(&syncs))
+	fi, err := os.Stat(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), fi.Size())
+}
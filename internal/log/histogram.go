@@ -0,0 +1,84 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// レコードサイズの分布を記録するヒストグラム。
+// Prometheusのヒストグラムと同じく、各バケツは上限(le)以下の値の累積数を持つ
+
+const recordSizeMetric = "proglog_record_size_bytes"
+
+type histogram struct {
+	bounds []uint64
+	// 各バケツに入った値の数。末尾は+Infのバケツ
+	counts []uint64
+	count  uint64
+	sum    uint64
+}
+
+func newHistogram(bounds []uint64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v uint64) {
+	i := 0
+	for ; i < len(h.bounds); i++ {
+		if v <= h.bounds[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Buckets: append([]uint64(nil), h.bounds...),
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     atomic.LoadUint64(&h.sum),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cumulative
+	}
+	return s
+}
+
+// ヒストグラムのスナップショット。
+// Counts[i]はBuckets[i]以下の値の累積数で、末尾の要素は全ての値の数(+Inf)
+type Histogram struct {
+	Buckets []uint64
+	Counts  []uint64
+	Count   uint64
+	Sum     uint64
+}
+
+// Prometheusのテキスト形式で書き出す
+func (h Histogram) WritePrometheus(w io.Writer, name string) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	for i, count := range h.Counts {
+		le := "+Inf"
+		if i < len(h.Buckets) {
+			le = strconv.FormatUint(h.Buckets[i], 10)
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, count); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", name, h.Sum, name, h.Count); err != nil {
+		return err
+	}
+	return nil
+}
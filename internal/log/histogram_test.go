@@ -0,0 +1,61 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// 既知のサイズのレコードを書き込み、期待したバケツに入ることを確認
+func TestSizeHistogram(t *testing.T) {
+	dir, err := os.MkdirTemp("", "size-histogram-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Metrics.RecordSizeBuckets = []uint64{16, 128, 1024}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var sum uint64
+	for _, n := range []int{4, 4, 100, 500, 2000} {
+		// 時刻によってサイズが変わらないよう、固定しておく
+		record := &api.Record{Value: make([]byte, n), Timestamp: 1}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+		sum += uint64(proto.Size(record))
+	}
+
+	h := log.SizeHistogram()
+	require.Equal(t, []uint64{16, 128, 1024}, h.Buckets)
+	require.Equal(t, []uint64{2, 3, 4, 5}, h.Counts)
+	require.Equal(t, uint64(5), h.Count)
+	require.Equal(t, sum, h.Sum)
+
+	var buf bytes.Buffer
+	require.NoError(t, log.WriteMetrics(&buf))
+	require.Contains(t, buf.String(), `proglog_record_size_bytes_bucket{le="128"} 3`)
+	require.Contains(t, buf.String(), `proglog_record_size_bytes_bucket{le="+Inf"} 5`)
+	require.Contains(t, buf.String(), "proglog_record_size_bytes_count 5")
+}
+
+// メトリクスが無効な場合は何も記録しない
+func TestSizeHistogramDisabled(t *testing.T) {
+	dir, err := os.MkdirTemp("", "size-histogram-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, Histogram{}, log.SizeHistogram())
+}
@@ -0,0 +1,189 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Config.Compaction.PunchHolesでは、封印済みのsegmentを書き直さず、取り除くレコードの並びをその場で一つの穴のフレームにする。
+// 穴のフレームは穴の印を立てたヘッダーで、読むときは中身ごと飛ばす。ヘッダーを書いてfsyncしてから、
+// 中身のブロックをfallocateのFALLOC_FL_PUNCH_HOLEでディスクから解放するので、途中で落ちても穴かレコードのどちらかが残る。
+// ファイルの大きさも残るレコードの位置も変わらないが、隣り合うレコードは一つの穴にまとめるので、
+// 進行中のScanはsegmentの穴を開けた回数が変わったのを見て、読む位置をindexから探し直す
+
+// ファイルシステムが穴を開けられない
+var errPunchUnsupported = errors.New("punching holes is not supported")
+
+// このsegmentは穴を開けずに書き直す
+var errCannotPunch = errors.New("cannot punch holes in segment")
+
+// 穴を開ける単位。これに揃わない端の部分は、ディスクに残る
+const holeBlockSize = 4096
+
+// oldのうちdropに含まれるレコードを穴にし、ディスクから解放したバイト数を返す。
+// ヘッダーの無い元の形式やObjectStoreのsegmentではerrCannotPunchを返すので、書き直すこと。
+// 穴を開けられないファイルシステムでも、レコードを穴にしたうえでerrCannotPunchを返す
+func (l *Log) punchSegment(old *segment, drop map[uint64]struct{}, flags uint32) (uint64, error) {
+	// 穴にしている間に読まれないよう、書き込みロックを取る
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	found := false
+	for _, s := range l.segments {
+		if s == old {
+			found = true
+			break
+		}
+	}
+	if !found || old == l.activeSegment {
+		return 0, fmt.Errorf("segment %d is not a sealed segment in the log", old.baseOffset)
+	}
+	if old.tiered {
+		return 0, errCannotPunch
+	}
+	if err := old.open(); err != nil {
+		return 0, err
+	}
+	if old.store.start == 0 {
+		return 0, errCannotPunch
+	}
+	// ReadRawで読んでいる途中のフレームは書き換えない
+	if old.store.pinned() {
+		return 0, errCannotPunch
+	}
+	// ロックの外で読んでいるReadKeyなどを待つ
+	old.pins.Lock()
+	// 作り直すフィルタに印を付ける
+	old.compacted = flags
+	punched, err := old.punchHoles(drop)
+	old.pins.Unlock()
+	// 穴にしたレコードを、キャッシュから読めないようにする
+	if l.records != nil {
+		l.records.removeRange(old.baseOffset, old.nextOffset)
+	}
+	return punched, err
+}
+
+// storeのうちdropに含まれるレコードを穴にし、index、timeindex、ブルームフィルタを作り直す
+func (s *segment) punchHoles(drop map[uint64]struct{}) (uint64, error) {
+	type run struct{ from, to uint64 }
+	var runs []run
+	var batchOpen bool
+	if err := s.walk(s.store.start, func(pos uint64, p []byte, size uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if _, ok := drop[record.Offset]; !ok {
+			batchOpen = record.BatchRemaining > 0
+			return nil
+		}
+		if n := len(runs); n > 0 && runs[n-1].to == pos {
+			runs[n-1].to = pos + size
+		} else {
+			runs = append(runs, run{from: pos, to: pos + size})
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if len(runs) == 0 {
+		return 0, nil
+	}
+	// 末尾を穴にすると、残った最後のレコードがバッチの途中に見え、開き直したときに切り詰められてしまう
+	if batchOpen && runs[len(runs)-1].to == s.store.size {
+		return 0, errCannotPunch
+	}
+
+	f, err := os.OpenFile(s.path(".store"), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	widths := make([]uint64, len(runs))
+	for i, r := range runs {
+		header := holeHeader(s.store.varint, r.to-r.from)
+		if _, err := f.WriteAt(header, int64(r.from)); err != nil {
+			return 0, err
+		}
+		widths[i] = uint64(len(header))
+	}
+	s.holes++
+	// 穴を読めない古い版では開かないよう、ヘッダーの版を穴のある版にする
+	if s.store.version < storeVersion {
+		if _, err := f.WriteAt([]byte{storeVersion}, int64(len(storeMagic))); err != nil {
+			return 0, err
+		}
+		s.store.version = storeVersion
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err := s.reindex(); err != nil {
+		return 0, err
+	}
+	if err := s.timeIndex.truncate(0); err != nil {
+		return 0, err
+	}
+	if err := s.rebuildTimeIndex(); err != nil {
+		return 0, err
+	}
+	s.bloom = nil
+	if _, err := s.buildBloom(); err != nil {
+		return 0, err
+	}
+
+	var punched uint64
+	for i, r := range runs {
+		from := (r.from + widths[i] + holeBlockSize - 1) / holeBlockSize * holeBlockSize
+		to := r.to / holeBlockSize * holeBlockSize
+		if to <= from {
+			continue
+		}
+		if err = punchHole(f, int64(from), int64(to-from)); err != nil {
+			break
+		}
+		punched += to - from
+	}
+	// 穴を開けると中身が0になるので、.crcは穴を開けた後のstoreから書く
+	if err := s.writeChecksumFile(); err != nil {
+		return punched, err
+	}
+	// 保持期限はレコードを書き込んだ時刻で決まるので、穴を開けた時刻にしない
+	if err := os.Chtimes(s.path(".store"), fi.ModTime(), fi.ModTime()); err != nil {
+		return punched, err
+	}
+	if err == errPunchUnsupported {
+		return punched, errCannotPunch
+	}
+	return punched, err
+}
+
+// 先頭の穴を飛ばした、storeの最初のレコードの位置。レコードが無ければstoreの大きさを返す。segmentは開いておくこと
+func (s *segment) firstRecordPos() (uint64, error) {
+	pos := s.store.start
+	for pos < s.store.size {
+		h, err := s.store.frameAt(pos)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !h.hole {
+			return pos, nil
+		}
+		pos += h.width + h.n
+	}
+	return s.store.size, nil
+}
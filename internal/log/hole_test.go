@@ -0,0 +1,164 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// PunchHolesでは、取り除いたレコードが穴になり、storeの大きさを変えずに読めなくなることを確認。どちらの形式のstoreでも同じ
+func TestCompactPunchHoles(t *testing.T) {
+	for name, compact := range map[string]bool{"fixed": false, "varint": true} {
+		t.Run(name, func(t *testing.T) {
+			testCompactPunchHoles(t, compact)
+		})
+	}
+}
+
+func testCompactPunchHoles(t *testing.T, compact bool) {
+	dir, err := os.MkdirTemp("", "compact-punch-holes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 << 10
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.CompactFormat = compact
+	c.Compaction.PunchHoles = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	value := bytes.Repeat([]byte("v"), 8<<10)
+	// 最初のsegmentのaは最後の一つ以外が取り除かれ、bは残る
+	var keys []string
+	for i := 0; i < 6; i++ {
+		key := "a"
+		if i == 3 {
+			key = "b"
+		}
+		keys = append(keys, key)
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: value})
+		require.NoError(t, err)
+	}
+	_, err = log.Append(&api.Record{Key: []byte("a"), Value: value})
+	require.NoError(t, err)
+	_, err = log.Roll()
+	require.NoError(t, err)
+	keys = append(keys, "a")
+
+	storePath := filepath.Join(dir, "0.store")
+	before, err := os.Stat(storePath)
+	require.NoError(t, err)
+
+	reclaimed, err := log.Compact()
+	require.NoError(t, err)
+	require.NotZero(t, reclaimed)
+
+	check := func(log *Log) {
+		for i := range keys {
+			got, err := log.Read(uint64(i))
+			if i != 3 && i != len(keys)-1 {
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(i)}, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), got.Offset)
+			require.Equal(t, value, got.Value)
+		}
+		it, err := log.Scan(0)
+		require.NoError(t, err)
+		var offsets []uint64
+		for it.Next() {
+			offsets = append(offsets, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		require.Equal(t, []uint64{3, uint64(len(keys) - 1)}, offsets)
+
+		problems, err := log.Verify()
+		require.NoError(t, err)
+		require.Empty(t, problems)
+	}
+	check(log)
+
+	// 穴を開けられるファイルシステムでは、storeを書き直さない
+	probe, err := os.CreateTemp(dir, "probe")
+	require.NoError(t, err)
+	require.NoError(t, probe.Truncate(holeBlockSize))
+	if punchHole(probe, 0, holeBlockSize) != errPunchUnsupported {
+		after, err := os.Stat(storePath)
+		require.NoError(t, err)
+		require.Equal(t, before.Size(), after.Size())
+		require.Equal(t, before.ModTime(), after.ModTime())
+	}
+	require.NoError(t, probe.Close())
+	require.NoError(t, os.Remove(probe.Name()))
+
+	// Readerで読んだstoreの内容も、穴を飛ばして読める
+	var frames int
+	r := log.Reader()
+	for {
+		_, err := readFrame(r)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		frames++
+	}
+	require.Equal(t, 2, frames)
+
+	require.NoError(t, log.Close())
+	// .crcは穴を開けた後のstoreと一致する
+	c.Segment.VerifyChecksums = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(keys)), off)
+}
+
+// 穴を開けている間に進めていたScanも、穴を飛ばして残りのレコードを読み続けられることを確認
+func TestCompactPunchHolesScan(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-punch-holes-scan-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 << 10
+	c.Segment.MaxIndexBytes = 1024
+	c.Compaction.PunchHoles = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	value := bytes.Repeat([]byte("v"), 8<<10)
+	for _, key := range []string{"a", "a", "a", "b", "a", "a", "a"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: value})
+		require.NoError(t, err)
+	}
+	_, err = log.Roll()
+	require.NoError(t, err)
+
+	it, err := log.Scan(0)
+	require.NoError(t, err)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.Equal(t, uint64(0), it.Record().Offset)
+
+	_, err = log.Compact()
+	require.NoError(t, err)
+	var offsets []uint64
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{3, 6}, offsets)
+}
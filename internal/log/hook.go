@@ -0,0 +1,42 @@
+package log
+
+import (
+	"errors"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc/status"
+)
+
+// AppendHookは、レコードをstoreに書き込む前に呼ぶ関数。
+// recordを書き換えてから書き込ませることも、エラーを返して書き込みを断ることもできる。
+// スキーマの検証や個人情報の削除など、producerごとに実装していた方針をログの側でかけるのに使う
+
+// recordを調べ、必要なら書き換える。エラーを返すと、そのレコードを書き込まない
+type AppendHook func(record *api.Record) error
+
+// Config.AppendHooksを順に呼ぶ。gRPCのステータスを持たないエラーはErrRecordRejectedに包む
+func runAppendHooks(record *api.Record, c Config) error {
+	for _, hook := range c.AppendHooks {
+		if err := hook(record); err != nil {
+			var st interface{ GRPCStatus() *status.Status }
+			if errors.As(err, &st) {
+				return err
+			}
+			return api.ErrRecordRejected{Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// フックを通してから、大きさの上限を確かめる。フックが書き換えた後の大きさで比べる。
+// Codecはログが圧縮したときにだけ付けるので、書き込むレコードに付いていれば断る
+func checkRecord(record *api.Record, c Config) error {
+	if record.Codec != 0 {
+		return api.ErrRecordRejected{Reason: "codec is set by the log, not by producers"}
+	}
+	if err := runAppendHooks(record, c); err != nil {
+		return err
+	}
+	return checkRecordSize(record, c)
+}
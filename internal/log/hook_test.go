@@ -0,0 +1,64 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// フックが書き換えたレコードが書き込まれ、フックが断ったレコードは書き込まれないことを確認
+func TestLogAppendHooks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-append-hooks-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxRecordBytes = 64
+	c.AppendHooks = []AppendHook{
+		func(record *api.Record) error {
+			if len(record.Key) == 0 {
+				return errors.New("key is required")
+			}
+			return nil
+		},
+		// 書き換えた後の大きさで上限を確かめる
+		func(record *api.Record) error {
+			if string(record.Key) == "secret" {
+				record.Value = []byte("redacted")
+			}
+			return nil
+		},
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	off, err := log.Append(&api.Record{Key: []byte("secret"), Value: make([]byte, 128)})
+	require.NoError(t, err)
+	got, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("redacted"), got.Value)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrRecordRejected{Reason: "key is required"}, err)
+
+	// バッチは、一つでも断られたらどれも書き込まない
+	_, _, err = log.AppendBatch([]*api.Record{
+		{Key: []byte("a"), Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+	})
+	require.ErrorAs(t, err, &api.ErrRecordRejected{})
+	_, err = log.Read(off + 1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// gRPCのステータスを持つエラーは、そのまま返す
+	log.Config.AppendHooks = []AppendHook{func(record *api.Record) error {
+		return api.ErrRecordTooLarge{Size: 1, Max: 0}
+	}}
+	_, err = log.Append(&api.Record{Key: []byte("a")})
+	require.Equal(t, api.ErrRecordTooLarge{Size: 1, Max: 0}, err)
+}
@@ -1,8 +1,10 @@
 package log
 
 import (
-	"io"
-	"os"
+	"fmt"
+	"math"
+
+	api "proglog/api/v1"
 
 	"github.com/tysonmote/gommap"
 )
@@ -10,6 +12,16 @@ import (
 // indexは、4バイト分のオフセットと、8バイト分のポジション、
 // 計12バイトが並ぶことにする
 // オフセット * entWidthで、実際のポジションが書かれたバイトにたどり着ける
+//
+// 新しく作るindexは、先頭にヘッダーを置いてエントリの形式を書いておく。
+// ヘッダーは4バイトのマジックナンバー、1バイトのバージョン、オフセットとポジションの幅が1バイトずつ、予約の1バイト。
+// ヘッダーの無い元の形式では最初のエントリのポジションが必ず0なので、バージョンの位置が0でなければヘッダーだとわかる。
+// 幅はバージョン1では4か8、バージョン2では1から8のいずれか。エントリはsegmentのbaseOffsetとstoreの先頭からの差分なので、
+// Config.Segment.CompactFormatでは、上限に収まる最小の幅で書いてエントリを縮める。
+// ヘッダーはMaxIndexBytesに含めず、エントリだけでMaxIndexBytesまで書ける。
+//
+// Config.Segment.IndexGrowBytesが0なら、開くときにファイルをMaxIndexBytesまで広げてすべてをメモリマップする。
+// 0でなければ、その大きさずつファイルとメモリマップを広げていき、小さなsegmentのindexが場所を取らないようにする
 
 const (
 	offWidth uint64 = 4
@@ -17,32 +29,78 @@ const (
 	entWidth        = offWidth + posWidth
 )
 
+const (
+	indexMagic        = "PLIX"
+	indexVersion byte = 1
+	// 4と8以外の幅のエントリを持つindex
+	indexNarrowVersion byte = 2
+	indexHeaderWidth        = formatHeaderWidth
+)
+
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64 // indexのサイズをどんどん記録していく
+	file     File
+	mmap     gommap.MMap
+	size     uint64 // indexのサイズをどんどん記録していく。ヘッダーも含む
+	syncMode IndexSyncMode
+	// エントリのオフセットとポジションの幅、エントリ全体の幅
+	offWidth uint64
+	posWidth uint64
+	entWidth uint64
+	// 最初のエントリの位置。ヘッダーがあればその後ろ
+	start uint64
+	// 読み取り専用でマップしたindex。ファイルを書き換えない
+	readOnly bool
+	// ヘッダーを含めたindexの大きさの上限と、メモリマップを一度に広げる大きさ。growが0なら広げない
+	max  uint64
+	grow uint64
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, c Config) (*index, error) {
 	// 引数で受け取ったファイルから、index構造体を生成
 	idx := &index{
-		file: f,
+		file:     f,
+		syncMode: c.Segment.IndexSyncMode,
+		readOnly: c.readOnly,
 	}
 
 	// ファイルの情報を取得し、index構造体のサイズに入れておく
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
 	// ファイルの元のサイズ記録。おそらく0だが。。
 	idx.size = uint64(fi.Size())
+	if idx.readOnly {
+		return idx, idx.mapReadOnly(c.indexLayout())
+	}
+	version, err := readFormatVersion(f, idx.size, indexMagic)
+	if err != nil {
+		return nil, err
+	}
+	// 空のindexには、これからヘッダーを書き込む
+	var header uint64
+	if version > 0 || idx.size == 0 {
+		header = indexHeaderWidth
+	}
+
+	idx.max = c.Segment.MaxIndexBytes + header
+	idx.grow = c.Segment.IndexGrowBytes
 
 	// ファイルのサイズを、メモリマップするために(おそらく1024byteに)変換する
-	// つまり、メモリの1024byte分をindexとして使う
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
-	); err != nil {
+	// つまり、メモリの1024byte分をindexとして使う。少しずつ広げるなら、今の大きさにgrowを足した分だけ
+	mapped := idx.max
+	if idx.grow > 0 && idx.size+idx.grow < mapped {
+		mapped = idx.size + idx.grow
+		// growがエントリの幅より小さくても、ヘッダーと一つ目のエントリは書き込めるようにする
+		if need := idx.size + header + entWidth; mapped < need {
+			mapped = need
+		}
+		if mapped > idx.max {
+			mapped = idx.max
+		}
+	}
+	if err = f.Truncate(int64(mapped)); err != nil {
 		return nil, err
 	}
 
@@ -55,12 +113,145 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	); err != nil {
 		return nil, err
 	}
+	if err = idx.readLayout(c.indexLayout()); err != nil {
+		return nil, err
+	}
 	return idx, nil
 }
 
+// ファイルの大きさのまま、読み取り専用でメモリマップする。空のindexはマップせず、ヘッダーも書かない
+func (i *index) mapReadOnly(layout IndexLayout) error {
+	if i.size > 0 {
+		var err error
+		if i.mmap, err = gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
+			return err
+		}
+		return i.readLayout(layout)
+	}
+	i.offWidth, i.posWidth, i.entWidth = offWidth, posWidth, entWidth
+	return nil
+}
+
+// ヘッダーからエントリの形式を読む。空のindexであれば、layoutの形式にしてヘッダーを書き込む
+func (i *index) readLayout(layout IndexLayout) error {
+	off, pos := uint64(offWidth), uint64(posWidth)
+	switch {
+	case i.size >= indexHeaderWidth && string(i.mmap[:len(indexMagic)]) == indexMagic && i.mmap[len(indexMagic)] != 0:
+		if v := i.mmap[len(indexMagic)]; v > indexNarrowVersion {
+			return fmt.Errorf("unsupported index version %d in %s", v, i.Name())
+		}
+		off, pos = uint64(i.mmap[len(indexMagic)+1]), uint64(i.mmap[len(indexMagic)+2])
+		i.start = indexHeaderWidth
+	case i.size == 0:
+		if layout.OffsetWidth != 0 {
+			off = layout.OffsetWidth
+		}
+		if layout.PositionWidth != 0 {
+			pos = layout.PositionWidth
+		}
+		if !validWidth(off) || !validWidth(pos) {
+			break
+		}
+		if uint64(len(i.mmap)) < indexHeaderWidth {
+			return fmt.Errorf("index is too small for a header: %d bytes", len(i.mmap))
+		}
+		copy(i.mmap, indexMagic)
+		i.mmap[len(indexMagic)] = indexVersion
+		if !wideWidth(off) || !wideWidth(pos) {
+			// 古いバージョンでは読めないので、バージョンを上げる
+			i.mmap[len(indexMagic)] = indexNarrowVersion
+		}
+		i.mmap[len(indexMagic)+1] = byte(off)
+		i.mmap[len(indexMagic)+2] = byte(pos)
+		i.mmap[len(indexMagic)+3] = 0
+		i.start, i.size = indexHeaderWidth, indexHeaderWidth
+	}
+	if !validWidth(off) || !validWidth(pos) {
+		return fmt.Errorf("unsupported index layout: offset width %d, position width %d", off, pos)
+	}
+	i.offWidth, i.posWidth, i.entWidth = off, pos, off+pos
+	return nil
+}
+
+// 新しく作るindexのエントリの形式。CompactFormatでIndexLayoutを指定していなければ、上限に収まる最小の幅にする
+func (c Config) indexLayout() IndexLayout {
+	layout := c.Segment.IndexLayout
+	if !c.Segment.CompactFormat || layout.OffsetWidth != 0 || layout.PositionWidth != 0 {
+		return layout
+	}
+	// 相対オフセットはレコードの数を、ポジションはstoreの大きさを超えない。マージしたsegmentはMergeBelowBytesまで大きくなる
+	limit := c.Segment.MaxStoreBytes
+	if c.Compaction.MergeBelowBytes > limit {
+		limit = c.Compaction.MergeBelowBytes
+	}
+	return IndexLayout{
+		OffsetWidth:   widthFor(limit),
+		PositionWidth: widthFor(limit + formatHeaderWidth),
+	}
+}
+
+func validWidth(w uint64) bool {
+	return w >= 1 && w <= 8
+}
+
+// バージョン1のindexでも書ける幅
+func wideWidth(w uint64) bool {
+	return w == 4 || w == 8
+}
+
+// vを書ける最小の幅
+func widthFor(v uint64) uint64 {
+	w := uint64(1)
+	for ; w < 8 && v > maxUint(w); w++ {
+	}
+	return w
+}
+
+// bの幅に応じて、1から8バイトの値をビッグエンディアンで読み書きする
+func getUint(b []byte) uint64 {
+	switch len(b) {
+	case 4:
+		return uint64(enc.Uint32(b))
+	case 8:
+		return enc.Uint64(b)
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func putUint(b []byte, v uint64) {
+	switch len(b) {
+	case 4:
+		enc.PutUint32(b, uint32(v))
+		return
+	case 8:
+		enc.PutUint64(b, v)
+		return
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
 func (i *index) Close() error {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
 	// メモリマップされた内容をファイルディスクリプタを介してファイルに書き込む
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	flags := gommap.MS_SYNC
+	if i.syncMode == IndexSyncModeAsync {
+		flags = gommap.MS_ASYNC
+	}
+	if err := i.mmap.Sync(flags); err != nil {
 		return err
 	}
 
@@ -70,8 +261,10 @@ func (i *index) Close() error {
 	}
 
 	// ファイルをディスクに書き込む。エディタでの保存のイメージ
-	if err := i.file.Sync(); err != nil {
-		return err
+	if i.syncMode != IndexSyncModeAsync {
+		if err := i.file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	// 記録しておいた元のファイルサイズに戻す
@@ -81,55 +274,181 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
-		return 0, 0, io.EOF
+// メモリマップの内容をファイルに書き戻し、fsyncする
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
+// indexに書き込まれていないエントリを読もうとした。エントリの番号はオフセットとは限らないので、
+// segmentは読もうとしたオフセットのapi.ErrOffsetOutOfRangeにして返す
+type errEntryOutOfRange struct {
+	entry uint64
+}
+
+func (e errEntryOutOfRange) Error() string {
+	return fmt.Sprintf("index entry %d out of range", e.entry)
+}
+
+// 書き込まれていないエントリを読もうとするとerrEntryOutOfRangeを返す
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
+	n := i.count()
+	if n == 0 {
+		if in == -1 {
+			in = 0
+		}
+		return 0, 0, errEntryOutOfRange{entry: uint64(in)}
 	}
 
 	// inは、indexのエントリで読み取りたい箇所。-1なら最後。そうでないなら何個目のエントリか。
 	// 読み取りたい箇所を、変数outに一時格納
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
+		out = n - 1
 	} else {
-		out = uint32(in)
+		out = uint64(in)
 	}
 
-	// outにエントリのサイズの12をかけ、何個目のエントリか？を、バイト数に変換
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
-		return 0, 0, io.EOF
+	// outをエントリの幅をかけたバイト数に変換し、何個目のエントリか？を、indexの中の位置にする
+	pos = i.at(out)
+	if i.size < pos+i.entWidth {
+		return 0, 0, errEntryOutOfRange{entry: out}
 	}
 
 	// 読み取りたかった箇所のオフセットをoutに格納
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
+	out = getUint(i.mmap[pos : pos+i.offWidth])
 
 	// 読み取りたかった箇所のポジションをposに格納
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	pos = getUint(i.mmap[pos+i.offWidth : pos+i.entWidth])
 	return out, pos, nil
 }
 
-func (i *index) Write(off uint32, pos uint64) error {
+// エントリを書き込む余地が無ければErrSegmentFullを返す
+func (i *index) Write(off uint64, pos uint64) error {
 	// エントリを書き込めるかどうか
 	if i.isMaxed() {
-		return io.EOF
+		return api.ErrSegmentFull{}
+	}
+	if off > i.maxOffset() || pos > i.maxPosition() {
+		return fmt.Errorf("index entry does not fit the layout: offset %d, position %d", off, pos)
+	}
+	if uint64(len(i.mmap)) < i.size+i.entWidth {
+		if err := i.remap(i.size + i.entWidth); err != nil {
+			return err
+		}
 	}
 
 	// オフセット分をバイナリにして書き込む。
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
+	putUint(i.mmap[i.size:i.size+i.offWidth], off)
 
 	// 実際のポジションをバイナリにして書き込む
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	putUint(i.mmap[i.size+i.offWidth:i.size+i.entWidth], pos)
 
 	// 書き込んだエントリ分のサイズを更新
-	i.size += uint64(entWidth)
+	i.size += i.entWidth
+
+	return nil
+}
+
+// ファイルとメモリマップをgrowだけ、足りなければneedまで広げる。maxを超えては広げない
+func (i *index) remap(need uint64) error {
+	size := uint64(len(i.mmap)) + i.grow
+	// growがエントリの幅より小さければ、needまで広げる
+	if size < need {
+		size = need
+	}
+	if size > i.max {
+		size = i.max
+	}
+	if err := i.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	mmap, err := gommap.Map(i.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	// MAP_SHAREDなので、書き込んだ内容は解放しても新しいマップから読める
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		mmap.UnsafeUnmap()
+		return err
+	}
+	i.mmap = mmap
+	return nil
+}
 
+// 書き込み済みのentry番目のエントリを書き直す。読み込み時の修復に使う
+func (i *index) rewrite(entry, off uint64, pos uint64) error {
+	at := i.at(entry)
+	if i.size < at+i.entWidth {
+		return errEntryOutOfRange{entry: entry}
+	}
+	putUint(i.mmap[at:at+i.offWidth], off)
+	putUint(i.mmap[at+i.offWidth:at+i.entWidth], pos)
 	return nil
 }
 
+// 書き込み済みのエントリを先頭から順にyieldへ渡す関数を返す。storeは読まず、メモリマップから直接読む。
+// yieldがfalseを返すとそこで止まる。外部のツールで、オフセットとポジションの対応だけが必要な場合に使う
+func (i *index) Entries2() func(yield func(relOff uint64, pos uint64) bool) {
+	return func(yield func(relOff uint64, pos uint64) bool) {
+		for at := i.start; at+i.entWidth <= i.size; at += i.entWidth {
+			relOff := getUint(i.mmap[at : at+i.offWidth])
+			pos := getUint(i.mmap[at+i.offWidth : at+i.entWidth])
+			if !yield(relOff, pos) {
+				return
+			}
+		}
+	}
+}
+
+// n番目以降のエントリを捨てる。ファイルは閉じるときに切り詰められる
+func (i *index) truncate(n uint64) {
+	if i.at(n) < i.size {
+		i.size = i.at(n)
+	}
+}
+
+// 書き込み済みのエントリの数
+func (i *index) count() uint64 {
+	return (i.size - i.start) / i.entWidth
+}
+
+// n番目のエントリの、indexの中での位置
+func (i *index) at(n uint64) uint64 {
+	return i.start + n*i.entWidth
+}
+
+// エントリに書ける最大の相対オフセットとポジション
+func (i *index) maxOffset() uint64 {
+	return maxUint(i.offWidth)
+}
+
+func (i *index) maxPosition() uint64 {
+	return maxUint(i.posWidth)
+}
+
+func maxUint(width uint64) uint64 {
+	if width >= 8 {
+		return math.MaxUint64
+	}
+	return 1<<(8*width) - 1
+}
+
 func (i *index) isMaxed() bool {
-	// エントリを書き込もうとした際、確保済みのメモリマップのサイズを超過しているかどうか。
-	// つまり、indexファイルには、メモリマップ以上のバイトを書き込めないようにする
-	return uint64(len(i.mmap)) < i.size+entWidth
+	return i.remaining() == 0
+}
+
+// あと何個のエントリを書き込めるか。メモリマップを広げれば書き込める分も数える
+func (i *index) remaining() uint64 {
+	limit := uint64(len(i.mmap))
+	if i.grow > 0 {
+		limit = i.max
+	}
+	if limit < i.size {
+		return 0
+	}
+	return (limit - i.size) / i.entWidth
 }
 
 func (i *index) Name() string {
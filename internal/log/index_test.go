@@ -1,10 +1,12 @@
 package log
 
 import (
-	"io"
+	"math"
 	"os"
 	"testing"
 
+	api "proglog/api/v1"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,7 +26,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), idx.Name())
 
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -42,7 +44,7 @@ func TestIndex(t *testing.T) {
 
 	// index and scanner should error when reading past existing entries
 	_, _, err = idx.Read(int64(len(entries)))
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, errEntryOutOfRange{entry: uint64(len(entries))}, err)
 	_ = idx.Close()
 
 	// index should build its state from the existing file
@@ -51,6 +53,229 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+// どちらの同期方法でも、閉じた後にindexを読み込めることを確認
+func TestIndexSyncMode(t *testing.T) {
+	for _, mode := range []IndexSyncMode{IndexSyncModeSync, IndexSyncModeAsync} {
+		f, err := os.CreateTemp(os.TempDir(), "index_sync_mode_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		c := Config{}
+		c.Segment.MaxIndexBytes = 1024
+		c.Segment.IndexSyncMode = mode
+		idx, err := newIndex(f, c)
+		require.NoError(t, err)
+		require.NoError(t, idx.Write(0, 0))
+		require.NoError(t, idx.Write(1, 10))
+		require.NoError(t, idx.Close())
+
+		f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		idx, err = newIndex(f, c)
+		require.NoError(t, err)
+		off, pos, err := idx.Read(-1)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), off)
+		require.Equal(t, uint64(10), pos)
+		require.NoError(t, idx.Close())
+	}
+}
+
+// Entries2が書き込んだエントリを順に返し、yieldがfalseを返すと止まることを確認
+func TestIndexEntries2(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_entries_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	type entry struct {
+		Off uint64
+		Pos uint64
+	}
+	want := []entry{{0, 0}, {1, 10}, {3, 25}}
+	for _, e := range want {
+		require.NoError(t, idx.Write(e.Off, e.Pos))
+	}
+
+	var got []entry
+	idx.Entries2()(func(relOff uint64, pos uint64) bool {
+		got = append(got, entry{relOff, pos})
+		return true
+	})
+	require.Equal(t, want, got)
+
+	got = nil
+	idx.Entries2()(func(relOff uint64, pos uint64) bool {
+		got = append(got, entry{relOff, pos})
+		return len(got) < 2
+	})
+	require.Equal(t, want[:2], got)
+}
+
+// どの形式でも書き込んだエントリを読み戻せ、開き直すと設定によらず作ったときの形式で読むことを確認
+func TestIndexLayout(t *testing.T) {
+	for scenario, layout := range map[string]IndexLayout{
+		"legacy":                       {},
+		"64-bit offsets":               {OffsetWidth: 8},
+		"32-bit positions":             {PositionWidth: 4},
+		"32-bit offsets and positions": {OffsetWidth: 4, PositionWidth: 4},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := os.CreateTemp(os.TempDir(), "index_layout_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.IndexLayout = layout
+			idx, err := newIndex(f, c)
+			require.NoError(t, err)
+
+			maxOff := idx.maxOffset()
+			maxPos := idx.maxPosition()
+			type entry struct {
+				Off uint64
+				Pos uint64
+			}
+			want := []entry{{0, 0}, {1, 10}, {maxOff, maxPos}}
+			for _, e := range want {
+				require.NoError(t, idx.Write(e.Off, e.Pos))
+			}
+			if maxPos < math.MaxUint64 {
+				require.Error(t, idx.Write(maxOff, maxPos+1))
+			}
+			require.NoError(t, idx.Close())
+
+			b, err := os.ReadFile(f.Name())
+			require.NoError(t, err)
+			// 元の形式と同じ幅でも、ヘッダーを置く
+			require.Equal(t, indexMagic, string(b[:len(indexMagic)]))
+			require.Len(t, b, int(indexHeaderWidth+3*idx.entWidth))
+
+			// 設定を変えて開き直しても、作ったときの形式で読む
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+			require.NoError(t, err)
+			c.Segment.IndexLayout = IndexLayout{OffsetWidth: 8, PositionWidth: 8}
+			if layout.OffsetWidth == 8 {
+				c.Segment.IndexLayout = IndexLayout{}
+			}
+			idx, err = newIndex(f, c)
+			require.NoError(t, err)
+			defer idx.Close()
+			var got []entry
+			idx.Entries2()(func(relOff uint64, pos uint64) bool {
+				got = append(got, entry{relOff, pos})
+				return true
+			})
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+// 対応していない形式やバージョンのindexは開けないことを確認
+func TestIndexLayoutUnsupported(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_layout_unsupported_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexLayout = IndexLayout{OffsetWidth: 9}
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+	// 対応していない形式のヘッダーは書き込まない
+	b := make([]byte, len(indexMagic))
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, indexMagic, string(b))
+
+	_, err = f.WriteAt([]byte(indexMagic+"\x03\x08\x08\x00"), 0)
+	require.NoError(t, err)
+	c.Segment.IndexLayout = IndexLayout{}
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+}
+
+// IndexGrowBytesずつファイルとメモリマップを広げ、MaxIndexBytesまで書き込めることを確認
+func TestIndexGrow(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_grow_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 10
+	c.Segment.IndexGrowBytes = entWidth * 2
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	fileSize := func() int64 {
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	require.Equal(t, int64(entWidth*2), fileSize())
+	require.Equal(t, uint64(10), idx.remaining())
+
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, idx.Write(i, i*10))
+		// 書き込んだ分より、一度に広げる大きさ以上には広げない
+		require.LessOrEqual(t, uint64(fileSize()), indexHeaderWidth+(i+1)*entWidth+c.Segment.IndexGrowBytes)
+	}
+	require.Equal(t, int64(indexHeaderWidth+entWidth*10), fileSize())
+	require.True(t, idx.isMaxed())
+	require.Equal(t, api.ErrSegmentFull{}, idx.Write(10, 100))
+	for i := uint64(0); i < 10; i++ {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, i*10, pos)
+	}
+	require.NoError(t, idx.Close())
+
+	// 開き直すと、書き込み済みの大きさからまた広げていく
+	c.Segment.MaxIndexBytes = entWidth * 20
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	require.Equal(t, int64(indexHeaderWidth+entWidth*12), fileSize())
+	require.Equal(t, uint64(10), idx.count())
+	require.NoError(t, idx.Write(10, 100))
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	require.Equal(t, uint64(100), pos)
+}
+
+// IndexGrowBytesがエントリの幅より小さくても、書き込むたびに足りる分だけ広げることを確認
+func TestIndexGrowSmall(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_grow_small_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Segment.IndexGrowBytes = 1
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 4; i++ {
+		require.NoError(t, idx.Write(i, i*10))
+	}
+	require.Equal(t, api.ErrSegmentFull{}, idx.Write(4, 40))
+	for i := uint64(0); i < 4; i++ {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, i*10, pos)
+	}
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,129 @@
+package log
+
+import (
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Iteratorは、ログのレコードをオフセットの順に読み進める。
+// Readと違ってindexを引くのはsegmentに入るときだけで、後はstoreを前から順に読み、読み込み用のバッファも使い回すので、
+// ログ全体を読むような走査が速い。Nextを呼んだ時点までに書き込まれたレコード(HideUncommittedならコミット済みのレコード)を読み、
+// 削除やコンパクションで無くなったオフセットは飛ばす。一つのゴルーチンから使うこと
+type Iterator struct {
+	log     *Log
+	segment *segment
+	// segmentに入ったときの、segmentの穴を開けた回数
+	holes  uint64
+	pos    uint64
+	next   uint64
+	record *api.Record
+	buf    []byte
+	err    error
+}
+
+// fromから読み始めるIteratorを返す。fromは保持されている最小のオフセットから、次に書き込まれるオフセットまで
+func (l *Log) Scan(from uint64) (*Iterator, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if from < l.lowestOffset() || from > l.activeSegment.nextOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: from}
+	}
+	return &Iterator{log: l, next: from}, nil
+}
+
+// 次のレコードに進む。これ以上レコードが無いか、エラーが起きればfalseを返す
+func (it *Iterator) Next() bool {
+	if it.log == nil || it.err != nil {
+		return false
+	}
+	it.record = nil
+	l := it.log
+	defer l.trimCache()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		it.err = ErrClosed
+		return false
+	}
+	for {
+		if lowest := l.lowestOffset(); it.next < lowest {
+			it.next = lowest
+		}
+		s := l.segmentFor(it.next)
+		if s == nil {
+			// 末尾まで読んだ
+			return false
+		}
+		// 読んでいたsegmentも、キャッシュから消されていればまた取ってくる。storeの内容は同じなのでposはそのまま使える
+		if it.err = s.open(); it.err != nil {
+			return false
+		}
+		if s != it.segment || s.holes != it.holes {
+			// 新しいsegmentに入ったか、読んでいたsegmentがコンパクションなどで置き換えられた。
+			// 穴を開けられたsegmentでは、posが穴の中を指していることがある
+			if it.pos, it.err = s.seek(it.next); it.err != nil {
+				return false
+			}
+			it.segment = s
+			it.holes = s.holes
+		}
+		for it.pos < s.store.size {
+			pos := it.pos
+			p, size, err := s.store.readRecordBuf(it.pos, &it.buf)
+			if err == errHole {
+				it.pos += size
+				continue
+			}
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.pos += size
+			record := &api.Record{}
+			if it.err = proto.Unmarshal(p, record); it.err != nil {
+				return false
+			}
+			if record.Offset < it.next {
+				continue
+			}
+			if !l.visible(record.Offset) {
+				// コミットされたら、次のNextでここから読む
+				it.pos = pos
+				return false
+			}
+			if it.err = decompressRecord(record, s.config); it.err != nil {
+				return false
+			}
+			it.next = record.Offset + 1
+			it.record = record
+			return true
+		}
+		if it.next >= l.activeSegment.nextOffset {
+			return false
+		}
+		it.next = s.nextOffset
+	}
+}
+
+// Nextで進んだ先のレコード
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// 走査を止めたエラー。末尾まで読んで終わったときはnil
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Iteratorを閉じ、バッファを手放す。以降のNextはfalseを返す
+func (it *Iterator) Close() error {
+	it.log = nil
+	it.segment = nil
+	it.record = nil
+	it.buf = nil
+	return nil
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// segmentをまたいで順に読めること、走査中の書き込みや削除されたオフセットを扱えることを確認
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"scan all records":              testIteratorAll,
+		"scan from the middle":          testIteratorFrom,
+		"scan out of range":             testIteratorOutOfRange,
+		"scan sees later appends":       testIteratorTail,
+		"scan skips truncated segments": testIteratorTruncate,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			// 間引いたindexと圧縮したレコードでも読めること
+			c.Segment.SparseIndex.EveryRecords = 2
+			c.Compression.Codec = SnappyCodec
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: iteratorValue(i)})
+				require.NoError(t, err)
+			}
+			require.Greater(t, len(log.segments), 2)
+
+			fn(t, log)
+		})
+	}
+}
+
+func iteratorValue(i int) []byte {
+	return []byte(fmt.Sprintf("record %d record %d record %d", i, i, i))
+}
+
+// itを最後まで読み、読んだオフセットを返す
+func drain(t *testing.T, it *Iterator) []uint64 {
+	t.Helper()
+	var offsets []uint64
+	for it.Next() {
+		record := it.Record()
+		require.Equal(t, iteratorValue(int(record.Offset)), record.Value)
+		offsets = append(offsets, record.Offset)
+	}
+	require.NoError(t, it.Err())
+	return offsets
+}
+
+func offsetsBetween(from, to uint64) []uint64 {
+	var offsets []uint64
+	for off := from; off < to; off++ {
+		offsets = append(offsets, off)
+	}
+	return offsets
+}
+
+func testIteratorAll(t *testing.T, log *Log) {
+	it, err := log.Scan(0)
+	require.NoError(t, err)
+	defer it.Close()
+	require.Equal(t, offsetsBetween(0, 10), drain(t, it))
+}
+
+func testIteratorFrom(t *testing.T, log *Log) {
+	for _, from := range []uint64{3, 5, 9, 10} {
+		it, err := log.Scan(from)
+		require.NoError(t, err)
+		require.Equal(t, offsetsBetween(from, 10), drain(t, it))
+		require.NoError(t, it.Close())
+	}
+}
+
+func testIteratorOutOfRange(t *testing.T, log *Log) {
+	_, err := log.Scan(11)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 11}, err)
+
+	require.NoError(t, log.Truncate(3))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	_, err = log.Scan(lowest - 1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: lowest - 1}, err)
+}
+
+func testIteratorTail(t *testing.T, log *Log) {
+	it, err := log.Scan(8)
+	require.NoError(t, err)
+	defer it.Close()
+	require.Equal(t, offsetsBetween(8, 10), drain(t, it))
+
+	// 末尾まで読んだ後に書き込まれたレコードも、続けて読める
+	for i := 10; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: iteratorValue(i)})
+		require.NoError(t, err)
+	}
+	require.Equal(t, offsetsBetween(10, 20), drain(t, it))
+
+	require.NoError(t, it.Close())
+	require.False(t, it.Next())
+}
+
+func testIteratorTruncate(t *testing.T, log *Log) {
+	it, err := log.Scan(0)
+	require.NoError(t, err)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.Equal(t, uint64(0), it.Record().Offset)
+
+	// 読んでいる途中でsegmentが削除されたら、残っている最小のオフセットから読み続ける
+	require.NoError(t, log.Truncate(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(1))
+	require.Equal(t, offsetsBetween(lowest, 10), drain(t, it))
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	api "proglog/api/v1"
+)
+
+// ExportとImportは、レコードを1行に一つのJSONオブジェクトで読み書きする。
+// 環境の間でログの中身を移したり、jqで中身を見たりするための形式で、keyとvalueはbase64で書く。
+// Importは書き込み先のログの末尾に追記するので、オフセットは書き込み先で振り直される。
+// producerのIDとシーケンス番号は書き込み先のログの重複の判定に使われるので、書き出さない
+
+// Exportで書き出すレコード
+type ExportedRecord struct {
+	Offset uint64 `json:"offset"`
+	// 書き込んだ時刻(UNIXエポックからのナノ秒)
+	Timestamp int64  `json:"timestamp"`
+	Key       []byte `json:"key,omitempty"`
+	Value     []byte `json:"value"`
+	// keyを削除するトゥームストーン
+	Tombstone bool             `json:"tombstone,omitempty"`
+	Headers   []ExportedHeader `json:"headers,omitempty"`
+	// レコードの有効期間(ナノ秒)。0なら期限は無い
+	Ttl int64 `json:"ttl,omitempty"`
+}
+
+// ExportedRecordのヘッダー
+type ExportedHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// 保持されているすべてのレコードを、オフセットの順にwへ書き出す
+func (l *Log) Export(w io.Writer) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	it, err := l.Scan(lowest)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+	for it.Next() {
+		record := it.Record()
+		exported := ExportedRecord{
+			Offset:    record.Offset,
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Value:     record.Value,
+			Tombstone: record.Tombstone,
+			Ttl:       record.Ttl,
+		}
+		for _, h := range record.Headers {
+			exported.Headers = append(exported.Headers, ExportedHeader{Key: h.Key, Value: h.Value})
+		}
+		if err := e.Encode(exported); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Exportで書き出したレコードをrから読み、時刻はそのままにログへ追記する。追記したレコードの数を返す
+func (l *Log) Import(r io.Reader) (int, error) {
+	d := json.NewDecoder(bufio.NewReader(r))
+	n := 0
+	for {
+		var record ExportedRecord
+		if err := d.Decode(&record); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		imported := &api.Record{
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Value:     record.Value,
+			Tombstone: record.Tombstone,
+			Ttl:       record.Ttl,
+		}
+		for _, h := range record.Headers {
+			imported.Headers = append(imported.Headers, &api.Header{Key: h.Key, Value: h.Value})
+		}
+		if _, err := l.Append(imported); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
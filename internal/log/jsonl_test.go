@@ -0,0 +1,100 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Exportで1行に一つのJSONを書き出し、Importで別のログに同じ時刻と値のまま追記できることを確認
+func TestLogExportImport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "export-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.MaxIndexBytes = 1024
+	src, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer src.Close()
+	for i := 0; i < 10; i++ {
+		_, err := src.Append(&api.Record{
+			Key:       []byte{byte(i)},
+			Value:     []byte("hello world"),
+			Timestamp: int64(i + 1),
+		})
+		require.NoError(t, err)
+	}
+	_, err = src.DeleteRecords(2)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(&buf))
+	s := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	var lines int
+	for s.Scan() {
+		var got ExportedRecord
+		require.NoError(t, json.Unmarshal(s.Bytes(), &got))
+		require.Equal(t, uint64(lines+2), got.Offset)
+		require.Equal(t, int64(lines+3), got.Timestamp)
+		lines++
+	}
+	require.Equal(t, 8, lines)
+
+	dstDir, err := os.MkdirTemp("", "import-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dstDir)
+	dst, err := NewLog(dstDir, c)
+	require.NoError(t, err)
+	defer dst.Close()
+	n, err := dst.Import(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+	for off := uint64(0); off < 8; off++ {
+		record, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(off + 2)}, record.Key)
+		require.Equal(t, []byte("hello world"), record.Value)
+		require.Equal(t, int64(off+3), record.Timestamp)
+	}
+
+	// トゥームストーン、ヘッダー、有効期間もそのまま移す
+	var meta bytes.Buffer
+	_, err = src.Append(&api.Record{
+		Key:     []byte("k"),
+		Value:   []byte("v"),
+		Headers: []*api.Header{{Key: "h", Value: []byte("1")}, {Key: "h", Value: []byte("2")}},
+		Ttl:     int64(time.Hour),
+	})
+	require.NoError(t, err)
+	_, err = src.Delete([]byte("k"))
+	require.NoError(t, err)
+	require.NoError(t, src.Export(&meta))
+	n, err = dst.Import(&meta)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	record, err := dst.Read(16)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), record.Value)
+	require.Equal(t, int64(time.Hour), record.Ttl)
+	require.Len(t, record.Headers, 2)
+	require.Equal(t, "h", record.Headers[1].Key)
+	require.Equal(t, []byte("2"), record.Headers[1].Value)
+	record, err = dst.Read(17)
+	require.NoError(t, err)
+	require.True(t, record.Tombstone)
+	require.Equal(t, []byte("k"), record.Key)
+
+	// 壊れた行があれば、そこまでを追記してエラーを返す
+	n, err = dst.Import(bytes.NewReader([]byte("{\"value\":\"aGk=\"}\n{")))
+	require.Error(t, err)
+	require.Equal(t, 1, n)
+}
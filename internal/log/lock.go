@@ -0,0 +1,67 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ログのディレクトリのロックファイルの名前。開いている間はflockで排他ロックを取り、持ち主のPIDを書いておく。
+// 二つのプロセスや二つのLogが、同じディレクトリのstoreやindexを書き換え合わないようにする
+const lockFileName = "LOCK"
+
+// 他のプロセスかLogがロックを持っているときに返す
+type ErrLogLocked struct {
+	Dir string
+	// ロックを持っているプロセスのID。ロックファイルから読めなければ0
+	PID int
+}
+
+func (e ErrLogLocked) Error() string {
+	return fmt.Sprintf("log directory %s is locked by process %d", e.Dir, e.PID)
+}
+
+// lockFileが、他のファイルディスクリプタでロックされているときに返す
+var errLocked = errors.New("file is locked")
+
+// ログのディレクトリのロックを取る。ロックはCloseで放す
+func (l *Log) lock() error {
+	f, err := os.OpenFile(filepath.Join(l.Dir, lockFileName), os.O_RDWR|os.O_CREATE, l.Config.fileMode())
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		if errors.Is(err, errLocked) {
+			b, _ := io.ReadAll(f)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+			err = ErrLogLocked{Dir: l.Dir, PID: pid}
+		}
+		f.Close()
+		return err
+	}
+	// ロックを取った後に書き換えるので、前の持ち主のPIDと混ざることは無い
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return err
+	}
+	l.lockFile = f
+	return nil
+}
+
+// ロックを放す。ファイルを閉じればロックも外れる。他のプロセスが取り直せるよう、ロックファイルは消さない
+func (l *Log) unlock() error {
+	if l.lockFile == nil {
+		return nil
+	}
+	err := l.lockFile.Close()
+	l.lockFile = nil
+	return err
+}
@@ -0,0 +1,30 @@
+package log
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 開いているログのディレクトリは、別のLogでは開けず、閉じれば開けることを確認
+func TestLogLock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("flock is only used on linux")
+	}
+	dir, err := os.MkdirTemp("", "log-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrLogLocked{Dir: dir, PID: os.Getpid()}, err)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
@@ -1,25 +1,87 @@
 package log
 
 import (
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
 type Log struct {
+	// ロックを待っているものを含めた、コミット待ちの書き込みの数。
+	// 32bit環境でのアトミック操作のため先頭に置く
+	pending int64
+	// storeとindexの合計バイト数。ロックを取らずに読めるよう、l.muを取って書き換えるときもアトミックに書く
+	bytes uint64
+
 	mu sync.RWMutex
+	// コンパクションを同時に一つだけ実行するためのロック
+	compactMu sync.Mutex
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+
+	// アクティブでないsegmentの合計バイト数。segmentの並びを変えたときにresetSizeで数え直す
+	sealedBytes uint64
+	// このLogを登録した予算
+	budgets []*RetentionBudget
+	// トピックのパーティションであれば、トピックのQuotaRejectのクォータ
+	quota *topicQuota
+
+	// レコードサイズの分布。メトリクスが無効ならnil
+	sizeHistogram *histogram
+	// 書き込みや読み込みの回数などの統計。常に数える
+	stats *logStats
+	// ObjectStoreから取ってきたsegmentのキャッシュ。Config.Tiering.CacheBytesが0ならnil
+	cache *tierCache
+	// 最近読んだレコードのキャッシュ。Config.RecordCacheBytesが0ならnil
+	records *recordCache
+	// 書き込みのfsyncをまとめる
+	commits *groupCommit
+	// AppendAsyncで受け付けた書き込みのキュー。asyncMuで、閉じた後にキューへ入れないようにする
+	asyncMu     sync.RWMutex
+	async       chan asyncAppend
+	asyncClosed bool
+	// producerごとに最近書き込んだシーケンス番号
+	producers map[string]*producerState
+	// DeleteRecordsで進めた開始オフセット。これより前のレコードはsegmentに残っていても読めない
+	startOffset uint64
+
+	// ディレクトリのロックファイル。開いている間はロックを持つ
+	lockFile *os.File
+
+	// Closeが呼ばれたあとは書き込みを受け付けない
+	closed bool
+	// Closeの開始を購読者に知らせる
+	closing chan struct{}
+	// 書き込みのたびに閉じて作り直し、待っている購読者を起こす
+	notifyMu sync.Mutex
+	appended chan struct{}
+	// 配信中の購読者
+	subscribers sync.WaitGroup
+	// CloseがConfig.CloseTimeoutまで待っても届け終わらなかった購読者に、配信をやめさせる
+	abandon chan struct{}
+	// 保持期限の削除などのバックグラウンドの処理
+	background sync.WaitGroup
+	// nilでなければ、置き換えたsegmentのファイルをos.Removeの代わりにこれで削除する。テストで失敗を差し込むのに使う
+	removeFile func(name string) error
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -30,18 +92,65 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxIndexBytes = 1024
 	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:     dir,
+		Config:  c,
+		stats:   &logStats{},
+		commits: newGroupCommit(),
+	}
+	if c.Metrics.RecordSizeBuckets != nil {
+		l.sizeHistogram = newHistogram(c.Metrics.RecordSizeBuckets)
 	}
 
 	return l, l.setup()
 }
 
-func (l *Log) setup() error {
+func (l *Log) setup() (err error) {
+	// 読み取り専用なら、書き込んでいるプロセスがロックを持ったままでも開く
+	if !l.Config.readOnly {
+		if err := recoverRestore(l.Dir); err != nil {
+			return err
+		}
+		if err := l.lock(); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			l.unlock()
+		}
+	}()
+	if dir := l.Config.Segment.IndexDir; dir != "" && !l.Config.readOnly {
+		if err := os.MkdirAll(dir, l.Config.dirMode()); err != nil {
+			return err
+		}
+	}
+	if !l.Config.readOnly {
+		if err := l.recoverReplace(); err != nil {
+			return err
+		}
+	}
+	l.closed = false
+	l.commits.reset()
+	l.closing = make(chan struct{})
+	l.abandon = make(chan struct{})
+	l.appended = make(chan struct{})
+	// 作り直すときに、前のsegmentをキャッシュに残さない
+	l.cache = nil
+	if l.Config.Tiering.CacheBytes > 0 {
+		l.cache = newTierCache(l.Config.Tiering.CacheBytes)
+	}
+	l.records = nil
+	if l.Config.RecordCacheBytes > 0 {
+		l.records = newRecordCache(l.Config.RecordCacheBytes)
+	}
+
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
+	if err := l.loadStartOffset(); err != nil {
+		return err
+	}
 
 	// ファイルにされたオフセットを取得する
 	// 連番のオフセットは、baseOffsetとしてsegment.goによってsegmentに分けられ、
@@ -50,7 +159,19 @@ func (l *Log) setup() error {
 	// つまり、logは複数のsegmentを持ち、segmentはIsMaxed()のサイズ以下のstoreとindexを一つずつ持つ。
 
 	var baseOffsets []uint64
+	// ObjectStoreに移したsegment。ローカルにstoreを取ってきていても、スタブを元に開く
+	tiered := make(map[uint64]bool)
 	for _, file := range files {
+		// コンパクション用のディレクトリや退避したファイルなど、segmentのファイル以外は無視する
+		if file.IsDir() {
+			continue
+		}
+		// indexは無くなっていてもstoreから作り直せるので、storeとスタブだけを数える
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".tiered" {
+			continue
+		}
+
 		// TrimSuffixは、第一引数で受け取った文字列の末尾から、第二引数で受け取った文字列を削除する。
 		// path.Ext()は、拡張子を返してくれる。
 		// そのため、ここではファイル名から拡張子を削除している
@@ -60,7 +181,13 @@ func (l *Log) setup() error {
 		)
 
 		// ファイル名は文字列なので、数値に変換。第二引数の10は十進数であることを示す。
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
+		if ext == ".tiered" {
+			tiered[off] = true
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -68,14 +195,25 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
+	// storeとスタブの両方があるsegmentは、一つにまとめる
+	for i := 1; i < len(baseOffsets); i++ {
+		if baseOffsets[i] == baseOffsets[i-1] {
+			baseOffsets = append(baseOffsets[:i], baseOffsets[i+1:]...)
+			i--
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+	}
+
+	// 復旧にかかる時間を抑えるため、新しい方からMaxRecoverySegments個のsegmentだけをすぐに開き、
+	// それより古いsegmentは最初に読み込まれるまで開かない
+	lazy := 0
+	if n := l.Config.MaxRecoverySegments; n > 0 && len(baseOffsets) > n {
+		lazy = len(baseOffsets) - n
+	}
+	if err := l.openSegments(baseOffsets, tiered, lazy); err != nil {
+		return err
+	}
+	if l.segments == nil && l.Config.readOnly {
+		return fmt.Errorf("no segments in %s", l.Dir)
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -83,13 +221,290 @@ func (l *Log) setup() error {
 		); err != nil {
 			return err
 		}
+	} else if last := l.segments[len(l.segments)-1]; last != l.activeSegment {
+		if l.Config.readOnly {
+			// 書き込まないので、最後のsegmentをそのままアクティブなsegmentとして扱う
+			l.activeSegment = last
+		} else if err = l.newSegment(last.nextOffset); err != nil {
+			// 最後のsegmentもObjectStoreに移してあれば、その続きから書き込む
+			return err
+		}
 	}
+	if err = l.loadProducers(); err != nil {
+		return err
+	}
+	l.resetSize()
+	if l.Config.readOnly {
+		return nil
+	}
+	l.startRetention()
+	l.startCompaction()
+	l.startFlusher()
+	l.startTiering()
+	l.startScrub()
+	l.startAsyncAppender()
 	return nil
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	if err := checkRecord(record, l.Config); err != nil {
+		return 0, err
+	}
+	return l.appendChecked(record)
+}
+
+// フックと大きさの確認を済ませたrecordを書き込む
+func (l *Log) appendChecked(record *api.Record) (uint64, error) {
+	// コミット待ちが溜まりすぎたら、待たせ続けるのではなく再送を促す
+	release, err := l.acquireCommit()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	off, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	if l.Config.Segment.Flush.GroupCommit {
+		if err := l.waitCommit(off + 1); err != nil {
+			return 0, err
+		}
+	}
+	l.notifyAppend()
+
+	if l.Config.Retention.MaxBytes > 0 {
+		if _, err := l.removeOverSize(l.Config.Retention.MaxBytes); err != nil {
+			return 0, err
+		}
+	}
+
+	// 他のLogと予算を共有している場合は、ロックを解放してから予算の調整を行う
+	if err := l.enforceBudgets(); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// keyのトゥームストーンを書き込み、そのオフセットを返す。
+// keyのそれまでのレコードは、コンパクションで取り除かれるまでは読める
+func (l *Log) Delete(key []byte) (uint64, error) {
+	if len(key) == 0 {
+		return 0, fmt.Errorf("tombstone requires a key")
+	}
+	return l.Append(&api.Record{Key: key, Tombstone: true})
+}
+
+// 複数のレコードを、ロックを一度だけ取って続けて書き込み、最初と最後のオフセットを返す。
+// 途中でsegmentが上限に達した場合は、新しいsegmentに続きを書き込む。
+// producerの再送のレコードは書き込まず、各レコードのOffsetには書き込んだ(再送なら書き込み済みの)オフセットを入れる。
+// 再送のレコードを含むと最初から最後までのオフセットは連続しないので、個々のオフセットはOffsetを見ること
+func (l *Log) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	return l.appendRecords(records, false)
+}
+
+// AppendBatchと同じだが、すべてのレコードを一つのsegmentにまとめて書き込み、読み込み側からはすべてが同時に見えるようにする。
+// 書き込みの途中で落ちても、起動時にコミットの印が無いバッチを取り除くので、一部のレコードだけが残ることは無い。
+// アクティブなsegmentに収まらなければ新しいsegmentに書き込み、空のsegmentにも収まらなければエラーを返す
+func (l *Log) AppendAtomic(records []*api.Record) (first, last uint64, err error) {
+	return l.appendRecords(records, true)
+}
+
+func (l *Log) appendRecords(records []*api.Record, atomic bool) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, fmt.Errorf("empty batch")
+	}
+	// 一部だけ書き込まないように、書き込む前にすべてのレコードを確かめる
+	for _, record := range records {
+		if err := checkRecord(record, l.Config); err != nil {
+			return 0, 0, err
+		}
+	}
+	return l.appendRecordsChecked(records, atomic)
+}
+
+// フックと大きさの確認を済ませたrecordsを書き込む
+func (l *Log) appendRecordsChecked(records []*api.Record, atomic bool) (first, last uint64, err error) {
+	release, err := l.acquireCommit()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	if atomic {
+		first, last, err = l.appendAtomic(records)
+	} else {
+		first, last, err = l.appendBatch(records)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if l.Config.Segment.Flush.GroupCommit {
+		if err := l.waitCommit(last + 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	l.notifyAppend()
+
+	if l.Config.Retention.MaxBytes > 0 {
+		if _, err := l.removeOverSize(l.Config.Retention.MaxBytes); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := l.enforceBudgets(); err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
+}
+
+func (l *Log) appendBatch(records []*api.Record) (first, last uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return 0, 0, err
+	}
+
+	fresh, err := l.dedupeBatch(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fresh) > 0 {
+		if err := l.checkQuota(); err != nil {
+			return 0, 0, err
+		}
+	}
+	now := time.Now().UnixNano()
+	for _, record := range fresh {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+	for rest := fresh; len(rest) > 0; {
+		if l.activeSegment.IsMaxed() {
+			if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+				return 0, 0, err
+			}
+			atomic.AddUint64(&l.stats.rolls, 1)
+		}
+		n, err := l.activeSegment.AppendBatch(rest)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			// 上限に達していないsegmentには必ず1レコードは書き込めるので、ここには来ない
+			return 0, 0, api.ErrSegmentFull{}
+		}
+		l.observeAppended(rest[:n])
+		rest = rest[n:]
+	}
+	return records[0].Offset, records[len(records)-1].Offset, nil
+}
+
+func (l *Log) appendAtomic(records []*api.Record) (first, last uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return 0, 0, err
+	}
+
+	all := records
+	if records, err = l.dedupeBatch(records); err != nil {
+		return 0, 0, err
+	}
+	if len(records) == 0 {
+		// すべて再送
+		return all[0].Offset, all[len(all)-1].Offset, nil
+	}
+	if err := l.checkQuota(); err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().UnixNano()
+	for i, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+		record.BatchRemaining = uint32(len(records) - 1 - i)
+	}
+	s := l.activeSegment
+	ok, err := s.appendAll(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok && s.nextOffset > s.baseOffset {
+		// 残りに収まらないので、新しいsegmentに書き込む
+		if err := l.newSegment(s.nextOffset); err != nil {
+			return 0, 0, err
+		}
+		atomic.AddUint64(&l.stats.rolls, 1)
+		if ok, err = l.activeSegment.appendAll(records); err != nil {
+			return 0, 0, err
+		}
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("atomic batch of %d records does not fit in a segment", len(records))
+	}
+	l.observeAppended(records)
+	return all[0].Offset, all[len(all)-1].Offset, nil
+}
+
+func (l *Log) observeAppended(records []*api.Record) {
+	for _, record := range records {
+		size := uint64(proto.Size(record))
+		atomic.AddUint64(&l.stats.appends, 1)
+		atomic.AddUint64(&l.stats.appendedBytes, size)
+		if l.sizeHistogram != nil {
+			l.sizeHistogram.observe(size)
+		}
+		l.observeProducer(record)
+	}
+	l.updateSize()
+}
+
+// recordの大きさがConfig.Segment.MaxRecordBytesを超えていればErrRecordTooLargeを返す。
+// 圧縮する前の大きさで比べるので、圧縮すれば収まるレコードも拒否する
+func checkRecordSize(record *api.Record, c Config) error {
+	max := c.Segment.MaxRecordBytes
+	if max == 0 {
+		return nil
+	}
+	if size := uint64(proto.Size(record)); size > max {
+		return api.ErrRecordTooLarge{Size: size, Max: max}
+	}
+	return nil
+}
+
+// GroupCommitでfsyncを待つ書き込みだけを、コミット待ちとして数える。fsyncを待たない書き込みはすぐに戻るので、溜まることがない
+func (l *Log) acquireCommit() (release func(), err error) {
+	if !l.Config.Segment.Flush.GroupCommit {
+		return func() {}, nil
+	}
+	return acquirePending(&l.pending, l.Config.Segment.MaxPendingCommits)
+}
+
+// コミット待ちの数を一つ増やし、戻すための関数を返す。maxを超える場合は増やさずにErrBackpressureを返す。maxが0なら制限しない
+func acquirePending(pending *int64, max int) (release func(), err error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+	if atomic.AddInt64(pending, 1) > int64(max) {
+		atomic.AddInt64(pending, -1)
+		return nil, api.ErrBackpressure{Pending: max}
+	}
+	return func() { atomic.AddInt64(pending, -1) }, nil
+}
+
+func (l *Log) append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	if off, dup, err := l.duplicateOf(record); dup || err != nil {
+		return off, err
+	}
+	if err := l.checkQuota(); err != nil {
+		return 0, err
+	}
 
 	highestOffset, err := l.highestOffset()
 	if err != nil {
@@ -101,62 +516,396 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
+		atomic.AddUint64(&l.stats.rolls, 1)
 	}
 
+	// レプリケーションされたレコードなどは、書き込んだ時刻を持っているのでそのまま使う
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.observeAppended([]*api.Record{record})
 	return off, err
 }
 
+// アクティブなsegmentをディスクに永続化する。封印済みのsegmentは、封印するときに書き出し済み
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return err
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	l.notifyCommitted()
+	return nil
+}
+
+// Config.Segment.Flush.Backgroundの間隔で、まだ書き出していない書き込みがあればアクティブなsegmentを書き出してfsyncする。
+// Config.Segment.Flush.Intervalの間隔でも書き出し、次の書き込みが来なくてもバッファに残さない。fsyncするかはFsyncに従う
+func (l *Log) startFlusher() {
+	c := l.Config.Segment.Flush
+	if c.Background <= 0 && c.Interval <= 0 {
+		return
+	}
+	closing := l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		// 設定していない方のチャネルはnilのままにして、selectで選ばれないようにする
+		var background, interval <-chan time.Time
+		if c.Background > 0 {
+			ticker := time.NewTicker(c.Background)
+			defer ticker.Stop()
+			background = ticker.C
+		}
+		if c.Interval > 0 {
+			ticker := time.NewTicker(c.Interval)
+			defer ticker.Stop()
+			interval = ticker.C
+		}
+		for {
+			var fsync bool
+			select {
+			case <-closing:
+				return
+			case <-background:
+				fsync = true
+			case <-interval:
+				fsync = c.Fsync || c.GroupCommit
+			}
+			if err := l.flushActive(fsync); err != nil {
+				zap.L().Named("flusher").Error(
+					"failed to flush active segment",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}()
+}
+
+// ロックを取ってバッファを書き出し、fsyncならロックを放してからfsyncする。fsyncの間も書き込みは止めない
+func (l *Log) flushActive(fsync bool) error {
+	l.mu.Lock()
+	s := l.activeSegment
+	// fsyncするなら、バッファを書き出しただけでfsyncしていないレコードも、ここでfsyncする
+	if l.closed || (s.unflushed == 0 && (!fsync || atomic.LoadUint64(&s.synced) == s.nextOffset)) {
+		l.mu.Unlock()
+		return nil
+	}
+	next := s.nextOffset
+	err := s.store.flush()
+	if err == nil {
+		err = s.timeIndex.flush()
+	}
+	if err == nil {
+		s.unflushed = 0
+		s.lastFlush = time.Now()
+		s.stats.flushed()
+	}
+	f := s.store.File
+	l.mu.Unlock()
+	if err != nil || !fsync {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		// fsyncの間に封印されたsegmentは、封印するときにfsyncしている。Logを閉じたのであれば、もう書き出さなくてよい
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+	s.markSynced(next)
+	l.notifyCommitted()
+	return nil
+}
+
+// レコードサイズのヒストグラムのスナップショットを返す。メトリクスが無効なら空
+func (l *Log) SizeHistogram() Histogram {
+	if l.sizeHistogram == nil {
+		return Histogram{}
+	}
+	return l.sizeHistogram.snapshot()
+}
+
+// メトリクスをPrometheusのテキスト形式で書き出す。レコードサイズのヒストグラムは、有効なときだけ書き出す
+func (l *Log) WriteMetrics(w io.Writer) error {
+	if err := l.Stats().WritePrometheus(w); err != nil {
+		return err
+	}
+	if l.sizeHistogram == nil {
+		return nil
+	}
+	return l.SizeHistogram().WritePrometheus(w, recordSizeMetric)
+}
+
+// アクティブなsegmentが上限に達していなくても封印し、次のオフセットから新しいsegmentを始める。
+// 外部のイベント(日次のチェックポイントなど)にsegmentの境界を揃えたいときに使う
+func (l *Log) Roll() (newBaseOffset uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	off := l.activeSegment.nextOffset
+	if off == l.activeSegment.baseOffset {
+		// アクティブなsegmentが空なら、同じbaseOffsetのsegmentは作れないのでそのまま使う
+		return off, nil
+	}
+	if err := l.newSegment(off); err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&l.stats.rolls, 1)
+	return off, nil
+}
+
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	record := &api.Record{}
+	if err := l.ReadInto(off, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Readと同じだが、呼び出し側のrecordに読み込む。多くのレコードを続けて読むときに、
+// recordを使い回してアロケーションを減らすためのもの。recordの元の内容は捨てる
+func (l *Log) ReadInto(off uint64, record *api.Record) error {
+	// ObjectStoreから取ってきたsegmentがキャッシュの上限を超えれば、読み終えてから消す
+	defer l.trimCache()
+	err := l.readInto(off, record)
+	if _, ok := err.(errIndexDrift); ok {
+		// indexを書き直すので、読み込みを止めてから直す
+		err = l.repairInto(off, record)
+	}
+	return err
+}
+
+func (l *Log) readInto(off uint64, record *api.Record) error {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
 
 	// 該当のオフセットを持つsegmentを探す
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+	s := l.segmentFor(off)
+	if s == nil {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	atomic.AddUint64(&l.stats.reads, 1)
+	return l.readCached(s, off, record)
+}
+
+// Config.Segment.ReadRepairで、ずれたindexのエントリを書き込みロックを取って直しながら読む
+func (l *Log) repairInto(off uint64, record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.segmentFor(off)
+	if s == nil {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return s.repairInto(off, record)
+}
+
+// offを範囲に持つsegmentを返す。segmentはbaseOffsetの昇順に並んでいるので二分探索する。
+// 無ければnil。呼び出し側でロックを取っておくこと
+func (l *Log) segmentFor(off uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || off < l.segments[i].baseOffset || off < l.startOffset || !l.visible(off) {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// レコードの値は返さずに、サイズや時刻、格納場所などのメタデータを返す
+func (l *Log) Stat(off uint64) (RecordStat, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s := l.segmentFor(off)
+	if s == nil {
+		return RecordStat{}, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return s.Stat(off)
+}
+
+// 時刻t以降に書き込まれた最初のレコードのオフセットを返す。無ければapi.ErrOffsetOutOfRangeに次のオフセットを入れて返す
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	timestamp := t.UnixNano()
+	for _, s := range l.segments {
+		off, ok, err := s.offsetByTime(timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			// 開始オフセットより前のレコードは読めないので、それ以降で最初のレコードを返す
+			if off < l.startOffset {
+				off = l.startOffset
+				if off == l.activeSegment.nextOffset {
+					break
+				}
+			}
+			return off, nil
 		}
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	return 0, api.ErrOffsetOutOfRange{Offset: l.activeSegment.nextOffset}
+}
+
+// 時刻t以降に書き込まれた最初のレコードを読む
+func (l *Log) ReadByTime(t time.Time) (*api.Record, error) {
+	off, err := l.OffsetForTime(t)
+	if err != nil {
+		return nil, err
 	}
-	return s.Read(off)
+	return l.Read(off)
 }
 
+// offのレコードの時刻を返す。最新のレコードの時刻と比べれば、読み手の遅れを時間で表せる。
+// レコードを読まずにtimeindexから求めるので、時刻が前のレコードより古ければ、offまでで最も新しい時刻を返す
+func (l *Log) TimeForOffset(off uint64) (time.Time, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s := l.segmentFor(off)
+	if s == nil {
+		return time.Time{}, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	timestamp, err := s.timeForOffset(off)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, timestamp), nil
+}
+
+// fromからtoまでのオフセットがすべて封印済みのsegmentにあれば、それらのsegmentのチェックサムから求めた値を返す。
+// 範囲がアクティブなsegmentにかかる場合は、内容が変わりうるのでsealedがfalseになる
+func (l *Log) RangeChecksum(from, to uint64) (sum uint32, sealed bool, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if to >= l.activeSegment.baseOffset {
+		return 0, false, nil
+	}
+	h := crc32.New(castagnoli)
+	b := make([]byte, 12)
+	for _, s := range l.segments {
+		if s.nextOffset <= from || to < s.baseOffset {
+			continue
+		}
+		c, err := s.checksum()
+		if err != nil {
+			return 0, false, err
+		}
+		enc.PutUint64(b, s.baseOffset)
+		enc.PutUint32(b[8:], c)
+		h.Write(b)
+	}
+	return h.Sum32(), true, nil
+}
+
+// 書き込みを止め、購読者に残りのレコードと終了のイベントを届け終えてから、segmentを閉じる。
+// Config.CloseTimeoutまでに届け終わらない購読者は、終了のイベントを送らずにCを閉じて打ち切る。2回目以降の呼び出しは何もしない
 func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.closing)
+	l.waitSubscribers()
+	l.background.Wait()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.saveProducers(); err != nil {
+		l.unlock()
+		return err
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
+			l.unlock()
 			return err
 		}
 	}
-	return nil
+	return l.unlock()
 }
 
 func (l *Log) Remove() error {
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
+	if err := l.removeIndexFiles(); err != nil {
+		return err
+	}
 	return os.RemoveAll(l.Dir)
 }
 
+// Config.Segment.IndexDirに置いた、このログのindexとtimeindexを消す。閉じてから呼ぶこと。
+// IndexDirは他のログと共有していることもあるので、ディレクトリごとは消さない
+func (l *Log) removeIndexFiles() error {
+	if l.Config.Segment.IndexDir == "" {
+		return nil
+	}
+	var paths []string
+	for _, s := range l.segments {
+		paths = append(paths, s.path(".index"), s.path(".timeindex"))
+	}
+	// 途中で失敗したコンパクションの残りも消す
+	dir, indexDir := l.compactDirs()
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if path.Ext(name) != ".store" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(name, ".store"), 10, 0)
+		if err != nil {
+			continue
+		}
+		paths = append(paths,
+			segmentPath(dir, indexDir, off, ".index"),
+			segmentPath(dir, indexDir, off, ".timeindex"),
+		)
+	}
+	for _, name := range paths {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// 他のログのファイルが残っていれば消えない
+	os.Remove(indexDir)
+	return nil
+}
+
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	// Removeでディレクトリごと消えるので作り直し、閉じたsegmentは忘れる
+	if err := os.MkdirAll(l.Dir, l.Config.dirMode()); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
 	return l.setup()
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	return l.lowestOffset(), nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -166,6 +915,13 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return l.highestOffset()
 }
 
+// 次に書き込まれるオフセット
+func (l *Log) NextOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset, nil
+}
+
 func (l *Log) highestOffset() (uint64, error) {
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
@@ -174,14 +930,19 @@ func (l *Log) highestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// 最大オフセットがlowest以下のsegmentを削除する。チェックポイントを済ませた消費者が、明示的に容量を空けるために使う。
+// アクティブなsegmentは書き込みを続けるために残すので、lowestがそれより大きくても削除しない
 func (l *Log) Truncate(lowest uint64) error {
 	// 最大オフセットが、引数のlowestよりも小さいsegmentを削除する
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return err
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -190,37 +951,191 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.resetSize()
 	return nil
 }
 
-// ログ全体を読み込むio.Readerを返す
+// 読み込み時にindexを修復した回数
+func (l *Log) ReadRepairs() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var n uint64
+	for _, s := range l.segments {
+		n += atomic.LoadUint64(&s.repairs)
+	}
+	return n
+}
+
+// ディスク上のstoreとindexの合計サイズ
+func (l *Log) Size() uint64 {
+	return atomic.LoadUint64(&l.bytes)
+}
+
+// アクティブでないsegmentを数え直し、合計バイト数を更新する。segmentの並びを変えたら呼ぶこと。l.muを取っておくこと
+func (l *Log) resetSize() {
+	l.sealedBytes = 0
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			l.sealedBytes += s.size()
+		}
+	}
+	l.updateSize()
+}
+
+// アクティブなsegmentに書き込んだ後に、合計バイト数を更新する。l.muを取っておくこと
+func (l *Log) updateSize() {
+	size := l.sealedBytes
+	if l.activeSegment != nil {
+		size += l.activeSegment.size()
+	}
+	old := atomic.LoadUint64(&l.bytes)
+	if l.quota != nil {
+		l.quota.add(old, size)
+	}
+	for _, b := range l.budgets {
+		b.add(old, size)
+	}
+	atomic.StoreUint64(&l.bytes, size)
+}
+
+// アクティブでない最古のsegmentを削除する。削除できるsegmentがなければfalseを返す
+func (l *Log) removeOldestSegment() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.segments) < 2 {
+		return false, nil
+	}
+	if err := l.segments[0].Remove(); err != nil {
+		return false, err
+	}
+	l.segments = l.segments[1:]
+	l.resetSize()
+	return true, nil
+}
+
+// ログ全体を読み込むio.Readerを返す。各segmentのstoreを古い順につなげたもので、レコードのデコードは行わない。
+// 呼び出した時点の内容までを読み、その後に書き込まれたレコードは含まないので、スナップショットの途中で書き込まれても一貫している。
+// DeleteRecordsで読めなくしたレコードは含まない
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+	lowest := l.lowestOffset()
+	var readers []io.Reader
+	for _, segment := range l.segments {
+		if segment.nextOffset <= lowest && segment != l.activeSegment {
+			continue
+		}
+		if err := segment.open(); err != nil {
+			return &errReader{err}
+		}
+		start := segment.store.start
+		if lowest > segment.baseOffset {
+			// 開始オフセットより前のレコードは、segmentに残っていても含めない
+			var err error
+			if start, err = segment.rawEnd(lowest - 1); err != nil {
+				return &errReader{err}
+			}
+		}
+		readers = append(readers, segment.store.frames(start, segment.store.size))
 	}
 	return io.MultiReader(readers...)
 }
 
-type originReader struct {
-	*store
-	off int64
+type errReader struct {
+	err error
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// 既存のsegmentを、Config.OpenConcurrencyの数のゴルーチンで並行して開く。
+// indexの検証や末尾の修復、封印のためのブルームフィルタの作成はsegmentごとに独立しているので、
+// segmentが多いログでも起動にかかる時間を抑えられる。最後のsegmentがローカルにあれば、アクティブなsegmentにする
+func (l *Log) openSegments(baseOffsets []uint64, tiered map[uint64]bool, lazy int) error {
+	segments := make([]*segment, len(baseOffsets))
+	errs := make([]error, len(baseOffsets))
+	open := func(i int) {
+		off := baseOffsets[i]
+		switch {
+		case tiered[off]:
+			segments[i], errs[i] = newTieredSegment(l.Dir, off, l.Config)
+			if errs[i] == nil {
+				segments[i].cache = l.cache
+			}
+		case i < lazy:
+			segments[i], errs[i] = newLazySegment(l.Dir, off, baseOffsets[i+1], l.Config)
+		default:
+			s, err := newSegment(l.Dir, off, l.Config)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			s.stats = l.stats
+			segments[i] = s
+			if i < len(baseOffsets)-1 {
+				errs[i] = s.seal()
+			}
+		}
+	}
+
+	workers := l.Config.OpenConcurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(baseOffsets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				open(i)
+			}
+		}()
+	}
+	for i := range baseOffsets {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		for _, s := range segments {
+			if s != nil {
+				s.Close()
+			}
+		}
+		return err
+	}
+	l.segments = append(l.segments, segments...)
+	if n := len(baseOffsets); n > 0 && !tiered[baseOffsets[n-1]] {
+		l.activeSegment = segments[n-1]
+	}
+	return nil
 }
 
 func (l *Log) newSegment(off uint64) error {
+	// 封印するsegmentのバッファは、これ以降の書き出しの機会が無いのでここで書き出し、fsyncしてコミット済みにする
+	if l.activeSegment != nil {
+		if err := l.activeSegment.syncStore(); err != nil {
+			return err
+		}
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	s.stats = l.stats
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
-	return nil
+	l.resetSize()
+	// 封印したsegmentまでのproducerの状態を書き出し、開くときに封印済みのsegmentを読まずに済むようにする
+	return l.saveProducers()
 }
@@ -1,13 +1,21 @@
 package log
 
 import (
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "proglog/api/v1"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -20,6 +28,15 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"stat":                              testStat,
+		"roll":                              testRoll,
+		"rotate segments":                   testRotate,
+		"truncate keeps the active segment": testTruncateActive,
+		"append batch":                      testAppendBatch,
+		"reader is a snapshot":              testReaderSnapshot,
+		"read by time":                      testReadByTime,
+		"keys and headers survive reopen":   testHeaders,
+		"read into reuses the record":       testReadInto,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -51,6 +68,59 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.NoError(t, log.Close())
 }
 
+// キーとヘッダーが保存され、開き直した後も書き込んだ順に読めることを確認
+func testHeaders(t *testing.T, o *Log) {
+	record := &api.Record{
+		Key:   []byte("user"),
+		Value: []byte("hello world"),
+		Headers: []*api.Header{
+			{Key: "trace", Value: []byte("1")},
+			{Key: "content-type", Value: []byte("text/plain")},
+			{Key: "trace", Value: []byte("2")},
+		},
+	}
+	off, err := o.Append(record)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, record.Key, read.Key)
+	require.Len(t, read.Headers, len(record.Headers))
+	for i, h := range record.Headers {
+		require.True(t, proto.Equal(h, read.Headers[i]))
+	}
+}
+
+// ReadIntoで同じRecordを使い回しても、前に読んだレコードの内容が残らないことを確認
+func testReadInto(t *testing.T, log *Log) {
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("first"), Headers: []*api.Header{{Key: "h", Value: []byte("1")}}},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	record := &api.Record{}
+	for off := range records {
+		require.NoError(t, log.ReadInto(uint64(off), record))
+		want, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, record))
+	}
+	require.Nil(t, record.Key)
+	require.Nil(t, record.Headers)
+
+	err := log.ReadInto(uint64(len(records)), record)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(len(records))}, err)
+	require.NoError(t, log.Close())
+}
+
 // ログに保存されている範囲外のオフセットを読み取ろうとするとエラーなことを確認
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
@@ -103,7 +173,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[frameWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 	require.NoError(t, log.Close())
@@ -126,3 +196,711 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+// 全オフセットを超えてTruncateしても、アクティブなsegmentは残って書き込みを続けられるかのテスト
+func testTruncateActive(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Truncate(10))
+	_, err := log.Read(1)
+	require.Error(t, err)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+}
+
+// 値を返さずに、正しいサイズと時刻、格納場所を返せるかのテスト
+func testStat(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	append.Offset = 2
+	p, err := proto.Marshal(append)
+	require.NoError(t, err)
+
+	stat, err := log.Stat(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stat.Offset)
+	require.Equal(t, uint64(len(p)), stat.Size)
+	require.Equal(t, uint64(len(p)), stat.StoredSize)
+	require.Equal(t, frameWidth+uint64(len(p))+entWidth, stat.DiskSize)
+	require.Equal(t, time.Unix(0, append.Timestamp), stat.Timestamp)
+	require.Equal(t, crc32.Checksum(p, castagnoli), stat.Checksum)
+	require.Equal(t, log.activeSegment.baseOffset, stat.BaseOffset)
+
+	_, err = log.Stat(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.NoError(t, log.Close())
+}
+
+// 起動時には新しいsegmentだけを開き、古いsegmentは読み込まれたときに開くことを確認
+// indexファイルが無くなっても壊れていても、storeから作り直してすべてのレコードを読めることを確認。
+// 古いsegmentは遅延して開くので、そちらでも作り直される
+func TestLogRebuildIndex(t *testing.T) {
+	for scenario, damage := range map[string]func(t *testing.T, name string){
+		"missing index": func(t *testing.T, name string) {
+			require.NoError(t, os.Remove(name))
+		},
+		"corrupt index": func(t *testing.T, name string) {
+			b, err := os.ReadFile(name)
+			require.NoError(t, err)
+			for i := range b {
+				b[i] = 0xff
+			}
+			require.NoError(t, os.WriteFile(name, b, 0600))
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-rebuild-index-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			c.MaxRecoverySegments = 1
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 8; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Close())
+
+			names, err := filepath.Glob(filepath.Join(dir, "*.index"))
+			require.NoError(t, err)
+			require.Len(t, names, 3)
+			for _, name := range names {
+				damage(t, name)
+			}
+
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := uint64(0); i < 8; i++ {
+				got, err := log.Read(i)
+				require.NoError(t, err)
+				require.Equal(t, i, got.Offset)
+				require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+			}
+			off, err := log.Append(&api.Record{Value: []byte("record 8")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(8), off)
+		})
+	}
+}
+
+// MmapSealedなら、封印したsegmentと、後から開いた古いsegmentのstoreがマップされることを確認
+func TestLogMmapSealed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-mmap-sealed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.MmapSealed = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+	require.NotNil(t, log.segments[0].store.mmap)
+	require.NotNil(t, log.segments[1].store.mmap)
+	require.Nil(t, log.activeSegment.store.mmap)
+	for i := uint64(0); i < 5; i++ {
+		got, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+	require.NoError(t, log.Close())
+
+	c.MaxRecoverySegments = 1
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), got.Value)
+	require.NotNil(t, log.segments[0].store.mmap)
+	require.Nil(t, log.activeSegment.store.mmap)
+}
+
+func TestLogMaxRecoverySegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth
+
+	// 1レコードずつのsegmentを1000個作る
+	for i := uint64(0); i < 1000; i++ {
+		s, err := newSegment(dir, i, c)
+		require.NoError(t, err)
+		_, err = s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+	}
+
+	var opened int32
+	c.MaxRecoverySegments = 10
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		if filepath.Ext(name) == ".store" {
+			atomic.AddInt32(&opened, 1)
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, int32(10), atomic.LoadInt32(&opened))
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(999), off)
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, int32(10), atomic.LoadInt32(&opened))
+
+	// 古いオフセットは、読み込んだときにsegmentが開かれる
+	record, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 5"), record.Value)
+	require.Equal(t, int32(11), atomic.LoadInt32(&opened))
+
+	_, err = log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, int32(11), atomic.LoadInt32(&opened))
+	require.NoError(t, log.Close())
+}
+
+// Rollした後の書き込みは、新しいsegmentに入ることを確認
+func testRoll(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello"),
+	}
+	_, err := log.Append(append)
+	require.NoError(t, err)
+	require.False(t, log.activeSegment.IsMaxed())
+
+	base, err := log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+	require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+
+	// 空のsegmentでRollしても、新しいsegmentは作らない
+	base, err = log.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+	require.Len(t, log.segments, 2)
+
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(2), log.activeSegment.nextOffset)
+
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+	require.NoError(t, log.Close())
+}
+
+// コミット待ちが上限に達すると再送を促すエラーを返し、待ちが捌けると書き込めるようになることを確認
+func TestLogMaxPendingCommits(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-backpressure-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxPendingCommits = 2
+	c.Segment.Flush.GroupCommit = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+
+	// ロックを取っておき、書き込みをコミット待ちのまま止める
+	log.mu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.Append(&api.Record{Value: []byte("pending")})
+			require.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&log.pending) == 2
+	}, time.Second, time.Millisecond)
+
+	_, err = log.Append(record)
+	require.Equal(t, api.ErrBackpressure{Pending: 2}, err)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	log.mu.Unlock()
+	wg.Wait()
+
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+// GroupCommitでなければfsyncを待たないので、コミット待ちが一杯でも書き込めることを確認
+func TestLogMaxPendingCommitsNonDurable(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-backpressure-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxPendingCommits = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	atomic.StoreInt64(&log.pending, 1)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	first, last, err := log.AppendBatch([]*api.Record{
+		{Value: []byte("hello")},
+		{Value: []byte("world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(2), last)
+	require.Equal(t, int64(1), atomic.LoadInt64(&log.pending))
+}
+
+// BackgroundかIntervalを設定すると、読み書きしなくてもバッファにあるレコードがファイルに書き出され、Closeで止まることを確認
+func TestLogBackgroundFlush(t *testing.T) {
+	for scenario, set := range map[string]func(c *FlushConfig){
+		"background": func(c *FlushConfig) { c.Background = 10 * time.Millisecond },
+		"interval":   func(c *FlushConfig) { c.Interval = 10 * time.Millisecond },
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-background-flush-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			set(&c.Segment.Flush)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			name := log.activeSegment.store.Name()
+			fi, err := os.Stat(name)
+			require.NoError(t, err)
+			empty := fi.Size()
+			_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Eventually(t, func() bool {
+				fi, err := os.Stat(name)
+				return err == nil && fi.Size() > empty
+			}, time.Second, 5*time.Millisecond)
+
+			require.NoError(t, log.Close())
+			// Closeの後は書き出しのゴルーチンが残っていない
+			log.background.Wait()
+		})
+	}
+}
+
+// fsyncが終わるまで待つstoreのファイル
+type blockingSyncFile struct {
+	File
+	syncing chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingSyncFile) Sync() error {
+	f.syncing <- struct{}{}
+	<-f.release
+	return f.File.Sync()
+}
+
+// 書き出しのfsyncはLogのロックの外で行い、fsyncしている間も書き込めることを確認
+func TestLogBackgroundFlushSyncsOutsideLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-background-flush-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	c := Config{}
+	c.Segment.HideUncommitted = true
+	c.FileOpener = func(name string, flag int, perm os.FileMode) (File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil || filepath.Ext(name) != ".store" {
+			return f, err
+		}
+		return &blockingSyncFile{File: f, syncing: syncing, release: release}, nil
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	flushed := make(chan error, 1)
+	go func() { flushed <- log.flushActive(true) }()
+	<-syncing
+
+	// fsyncを止めている間も、書き込みと読み込みはロックを待たない
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	committed, err := log.CommittedOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), committed)
+
+	close(release)
+	require.NoError(t, <-flushed)
+	// fsyncを始めたときまでのレコードだけがコミット済みになる
+	committed, err = log.CommittedOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), committed)
+	go func() {
+		for range syncing {
+		}
+	}()
+	require.NoError(t, log.Close())
+	close(syncing)
+}
+
+// 上限を超えるレコードは、storeに何も書き込まずにErrRecordTooLargeで拒否されることを確認
+func TestLogMaxRecordBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-max-record-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxRecordBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	small := &api.Record{Value: make([]byte, 32)}
+	large := &api.Record{Value: make([]byte, 64)}
+	_, err = log.Append(small)
+	require.NoError(t, err)
+	size := log.Size()
+
+	_, err = log.Append(large)
+	var tooLarge api.ErrRecordTooLarge
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, uint64(64), tooLarge.Max)
+	require.Equal(t, uint64(proto.Size(large)), tooLarge.Size)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// バッチは一部だけ書き込むこともしない
+	_, _, err = log.AppendBatch([]*api.Record{small, large})
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, size, log.Size())
+
+	off, err := log.Append(small)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// segmentが上限に達すると新しいsegmentに切り替わり、どのオフセットも正しいsegmentから読めることを確認
+func testRotate(t *testing.T, log *Log) {
+	for i := 0; i < 10; i++ {
+		off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: 1})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	// MaxStoreBytesが32なので、2レコードごとにsegmentが切り替わる
+	require.Len(t, log.segments, 5)
+
+	for i := 9; i >= 0; i-- {
+		got, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+	_, err := log.Read(10)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 10}, err)
+	require.NoError(t, log.Close())
+}
+
+// 複数のレコードをまとめて書き込み、segmentをまたいでも連番のオフセットで読めるかのテスト
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	first, last, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(5), last)
+	// MaxStoreBytesが32なので、途中で新しいsegmentに切り替わっている
+	require.Greater(t, len(log.segments), 1)
+
+	for i, record := range records {
+		got, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+		require.Equal(t, first+uint64(i), got.Offset)
+	}
+
+	off, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	_, _, err = log.AppendBatch(nil)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+}
+
+// Readerは呼び出した時点までのレコードだけを、segmentをまたいで順に読めるかのテスト
+func testReaderSnapshot(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	_, err := log.Append(&api.Record{Value: []byte("after reader")})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		p, err := readFrame(reader)
+		require.NoError(t, err)
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(p, got))
+		require.Equal(t, uint64(i), got.Offset)
+	}
+	_, err = readFrame(reader)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, log.Close())
+}
+
+// 時刻を指定すると、その時刻以降に書き込まれた最初のレコードが読めることを確認。
+// segmentをまたいでも、開き直しても、timeindexが消えていても同じ結果になる
+func testReadByTime(t *testing.T, log *Log) {
+	for i, ts := range []int64{10, 20, 20, 30, 40, 50} {
+		off, err := log.Append(&api.Record{Value: []byte("hello"), Timestamp: ts})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	check := func(log *Log) {
+		for ts, want := range map[int64]uint64{0: 0, 10: 0, 20: 1, 25: 3, 50: 5} {
+			record, err := log.ReadByTime(time.Unix(0, ts))
+			require.NoError(t, err)
+			require.Equal(t, want, record.Offset)
+		}
+		_, err := log.ReadByTime(time.Unix(0, 51))
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+		off, err := log.OffsetForTime(time.Unix(0, 35))
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), off)
+		for off, ts := range []int64{10, 20, 20, 30, 40, 50} {
+			got, err := log.TimeForOffset(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, time.Unix(0, ts), got)
+		}
+		_, err = log.TimeForOffset(6)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+	}
+	check(log)
+
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	check(log)
+
+	require.NoError(t, log.Close())
+	names, err := filepath.Glob(filepath.Join(log.Dir, "*.timeindex"))
+	require.NoError(t, err)
+	require.NotEmpty(t, names)
+	for _, name := range names {
+		require.NoError(t, os.Remove(name))
+	}
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+}
+
+// AppendAtomicのバッチが一つのsegmentに書き込まれ、途中までしか書かれずに落ちた場合は、開き直すとバッチごと取り除かれることを確認
+func TestLogAppendAtomic(t *testing.T) {
+	dir, err := os.MkdirTemp("", "append-atomic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	batch := func(n int) []*api.Record {
+		var records []*api.Record
+		for i := 0; i < n; i++ {
+			records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		}
+		return records
+	}
+	_, err = log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	// アクティブなsegmentには残り3レコードしか入らないので、新しいsegmentに書き込む
+	first, last, err := log.AppendAtomic(batch(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(4), last)
+	require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+	_, _, err = log.AppendAtomic(batch(5))
+	require.Error(t, err)
+
+	first, last, err = log.AppendAtomic(batch(3))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+	require.Equal(t, uint64(7), last)
+	got, err := log.Read(7)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), got.BatchRemaining)
+	require.NoError(t, log.Close())
+
+	// 最後のバッチの、最後のレコードの途中で落ちたことにする
+	name := filepath.Join(dir, "5.store")
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, fi.Size()-3))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), next)
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+	got, err = log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 3"), got.Value)
+
+	off, err := log.Append(&api.Record{Value: []byte("after"), BatchRemaining: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	got, err = log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), got.BatchRemaining)
+}
+
+// RollIntervalの区間が変わった後の書き込みは、大きさの上限に達していなくても新しいsegmentに入ることを確認
+func TestLogRollInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-roll-interval-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.RollInterval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// レコードの時刻が前の区間でも、書き込んだ時刻の区間で決めるので切り替えない
+	old := time.Now().Add(-time.Hour).UnixNano()
+	_, err = log.Append(&api.Record{Value: []byte("old"), Timestamp: old})
+	require.NoError(t, err)
+	require.False(t, log.activeSegment.IsMaxed())
+	require.Equal(t, uint64(0), log.activeSegment.baseOffset)
+	// 前の区間に書き込んだことにする
+	log.activeSegment.created = time.Now().Add(-time.Hour)
+
+	for i := uint64(1); i < 4; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("new")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		// 同じ区間の書き込みは同じsegmentに入る
+		require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+	}
+	require.Len(t, log.segments, 2)
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), got.Value)
+}
+
+// 並行して開いても、segmentが順に並び、封印済みのsegmentと最後のアクティブなsegmentが元通りになることを確認
+func TestLogOpenConcurrency(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-open-concurrency-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 41; i++ {
+		_, err := log.Append(&api.Record{Key: []byte(fmt.Sprintf("key %d", i)), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 21)
+	require.NoError(t, log.Close())
+
+	for _, workers := range []int{1, 8} {
+		c.OpenConcurrency = workers
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		require.Len(t, log.segments, 21)
+		for i, s := range log.segments {
+			require.Equal(t, uint64(i*2), s.baseOffset)
+			require.Equal(t, i < 20, s.sealed)
+		}
+		require.Equal(t, log.segments[20], log.activeSegment)
+		for i := 0; i < 41; i++ {
+			record, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+		}
+		record, err := log.ReadKey([]byte("key 7"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(7), record.Offset)
+		next, err := log.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(41), next)
+		require.NoError(t, log.Close())
+	}
+}
+
+// TimeForOffsetはtimeindexから求めるので、時刻が戻ったレコードにはそれまでで最も新しい時刻を返すことを確認
+func TestLogTimeForOffsetUsesTimeIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-time-for-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	for _, ts := range []int64{10, 30, 20, 40} {
+		_, err := log.Append(&api.Record{Value: []byte("hello"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	for off, want := range []int64{10, 30, 30, 40} {
+		got, err := log.TimeForOffset(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, time.Unix(0, want), got)
+	}
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	api "proglog/api/v1"
+)
+
+// ログの開始オフセットは、DeleteRecordsで進めた、読めるレコードの最小のオフセット。
+// 開始オフセットより前のレコードしか無いsegmentは削除し、途中までのsegmentは残したまま、それより前のレコードを読めなくする。
+// 再起動しても戻らないよう、ログのディレクトリに書き出しておく
+
+// 開始オフセットを書き出すファイルの名前。8バイトのオフセットだけを持つ
+const startOffsetFile = "start.offset"
+
+// オフセットがbeforeより小さいレコードを削除し、新しい最小のオフセットを返す。
+// チェックポイントを済ませた下流の消費者が、プログラムから容量を空けるために使う。
+// beforeは次に書き込まれるオフセットまでで、今の最小のオフセット以下なら何もしない
+func (l *Log) DeleteRecords(before uint64) (lowest uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return 0, err
+	}
+	if before > l.activeSegment.nextOffset {
+		return 0, api.ErrOffsetOutOfRange{Offset: before}
+	}
+	if lowest := l.lowestOffset(); before <= lowest {
+		return lowest, nil
+	}
+	// segmentを消している途中で落ちても、再起動後に消したはずのレコードが見えないよう、先に書き出す
+	b := make([]byte, 8)
+	enc.PutUint64(b, before)
+	if err := writeFileAtomic(filepath.Join(l.Dir, startOffsetFile), bytes.NewReader(b), l.Config.fileMode()); err != nil {
+		return 0, err
+	}
+	l.startOffset = before
+
+	var segments []*segment
+	for i, s := range l.segments {
+		if s.nextOffset <= before && s != l.activeSegment {
+			if err := s.Remove(); err != nil {
+				l.segments = append(segments, l.segments[i:]...)
+				l.resetSize()
+				return 0, err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.resetSize()
+	return before, nil
+}
+
+// 読めるレコードの最小のオフセット。呼び出し側でロックを取っておくこと
+func (l *Log) lowestOffset() uint64 {
+	if lowest := l.segments[0].baseOffset; lowest > l.startOffset {
+		return lowest
+	}
+	return l.startOffset
+}
+
+// 書き出しておいた開始オフセットを読む。DeleteRecordsを呼んだことが無ければ0
+func (l *Log) loadStartOffset() error {
+	b, err := os.ReadFile(filepath.Join(l.Dir, startOffsetFile))
+	if os.IsNotExist(err) {
+		l.startOffset = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) != 8 {
+		return fmt.Errorf("%s is %d bytes, want 8", startOffsetFile, len(b))
+	}
+	l.startOffset = enc.Uint64(b)
+	return nil
+}
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// DeleteRecordsで、前のsegmentが消え、途中のsegmentでは開始オフセットより前のレコードが読めなくなり、
+// 開き直しても開始オフセットが戻らないことを確認
+func TestLogDeleteRecords(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-delete-records-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{Key: []byte("key"), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	_, err = log.DeleteRecords(9)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 9}, err)
+	lowest, err := log.DeleteRecords(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	// 0から2のsegmentは消え、3から5のsegmentは残る
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(3), log.segments[0].baseOffset)
+	// 戻すことはできない
+	lowest, err = log.DeleteRecords(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+
+	check := func(log *Log) {
+		t.Helper()
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), lowest)
+		_, err = log.Read(3)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+		record, err := log.Read(4)
+		require.NoError(t, err)
+		require.Equal(t, []byte("record 4"), record.Value)
+
+		it, err := log.Scan(4)
+		require.NoError(t, err)
+		require.True(t, it.Next())
+		require.Equal(t, uint64(4), it.Record().Offset)
+		_, err = log.Scan(3)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+		// raftのスナップショットに使うReaderも、開始オフセットから読む
+		p, err := readFrame(log.Reader())
+		require.NoError(t, err)
+		first := &api.Record{}
+		require.NoError(t, proto.Unmarshal(p, first))
+		require.Equal(t, uint64(4), first.Offset)
+	}
+	check(log)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+
+	// すべて消しても、書き込みは続けられる
+	lowest, err = log.DeleteRecords(8)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), lowest)
+	_, err = log.ReadKey([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	off, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+}
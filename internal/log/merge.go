@@ -0,0 +1,88 @@
+package log
+
+import (
+	"errors"
+
+	api "proglog/api/v1"
+)
+
+// マージは、リテンションやTruncateの後に残った小さな封印済みsegmentを、隣り合うもの同士で一つにまとめる。
+// レコードのオフセットは変わらず、segmentの数とファイルディスクリプタの数を抑える
+
+// Config.Compaction.MergeBelowBytesに従って小さな封印済みsegmentをまとめ、減ったsegmentの数を返す
+func (l *Log) Merge() (merged int, err error) {
+	threshold := l.Config.Compaction.MergeBelowBytes
+	if threshold == 0 {
+		return 0, nil
+	}
+	if l.Config.readOnly {
+		return 0, ErrReadOnly
+	}
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	groups := l.planMerge(threshold)
+	l.mu.RUnlock()
+
+	for _, group := range groups {
+		// 組み立てている間も読み込みは続けられ、Truncateなどでgroupが消されないように読み込みロックを取る
+		l.mu.RLock()
+		// まとめたsegmentには、まとめるすべてのsegmentにあった印だけを付ける
+		flags := bloomFlagMask
+		for _, s := range group {
+			f, err := s.bloomFlags()
+			if err != nil {
+				l.mu.RUnlock()
+				return merged, err
+			}
+			flags &= f
+		}
+		m, err := l.rewriteSegments(group, func(*api.Record) bool { return true }, flags)
+		l.mu.RUnlock()
+		if err != nil {
+			return merged, err
+		}
+		if err := l.replaceSegments(group, m); err != nil {
+			if errors.Is(err, errRemoveReplaced) {
+				// 置き換え自体は済んでいる
+				merged += len(group) - 1
+			}
+			return merged, err
+		}
+		merged += len(group) - 1
+	}
+	return merged, nil
+}
+
+// まとめる封印済みsegmentの組を、古い方から選ぶ。まとめたindexがMaxIndexBytesに収まる範囲に限る。
+// 呼び出し側でロックを取っておくこと
+func (l *Log) planMerge(threshold uint64) [][]*segment {
+	var groups [][]*segment
+	var group []*segment
+	var size, indexSize uint64
+	flush := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group, size, indexSize = nil, 0, 0
+	}
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		n := s.size()
+		if n >= threshold {
+			flush()
+			continue
+		}
+		if size+n > threshold || indexSize+s.indexSize() > l.Config.Segment.MaxIndexBytes {
+			flush()
+		}
+		group = append(group, s)
+		size += n
+		indexSize += s.indexSize()
+	}
+	flush()
+	return groups
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 小さな封印済みsegmentが隣り合うもの同士でまとめられ、オフセットを変えずに読めることを確認
+func TestMerge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "merge-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: int64(i + 1)})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 5)
+
+	// しきい値が無ければまとめない
+	merged, err := log.Merge()
+	require.NoError(t, err)
+	require.Equal(t, 0, merged)
+
+	// 2つずつまとまる。アクティブなsegmentはまとめない
+	log.Config.Compaction.MergeBelowBytes = log.segments[1].size() * 2
+	merged, err = log.Merge()
+	require.NoError(t, err)
+	require.Equal(t, 2, merged)
+	require.Len(t, log.segments, 3)
+	require.Equal(t, []uint64{0, 4, 8}, []uint64{
+		log.segments[0].baseOffset,
+		log.segments[1].baseOffset,
+		log.segments[2].baseOffset,
+	})
+
+	check := func(log *Log) {
+		for i := uint64(0); i < 10; i++ {
+			got, err := log.Read(i)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+		}
+		got, err := log.ReadByTime(time.Unix(0, 4))
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), got.Offset)
+	}
+	check(log)
+
+	// まとめ終わったsegmentは、もうまとめられない
+	merged, err = log.Merge()
+	require.NoError(t, err)
+	require.Equal(t, 0, merged)
+
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	require.Len(t, stores, 3)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 3)
+	check(log)
+}
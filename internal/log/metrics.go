@@ -0,0 +1,149 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Logの動作を数えるカウンター。32bit環境でのアトミック操作のため、Logとは別に確保する
+type logStats struct {
+	appends       uint64
+	appendedBytes uint64
+	reads         uint64
+	flushes       uint64
+	rolls         uint64
+	groupCommits  uint64
+	// スクラブで読んだバイト数とsegmentの数、壊れたレコードが見つかったsegmentの数
+	scrubbedBytes    uint64
+	scrubbedSegments uint64
+	corruptSegments  uint64
+}
+
+// segmentから書き出しを数える。コンパクションなどでLogを介さずに作ったsegmentはnilのまま使うので、nilなら数えない
+func (s *logStats) flushed() {
+	if s != nil {
+		atomic.AddUint64(&s.flushes, 1)
+	}
+}
+
+// Logの統計のスナップショット。カウンターはNewLogからの累計で、SegmentsとBytesはその時点の値
+type Stats struct {
+	// 書き込んだレコードの数と、エンコードしたレコードの合計バイト数
+	Appends       uint64
+	AppendedBytes uint64
+	// ReadとReadIntoで読んだレコードの数
+	Reads uint64
+	// アクティブなsegmentのバッファをファイルに書き出した回数
+	Flushes uint64
+	// アクティブなsegmentを封印して、新しいsegmentに切り替えた回数
+	Rolls uint64
+	// グループコミットでfsyncした回数
+	GroupCommits uint64
+	// スクラブで読み直したバイト数とsegmentの数、壊れたレコードが見つかったsegmentの数
+	ScrubbedBytes    uint64
+	ScrubbedSegments uint64
+	CorruptSegments  uint64
+	// segmentの数と、storeとindexの合計バイト数
+	Segments int
+	Bytes    uint64
+	// segmentごとの内訳。baseOffsetの昇順
+	SegmentDetails []SegmentStats
+}
+
+// segmentごとの統計
+type SegmentStats struct {
+	BaseOffset uint64
+	// 次のsegmentのbaseOffset。このsegmentにあるオフセットは、これより小さい
+	NextOffset uint64
+	StoreBytes uint64
+	IndexBytes uint64
+	// indexのエントリの数。まだ開いていないsegmentは0
+	IndexEntries uint64
+	// 最初のレコードの時刻と、最後にレコードを書き込んだ時刻。まだ開いていないsegmentのCreatedはゼロ値
+	Created  time.Time
+	Modified time.Time
+	// 封印済みか、アクティブなsegmentか
+	Sealed bool
+	Active bool
+	// ObjectStoreに移したsegmentか、起動時に開かずに最初に読まれるのを待っているsegmentか
+	Tiered bool
+	Lazy   bool
+}
+
+func (s *segment) segmentStats() SegmentStats {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	stats := SegmentStats{
+		BaseOffset: s.baseOffset,
+		NextOffset: s.nextOffset,
+		Modified:   s.modTime,
+		Sealed:     s.sealed,
+		Tiered:     s.tiered,
+		Lazy:       s.lazy,
+	}
+	if s.lazy {
+		stats.StoreBytes, stats.IndexBytes = s.lazyStoreSize, s.lazyIndexSize
+		return stats
+	}
+	stats.StoreBytes, stats.IndexBytes = s.store.size, s.index.size
+	stats.IndexEntries = s.index.count()
+	if entries := s.timeIndex.entries; len(entries) > 0 {
+		stats.Created = time.Unix(0, entries[0].timestamp)
+	}
+	return stats
+}
+
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	details := make([]SegmentStats, 0, len(l.segments))
+	var bytes uint64
+	for _, s := range l.segments {
+		stats := s.segmentStats()
+		stats.Active = s == l.activeSegment
+		bytes += stats.StoreBytes + stats.IndexBytes
+		details = append(details, stats)
+	}
+	l.mu.RUnlock()
+	return Stats{
+		Appends:          atomic.LoadUint64(&l.stats.appends),
+		AppendedBytes:    atomic.LoadUint64(&l.stats.appendedBytes),
+		Reads:            atomic.LoadUint64(&l.stats.reads),
+		Flushes:          atomic.LoadUint64(&l.stats.flushes),
+		Rolls:            atomic.LoadUint64(&l.stats.rolls),
+		GroupCommits:     atomic.LoadUint64(&l.stats.groupCommits),
+		ScrubbedBytes:    atomic.LoadUint64(&l.stats.scrubbedBytes),
+		ScrubbedSegments: atomic.LoadUint64(&l.stats.scrubbedSegments),
+		CorruptSegments:  atomic.LoadUint64(&l.stats.corruptSegments),
+		Segments:         len(details),
+		Bytes:            bytes,
+		SegmentDetails:   details,
+	}
+}
+
+// Prometheusのテキスト形式で書き出す
+func (s Stats) WritePrometheus(w io.Writer) error {
+	for _, m := range []struct {
+		name  string
+		typ   string
+		value uint64
+	}{
+		{"proglog_appends_total", "counter", s.Appends},
+		{"proglog_appended_bytes_total", "counter", s.AppendedBytes},
+		{"proglog_reads_total", "counter", s.Reads},
+		{"proglog_flushes_total", "counter", s.Flushes},
+		{"proglog_segment_rolls_total", "counter", s.Rolls},
+		{"proglog_group_commits_total", "counter", s.GroupCommits},
+		{"proglog_scrubbed_bytes_total", "counter", s.ScrubbedBytes},
+		{"proglog_scrubbed_segments_total", "counter", s.ScrubbedSegments},
+		{"proglog_corrupt_segments_total", "counter", s.CorruptSegments},
+		{"proglog_segments", "gauge", uint64(s.Segments)},
+		{"proglog_log_bytes", "gauge", s.Bytes},
+	} {
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s %d\n", m.name, m.typ, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
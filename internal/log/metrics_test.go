@@ -0,0 +1,73 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// 書き込み、読み込み、書き出し、segmentの切り替えが数えられ、Prometheusの形式で書き出せることを確認
+func TestLogStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-stats-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+	var size uint64
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+		size += uint64(proto.Size(record))
+	}
+	// 書き込んだレコードにはオフセットと時刻が入るので、その後の大きさを数える
+	batch := &api.Record{Value: []byte("batch")}
+	_, _, err = log.AppendBatch([]*api.Record{batch})
+	require.NoError(t, err)
+	size += uint64(proto.Size(batch))
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.ReadInto(1, &api.Record{}))
+	require.NoError(t, log.Sync())
+
+	stats := log.Stats()
+	require.Equal(t, uint64(4), stats.Appends)
+	require.Equal(t, size, stats.AppendedBytes)
+	require.Equal(t, uint64(2), stats.Reads)
+	require.Equal(t, uint64(1), stats.Rolls)
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, log.Size(), stats.Bytes)
+	// segmentを切り替えるときと、Syncのときに書き出す
+	require.Equal(t, uint64(2), stats.Flushes)
+
+	require.Len(t, stats.SegmentDetails, 2)
+	var total uint64
+	for i, d := range stats.SegmentDetails {
+		require.Equal(t, uint64(i*2), d.BaseOffset)
+		require.Equal(t, uint64(i*2+2), d.NextOffset)
+		require.Equal(t, uint64(2), d.IndexEntries)
+		require.Equal(t, i == 0, d.Sealed)
+		require.Equal(t, i == 1, d.Active)
+		require.False(t, d.Created.IsZero())
+		require.False(t, d.Modified.Before(d.Created))
+		total += d.StoreBytes + d.IndexBytes
+	}
+	require.Equal(t, stats.Bytes, total)
+
+	var buf bytes.Buffer
+	require.NoError(t, log.WriteMetrics(&buf))
+	require.Contains(t, buf.String(), "# TYPE proglog_appends_total counter\nproglog_appends_total 4\n")
+	require.Contains(t, buf.String(), "proglog_segments 2\n")
+	// ヒストグラムは有効にしていない
+	require.NotContains(t, buf.String(), recordSizeMetric)
+}
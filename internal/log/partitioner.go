@@ -0,0 +1,38 @@
+package log
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	api "proglog/api/v1"
+)
+
+// Partitionerは、トピックに書き込むレコードのパーティションを、0からpartitions-1の間で選ぶ。
+// 複数のゴルーチンから同時に呼ばれる
+type Partitioner interface {
+	Partition(record *api.Record, partitions int) int
+}
+
+// キーのハッシュ(FNV-1a)でパーティションを選ぶ。同じキーのレコードは同じパーティションに書き込まれるので、
+// キーごとの順序が保たれる。キーの無いレコードは、順番にパーティションへ振り分ける
+type HashPartitioner struct {
+	keyless RoundRobinPartitioner
+}
+
+func (p *HashPartitioner) Partition(record *api.Record, partitions int) int {
+	if len(record.Key) == 0 {
+		return p.keyless.Partition(record, partitions)
+	}
+	h := fnv.New32a()
+	h.Write(record.Key)
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// キーによらず、順番にパーティションへ振り分ける
+type RoundRobinPartitioner struct {
+	next uint64
+}
+
+func (p *RoundRobinPartitioner) Partition(_ *api.Record, partitions int) int {
+	return int((atomic.AddUint64(&p.next, 1) - 1) % uint64(partitions))
+}
@@ -0,0 +1,249 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 冪等な書き込みのため、producerごとに最近書き込んだシーケンス番号の範囲と、そのオフセットを覚えておく。
+// シーケンス番号とオフセットがともに連続するレコードは一つの範囲にまとめ、producerごとに最後のmaxProducerRuns個の範囲を持つので、
+// 再送されたバッチがまとめて書き込まれていれば、途中のレコードからでも重複と判定できる。
+// 覚えておくproducerの数はConfig.MaxProducersまでで、超えたら最も長く書き込んでいないproducerを忘れる。
+// segmentを封印するときとCloseで状態をproducers.snapshotに書き出し、開くときはそれ以降のレコードだけを読んで作り直す。
+// スナップショットの無いログでは開いたsegmentのレコードだけから作り直すので、
+// 遅延して開くsegmentやObjectStoreに移したsegmentにしか無いproducerは、以降の再送を重複と判定できない
+
+// producerの状態を書き出すファイルの名前
+const producerSnapshotFile = "producers.snapshot"
+
+// producerごとに覚えておく範囲の数
+const maxProducerRuns = 5
+
+// Config.MaxProducersが0のときの、覚えておくproducerの数
+const defaultMaxProducers = 10000
+
+// シーケンス番号がFirstSequenceからLastSequenceまでのレコードが、FirstOffsetから続けて書き込まれている
+type producerRun struct {
+	FirstSequence uint64 `json:"first_sequence"`
+	LastSequence  uint64 `json:"last_sequence"`
+	FirstOffset   uint64 `json:"first_offset"`
+}
+
+func (r producerRun) lastOffset() uint64 {
+	return r.FirstOffset + r.LastSequence - r.FirstSequence
+}
+
+type producerState struct {
+	// 古い順
+	runs []producerRun
+}
+
+func (p *producerState) last() producerRun {
+	return p.runs[len(p.runs)-1]
+}
+
+// producers.snapshotの中身
+type producerSnapshot struct {
+	// 状態に含まれる、次に書き込まれるレコードのオフセット
+	NextOffset uint64                   `json:"next_offset"`
+	Producers  map[string][]producerRun `json:"producers"`
+}
+
+// recordが確認応答を受けたレコードの再送であれば、書き込み済みのオフセットとtrueを返す。
+// 覚えている範囲より古いシーケンス番号であればErrStaleSequenceを返す。l.muを取っておくこと
+func (l *Log) duplicateOf(record *api.Record) (uint64, bool, error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok || record.Sequence > p.last().LastSequence {
+		return 0, false, nil
+	}
+	for i := len(p.runs) - 1; i >= 0; i-- {
+		r := p.runs[i]
+		if r.FirstSequence <= record.Sequence && record.Sequence <= r.LastSequence {
+			return r.FirstOffset + record.Sequence - r.FirstSequence, true, nil
+		}
+	}
+	return 0, false, api.ErrStaleSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		Last:       p.last().LastSequence,
+	}
+}
+
+// バッチのうち、再送ではないレコードを返す。再送のレコードのOffsetには、書き込み済みのオフセットを入れる。
+// 同じproducerのシーケンス番号がバッチの中で増えていなかったり、古すぎたりすればErrStaleSequenceを返す。l.muを取っておくこと
+func (l *Log) dedupeBatch(records []*api.Record) ([]*api.Record, error) {
+	fresh := records[:0:0]
+	last := make(map[string]uint64)
+	for _, record := range records {
+		if record.ProducerId == "" {
+			fresh = append(fresh, record)
+			continue
+		}
+		if seq, ok := last[record.ProducerId]; ok && record.Sequence <= seq {
+			return nil, api.ErrStaleSequence{
+				ProducerID: record.ProducerId,
+				Sequence:   record.Sequence,
+				Last:       seq,
+			}
+		}
+		last[record.ProducerId] = record.Sequence
+		off, dup, err := l.duplicateOf(record)
+		if err != nil {
+			return nil, err
+		}
+		if dup {
+			record.Offset = off
+			continue
+		}
+		fresh = append(fresh, record)
+	}
+	return fresh, nil
+}
+
+// 書き込んだrecordのシーケンス番号を覚える。l.muを取っておくこと
+func (l *Log) observeProducer(record *api.Record) {
+	if record.ProducerId == "" {
+		return
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		l.evictProducer()
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	if n := len(p.runs); n > 0 {
+		r := &p.runs[n-1]
+		if record.Sequence <= r.LastSequence {
+			return
+		}
+		if record.Sequence == r.LastSequence+1 && record.Offset == r.lastOffset()+1 {
+			r.LastSequence++
+			return
+		}
+	}
+	p.runs = append(p.runs, producerRun{
+		FirstSequence: record.Sequence,
+		LastSequence:  record.Sequence,
+		FirstOffset:   record.Offset,
+	})
+	if len(p.runs) > maxProducerRuns {
+		p.runs = append(p.runs[:0], p.runs[1:]...)
+	}
+}
+
+// 覚えているproducerが上限に達していれば、最後に書き込んだオフセットが最も古いproducerを忘れる
+func (l *Log) evictProducer() {
+	max := l.Config.MaxProducers
+	if max <= 0 {
+		max = defaultMaxProducers
+	}
+	if len(l.producers) < max {
+		return
+	}
+	var oldest string
+	var oldestOffset uint64
+	first := true
+	for id, p := range l.producers {
+		if off := p.last().lastOffset(); first || off < oldestOffset {
+			oldest, oldestOffset, first = id, off, false
+		}
+	}
+	delete(l.producers, oldest)
+}
+
+// producerごとのシーケンス番号を、スナップショットとその後のレコードから作り直す
+func (l *Log) loadProducers() error {
+	l.producers = make(map[string]*producerState)
+	snapshot, err := l.readProducerSnapshot()
+	if err != nil {
+		return err
+	}
+	// 切り詰めた後など、スナップショットがログより先を含んでいれば使わない
+	var from uint64
+	if snapshot != nil && snapshot.NextOffset <= l.activeSegment.nextOffset {
+		for id, runs := range snapshot.Producers {
+			if len(runs) > 0 {
+				l.producers[id] = &producerState{runs: runs}
+			}
+		}
+		from = snapshot.NextOffset
+	} else {
+		snapshot = nil
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= from {
+			continue
+		}
+		if s.lazy {
+			// スナップショットの後のsegmentは、遅延していても開いて読む
+			if snapshot == nil {
+				continue
+			}
+			if err := s.open(); err != nil {
+				return err
+			}
+		}
+		start, err := s.seek(from)
+		if err != nil {
+			return err
+		}
+		// 値は使わないので、展開せずにフィールドだけを読む
+		if err := s.walk(start, func(_ uint64, p []byte, _ uint64) error {
+			record := &api.Record{}
+			if err := proto.Unmarshal(p, record); err != nil {
+				return err
+			}
+			if record.Offset >= from {
+				l.observeProducer(record)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 書き出しておいたproducerの状態を読む。無ければnil
+func (l *Log) readProducerSnapshot() (*producerSnapshot, error) {
+	b, err := os.ReadFile(filepath.Join(l.Dir, producerSnapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &producerSnapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// 今のproducerの状態を書き出す。l.muを取っておくこと
+func (l *Log) saveProducers() error {
+	if l.Config.readOnly || l.producers == nil {
+		return nil
+	}
+	snapshot := producerSnapshot{
+		NextOffset: l.activeSegment.nextOffset,
+		Producers:  make(map[string][]producerRun, len(l.producers)),
+	}
+	for id, p := range l.producers {
+		snapshot.Producers[id] = p.runs
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(l.Dir, producerSnapshotFile), bytes.NewReader(b), l.Config.fileMode())
+}
@@ -0,0 +1,155 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 同じproducerの同じシーケンス番号の再送は書き込まれずに元のオフセットが返り、開き直しても重複を判定できることを確認
+func TestLogIdempotentProducer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	produce := func(log *Log, producer string, seq uint64) (uint64, error) {
+		return log.Append(&api.Record{Value: []byte("hello"), ProducerId: producer, Sequence: seq})
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		off, err := produce(log, "a", seq)
+		require.NoError(t, err)
+		require.Equal(t, seq-1, off)
+	}
+	off, err := produce(log, "a", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	// 続けて書き込んだ範囲の途中のレコードも、重複と判定する
+	off, err = produce(log, "a", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = produce(log, "a", 0)
+	require.Equal(t, api.ErrStaleSequence{ProducerID: "a", Sequence: 0, Last: 3}, err)
+	// 別のproducerや、producerの無い書き込みは重複と判定しない
+	off, err = produce(log, "b", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = produce(log, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	off, err = produce(log, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = produce(log, "a", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = produce(log, "a", 4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), next)
+}
+
+// AppendBatchとAppendAtomicでも、再送のレコードは書き込まずに元のオフセットをOffsetに入れることを確認
+func TestLogIdempotentProducerBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producer-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	batch := func(seqs ...uint64) []*api.Record {
+		var records []*api.Record
+		for _, seq := range seqs {
+			records = append(records, &api.Record{Value: []byte("hello"), ProducerId: "a", Sequence: seq})
+		}
+		return records
+	}
+	for _, appendFn := range []func([]*api.Record) (uint64, uint64, error){log.AppendBatch, log.AppendAtomic} {
+		next, err := log.NextOffset()
+		require.NoError(t, err)
+		seq := next + 1
+		first, last, err := appendFn(batch(seq, seq+1, seq+2))
+		require.NoError(t, err)
+		require.Equal(t, next, first)
+		require.Equal(t, next+2, last)
+
+		// まるごとの再送は何も書き込まない
+		records := batch(seq, seq+1, seq+2)
+		first, last, err = appendFn(records)
+		require.NoError(t, err)
+		require.Equal(t, next, first)
+		require.Equal(t, next+2, last)
+		got, err := log.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, next+3, got)
+
+		// 一部が再送なら、新しいレコードだけを書き込む
+		records = batch(seq+2, seq+3)
+		first, last, err = appendFn(records)
+		require.NoError(t, err)
+		require.Equal(t, next+2, first)
+		require.Equal(t, next+3, last)
+		require.Equal(t, next+2, records[0].Offset)
+		require.Equal(t, next+3, records[1].Offset)
+
+		// バッチの中でシーケンス番号が戻っていれば、何も書き込まない
+		_, _, err = appendFn(batch(seq+5, seq+4))
+		require.Equal(t, api.ErrStaleSequence{ProducerID: "a", Sequence: seq + 4, Last: seq + 5}, err)
+		got, err = log.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, next+4, got)
+	}
+}
+
+// 遅延して開くsegmentにしか無いproducerも、スナップショットから再送を判定でき、覚えるproducerの数は上限までであることを確認
+func TestLogProducerSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producer-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.MaxRecoverySegments = 1
+	c.MaxProducers = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, producer := range []string{"a", "b"} {
+		_, err := log.Append(&api.Record{Value: []byte("hello"), ProducerId: producer, Sequence: 1})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.True(t, log.segments[0].lazy)
+	off, err := log.Append(&api.Record{Value: []byte("hello"), ProducerId: "a", Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// 3つ目のproducerで、最も長く書き込んでいないaを忘れる
+	_, err = log.Append(&api.Record{Value: []byte("hello"), ProducerId: "c", Sequence: 1})
+	require.NoError(t, err)
+	require.Len(t, log.producers, 2)
+	require.NotContains(t, log.producers, "a")
+	require.NoError(t, log.Close())
+}
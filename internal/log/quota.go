@@ -0,0 +1,92 @@
+package log
+
+import (
+	"sync/atomic"
+
+	api "proglog/api/v1"
+)
+
+// トピックのクォータは、トピックのすべてのパーティションの合計サイズに上限を設ける。
+// QuotaRejectでは、上限に達したトピックへの書き込みをErrQuotaExceededで断る。
+// 確かめるのはパーティションのLogが書き込みのロックを取ってからなので、Topic.Partitionから直接書き込んでも断る。
+// 合計はパーティションのLogが書き込むたびに差分を足して数えるので、確かめるのにsegmentを数え直すことはない。
+// ほかのパーティションへの書き込みとは同時に確かめるので、合計はパーティションごとに1回分の書き込みだけ上限を超えることがある。
+// QuotaDeleteOldestでは、パーティションをRetentionBudgetに登録し、書き込みのたびに古いsegmentから削除する。
+// アクティブなsegmentは数えるだけで削除しないので、合計は上限を少し超えることがある
+
+// 上限に達したトピックをどう扱うか
+type QuotaPolicy int
+
+const (
+	// 上限に達したら、それ以上の書き込みを断る
+	QuotaReject QuotaPolicy = iota
+	// 上限を超えたら、古いsegmentから削除する
+	QuotaDeleteOldest
+)
+
+// トピックのディスクの使用量の上限
+type QuotaConfig struct {
+	// トピックのstoreとindexの合計バイト数の上限。0なら制限しない
+	MaxBytes uint64
+	Policy   QuotaPolicy
+}
+
+// トピックのすべてのパーティションで共有する、QuotaRejectの上限と合計バイト数
+type topicQuota struct {
+	// 32bit環境でのアトミック操作のため先頭に置く
+	used  uint64
+	topic string
+	max   uint64
+}
+
+// パーティションの合計バイト数がoldからnewに変わった
+func (q *topicQuota) add(old, new uint64) {
+	atomic.AddUint64(&q.used, new-old)
+}
+
+// トピックが上限に達していればErrQuotaExceededを返す
+func (q *topicQuota) check() error {
+	if used := atomic.LoadUint64(&q.used); used >= q.max {
+		return api.ErrQuotaExceeded{Topic: q.topic, Size: used, Max: q.max}
+	}
+	return nil
+}
+
+// トピックのクォータを用意する。QuotaRejectならパーティションにクォータを持たせ、QuotaDeleteOldestなら予算に登録する
+func (t *Topic) setupQuota(quota QuotaConfig) {
+	t.quota = quota
+	if quota.MaxBytes == 0 {
+		return
+	}
+	if quota.Policy == QuotaDeleteOldest {
+		budget := NewRetentionBudget(quota.MaxBytes)
+		for _, l := range t.partitions {
+			budget.Register(l, 1)
+		}
+		return
+	}
+	q := &topicQuota{topic: t.Name, max: quota.MaxBytes}
+	for _, l := range t.partitions {
+		l.mu.Lock()
+		l.quota = q
+		q.add(0, atomic.LoadUint64(&l.bytes))
+		l.mu.Unlock()
+	}
+}
+
+// パーティションのクォータに達していればErrQuotaExceededを返す。l.muを取っておくこと
+func (l *Log) checkQuota() error {
+	if l.quota == nil {
+		return nil
+	}
+	return l.quota.check()
+}
+
+// すべてのパーティションのstoreとindexの合計バイト数
+func (t *Topic) Size() uint64 {
+	var size uint64
+	for _, l := range t.partitions {
+		size += l.Size()
+	}
+	return size
+}
@@ -0,0 +1,84 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// クォータに達したトピックは、QuotaRejectでは書き込みを断り、QuotaDeleteOldestでは古いsegmentを削除することを確認
+func TestTopicQuota(t *testing.T) {
+	for scenario, policy := range map[string]QuotaPolicy{
+		"reject":        QuotaReject,
+		"delete oldest": QuotaDeleteOldest,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "topic-quota-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			const max = 400
+			topics := map[string]TopicConfig{
+				"limited": {MaxStoreBytes: 64, Quota: &QuotaConfig{MaxBytes: max, Policy: policy}},
+				"free":    {MaxStoreBytes: 64},
+			}
+			m, err := NewLogManager(dir, Config{}, topics)
+			require.NoError(t, err)
+			defer m.Close()
+			m.Partitions = 2
+
+			limited, err := m.Create("limited", 0)
+			require.NoError(t, err)
+			free, err := m.Create("free", 0)
+			require.NoError(t, err)
+
+			var rejected error
+			for i := 0; i < 100; i++ {
+				record := &api.Record{Value: []byte("hello world")}
+				if _, _, err := limited.Append(record); err != nil {
+					rejected = err
+					break
+				}
+				_, _, err := free.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			// 上限の無いトピックは、クォータの影響を受けない
+			require.Greater(t, free.Size(), uint64(max))
+
+			// 書き込みのたびに足していった合計は、segmentを数え直した合計と一致する
+			for _, l := range limited.partitions {
+				var size uint64
+				for _, s := range l.segments {
+					size += s.size()
+				}
+				require.Equal(t, size, l.Size())
+			}
+
+			if policy == QuotaReject {
+				require.Equal(t, api.ErrQuotaExceeded{Topic: "limited", Size: limited.Size(), Max: max}, rejected)
+				require.GreaterOrEqual(t, limited.Size(), uint64(max))
+				// パーティションのLogに直接書き込んでも断る
+				for i := 0; i < limited.Partitions(); i++ {
+					p, err := limited.Partition(i)
+					require.NoError(t, err)
+					_, err = p.Append(&api.Record{Value: []byte("hello world")})
+					require.ErrorAs(t, err, &api.ErrQuotaExceeded{})
+				}
+				return
+			}
+			require.NoError(t, rejected)
+			// アクティブなsegmentの分だけ超えることがある
+			var active uint64
+			for _, l := range limited.partitions {
+				active += l.activeSegment.size()
+				lowest, err := l.LowestOffset()
+				require.NoError(t, err)
+				require.NotZero(t, lowest)
+			}
+			require.LessOrEqual(t, limited.Size(), max+active)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 追いつくまでの複製では、レコードを一件ずつ読んで送る代わりに、storeのフレームをそのまま流す。
+// ReadRawで読んだフレームをAppendRawに渡せば、オフセットを変えずに書き込める。
+// 暗号化したsegmentのフレームは、Readerと同じく復号してから渡し、版3のstoreのフレームは8バイトの長さに書き直して渡す。
+// 返すReaderを閉じるまではstoreのファイルを閉じないので、保持期間やコンパクションでsegmentが消されても読み続けられる。
+// 読んでいる途中のsegmentには穴を開けず、書き直す。TruncateAfterで捨てたレコードは読めなくなる
+
+// fromからtoまでのレコードのstoreのフレームを続けて読むio.ReadCloserを返す。
+// 呼び出した時点の内容までを読む。読み終えたら閉じること
+func (l *Log) ReadRaw(from, to uint64) (io.ReadCloser, error) {
+	defer l.trimCache()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	if from < l.lowestOffset() {
+		return nil, api.ErrOffsetOutOfRange{Offset: from}
+	}
+	if to >= l.visibleOffset() {
+		return nil, api.ErrOffsetOutOfRange{Offset: to}
+	}
+	r := &rawReader{}
+	var readers []io.Reader
+	for _, s := range l.segments {
+		if s.nextOffset <= from || to < s.baseOffset {
+			continue
+		}
+		if err := s.open(); err != nil {
+			r.Close()
+			return nil, err
+		}
+		start := s.store.start
+		if from > s.baseOffset {
+			// indexを間引いていても、fromより前のレコードは含めない
+			var err error
+			if start, err = s.rawEnd(from - 1); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		end, err := s.rawEnd(to)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		s.store.pin()
+		r.stores = append(r.stores, s.store)
+		readers = append(readers, s.store.frames(start, end))
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+// ReadRawが返すReader。閉じると、読んでいたstoreのpinを外す
+type rawReader struct {
+	io.Reader
+	once   sync.Once
+	stores []*store
+	err    error
+}
+
+func (r *rawReader) Close() error {
+	r.once.Do(func() {
+		for _, s := range r.stores {
+			if err := s.unpin(); err != nil && r.err == nil {
+				r.err = err
+			}
+		}
+	})
+	return r.err
+}
+
+// オフセットがtoより大きい最初のレコードの位置を返す。無ければstoreの末尾
+func (s *segment) rawEnd(to uint64) (uint64, error) {
+	if to+1 >= s.nextOffset {
+		return s.store.size, nil
+	}
+	start, err := s.seek(to + 1)
+	if err != nil {
+		return 0, err
+	}
+	end := s.store.size
+	err = s.walk(start, func(pos uint64, p []byte, _ uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if record.Offset > to {
+			end = pos
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return 0, err
+	}
+	return end, nil
+}
+
+// walkを途中で止めるためのエラー
+var errStopWalk = errors.New("stop walk")
+
+// ReadRawで読んだフレームのレコードを、オフセットを変えずに書き込み、書き込んだ数を返す。
+// すでにあるオフセットのレコードは飛ばす。コンパクションで飛んだオフセットは、飛んだまま書き込む。
+// 複製元で重複を判定し終えたレコードをそのまま写すので、producerの再送かどうかは確かめず、シーケンス番号だけを覚える
+func (l *Log) AppendRaw(r io.Reader) (int, error) {
+	n := 0
+	for {
+		p, err := readFrame(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return n, err
+		}
+		ok, err := l.appendRaw(record)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	if n > 0 {
+		l.notifyAppend()
+	}
+	return n, nil
+}
+
+func (l *Log) appendRaw(record *api.Record) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return false, err
+	}
+	if record.Offset < l.activeSegment.nextOffset {
+		return false, nil
+	}
+	if l.activeSegment.IsMaxed() ||
+		// 相対オフセットがindexのエントリに書けないほど飛んでいる
+		record.Offset-l.activeSegment.baseOffset > l.activeSegment.index.maxOffset() {
+		if err := l.newSegment(record.Offset); err != nil {
+			return false, err
+		}
+		atomic.AddUint64(&l.stats.rolls, 1)
+	}
+	// 圧縮されたままのレコードは、そのまま書き込む
+	if _, err := l.activeSegment.write(record); err != nil {
+		return false, err
+	}
+	l.observeAppended([]*api.Record{record})
+	return true, nil
+}
@@ -0,0 +1,277 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// ReadRawで読んだフレームをAppendRawに渡すと、segmentをまたいでも同じオフセットのレコードが書き込まれることを確認
+func TestLogReadRaw(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raw-leader-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	followerDir, err := os.MkdirTemp("", "raw-follower-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(followerDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	leader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer leader.Close()
+	for i := 0; i < 10; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	follower, err := NewLog(followerDir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	r, err := leader.ReadRaw(0, 4)
+	require.NoError(t, err)
+	n, err := follower.AppendRaw(r)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.NoError(t, r.Close())
+	next, err := follower.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), next)
+
+	// すでにあるオフセットは飛ばす
+	r, err = leader.ReadRaw(3, 9)
+	require.NoError(t, err)
+	n, err = follower.AppendRaw(r)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.NoError(t, r.Close())
+	for i := uint64(0); i < 10; i++ {
+		got, err := follower.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+		require.Equal(t, i, got.Offset)
+	}
+
+	_, err = leader.ReadRaw(5, 10)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 10}, err)
+	_, err = leader.ReadRaw(5, 4)
+	require.Error(t, err)
+}
+
+// ReadRawで読んでいる途中にsegmentを消したりログを閉じたりしても、閉じるまでは読み続けられることを確認
+func TestLogReadRawPinsSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raw-pin-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	followerDir, err := os.MkdirTemp("", "raw-pin-follower-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(followerDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	leader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	r, err := leader.ReadRaw(0, 9)
+	require.NoError(t, err)
+	require.NoError(t, leader.Truncate(8))
+	_, err = leader.Read(0)
+	require.Error(t, err)
+	require.NoError(t, leader.Close())
+
+	follower, err := NewLog(followerDir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+	n, err := follower.AppendRaw(r)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+}
+
+// ConsumeRawだけを返すクライアント
+type rawClient struct {
+	api.LogClient
+	frames []byte
+}
+
+func (c *rawClient) ConsumeRaw(ctx context.Context, in *api.ConsumeRawRequest, opts ...grpc.CallOption) (api.Log_ConsumeRawClient, error) {
+	return &rawStream{frames: c.frames}, nil
+}
+
+// 3バイトずつフレームを返す
+type rawStream struct {
+	grpc.ClientStream
+	frames []byte
+}
+
+func (s *rawStream) Recv() (*api.ConsumeRawResponse, error) {
+	if len(s.frames) == 0 {
+		return nil, io.EOF
+	}
+	n := 3
+	if n > len(s.frames) {
+		n = len(s.frames)
+	}
+	res := &api.ConsumeRawResponse{Frames: s.frames[:n]}
+	s.frames = s.frames[n:]
+	return res, nil
+}
+
+// 追いつくまでの複製で、ConsumeRawで受け取ったフレームをローカルのログにそのまま書き込むことを確認
+func TestReplicatorCatchUp(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replicator-leader-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	followerDir, err := os.MkdirTemp("", "replicator-follower-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(followerDir)
+
+	leader, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer leader.Close()
+	for i := 0; i < 5; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	r, err := leader.ReadRaw(0, 4)
+	require.NoError(t, err)
+	frames, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	follower, err := NewLog(followerDir, Config{})
+	require.NoError(t, err)
+	defer follower.Close()
+	replicator := &Replicator{LocalLog: follower}
+	next, err := replicator.catchUp(context.Background(), &rawClient{frames: frames})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), next)
+	for i := uint64(0); i < 5; i++ {
+		got, err := follower.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+}
+
+// FSMのスナップショットから復元すると、開始オフセットより後のレコードが同じオフセットで戻ることを確認
+func TestFSMSnapshotRestore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fsm-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restoredDir, err := os.MkdirTemp("", "fsm-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoredDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, err = l.DeleteRecords(4)
+	require.NoError(t, err)
+
+	snap, err := (&fsm{log: l}).Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, snap.(*snapshot).reader)
+	require.NoError(t, err)
+	snap.Release()
+
+	restored, err := NewLog(restoredDir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, (&fsm{log: restored}).Restore(io.NopCloser(&buf)))
+	lowest, err := restored.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	for i := uint64(4); i < 10; i++ {
+		got, err := restored.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+}
+
+// トピックを複製するFSMのスナップショットに、元のログとトピックのパーティションが含まれ、
+// 復元するとノードにあった他のトピックが消えることを確認
+func TestFSMSnapshotRestoreTopics(t *testing.T) {
+	newFSM := func(prefix string) *fsm {
+		dir, err := os.MkdirTemp("", prefix)
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+		l, err := NewLog(filepath.Join(dir, "log"), Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		m, err := NewLogManager(filepath.Join(dir, "topics"), Config{}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		return &fsm{log: l, topics: m}
+	}
+	f := newFSM("fsm-snapshot-topics-test")
+	for i := 0; i < 3; i++ {
+		_, err := f.log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	orders, err := f.topics.Create("orders", 2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, _, err := orders.Append(&api.Record{Value: []byte(fmt.Sprintf("order %d", i))})
+		require.NoError(t, err)
+	}
+	_, err = f.topics.Create("empty", 1)
+	require.NoError(t, err)
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).persistTopics(&buf))
+	snap.Release()
+
+	restored := newFSM("fsm-restore-topics-test")
+	_, err = restored.topics.Create("stale", 1)
+	require.NoError(t, err)
+	require.NoError(t, restored.Restore(io.NopCloser(&buf)))
+
+	require.Equal(t, []string{"empty", "orders"}, restored.topics.Topics())
+	got, err := restored.log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), got.Value)
+	topic, err := restored.topics.Get("orders")
+	require.NoError(t, err)
+	require.Equal(t, 2, topic.Partitions())
+	for i := 0; i < 2; i++ {
+		want, err := orders.Partition(i)
+		require.NoError(t, err)
+		p, err := topic.Partition(i)
+		require.NoError(t, err)
+		next, err := p.NextOffset()
+		require.NoError(t, err)
+		wantNext, err := want.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, wantNext, next)
+		for off := uint64(0); off < next; off++ {
+			w, err := want.Read(off)
+			require.NoError(t, err)
+			g, err := p.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, w.Value, g.Value)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package log
+
+import "errors"
+
+// 読み取り専用で開いたログへの書き込みや、ファイルを書き換える操作で返す
+var ErrReadOnly = errors.New("log is read-only")
+
+// 他のプロセスが書き込んでいるログのディレクトリを、ファイルを一切書き換えずに読むために開く。
+// 中身を調べるツールやエクスポーター、バックアップのジョブが使う。
+// indexは読み取り専用でメモリマップし、書きかけの末尾は切り詰めずに読まないだけにする。
+// 開いた時点までのレコードを読み、その後に書き込まれたものは開き直すまで見えない。
+// ディレクトリのロックは取らず、書き込みなどはErrReadOnlyを返す
+func OpenReadOnly(dir string, c Config) (*Log, error) {
+	c.readOnly = true
+	return NewLog(dir, c)
+}
+
+// 書き込めるかどうか。閉じていればErrClosed、読み取り専用ならErrReadOnlyを返す
+func (l *Log) writable() error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 書き込み中のログを読み取り専用で開いて読めること、書き込みは拒否され、どのファイルも書き換えないことを確認
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Key: []byte("key"), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// 最後のレコードはまだバッファにあり、読み取り専用のログからは見えない
+	require.NoError(t, log.activeSegment.flush())
+	_, err = log.Append(&api.Record{Value: []byte("buffered")})
+	require.NoError(t, err)
+
+	before := dirContents(t, dir)
+	ro, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		record, err := ro.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err = ro.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+	record, err := ro.ReadKey([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+
+	_, err = ro.Append(&api.Record{Value: []byte("rejected")})
+	require.Equal(t, ErrReadOnly, err)
+	_, _, err = ro.AppendBatch([]*api.Record{{Value: []byte("rejected")}})
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ro.Roll()
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.Truncate(2))
+	require.NoError(t, ro.Close())
+	require.Equal(t, before, dirContents(t, dir))
+
+	// 書き込む側は、読み取り専用で開かれていても続けられる
+	off, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	_, err = OpenReadOnly(t.TempDir(), c)
+	require.Error(t, err)
+}
+
+// ディレクトリのファイルの名前と中身
+func dirContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	contents := make(map[string]string)
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		require.NoError(t, err)
+		contents[f.Name()] = string(b)
+	}
+	return contents
+}
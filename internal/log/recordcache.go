@@ -0,0 +1,101 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 最近読んだレコードの、オフセットをキーにしたメモリのキャッシュ。最も長く読まれていないものから捨てる。
+// 末尾を読み直す消費者や再試行が、同じレコードのためにstoreを読んでデコードし直さずに済む。
+// オフセットのレコードは書き換わらないので、コンパクションでsegmentを置き換えたときだけ捨てればよい
+type recordCache struct {
+	mu    sync.Mutex
+	max   uint64
+	size  uint64
+	lru   *list.List
+	elems map[uint64]*list.Element
+}
+
+type recordCacheEntry struct {
+	record *api.Record
+	size   uint64
+}
+
+func newRecordCache(max uint64) *recordCache {
+	return &recordCache{
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[uint64]*list.Element),
+	}
+}
+
+// offのレコードがあれば、recordに写す
+func (c *recordCache) get(off uint64, record *api.Record) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.elems[off]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(e)
+	proto.Reset(record)
+	proto.Merge(record, e.Value.(*recordCacheEntry).record)
+	return true
+}
+
+// 読んだレコードの写しを加え、上限を超えた分を古いものから捨てる。上限より大きいレコードは加えない
+func (c *recordCache) add(record *api.Record) {
+	size := uint64(proto.Size(record))
+	if size > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.elems[record.Offset]; ok {
+		return
+	}
+	entry := &recordCacheEntry{record: proto.Clone(record).(*api.Record), size: size}
+	c.elems[record.Offset] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.max {
+		e := c.lru.Back()
+		c.removeElement(e)
+	}
+}
+
+// [from, to)のオフセットのレコードを捨てる
+func (c *recordCache) removeRange(from, to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for off, e := range c.elems {
+		if from <= off && off < to {
+			c.removeElement(e)
+		}
+	}
+}
+
+func (c *recordCache) removeElement(e *list.Element) {
+	entry := e.Value.(*recordCacheEntry)
+	c.size -= entry.size
+	c.lru.Remove(e)
+	delete(c.elems, entry.record.Offset)
+}
+
+// segmentから読む前にキャッシュを引き、無ければ読んだレコードをキャッシュに加える
+func (l *Log) readCached(s *segment, off uint64, record *api.Record) error {
+	if l.records == nil {
+		return s.ReadInto(off, record)
+	}
+	if l.records.get(off, record) {
+		return nil
+	}
+	if err := s.ReadInto(off, record); err != nil {
+		return err
+	}
+	l.records.add(record)
+	return nil
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// 読んだレコードがキャッシュに入り、上限を超えると最も長く読まれていないものから捨てられることを確認
+func TestLogRecordCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-record-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	record := func(i int) *api.Record {
+		return &api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: 1}
+	}
+	c := Config{}
+	// オフセットとtimestampを入れて、2件分だけ入る
+	c.RecordCacheBytes = uint64(proto.Size(&api.Record{Value: record(0).Value, Offset: 2, Timestamp: 1})) * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record(i))
+		require.NoError(t, err)
+	}
+
+	for off := uint64(0); off < 3; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, record(int(off)).Value, got.Value)
+	}
+	require.Len(t, log.records.elems, 2)
+	require.NotContains(t, log.records.elems, uint64(0))
+
+	// 返したレコードを書き換えても、キャッシュは変わらない
+	got, err := log.Read(1)
+	require.NoError(t, err)
+	got.Value[0] = 'X'
+	var into api.Record
+	require.NoError(t, log.ReadInto(1, &into))
+	require.Equal(t, []byte("record 1"), into.Value)
+	require.Equal(t, uint64(1), into.Offset)
+
+	// 1を読んだので、次に捨てられるのは2
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.Contains(t, log.records.elems, uint64(0))
+	require.Contains(t, log.records.elems, uint64(1))
+
+	log.records.removeRange(0, 1)
+	require.Len(t, log.records.elems, 1)
+	require.Equal(t, log.records.size, log.records.lru.Front().Value.(*recordCacheEntry).size)
+}
@@ -2,17 +2,29 @@ package log
 
 import (
 	"context"
+	"io"
 	"sync"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	api "proglog/api/v1"
 )
 
+// 複製先のローカルのログ。log.Logが満たす
+type RawAppender interface {
+	AppendRaw(r io.Reader) (int, error)
+	NextOffset() (uint64, error)
+}
+
 type Replicator struct {
 	DialOptions []grpc.DialOption
 	LocalServer api.LogClient
+	// nilでなければ、まずConsumeRawでコミット済みのレコードをフレームのまま写して追いつき、
+	// その後に書き込まれたレコードを一件ずつLocalServerに書き込む
+	LocalLog RawAppender
 
 	logger *zap.Logger
 
@@ -55,9 +67,14 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	client := api.NewLogClient(cc)
 
 	ctx := context.Background()
+	offset, err := r.catchUp(ctx, client)
+	if err != nil {
+		r.logError(err, "failed to catch up", addr)
+		return
+	}
 	stream, err := client.ConsumeStream(ctx,
 		&api.ConsumeRequest{
-			Offset: 0,
+			Offset: offset,
 		},
 	)
 	if err != nil {
@@ -98,6 +115,47 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	}
 }
 
+// LocalLogがあれば、接続先のコミット済みのレコードをフレームのまま書き込み、一件ずつ読み始めるオフセットを返す。
+// 接続先がConsumeRawに対応していなければ、ローカルのログの末尾から一件ずつ読む
+func (r *Replicator) catchUp(ctx context.Context, client api.LogClient) (uint64, error) {
+	if r.LocalLog == nil {
+		return 0, nil
+	}
+	next, err := r.LocalLog.NextOffset()
+	if err != nil {
+		return 0, err
+	}
+	stream, err := client.ConsumeRaw(ctx, &api.ConsumeRawRequest{Offset: next})
+	if err != nil {
+		return 0, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(res.Frames); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = r.LocalLog.AppendRaw(pr)
+	pr.CloseWithError(err)
+	if status.Code(err) == codes.Unimplemented {
+		return next, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return r.LocalLog.NextOffset()
+}
+
 // 該当のサーバを離脱する際の処理
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
@@ -0,0 +1,88 @@
+package log
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 保持期限を過ぎたsegmentを、バックグラウンドで定期的に削除する。
+// segmentの最新のレコードがConfig.Retention.MaxAgeより古くなったら、そのsegmentを丸ごと削除する。
+// また、storeの合計サイズがConfig.Retention.MaxBytesを超えたら、書き込みのたびに古いsegmentから削除する。
+// どちらの場合もアクティブなsegmentは削除しない。
+
+// バックグラウンドの削除を始める。MaxAgeが0なら何もしない。Closeで止まる
+func (l *Log) startRetention() {
+	maxAge := l.Config.Retention.MaxAge
+	if maxAge <= 0 {
+		return
+	}
+	interval := l.Config.Retention.CheckInterval
+	if interval <= 0 {
+		interval = maxAge / 10
+	}
+	closing := l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case now := <-ticker.C:
+				if _, err := l.removeExpired(now.Add(-maxAge)); err != nil {
+					zap.L().Named("retention").Error(
+						"failed to remove expired segments",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// 最新のレコードがbeforeより古い封印済みのsegmentを、古い方から削除する。削除したsegmentの数を返す
+func (l *Log) removeExpired(before time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	removed := 0
+	for len(l.segments) > 1 && l.segments[0].modTime.Before(before) {
+		if err := l.segments[0].Remove(); err != nil {
+			return removed, err
+		}
+		l.segments = l.segments[1:]
+		removed++
+	}
+	if removed > 0 {
+		l.resetSize()
+	}
+	return removed, nil
+}
+
+// storeの合計サイズがmaxBytes以下になるまで、封印済みのsegmentを古い方から削除する。削除したsegmentの数を返す
+func (l *Log) removeOverSize(maxBytes uint64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var total uint64
+	for _, s := range l.segments {
+		total += s.storeSize()
+	}
+	removed := 0
+	for len(l.segments) > 1 && total > maxBytes {
+		s := l.segments[0]
+		size := s.storeSize()
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		l.segments = l.segments[1:]
+		total -= size
+		removed++
+	}
+	if removed > 0 {
+		l.resetSize()
+	}
+	return removed, nil
+}
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// 保持期限を過ぎた封印済みのsegmentがバックグラウンドで削除され、アクティブなsegmentは残ることを確認
+func TestRetention(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Retention.MaxAge = 100 * time.Millisecond
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	// 保持期限内なので、まだ削除されない
+	_, err = log.Read(0)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		return off == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	got, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, got.Value)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	// 書き込みを続ければ、新しいレコードは保持期限までは残る
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+}
+
+// storeの合計サイズが上限を超えると古いsegmentから削除され、上限以下に保たれることを確認
+func TestRetentionMaxBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	record := &api.Record{Value: []byte("hello world"), Timestamp: time.Now().UnixNano()}
+	recordSize := uint64(frameWidth + proto.Size(&api.Record{
+		Value:     record.Value,
+		Offset:    1,
+		Timestamp: record.Timestamp,
+	}))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Retention.MaxBytes = recordSize * 5
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+
+		var total uint64
+		for _, s := range log.segments {
+			total += s.storeSize()
+		}
+		require.LessOrEqual(t, total, c.Retention.MaxBytes)
+	}
+
+	// 2レコードずつのsegmentのうち、新しい2つだけが残る
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+	_, err = log.Read(19)
+	require.NoError(t, err)
+}
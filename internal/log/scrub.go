@@ -0,0 +1,183 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// スクラブでは、Config.Scrub.Intervalごとに封印済みのsegmentのstoreを読み直し、レコードのCRC32Cを確かめる。
+// ディスクの中で壊れたレコードは読まれるまで気づけないので、読み手より先に見つけてConfig.Scrub.OnCorruptで知らせる。
+// 書き込みを止めないようLogのロックは取らず、storeのファイルを別に開いて読む。
+// ローカルにファイルの無いObjectStoreのsegmentは読まない
+
+// Closeでスクラブを途中でやめた
+var errScrubStopped = errors.New("scrub stopped")
+
+// バックグラウンドのスクラブを始める。Intervalが0なら何もしない。Closeで止まる
+func (l *Log) startScrub() {
+	interval := l.Config.Scrub.Interval
+	if interval <= 0 {
+		return
+	}
+	closing := l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+				if err := l.scrub(closing); err != nil {
+					zap.L().Named("scrub").Error(
+						"failed to scrub segments",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// 封印済みのsegmentを一通り読み直す。closingが閉じられたら途中でやめる
+func (l *Log) scrub(closing <-chan struct{}) error {
+	type target struct {
+		baseOffset uint64
+		path       string
+	}
+	l.mu.RLock()
+	var targets []target
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		targets = append(targets, target{baseOffset: s.baseOffset, path: s.path(".store")})
+	}
+	l.mu.RUnlock()
+
+	for _, t := range targets {
+		problems, err := l.scrubStore(t.baseOffset, t.path, closing)
+		if err == errScrubStopped {
+			return nil
+		}
+		// 読む前に削除されたsegmentや、ObjectStoreに移したsegment
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&l.stats.scrubbedSegments, 1)
+		if len(problems) == 0 {
+			continue
+		}
+		atomic.AddUint64(&l.stats.corruptSegments, 1)
+		for _, p := range problems {
+			zap.L().Named("scrub").Warn(
+				"found corrupt record",
+				zap.String("dir", l.Dir),
+				zap.String("problem", p.String()),
+			)
+		}
+		if onCorrupt := l.Config.Scrub.OnCorrupt; onCorrupt != nil {
+			onCorrupt(problems)
+		}
+	}
+	return nil
+}
+
+// storeのファイルを先頭から読み、CRC32Cが一致しないレコードと途切れたレコードを返す
+func (l *Log) scrubStore(baseOffset uint64, path string, closing <-chan struct{}) ([]Problem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	version, start, err := readStoreFormat(f, size)
+	if err != nil {
+		return nil, err
+	}
+	varint := version >= storeVarintVersion
+
+	var problems []Problem
+	report := func(kind ProblemKind, pos uint64, detail string) {
+		problems = append(problems, Problem{
+			Kind:       kind,
+			BaseOffset: baseOffset,
+			Position:   pos,
+			Detail:     detail,
+		})
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(f, int64(start), int64(size-start)), 64<<10)
+	began := time.Now()
+	var read uint64
+	for pos := start; pos < size; {
+		h, err := readFrameHeader(r, varint)
+		if err == io.ErrUnexpectedEOF {
+			report(ProblemTruncatedRecord, pos, "header is cut off at the end of the store")
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+		end := pos + h.width + h.n
+		if end > size || end < pos {
+			report(ProblemTruncatedRecord, pos, "record ends beyond the end of the store")
+			break
+		}
+		if h.hole {
+			// 穴の中身は読まない
+			if _, err := r.Discard(int(h.n)); err != nil {
+				return problems, err
+			}
+			pos = end
+			continue
+		}
+		p := make([]byte, h.n)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return problems, err
+		}
+		if err := verifyFrame(h, p, pos); err != nil {
+			report(ProblemCorruptRecord, pos, err.Error())
+		}
+		read += end - pos
+		atomic.AddUint64(&l.stats.scrubbedBytes, end-pos)
+		pos = end
+
+		// BytesPerSecondを超えないよう、読んだ量に見合う時間が経つまで待つ
+		var wait time.Duration
+		if bps := l.Config.Scrub.BytesPerSecond; bps > 0 {
+			wait = time.Duration(float64(read)/float64(bps)*float64(time.Second)) - time.Since(began)
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-closing:
+				timer.Stop()
+				return problems, errScrubStopped
+			case <-timer.C:
+			}
+			continue
+		}
+		select {
+		case <-closing:
+			return problems, errScrubStopped
+		default:
+		}
+	}
+	return problems, nil
+}
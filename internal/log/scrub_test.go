@@ -0,0 +1,99 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// バックグラウンドのスクラブが封印済みのsegmentの壊れたレコードを見つけて知らせることを確認
+func TestLogScrub(t *testing.T) {
+	dir, err := os.MkdirTemp("", "scrub-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	found := make(chan []Problem, 16)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.MaxIndexBytes = 1024
+	c.Scrub.Interval = 10 * time.Millisecond
+	c.Scrub.OnCorrupt = func(problems []Problem) {
+		found <- problems
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(l.segments), 2)
+
+	// 壊れていなければ知らせない
+	require.NoError(t, l.scrub(make(chan struct{})))
+	require.Empty(t, found)
+	stats := l.Stats()
+	// バックグラウンドのスクラブも読んでいることがある
+	require.GreaterOrEqual(t, stats.ScrubbedSegments, uint64(len(l.segments)-1))
+	require.NotZero(t, stats.ScrubbedBytes)
+	require.Zero(t, stats.CorruptSegments)
+
+	// 2番目のsegmentの最初のレコードの本体を1バイト壊す
+	s := l.segments[1]
+	f, err := os.OpenFile(s.path(".store"), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(s.store.start+frameWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	select {
+	case problems := <-found:
+		require.Len(t, problems, 1)
+		require.Equal(t, ProblemCorruptRecord, problems[0].Kind)
+		require.Equal(t, s.baseOffset, problems[0].BaseOffset)
+		require.Equal(t, s.store.start, problems[0].Position)
+	case <-time.After(5 * time.Second):
+		t.Fatal("corrupt segment was not reported")
+	}
+	require.NotZero(t, l.Stats().CorruptSegments)
+}
+
+// BytesPerSecondで読む速さを抑え、Closeで途中でやめることを確認
+func TestLogScrubThrottle(t *testing.T) {
+	dir, err := os.MkdirTemp("", "scrub-throttle-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Scrub.BytesPerSecond = 1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	closing := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- l.scrub(closing)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(closing)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrub did not stop")
+	}
+	// 1バイト毎秒なので、最初のレコードを読んだところで待っている
+	require.Less(t, l.Stats().ScrubbedBytes, uint64(1024))
+	require.Zero(t, l.Stats().ScrubbedSegments)
+}
@@ -2,66 +2,636 @@ package log
 
 import (
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	api "proglog/api/v1"
 
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
 type segment struct {
+	// storeをfsyncし終えたときのnextOffset。これより前のレコードはコミット済み。
+	// 32bit環境でのアトミック操作のため先頭に置く
+	synced uint64
+
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	// 書き出しを数えるLogの統計。Logのアクティブなsegmentとして作ったときだけ持つ
+	stats *logStats
+
+	dir string
+	// indexとtimeindexを置くディレクトリ。Config.Segment.IndexDirが空ならdirと同じ
+	indexDir string
+	// 遅延して開くsegmentのためのロック。lazyがtrueの間は、storeとindexはまだ開かれていない
+	openMu sync.Mutex
+	lazy   bool
+	// 開く前のsegmentのサイズ。ファイルの情報から求めておく
+	lazyStoreSize, lazyIndexSize uint64
+
+	// 読み込み時にindexを修復した回数
+	repairs uint64
+
+	// 前回storeのバッファを書き出してから書き込んだレコードの数と、書き出した時刻
+	unflushed int
+	lastFlush time.Time
+
+	// 最後にindexへエントリを書き込んだレコードから数えた、書き込んだレコードの数と、そのレコードの位置
+	sinceIndexed int
+	indexedPos   uint64
+
+	// 最後にレコードを書き込んだ時刻。既存のsegmentはstoreファイルの更新時刻から求める
+	modTime time.Time
+	// 最初のレコードを書き込んだ時刻。RollIntervalの区間はこれで決める。
+	// 既存のsegmentでは分からないので、storeファイルの更新時刻で代える
+	created time.Time
+
+	// これ以上書き込まないsegmentかどうか
+	sealed bool
+	// ObjectStoreにファイルを置いたsegmentかどうかと、置いたファイルの拡張子
+	tiered      bool
+	tieredFiles []string
+	// 取ってきたsegmentを置いておくキャッシュ。Config.Tiering.CacheBytesが0ならnil
+	cache *tierCache
+
+	// 封印済みのsegmentのキーのブルームフィルタ。openMuで守る
+	bloom *bloomFilter
+	// コンパクションで書き出すときに、フィルタに付ける印
+	compacted uint32
+	// 穴を開けた回数。Logのロックで守る。Iteratorは読んでいる間に変わったら、読む位置を探し直す
+	holes uint64
+
+	// Logのロックの外で読んでいる間はRLockを取る。ファイルを閉じたり、封印後に書き換えたりするときはLockを取り、読み終わるのを待つ。
+	// openMuより先に取ること
+	pins sync.RWMutex
+
+	// 封印後に求めたstoreのチェックサム
+	sumMu  sync.Mutex
+	sum    uint32
+	summed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	return newSegmentIn(dir, indexDirFor(dir, c), baseOffset, c)
+}
+
+// indexとtimeindexをindexDirに置くsegmentを作る
+func newSegmentIn(dir, indexDir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		dir:        dir,
+		indexDir:   indexDir,
 	}
-	storeFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0600,
-	)
+	if err := s.openFiles(); err != nil {
+		return nil, err
+	}
+
+	if off, pos, err := s.index.Read(-1); err != nil {
+		// もし何もindexに書き込まれていないのであれば、次に書き込まれるべきオフセットはbaseOffset
+		s.nextOffset = baseOffset
+	} else {
+		// もし何か書き込まれているのであれば、次に書き込まれるべきオフセットは、取得できた末尾のオフセットに、baseOffsetと1を加算した値
+		s.nextOffset = baseOffset + uint64(off) + 1
+		// indexを間引いている場合は、末尾のエントリより後ろにもレコードがあるので、storeを読み進める
+		s.sinceIndexed, s.indexedPos = 0, pos
+		if err := s.walk(pos, func(_ uint64, p []byte, _ uint64) error {
+			record := &api.Record{}
+			if err := proto.Unmarshal(p, record); err != nil {
+				return err
+			}
+			s.nextOffset = record.Offset + 1
+			s.sinceIndexed++
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	// 開いたときにファイルにあったレコードは、コミット済みとして扱う
+	s.synced = s.nextOffset
+	if s.nextOffset > s.baseOffset {
+		s.created = s.modTime
+	}
+	return s, nil
+}
+
+// ファイルを開かずにsegmentを作る。実際にファイルを開くのは最初に読み込まれるとき。
+// indexは間引かれていることもあり、末尾のオフセットはstoreを読まないとわからないので、
+// 次のsegmentのbaseOffsetであるmaxNextOffsetまでをこのsegmentの範囲とする
+func newLazySegment(dir string, baseOffset, maxNextOffset uint64, c Config) (*segment, error) {
+	s := &segment{
+		baseOffset: baseOffset,
+		config:     c,
+		dir:        dir,
+		indexDir:   indexDirFor(dir, c),
+		lazy:       true,
+		sealed:     true,
+	}
+	storeInfo, err := os.Stat(s.path(".store"))
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	s.lazyStoreSize = uint64(storeInfo.Size())
+	s.modTime = storeInfo.ModTime()
+	// indexが無くなっていれば、開くときにstoreから作り直す
+	if indexInfo, err := os.Stat(s.path(".index")); err == nil {
+		s.lazyIndexSize = uint64(indexInfo.Size())
+	} else if !os.IsNotExist(err) {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0600,
+	s.nextOffset = maxNextOffset
+	return s, nil
+}
+
+func (s *segment) path(ext string) string {
+	return segmentPath(s.dir, s.indexDir, s.baseOffset, ext)
+}
+
+// dirに置くsegmentのファイルのパス。indexとtimeindexはindexDirに置く
+func segmentPath(dir, indexDir string, baseOffset uint64, ext string) string {
+	if ext == ".index" || ext == ".timeindex" {
+		dir = indexDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
+// dirに置くsegmentの、indexとtimeindexを置くディレクトリ。Config.Segment.IndexDirが空ならdirと同じ
+func indexDirFor(dir string, c Config) string {
+	if c.Segment.IndexDir == "" {
+		return dir
+	}
+	return c.Segment.IndexDir
+}
+
+// segmentのファイルを置くディレクトリをfsyncする
+func (s *segment) syncDirs() error {
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	if s.indexDir != s.dir {
+		return syncDir(s.indexDir)
+	}
+	return nil
+}
+
+func (s *segment) openFiles() error {
+	if err := s.migrate(".store", storeMagic, storeVersion); err != nil {
+		return err
+	}
+	if err := s.migrate(".index", indexMagic, indexVersion); err != nil {
+		return err
+	}
+	storeFile, err := s.config.openFile(
+		s.path(".store"),
+		s.openFlag(os.O_RDWR|os.O_CREATE|os.O_APPEND),
+		s.config.fileMode(),
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+	if s.store, err = newStore(storeFile); err != nil {
+		return err
+	}
+	if s.config.Segment.PreallocateStore && !s.sealed && s.store.size == 0 && !s.config.readOnly {
+		// 書き込みの途中でENOSPCにならないよう、作ったときにMaxStoreBytesまでの領域を確保しておく。
+		// ファイルの大きさは変えないので、storeの大きさはこれまで通りファイルの大きさから求められる
+		if err := preallocate(storeFile, int64(s.config.Segment.MaxStoreBytes+formatHeaderWidth)); err != nil {
+			return err
+		}
+	}
+	// 空のstoreであれば、新しく作ったsegment
+	created := s.store.size == 0 && !s.config.readOnly
+	if s.store.aead, s.store.aad, err = s.openCipher(); err != nil {
+		return err
+	}
+	if !s.config.readOnly {
+		if err := s.store.writeHeader(s.config.storeFormatVersion()); err != nil {
+			return err
+		}
+	}
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return err
+	}
+	s.modTime = fi.ModTime()
+	s.lastFlush = time.Now()
+	indexFile, err := s.config.openFile(
+		s.path(".index"),
+		s.openFlag(os.O_RDWR|os.O_CREATE),
+		s.config.fileMode(),
+	)
+	if err != nil {
+		return err
+	}
+	if s.index, err = newIndex(indexFile, s.config); err != nil {
+		return err
+	}
+	timeIndexFile, err := s.config.openFile(
+		s.path(".timeindex"),
+		s.openFlag(os.O_RDWR|os.O_CREATE|os.O_APPEND),
+		s.config.fileMode(),
+	)
+	if err != nil {
+		return err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.index.offWidth); err != nil {
+		return err
+	}
+	if created {
+		// ファイルを作ったことがクラッシュで失われないよう、ディレクトリもfsyncする
+		if err := s.syncDirs(); err != nil {
+			return err
+		}
+	}
+	s.timeIndex.readOnly = s.config.readOnly
+	if !s.indexValid() {
+		if s.config.readOnly {
+			return fmt.Errorf("index of segment %d needs to be rebuilt: %w", s.baseOffset, ErrReadOnly)
+		}
+		// indexが無くなったか壊れているので、storeから作り直す
+		if err = s.rebuildIndex(); err != nil {
+			return err
+		}
+	}
+	if err = s.recover(); err != nil {
+		return err
 	}
+	if len(s.timeIndex.entries) == 0 && s.index.count() > 0 {
+		// timeindexが無かった頃のsegmentなので、storeから作り直す
+		if err = s.rebuildTimeIndex(); err != nil {
+			return err
+		}
+	}
+	if s.sealed {
+		s.store.dropCache = s.config.Segment.DropCacheAfterRead
+		if err := s.checkChecksumFile(); err != nil {
+			return err
+		}
+	}
+	if s.sealed && s.config.Segment.MmapSealed {
+		return s.store.mapSealed()
+	}
+	return nil
+}
 
-	if off, _, err := s.index.Read(-1); err != nil {
-		// もし何もindexに書き込まれていないのであれば、次に書き込まれるべきオフセットはbaseOffset
-		s.nextOffset = baseOffset
-	} else {
-		// もし何か書き込まれているのであれば、次に書き込まれるべきオフセットは、取得できた末尾のオフセットに、baseOffsetと1を加算した値
-		s.nextOffset = baseOffset + uint64(off) + 1
+// 読み取り専用のログでは、flagに関わらず読み取り専用で開き、無いファイルは作らない
+func (s *segment) openFlag(flag int) int {
+	if s.config.readOnly {
+		return os.O_RDONLY
 	}
-	return s, nil
+	return flag
+}
+
+// これ以上書き込まないsegmentにする。Config.Segment.MmapSealedであれば、storeをメモリマップする
+func (s *segment) seal() error {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	s.sealed = true
+	if s.lazy {
+		return nil
+	}
+	if s.config.Segment.PreallocateStore && !s.config.readOnly {
+		// 確保したまま使わなかった末尾の領域を解放する
+		if err := s.store.truncate(s.store.size); err != nil {
+			return err
+		}
+	}
+	s.store.dropCache = s.config.Segment.DropCacheAfterRead
+	if err := s.checkChecksumFile(); err != nil {
+		return err
+	}
+	if bloom, err := s.loadBloom(); err != nil {
+		return err
+	} else if bloom == nil && !s.config.readOnly {
+		if _, err := s.buildBloom(); err != nil {
+			return err
+		}
+	}
+	if !s.config.Segment.MmapSealed {
+		return nil
+	}
+	return s.store.mapSealed()
+}
+
+// 電源断などで書きかけのまま残った末尾のレコードを、store、index、timeindexから切り詰める。
+// indexは閉じるときに切り詰めるので、閉じずに終わった場合は、末尾に書かれていないエントリも残っている
+func (s *segment) recover() error {
+	// オフセットもポジションも増えていくはずなので、そうでなくなったところから後ろは書かれていないエントリ
+	n := s.index.count()
+	var entries uint64
+	var lastOff uint64
+	var lastPos uint64
+	for ; entries < n; entries++ {
+		out, pos, err := s.index.Read(int64(entries))
+		if err != nil {
+			return err
+		}
+		if entries > 0 && (out <= lastOff || pos <= lastPos) {
+			break
+		}
+		lastOff, lastPos = out, pos
+	}
+	s.index.truncate(entries)
+
+	// storeにあるはずの末尾のエントリから、レコードが最後まで書かれているか確かめていく
+	start := s.store.start
+	var cut uint64
+	for i := int64(entries) - 1; i >= 0; i-- {
+		_, pos, err := s.index.Read(i)
+		if err != nil {
+			return err
+		}
+		if pos < s.store.size {
+			// 末尾のレコードがバッチの途中かどうかを知るため、一つ前のエントリから読む
+			if i > 0 {
+				i--
+			}
+			out, pos, err := s.index.Read(i)
+			if err != nil {
+				return err
+			}
+			start, cut = pos, out
+			break
+		}
+	}
+	var open bool
+	pos, err := s.completeFrames(start, func(_ uint64, record *api.Record) error {
+		cut = record.Offset - s.baseOffset + 1
+		open = record.BatchRemaining > 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if open {
+		// 末尾のバッチがコミットされていないので、バッチの最初のレコードから切り詰める
+		if pos, cut, err = s.openBatch(); err != nil {
+			return err
+		}
+	}
+	if pos < s.store.size {
+		zap.L().Named("segment").Warn(
+			"truncated torn write",
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("pos", pos),
+			zap.Uint64("size", s.store.size),
+		)
+		if s.config.readOnly {
+			// 書いている途中かもしれないので切り詰めず、読まないだけにする
+			s.store.size = pos
+		} else if err := s.store.truncate(pos); err != nil {
+			return err
+		}
+	}
+
+	// 切り詰めたレコードを指すエントリを捨てる
+	for entries > 0 {
+		if _, p, err := s.index.Read(int64(entries) - 1); err != nil || p < pos {
+			break
+		}
+		entries--
+	}
+	s.index.truncate(entries)
+	return s.timeIndex.truncate(cut)
+}
+
+// 末尾のコミットされていないバッチの最初のレコードの位置と、その相対オフセットを返す。
+// バッチはindexのエントリより前から始まっていることもあるので、storeを先頭から読む
+func (s *segment) openBatch() (pos, relOff uint64, err error) {
+	inBatch := false
+	_, err = s.completeFrames(s.store.start, func(p uint64, record *api.Record) error {
+		if !inBatch && record.BatchRemaining > 0 {
+			pos, relOff = p, record.Offset-s.baseOffset
+		}
+		inBatch = record.BatchRemaining > 0
+		return nil
+	})
+	return pos, relOff, err
+}
+
+// storeのfromの位置から、最後まで書かれていてCRC32Cも一致するレコードを順にfnへ渡し、
+// 最後に渡したレコードの終わりの位置を返す
+func (s *segment) completeFrames(from uint64, fn func(pos uint64, record *api.Record) error) (uint64, error) {
+	pos := from
+	for pos < s.store.size {
+		h, err := s.store.frameAt(pos)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if h.n > s.store.size-pos-h.width {
+			break
+		}
+		if h.hole {
+			pos += h.width + h.n
+			continue
+		}
+		p := make([]byte, h.n)
+		if _, err := s.store.ReadAt(p, int64(pos+h.width)); err != nil {
+			return 0, err
+		}
+		if verifyFrame(h, p, pos) != nil {
+			break
+		}
+		if p, err = s.store.unseal(p, pos); err != nil {
+			break
+		}
+		record := &api.Record{}
+		if proto.Unmarshal(p, record) != nil {
+			break
+		}
+		if err := fn(pos, record); err != nil {
+			return 0, err
+		}
+		pos += h.width + h.n
+	}
+	return pos, nil
+}
+
+// indexのエントリが、storeのレコードを指していそうか確かめる。
+// 閉じずに終わった場合に末尾に残る、書かれていない(すべて0の)エントリは問題にしない
+func (s *segment) indexValid() bool {
+	// コンパクションで先頭のレコードが穴になっていれば、その後ろの最初のレコードにエントリがある
+	first, err := s.firstRecordPos()
+	if err != nil {
+		return false
+	}
+	if first >= s.store.size {
+		return true
+	}
+	n := s.index.count()
+	if n == 0 {
+		return false
+	}
+	var lastOff uint64
+	var lastPos uint64
+	for i := uint64(0); i < n; i++ {
+		out, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return false
+		}
+		if i == 0 {
+			// 最初のレコードには必ずエントリがある
+			if pos != first {
+				return false
+			}
+		} else if out <= lastOff || pos <= lastPos {
+			for _, b := range s.index.mmap[s.index.at(i):s.index.at(n)] {
+				if b != 0 {
+					return false
+				}
+			}
+			return true
+		}
+		lastOff, lastPos = out, pos
+	}
+	return true
+}
+
+// storeを先頭から読んで、indexを作り直す。書きかけのレコードがあれば、その手前まで
+func (s *segment) rebuildIndex() error {
+	zap.L().Named("segment").Warn(
+		"rebuilding index",
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Uint64("entries", s.index.count()),
+	)
+	// 作り直したindexの形式がtimeindexと異なることがあるので、timeindexもこの後で作り直す
+	if err := s.timeIndex.truncate(0); err != nil {
+		return err
+	}
+	return s.reindex()
+}
+
+// indexのエントリを捨て、storeのレコードから書き直す
+func (s *segment) reindex() error {
+	s.index.truncate(0)
+	s.sinceIndexed, s.indexedPos = 0, 0
+	_, err := s.completeFrames(s.store.start, func(pos uint64, record *api.Record) error {
+		return s.writeIndex(record.Offset-s.baseOffset, pos)
+	})
+	return err
+}
+
+// storeのレコードを先頭から読んで、timeindexを作り直す
+func (s *segment) rebuildTimeIndex() error {
+	if err := s.walk(s.store.start, func(_ uint64, p []byte, _ uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		return s.timeIndex.observe(record.Timestamp, record.Offset-s.baseOffset)
+	}); err != nil {
+		return err
+	}
+	return s.timeIndex.flush()
+}
+
+// storeのfromの位置から末尾まで、レコードとヘッダーを含めたstoreの中でのバイト数を順に読み出す。segmentは開いておくこと。
+// pはプールしたバッファを指すので、fnの中でだけ使える
+func (s *segment) walk(from uint64, fn func(pos uint64, p []byte, size uint64) error) error {
+	buf := getBuf()
+	defer putBuf(buf)
+	for pos := from; pos < s.store.size; {
+		p, size, err := s.store.readRecordBuf(pos, buf)
+		if err == errHole {
+			pos += size
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(pos, p, size); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// 遅延しているsegmentであれば、ここでファイルを開く。何度呼んでもよい
+func (s *segment) open() error {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if !s.lazy {
+		if s.tiered && s.cache != nil {
+			s.cache.touch(s, s.store.size+s.index.size)
+		}
+		return nil
+	}
+	if s.tiered {
+		if err := s.fetch(); err != nil {
+			return err
+		}
+	}
+	if err := s.openFiles(); err != nil {
+		return err
+	}
+	s.lazy = false
+	if s.tiered && s.cache != nil {
+		s.cache.touch(s, s.store.size+s.index.size)
+	}
+	return nil
+}
+
+// storeとindexの合計サイズ
+func (s *segment) size() uint64 {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if s.lazy {
+		return s.lazyStoreSize + s.lazyIndexSize
+	}
+	return s.store.size + s.index.size
+}
+
+// storeのサイズ
+func (s *segment) storeSize() uint64 {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if s.lazy {
+		return s.lazyStoreSize
+	}
+	return s.store.size
+}
+
+// indexのサイズ
+func (s *segment) indexSize() uint64 {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if s.lazy {
+		return s.lazyIndexSize
+	}
+	return s.index.size
 }
 
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	// curは書き込むオフセット
 	cur := s.nextOffset
-
-	// record構造体をbyteにエンコード
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	// 複製元などから届いたレコードに、バッチの印を残さない
+	record.BatchRemaining = 0
+	return s.write(record)
+}
+
+// record.Offsetのオフセットのまま書き込む。コンパクションでは取り除いたレコードの分だけオフセットが飛ぶ
+func (s *segment) write(record *api.Record) (offset uint64, err error) {
+	// record構造体をbyteにエンコード。圧縮するならその後
+	stored, err := compressRecord(record, s.config)
+	if err != nil {
+		return 0, err
+	}
+	p, err := proto.Marshal(stored)
 	if err != nil {
 		return 0, err
 	}
@@ -77,63 +647,601 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
+	if err = s.writeIndex(
 		// インデックスのオフセットは、baseOffsetからの相対
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		record.Offset-s.baseOffset,
 		pos,
 	); err != nil {
 		return 0, err
 	}
+	if err = s.timeIndex.observe(record.Timestamp, record.Offset-s.baseOffset); err != nil {
+		return 0, err
+	}
+
+	// 次に書き込まれるべきオフセットを更新。ここの処理で書き込んだので。
+	s.nextOffset = record.Offset + 1
+	// storeはバッファリングしているので、ファイルの更新時刻ではなく書き込んだ時刻を覚えておく
+	s.modTime = time.Now()
+	if s.created.IsZero() {
+		s.created = s.modTime
+	}
+	s.unflushed++
+	if s.flushDue() {
+		if err := s.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return record.Offset, nil
+}
+
+// recordsを先頭から、segmentが上限に達するまで続けてnextOffsetから書き込み、書き込んだ数を返す。
+// 上限の判定はIsMaxedと同じで、上限に達する前であれば1レコード分は超えてもよい
+func (s *segment) AppendBatch(records []*api.Record) (n int, err error) {
+	return s.appendBatch(records, false)
+}
+
+// recordsがすべて収まるときだけ書き込み、書き込んだかどうかを返す
+func (s *segment) appendAll(records []*api.Record) (bool, error) {
+	n, err := s.appendBatch(records, true)
+	return n == len(records), err
+}
+
+func (s *segment) appendBatch(records []*api.Record, all bool) (n int, err error) {
+	storeSize := s.store.size
+	entries := s.index.remaining()
+	var ps [][]byte
+	for _, record := range records {
+		if storeSize-s.store.start >= s.config.Segment.MaxStoreBytes ||
+			s.index.size-s.index.start+uint64(len(ps))*s.index.entWidth >= s.config.Segment.MaxIndexBytes ||
+			uint64(len(ps)) >= entries ||
+			s.nextOffset+uint64(len(ps))-s.baseOffset > s.index.maxOffset() ||
+			storeSize > s.index.maxPosition() {
+			break
+		}
+		record.Offset = s.nextOffset + uint64(len(ps))
+		if !all {
+			record.BatchRemaining = 0
+		}
+		stored, err := compressRecord(record, s.config)
+		if err != nil {
+			return 0, err
+		}
+		p, err := proto.Marshal(stored)
+		if err != nil {
+			return 0, err
+		}
+		ps = append(ps, p)
+		storeSize += s.store.frameSize(uint64(len(p)))
+	}
+	if len(ps) == 0 || all && len(ps) < len(records) {
+		return 0, nil
+	}
+
+	positions, err := s.store.AppendBatch(ps)
+	if err != nil {
+		return 0, err
+	}
+	for i, pos := range positions {
+		if err = s.writeIndex(s.nextOffset-s.baseOffset, pos); err != nil {
+			return i, err
+		}
+		if err = s.timeIndex.observe(records[i].Timestamp, s.nextOffset-s.baseOffset); err != nil {
+			return i, err
+		}
+		s.nextOffset++
+	}
+	s.modTime = time.Now()
+	if s.created.IsZero() {
+		s.created = s.modTime
+	}
+	s.unflushed += len(ps)
+	if s.flushDue() {
+		if err := s.flush(); err != nil {
+			return len(ps), err
+		}
+	}
+	return len(ps), nil
+}
+
+// Config.Segment.SparseIndexに従って、必要であればindexにエントリを書き込む。
+// segmentの最初のレコードには、必ずエントリを書き込む
+func (s *segment) writeIndex(relOff uint64, pos uint64) error {
+	c := s.config.Segment.SparseIndex
+	due := s.index.count() == 0 ||
+		(c.EveryRecords == 0 && c.EveryBytes == 0) ||
+		(c.EveryRecords > 0 && s.sinceIndexed >= c.EveryRecords) ||
+		(c.EveryBytes > 0 && pos-s.indexedPos >= c.EveryBytes)
+	if !due {
+		s.sinceIndexed++
+		return nil
+	}
+	if err := s.index.Write(relOff, pos); err != nil {
+		return err
+	}
+	s.sinceIndexed = 1
+	s.indexedPos = pos
+	return nil
+}
+
+// Config.Segment.Flushに従って、storeのバッファを書き出す頃合いかどうか
+func (s *segment) flushDue() bool {
+	c := s.config.Segment.Flush
+	if c.EveryRecords > 0 && s.unflushed >= c.EveryRecords {
+		return true
+	}
+	return c.Interval > 0 && time.Since(s.lastFlush) >= c.Interval
+}
+
+// storeとtimeindexのバッファを書き出す。Fsyncが有効ならstoreのfsyncもする
+func (s *segment) flush() error {
+	var err error
+	fsync := s.config.Segment.Flush.Fsync || s.config.Segment.Flush.GroupCommit
+	if fsync {
+		err = s.store.Sync()
+	} else {
+		err = s.store.flush()
+	}
+	if err != nil {
+		return err
+	}
+	if fsync {
+		s.markSynced(s.nextOffset)
+	}
+	if err := s.timeIndex.flush(); err != nil {
+		return err
+	}
+	s.unflushed = 0
+	s.lastFlush = time.Now()
+	s.stats.flushed()
+	return nil
+}
+
+// storeを書き出してfsyncする。indexはメモリマップなのでここでは同期せず、開き直すときにstoreから直せる
+func (s *segment) syncStore() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	s.markSynced(s.nextOffset)
+	if err := s.timeIndex.flush(); err != nil {
+		return err
+	}
+	s.unflushed = 0
+	s.lastFlush = time.Now()
+	s.stats.flushed()
+	return nil
+}
+
+// storeとindexをファイルに書き出してfsyncし、これまでの書き込みをディスクに永続化する
+func (s *segment) Sync() error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	s.markSynced(s.nextOffset)
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.flush(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.file.Sync(); err != nil {
+		return err
+	}
+	s.unflushed = 0
+	s.lastFlush = time.Now()
+	s.stats.flushed()
+	return nil
+}
+
+// オフセットoffのindexのエントリを探し、エントリの番号とstore内のポジションを返す。
+// 普通は相対オフセットの番号にあるが、コンパクション後のsegmentはオフセットが歯抜けになるので二分探索する。
+// indexを間引いていてエントリが無ければ、手前のエントリの位置からstoreを読み進めて探し、エントリの番号は-1を返す
+func (s *segment) lookup(off uint64) (entry int64, pos uint64, err error) {
+	rel := off - s.baseOffset
+	if out, pos, err := s.index.Read(int64(rel)); err == nil && out == rel {
+		return int64(rel), pos, nil
+	}
+	i := s.floorEntry(rel)
+	if i < 0 {
+		return 0, 0, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	out, pos, err := s.index.Read(i)
+	if err != nil {
+		return 0, 0, offsetError(err, off)
+	}
+	if out == rel {
+		return i, pos, nil
+	}
+	for pos < s.store.size {
+		p, size, err := s.store.readRecord(pos)
+		if err == errHole {
+			pos += size
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return 0, 0, err
+		}
+		if record.Offset == off {
+			return -1, pos, nil
+		}
+		if record.Offset > off {
+			// コンパクションで取り除かれたオフセット
+			break
+		}
+		pos += size
+	}
+	return 0, 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// 相対オフセットがrel以下で最大のindexのエントリの番号を返す。無ければ-1
+func (s *segment) floorEntry(rel uint64) int64 {
+	// relより大きい最初のエントリの一つ手前が、rel以下で最大のエントリ
+	n := int(s.index.count())
+	return int64(sort.Search(n, func(i int) bool {
+		out, _, _ := s.index.Read(int64(i))
+		return out > rel
+	})) - 1
+}
+
+// オフセットがoff以上のレコードを探し始めるstoreのポジションを返す。offより手前のレコードを指すこともある
+func (s *segment) seek(off uint64) (uint64, error) {
+	if off <= s.baseOffset {
+		return s.store.start, nil
+	}
+	i := s.floorEntry(off - s.baseOffset)
+	if i < 0 {
+		return s.store.start, nil
+	}
+	_, pos, err := s.index.Read(i)
+	return pos, offsetError(err, off)
+}
 
-	// 次に書き込まれるべきオフセットを加算。ここの処理で書き込んだので。
-	s.nextOffset++
-	return cur, nil
+// indexのエントリが無いことを表すerrEntryOutOfRangeを、読もうとしたオフセットoffのErrOffsetOutOfRangeにする
+func offsetError(err error, off uint64) error {
+	if _, ok := err.(errEntryOutOfRange); ok {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return err
+}
+
+// timestamp以降に書き込まれた最初のレコードのオフセットを返す。無ければfalse
+func (s *segment) offsetByTime(timestamp int64) (uint64, bool, error) {
+	if err := s.open(); err != nil {
+		return 0, false, err
+	}
+	relOff, ok := s.timeIndex.lookup(timestamp)
+	return s.baseOffset + relOff, ok, nil
+}
+
+// offまでに書き込まれたレコードの、最も新しい時刻を返す
+func (s *segment) timeForOffset(off uint64) (int64, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	if timestamp, ok := s.timeIndex.timeAt(off - s.baseOffset); ok {
+		return timestamp, nil
+	}
+	// timeindexにエントリが無ければ、レコードを読む
+	record, err := s.Read(off)
+	if err != nil {
+		return 0, err
+	}
+	return record.Timestamp, nil
 }
 
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	record := &api.Record{}
+	if err := s.ReadInto(off, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Readと同じだが、呼び出し側のrecordに読み込む。recordの元の内容は捨てる
+func (s *segment) ReadInto(off uint64, record *api.Record) error {
+	if err := s.open(); err != nil {
+		return err
+	}
 	// 相対位置のオフセットにより、indexからポジションを取得
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	entry, pos, err := s.lookup(off)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// 取得したポジションで、storeから値を取得。Unmarshalは値をコピーするので、バッファはすぐにプールへ戻せる
+	buf := getBuf()
+	p, _, err := s.store.readRecordBuf(pos, buf)
+	if err == errHole {
+		// コンパクションで穴にしたレコード
+		err = api.ErrOffsetOutOfRange{Offset: off}
 	}
+	if err == nil {
+		// プロトコルバッファのRecordオブジェクトに格納
+		err = proto.Unmarshal(p, record)
+	}
+	putBuf(buf)
+	if err != nil {
+		return err
+	}
+	if entry >= 0 && record.Offset != off && s.config.Segment.ReadRepair && !s.config.readOnly {
+		// indexが別のレコードを指していた。書き直すので、Logの書き込みロックを取ってからrepairで直す
+		return errIndexDrift{entry: entry}
+	}
+	return decompressRecord(record, s.config)
+}
+
+// indexのentry番目のエントリが、別のレコードを指している
+type errIndexDrift struct {
+	entry int64
+}
+
+func (e errIndexDrift) Error() string {
+	return fmt.Sprintf("index entry %d points to another record", e.entry)
+}
 
-	// 取得したポジションで、storeから値を取得
-	p, err := s.store.Read(pos)
+// ReadIntoと同じだが、indexのずれを見つけたらstoreを信頼して直す。Logの書き込みロックを取っておくこと
+func (s *segment) repairInto(off uint64, record *api.Record) error {
+	err := s.ReadInto(off, record)
+	drift, ok := err.(errIndexDrift)
+	if !ok {
+		return err
+	}
+	repaired, err := s.repair(off, drift.entry)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	proto.Reset(record)
+	proto.Merge(record, repaired)
+	return decompressRecord(record, s.config)
+}
+
+// storeを先頭から走査してオフセットがoffのレコードを探し、indexのentry番目のエントリを正しい位置に書き直す。
+// readRecordはフレームのCRC32Cを確かめるので、壊れたフレームや解釈できないレコードがあれば、直さずにエラーを返す。
+// Logの書き込みロックを取っておくこと
+func (s *segment) repair(off uint64, entry int64) (*api.Record, error) {
+	for pos := s.store.start; pos < s.store.size; {
+		p, size, err := s.store.readRecord(pos)
+		if err == errHole {
+			pos += size
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, err
+		}
+		if record.Offset == off {
+			if err := s.index.rewrite(uint64(entry), off-s.baseOffset, pos); err != nil {
+				return nil, err
+			}
+			atomic.AddUint64(&s.repairs, 1)
+			zap.L().Named("segment").Warn(
+				"repaired index entry",
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Uint64("offset", off),
+				zap.Uint64("pos", pos),
+			)
+			return record, nil
+		}
+		pos += size
 	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
 
-	// プロトコルバッファのRecordオブジェクトに格納
+// segment内の全レコードを順に読み出す。sizeはレコードがstoreとindexで占めるバイト数
+func (s *segment) scan(fn func(record *api.Record, size uint64) error) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	// indexは間引かれていることもあるので、storeを先頭から読み、エントリのあるレコードだけその分も足す
+	var entry int64
+	return s.walk(s.store.start, func(pos uint64, p []byte, size uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if err := decompressRecord(record, s.config); err != nil {
+			return err
+		}
+		if _, entryPos, err := s.index.Read(entry); err == nil && entryPos == pos {
+			size += s.index.entWidth
+			entry++
+		}
+		return fn(record, size)
+	})
+}
+
+// storeのstartPosからlengthバイトを読み取り専用でメモリマップし、そのスライスと解放用の関数を返す。
+// 分析用途などで、1回のマップから多くのレコードを、レコードごとのシステムコールやコピー無しでデコードするためのもの。
+//
+// 返したスライスは、解放用の関数を呼ぶまでの間だけ有効。解放後にスライスへアクセスするとプロセスがクラッシュするため、
+// スライス(やそこから切り出したスライス)を解放後まで保持してはいけない。必要ならコピーしておくこと。
+// マップは読み取り専用で、書き込もうとするとクラッシュする。
+// storeを暗号化している場合、マップしたbyteも暗号化されたまま。
+// segmentをClose・Removeしてもマップは有効なままだが、ファイルが切り詰められるとマップ範囲の読み取りでSIGBUSとなるため、
+// 解放前にsegmentを削除しないこと。解放用の関数は何度呼んでも安全。
+func (s *segment) MapRange(startPos, length uint64) ([]byte, func() error, error) {
+	if err := s.open(); err != nil {
+		return nil, nil, err
+	}
+	mmap, b, err := s.store.mapRange(startPos, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	unmap := func() error {
+		var err error
+		once.Do(func() {
+			err = mmap.UnsafeUnmap()
+		})
+		return err
+	}
+	return b, unmap, nil
+}
+
+// storeの内容のチェックサム。封印済みのsegmentは書き換わらないので、一度求めたら覚えておく。
+// アクティブなsegmentに対して呼んではいけない
+func (s *segment) checksum() (uint32, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	s.sumMu.Lock()
+	defer s.sumMu.Unlock()
+	if s.summed {
+		return s.sum, nil
+	}
+	h := crc32.New(castagnoli)
+	if _, err := io.Copy(h, io.NewSectionReader(s.store, int64(s.store.start), int64(s.store.size-s.store.start))); err != nil {
+		return 0, err
+	}
+	s.sum, s.summed = h.Sum32(), true
+	return s.sum, nil
+}
+
+type RecordStat struct {
+	Offset uint64
+	// 値を展開したレコードのバイト数
+	Size uint64
+	// storeに書き込んだ、圧縮や暗号化をした後のレコードのバイト数
+	StoredSize uint64
+	// 長さとCRC32Cのヘッダーと(あれば)indexのエントリを含めた、ディスク上で占めるバイト数
+	DiskSize uint64
+	// レコードを書き込んだ時刻
+	Timestamp time.Time
+	// storeに書き込んだバイト列のCRC32C
+	Checksum uint32
+	// レコードを持つsegmentのbaseOffset
+	BaseOffset uint64
+	// store内でのレコードの位置
+	Position uint64
+}
+
+// indexとフレームを読んで、レコードのメタデータを返す。値は、圧縮されていれば大きさを知るためだけに展開する
+func (s *segment) Stat(off uint64) (RecordStat, error) {
+	if err := s.open(); err != nil {
+		return RecordStat{}, err
+	}
+	entry, pos, err := s.lookup(off)
+	if err != nil {
+		return RecordStat{}, err
+	}
+	h, err := s.store.frameAt(pos)
+	if err != nil {
+		return RecordStat{}, err
+	}
+	p, _, err := s.store.readRecord(pos)
+	if err != nil {
+		return RecordStat{}, err
+	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err := proto.Unmarshal(p, record); err != nil {
+		return RecordStat{}, err
+	}
+	size := uint64(len(p))
+	if record.Codec != 0 {
+		if err := decompressRecord(record, s.config); err != nil {
+			return RecordStat{}, err
+		}
+		size = uint64(proto.Size(record))
+	}
+	disk := h.width + h.n
+	if entry >= 0 {
+		disk += s.index.entWidth
+	}
+	return RecordStat{
+		Offset:     off,
+		Size:       size,
+		StoredSize: h.n,
+		DiskSize:   disk,
+		Timestamp:  time.Unix(0, record.Timestamp),
+		Checksum:   h.crc,
+		BaseOffset: s.baseOffset,
+		Position:   pos,
+	}, nil
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes ||
-		s.index.isMaxed()
+	// ヘッダーは上限に含めない
+	return s.store.size-s.store.start >= s.config.Segment.MaxStoreBytes ||
+		s.index.size-s.index.start >= s.config.Segment.MaxIndexBytes ||
+		s.index.isMaxed() ||
+		// 次のレコードの相対オフセットかポジションが、indexのエントリに書けない
+		s.nextOffset-s.baseOffset > s.index.maxOffset() ||
+		s.store.size > s.index.maxPosition() ||
+		s.rollDue(time.Now())
+}
+
+// RollIntervalで区切った区間のうち、最初のレコードを書き込んだ時刻の区間をnowが過ぎていればtrue。空のsegmentは切り替えない。
+// レコードの時刻は書き込む側が決められるので使わない
+func (s *segment) rollDue(now time.Time) bool {
+	interval := int64(s.config.Segment.RollInterval)
+	if interval <= 0 || s.created.IsZero() {
+		return false
+	}
+	return now.UnixNano()/interval != s.created.UnixNano()/interval
 }
 
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if s.tiered {
+		// ローカルにはファイルが無いこともある
+		if err := s.removeTiered(); err != nil {
+			return err
+		}
+		for _, ext := range append(tieredExts, ".bloom") {
+			if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return s.syncDirs()
+	}
+	if err := os.Remove(s.path(".index")); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := os.Remove(s.path(".store")); err != nil {
 		return err
 	}
-	return nil
+	// 一度も開かれていない古いsegmentにはtimeindexや.bloom、.crcが無いこともあり、暗号化していなければ.keyも無い
+	for _, ext := range []string{".timeindex", ".key", ".bloom", ".crc"} {
+		if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return s.syncDirs()
 }
 
 func (s *segment) Close() error {
+	s.pins.Lock()
+	defer s.pins.Unlock()
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if s.lazy {
+		// 一度も開かれていないので、閉じるものはない
+		return nil
+	}
+	return s.closeFiles()
+}
+
+// storeとindex、timeindexを閉じる。openMuを取っておくこと
+func (s *segment) closeFiles() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -1,9 +1,12 @@
 package log
 
 import (
-	"io"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	api "proglog/api/v1"
 
@@ -38,14 +41,14 @@ func TestSegment(t *testing.T) {
 	}
 
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, api.ErrSegmentFull{}, err)
 
 	// インデックスが最大
 	require.True(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 
 	p, _ := proto.Marshal(want)
-	c.Segment.MaxStoreBytes = uint64(len(p)+lenWidth) * 4
+	c.Segment.MaxStoreBytes = uint64(len(p)+frameWidth) * 4
 	c.Segment.MaxIndexBytes = 1024
 	// 既存のセグメントを再構築
 	s, err = newSegment(dir, 16, c)
@@ -60,3 +63,469 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 }
+
+// メモリマップした範囲から複数のレコードをデコードし、通常の読み込みと一致することを確認
+func TestSegmentMapRange(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-map-range-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// 2番目のレコードから末尾までをマップする
+	_, start, err := s.index.Read(1)
+	require.NoError(t, err)
+	b, unmap, err := s.MapRange(start, s.store.size-start)
+	require.NoError(t, err)
+
+	for off := uint64(1); off < 5; off++ {
+		size := enc.Uint64(b[:lenWidth])
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[frameWidth:frameWidth+size], got))
+		b = b[frameWidth+size:]
+
+		want, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Offset, got.Offset)
+	}
+	require.Empty(t, b)
+	require.NoError(t, unmap())
+	require.NoError(t, unmap())
+
+	_, _, err = s.MapRange(start, s.store.size)
+	require.Error(t, err)
+}
+
+// 間違ったindexのエントリが、読み込みによって修復されることを確認
+func TestSegmentReadRepair(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-read-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.ReadRepair = true
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, want, err := s.index.Read(1)
+	require.NoError(t, err)
+	_, wrong, err := s.index.Read(2)
+	require.NoError(t, err)
+
+	// 2番目のエントリが3番目のレコードを指すように壊す
+	require.NoError(t, s.index.rewrite(1, 1, wrong))
+
+	// 読み込みだけではindexを書き換えない
+	_, err = s.Read(17)
+	require.Equal(t, errIndexDrift{entry: 1}, err)
+	require.Equal(t, uint64(0), s.repairs)
+
+	got := &api.Record{}
+	require.NoError(t, s.repairInto(17, got))
+	require.Equal(t, uint64(17), got.Offset)
+	require.Equal(t, []byte("record 1"), got.Value)
+	require.Equal(t, uint64(1), s.repairs)
+
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, want, pos)
+
+	// 修復済みなので、再度読み込んでも修復は起きない
+	_, err = s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), s.repairs)
+}
+
+// Logの読み込みでずれたindexを直し、修復に使うレコードのCRC32Cが合わなければ直さないことを確認
+func TestLogReadRepair(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-read-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.ReadRepair = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	s := log.activeSegment
+	_, want, err := s.index.Read(1)
+	require.NoError(t, err)
+	_, wrong, err := s.index.Read(2)
+	require.NoError(t, err)
+	require.NoError(t, s.index.rewrite(1, 1, wrong))
+
+	got, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), got.Value)
+	require.Equal(t, uint64(1), log.ReadRepairs())
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, want, pos)
+
+	// 探す途中のフレームが壊れていれば、そのままエラーにする
+	require.NoError(t, s.index.rewrite(1, 1, wrong))
+	require.NoError(t, s.store.flush())
+	f, err := os.OpenFile(s.path(".store"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(s.store.start+frameWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = log.Read(1)
+	var corrupted ErrCorrupted
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, uint64(1), log.ReadRepairs())
+}
+
+// Flushの設定に従ってstoreのバッファがファイルに書き出され、Syncでも書き出されることを確認
+func TestSegmentFlushPolicy(t *testing.T) {
+	record := &api.Record{Value: []byte("hello world")}
+	onDisk := func(t *testing.T, s *segment) uint64 {
+		fi, err := os.Stat(s.path(".store"))
+		require.NoError(t, err)
+		return uint64(fi.Size())
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T, c Config, dir string){
+		"every n records": func(t *testing.T, c Config, dir string) {
+			c.Segment.Flush.EveryRecords = 2
+			s, err := newSegment(dir, 0, c)
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, err = s.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, formatHeaderWidth, onDisk(t, s))
+			_, err = s.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, s.store.size, onDisk(t, s))
+		},
+		"interval": func(t *testing.T, c Config, dir string) {
+			c.Segment.Flush.Interval = 50 * time.Millisecond
+			c.Segment.Flush.Fsync = true
+			s, err := newSegment(dir, 0, c)
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, err = s.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, formatHeaderWidth, onDisk(t, s))
+			time.Sleep(60 * time.Millisecond)
+			_, err = s.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, s.store.size, onDisk(t, s))
+		},
+		"explicit sync": func(t *testing.T, c Config, dir string) {
+			s, err := newSegment(dir, 0, c)
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, err = s.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, formatHeaderWidth, onDisk(t, s))
+			require.NoError(t, s.Sync())
+			require.Equal(t, s.store.size, onDisk(t, s))
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "segment-flush-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			fn(t, c, dir)
+		})
+	}
+}
+
+// indexを間引いても、エントリの無いレコードを含めてすべて読め、開き直しても続きから書き込めることを確認
+func TestSegmentSparseIndex(t *testing.T) {
+	for scenario, fn := range map[string]func(c *Config) (entries uint64){
+		"every n records": func(c *Config) uint64 {
+			c.Segment.SparseIndex.EveryRecords = 3
+			// 0, 3, 6, 9, 12番目のレコード
+			return 5
+		},
+		"every n bytes": func(c *Config) uint64 {
+			// ヘッダーを含めて1レコード29バイトなので、3レコードごと
+			c.Segment.SparseIndex.EveryBytes = 80
+			return 5
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "segment-sparse-index-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			entries := fn(&c)
+
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := uint64(0); i < 10; i++ {
+				off, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: 1})
+				require.NoError(t, err)
+				require.Equal(t, 16+i, off)
+			}
+			require.Less(t, s.index.size/entWidth, uint64(10))
+
+			// 開き直すと、末尾のエントリより後ろのレコードも数えて続きから書き込む
+			require.NoError(t, s.Close())
+			s, err = newSegment(dir, 16, c)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, uint64(26), s.nextOffset)
+			for i := uint64(10); i < 13; i++ {
+				off, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: 1})
+				require.NoError(t, err)
+				require.Equal(t, 16+i, off)
+			}
+			require.Equal(t, entries, s.index.size/entWidth)
+
+			var indexed uint64
+			for i := uint64(0); i < 13; i++ {
+				got, err := s.Read(16 + i)
+				require.NoError(t, err)
+				require.Equal(t, 16+i, got.Offset)
+
+				stat, err := s.Stat(16 + i)
+				require.NoError(t, err)
+				if stat.DiskSize == frameWidth+stat.Size+entWidth {
+					indexed++
+				}
+			}
+			require.Equal(t, s.index.size/entWidth, indexed)
+			_, err = s.Read(29)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: 29}, err)
+
+			var scanned int
+			require.NoError(t, s.scan(func(*api.Record, uint64) error {
+				scanned++
+				return nil
+			}))
+			require.Equal(t, 13, scanned)
+		})
+	}
+}
+
+// 書きかけのまま残った末尾のレコードが、開くときにstore、index、timeindexから切り詰められることを確認
+func TestSegmentRecoverTornWrite(t *testing.T) {
+	for scenario, tear := range map[string]func(t *testing.T, s *segment){
+		"torn header": func(t *testing.T, s *segment) {
+			appendFile(t, s.path(".store"), []byte{0, 0, 0})
+		},
+		"torn payload": func(t *testing.T, s *segment) {
+			header := make([]byte, frameWidth)
+			enc.PutUint64(header, 100)
+			appendFile(t, s.path(".store"), append(header, "partial"...))
+		},
+		"corrupted tail": func(t *testing.T, s *segment) {
+			header := make([]byte, frameWidth)
+			enc.PutUint64(header, 7)
+			appendFile(t, s.path(".store"), append(header, "corrupt"...))
+		},
+		"unclean shutdown": func(t *testing.T, s *segment) {
+			// indexは閉じられずに確保したサイズのまま、書きかけのレコードを指すエントリが残っている
+			ent := make([]byte, entWidth)
+			enc.PutUint32(ent, 3)
+			enc.PutUint64(ent[offWidth:], s.store.size)
+			appendFile(t, s.path(".index"), ent)
+			require.NoError(t, os.Truncate(s.path(".index"), int64(indexHeaderWidth+s.config.Segment.MaxIndexBytes)))
+			ts := make([]byte, tsWidth+offWidth)
+			enc.PutUint64(ts, 4)
+			enc.PutUint32(ts[tsWidth:], 3)
+			appendFile(t, s.path(".timeindex"), ts)
+			appendFile(t, s.path(".store"), []byte{0, 0, 0, 0, 0, 0, 0, 100})
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "segment-recover-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: int64(i + 1)})
+				require.NoError(t, err)
+			}
+			size := s.store.size
+			require.NoError(t, s.Close())
+			tear(t, s)
+
+			s, err = newSegment(dir, 16, c)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, size, s.store.size)
+			require.Equal(t, indexHeaderWidth+3*entWidth, s.index.size)
+			require.Equal(t, uint64(19), s.nextOffset)
+			_, ok := s.timeIndex.lookup(4)
+			require.False(t, ok)
+
+			off, err := s.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(19), off)
+			for off := uint64(16); off < 20; off++ {
+				got, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, got.Offset)
+			}
+		})
+	}
+}
+
+func appendFile(t *testing.T, name string, b []byte) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// indexの形式を変えても読み書きでき、相対オフセットがindexに書けなくなればsegmentが上限に達することを確認
+func TestSegmentIndexLayout(t *testing.T) {
+	for scenario, layout := range map[string]IndexLayout{
+		"legacy":           {},
+		"64-bit offsets":   {OffsetWidth: 8},
+		"32-bit positions": {PositionWidth: 4},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "segment-index-layout-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.IndexLayout = layout
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := int64(0); i < 3; i++ {
+				_, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: i + 1})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+
+			// 開き直すときの設定によらず、作ったときの形式で読む
+			c.Segment.IndexLayout = IndexLayout{}
+			s, err = newSegment(dir, 16, c)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, uint64(19), s.nextOffset)
+			for off := uint64(16); off < 19; off++ {
+				got, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, got.Offset)
+			}
+			off, ok, err := s.offsetByTime(2)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, uint64(17), off)
+
+			require.False(t, s.IsMaxed())
+			s.nextOffset = s.baseOffset + math.MaxUint32 + 1
+			require.Equal(t, layout.OffsetWidth != 8, s.IsMaxed())
+		})
+	}
+}
+
+// Config.Segment.IndexDirを設定すると、indexとtimeindexだけがそちらに置かれ、コンパクション後も開き直せることを確認
+func TestLogIndexDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "index-dir-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	indexDir, err := os.MkdirTemp("", "index-dir-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(indexDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.IndexDir = indexDir
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "a", "b", "c"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	for _, base := range []string{"0", "2"} {
+		require.FileExists(t, filepath.Join(dir, base+".store"))
+		require.NoFileExists(t, filepath.Join(dir, base+".index"))
+		require.FileExists(t, filepath.Join(indexDir, base+".index"))
+		require.FileExists(t, filepath.Join(indexDir, base+".timeindex"))
+	}
+
+	_, err = log.Compact()
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(1); off < 4; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	require.NoFileExists(t, filepath.Join(dir, "0.index"))
+}
+
+// コンパクション用のディレクトリと同じ名前のログでも、indexはIndexDirの直下に置かれ、
+// Removeは共有しているIndexDirの他のファイルを消さないことを確認
+func TestLogIndexDirShared(t *testing.T) {
+	parent, err := os.MkdirTemp("", "index-dir-shared-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, compactDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	indexDir := filepath.Join(parent, "index")
+	require.NoError(t, os.Mkdir(indexDir, 0755))
+	other := filepath.Join(indexDir, "other")
+	require.NoError(t, os.WriteFile(other, []byte("other"), 0644))
+
+	c := Config{}
+	c.Segment.IndexDir = indexDir
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(indexDir, "0.index"))
+	require.NoDirExists(t, filepath.Join(indexDir, compactDir))
+
+	require.NoError(t, log.Remove())
+	require.NoFileExists(t, filepath.Join(indexDir, "0.index"))
+	require.NoFileExists(t, filepath.Join(indexDir, "0.timeindex"))
+	require.FileExists(t, other)
+}
@@ -0,0 +1,294 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// スナップショットは、封印済みのsegmentのstoreと暗号化の鍵のIDを、マニフェストとともにtarにまとめたもの。
+// 封印済みのsegmentは書き換わらないので、書き込みを止めずに一貫した内容を書き出せる。
+// indexとtimeindexはstoreから作り直せるので含めず、復元したログを開くときに作り直す。
+// アクティブなsegmentは含めないので、復元したログは最後の封印済みsegmentの末尾から書き込みを再開する。
+// DeleteRecordsで進めた開始オフセットもマニフェストに含め、復元したログでも削除したレコードを読めないようにする
+
+// tarの先頭に置くマニフェストのファイル名
+const snapshotManifest = "MANIFEST.json"
+
+const snapshotVersion = 1
+
+// スナップショットの内容
+type SnapshotManifest struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Segments []SnapshotSegment `json:"segments"`
+	// DeleteRecordsで進めた開始オフセット。進めていなければ0
+	StartOffset uint64 `json:"start_offset,omitempty"`
+}
+
+type SnapshotSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// 次のsegmentのbaseOffset。このsegmentにあるオフセットは、これより小さい
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes int64  `json:"store_bytes"`
+	// 暗号化していれば、.keyファイルの中身(鍵のIDと、暗号文を位置に結び付けているかどうか)
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// スナップショットに書き出すsegmentのファイル。ロックを解放した後に削除や置き換えがあっても読めるよう、先に開いておく
+type snapshotFile struct {
+	segment SnapshotSegment
+	store   *os.File
+}
+
+// 封印済みのsegmentをマニフェストとともにtarでwに書き出し、書き出した内容を返す
+func (l *Log) Snapshot(w io.Writer) (*SnapshotManifest, error) {
+	files, start, err := l.snapshotFiles()
+	defer func() {
+		for _, f := range files {
+			f.store.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &SnapshotManifest{Version: snapshotVersion, Created: time.Now(), StartOffset: start}
+	for _, f := range files {
+		manifest.Segments = append(manifest.Segments, f.segment)
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, snapshotManifest, int64(len(b)), manifest.Created, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := fmt.Sprintf("%d.store", f.segment.BaseOffset)
+		r := io.LimitReader(f.store, f.segment.StoreBytes)
+		if err := writeTarFile(tw, name, f.segment.StoreBytes, manifest.Created, r); err != nil {
+			return nil, err
+		}
+		if id := f.segment.KeyID; id != "" {
+			name := fmt.Sprintf("%d.key", f.segment.BaseOffset)
+			if err := writeTarFile(tw, name, int64(len(id)), manifest.Created, bytes.NewReader([]byte(id))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 書き出すsegmentのファイルと、開始オフセットを返す。開始オフセットは、書き出すsegmentの末尾までに収める
+func (l *Log) snapshotFiles() (files []snapshotFile, start uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, 0, ErrClosed
+	}
+	start = l.startOffset
+	if end := l.activeSegment.baseOffset; start > end {
+		start = end
+	}
+	for i, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		// ObjectStoreに移したsegmentは、取ってきてから読む
+		if err := s.open(); err != nil {
+			return files, start, err
+		}
+		f, err := os.Open(s.path(".store"))
+		if err != nil {
+			return files, start, err
+		}
+		files = append(files, snapshotFile{store: f})
+		info := &files[len(files)-1].segment
+		info.BaseOffset = s.baseOffset
+		info.NextOffset = l.segments[i+1].baseOffset
+		// 封印するときに書き出し済みなので、ファイルの大きさがそのままstoreの大きさになる
+		info.StoreBytes = int64(s.storeSize())
+		id, err := os.ReadFile(s.path(".key"))
+		if err != nil && !os.IsNotExist(err) {
+			return files, start, err
+		}
+		info.KeyID = string(id)
+	}
+	return files, start, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("snapshot file %s is %d bytes, want %d", name, n, size)
+	}
+	return nil
+}
+
+// Snapshotで書き出したtarからログを作り直す。今のログの内容はすべて捨てる。
+// 一時ディレクトリに展開してマニフェストと突き合わせてから置き換えるので、スナップショットが壊れていれば元のログは変わらない。
+// 置き換えは元のディレクトリを脇に移してから展開したディレクトリを移すので、途中で落ちても開くときにrecoverRestoreでどちらかに揃う
+func (l *Log) RestoreFrom(r io.Reader) error {
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	dir := filepath.Clean(l.Dir) + ".restore"
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, l.Config.dirMode()); err != nil {
+		return err
+	}
+	if err := extractSnapshot(dir, r, l.Config.fileMode()); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	if err := l.Close(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// indexは復元したstoreから作り直すので、別のディレクトリに置いていれば、そちらの古いindexも消す
+	if err := l.removeIndexFiles(); err != nil {
+		return err
+	}
+	old := filepath.Clean(l.Dir) + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(l.Dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, l.Dir); err != nil {
+		// 元のディレクトリを戻す
+		if err := os.Rename(old, l.Dir); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.Dir)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return l.setup()
+}
+
+// RestoreFromの置き換えの途中で落ちていれば、元に戻すか置き換えを終える。
+// ディレクトリが無く脇に移した元のディレクトリがあれば元に戻し、両方あれば置き換えは済んでいるので元のディレクトリを消す
+func recoverRestore(dir string) error {
+	old := filepath.Clean(dir) + ".old"
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.Rename(old, dir); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(filepath.Clean(dir)))
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// tarをdirに展開し、マニフェストにあるファイルがすべてそろっていることを確かめる
+func extractSnapshot(dir string, r io.Reader, perm os.FileMode) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("read snapshot manifest: %w", err)
+	}
+	if hdr.Name != snapshotManifest {
+		return fmt.Errorf("snapshot starts with %q, want %s", hdr.Name, snapshotManifest)
+	}
+	var manifest SnapshotManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("decode snapshot manifest: %w", err)
+	}
+	if manifest.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+	// マニフェストにあるファイルだけを、決まった名前で書き出す。tarの中のパスはそのまま使わない
+	want := make(map[string]int64)
+	for _, s := range manifest.Segments {
+		want[fmt.Sprintf("%d.store", s.BaseOffset)] = s.StoreBytes
+		if s.KeyID != "" {
+			want[fmt.Sprintf("%d.key", s.BaseOffset)] = int64(len(s.KeyID))
+		}
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size, ok := want[hdr.Name]
+		if !ok {
+			return fmt.Errorf("unexpected file %q in snapshot", hdr.Name)
+		}
+		if hdr.Size != size {
+			return fmt.Errorf("snapshot file %s is %d bytes, want %d", hdr.Name, hdr.Size, size)
+		}
+		if err := writeSnapshotFile(filepath.Join(dir, hdr.Name), tr, size, perm); err != nil {
+			return err
+		}
+		delete(want, hdr.Name)
+	}
+	for name := range want {
+		return fmt.Errorf("snapshot is missing %s", name)
+	}
+	if manifest.StartOffset > 0 {
+		b := make([]byte, 8)
+		enc.PutUint64(b, manifest.StartOffset)
+		if err := writeSnapshotFile(filepath.Join(dir, startOffsetFile), bytes.NewReader(b), 8, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSnapshotFile(name string, r io.Reader, size int64, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
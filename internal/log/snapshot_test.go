@@ -0,0 +1,143 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 封印済みのsegmentのスナップショットから、別のディレクトリにログを作り直せることを確認
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restoreDir, err := os.MkdirTemp("", "snapshot-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := log.Snapshot(&buf)
+	require.NoError(t, err)
+	// アクティブなsegment(オフセット6)は含めない
+	require.Len(t, manifest.Segments, 2)
+	require.Equal(t, uint64(3), manifest.Segments[1].BaseOffset)
+	require.Equal(t, uint64(6), manifest.Segments[1].NextOffset)
+	snapshot := buf.Bytes()
+
+	restored, err := NewLog(restoreDir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	_, err = restored.Append(&api.Record{Value: []byte("discarded")})
+	require.NoError(t, err)
+
+	// 壊れたスナップショットでは、元のログは変わらない
+	require.Error(t, restored.RestoreFrom(bytes.NewReader(snapshot[:len(snapshot)/2])))
+	got, err := restored.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("discarded"), got.Value)
+
+	require.NoError(t, restored.RestoreFrom(bytes.NewReader(snapshot)))
+	for i := 0; i < 6; i++ {
+		got, err := restored.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+	_, err = restored.Read(6)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+
+	// 最後の封印済みsegmentの末尾から書き込みを再開する
+	off, err := restored.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+// DeleteRecordsで進めた開始オフセットがスナップショットに含まれ、復元したログでも削除したレコードを読めないことを確認
+func TestSnapshotStartOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot-start-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restoreDir, err := os.MkdirTemp("", "snapshot-start-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, err = log.DeleteRecords(4)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	manifest, err := log.Snapshot(&buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), manifest.StartOffset)
+
+	restored, err := NewLog(restoreDir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.RestoreFrom(&buf))
+	lowest, err := restored.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	_, err = restored.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+	got, err := restored.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), got.Value)
+}
+
+// RestoreFromの置き換えの途中で落ちても、開くときに元のログか置き換えた後のログのどちらかに揃うことを確認
+func TestRestoreFromRecoversInterruptedSwap(t *testing.T) {
+	parent, err := os.MkdirTemp("", "snapshot-swap-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "log")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// 元のディレクトリを脇に移したところで落ちた
+	require.NoError(t, os.Rename(dir, dir+".old"))
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before"), got.Value)
+	require.NoError(t, log.Close())
+
+	// 置き換えた後、元のディレクトリを消す前に落ちた
+	require.NoError(t, os.Mkdir(dir+".old", 0755))
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = os.Stat(dir + ".old")
+	require.True(t, os.IsNotExist(err))
+	got, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before"), got.Value)
+}
@@ -2,9 +2,17 @@ package log
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+
+	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -13,91 +21,617 @@ var (
 
 const (
 	lenWidth = 8 // Appendするbyteのサイズは、必ず8バイト=2^64で統一する
+	crcWidth = 4 // byteのCRC32C
+	// レコードの前に置くヘッダーの幅。長さ、CRC32Cの順に並ぶ
+	frameWidth = lenWidth + crcWidth
+	// 長さのこのビットが立っていれば、コンパクションで取り除いたレコードの跡(穴)。中身は読まずに飛ばす
+	holeFlag uint64 = 1 << 63
 )
 
+// 読もうとした位置が、取り除いたレコードの穴だった。返すバイト数だけ飛ばせば次のレコードに進める
+var errHole = errors.New("hole in store")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptedは、storeから読んだbyteがCRC32Cと一致しなかったときに返す
+type ErrCorrupted struct {
+	// レコードのstore内での位置
+	Pos      uint64
+	Expected uint32
+	Actual   uint32
+}
+
+func (e ErrCorrupted) Error() string {
+	return fmt.Sprintf(
+		"corrupted record at position %d: crc32c %08x, want %08x",
+		e.Pos, e.Actual, e.Expected,
+	)
+}
+
 type store struct {
-	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer // バッファを利用したI/Oを行ってくれる構造体。効率的な書き込みが可能
+	File
+	// 読み込み同士は並行に行えるよう、読み込みは読み込みロック、書き込みとバッファの書き出しは書き込みロックで行う
+	mu   sync.RWMutex
+	buf  *tailBuffer // まだファイルに書き出していないstoreの末尾。書き出す前でも読める
 	size uint64
+	// 最初のレコードの位置。ヘッダーがあればその後ろ、ヘッダーの無い元の形式なら0
+	start uint64
+	// ヘッダーに書かれた形式の版と、フレームの長さをuvarintで書く版3のstoreかどうか
+	version byte
+	varint  bool
+	// nilでなければ、書き込むbyteをこれで暗号化する
+	aead cipher.AEAD
+	// nilでなければ、暗号文をこれとフレームの位置に結び付ける
+	aad []byte
+	// 封印後にstore全体を読み取り専用でマップしたもの。nilでなければ、読み込みはここから行う
+	mmap gommap.MMap
+	// trueなら、読んだ分をページキャッシュから落とす。封印済みのstoreでだけ使う
+	dropCache bool
+	// 前回ページキャッシュから落としてから読んだバイト数
+	unadvised uint64
+	// ReadRawで読んでいる途中のまま閉じるかどうか。muで守る。
+	// 読んでいる間にCloseしてもファイルは閉じず、最後に読み終えたときに閉じる
+	refs    int
+	closing bool
+}
+
+// ページキャッシュから落とすまでに読むバイト数。読み込みのたびにシステムコールを呼ばないよう、まとめて落とす
+const dropCacheEvery = 1 << 20
+
+// 読んだバイト数を数え、dropCacheEveryを超えたらファイル全体をページキャッシュから落とす
+func (s *store) adviseRead(n uint64) {
+	if !s.dropCache || atomic.AddUint64(&s.unadvised, n) < dropCacheEvery {
+		return
+	}
+	atomic.StoreUint64(&s.unadvised, 0)
+	// ページキャッシュの扱いはただのヒントなので、失敗しても読み込みは続ける
+	_ = dropPageCache(s.File)
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File) (*store, error) {
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
 	size := uint64(fi.Size())
-
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+		buf:  newTailBuffer(f),
+	}
+	version, start, err := readStoreFormat(f, size)
+	if err != nil {
+		return nil, err
+	}
+	if version > storeVarintVersion {
+		return nil, fmt.Errorf("unsupported store version %d in %s", version, f.Name())
+	}
+	if version == 0 && size > 0 {
+		return nil, fmt.Errorf("store %s has no record checksums; rewrite it with Config.Segment.MigrateFormat", f.Name())
+	}
+	s.start = start
+	s.version, s.varint = version, version >= storeVarintVersion
+	return s, nil
+}
+
+// 空のstoreの先頭に、versionの形式のヘッダーを書き込む。空でなければ何もしない
+func (s *store) writeHeader(version byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size != 0 {
+		return nil
+	}
+	if _, err := s.File.Write(formatHeader(storeMagic, version)); err != nil {
+		return err
+	}
+	s.size, s.start = formatHeaderWidth, formatHeaderWidth
+	s.version, s.varint = version, version >= storeVarintVersion
+	return nil
+}
+
+// tailBufferの大きさ
+const tailBufferSize = 4096
+
+// tailBufferは、bufio.Writerと同じように書き込みをまとめてファイルへ書き出すが、
+// 書き出す前の内容も読めるので、読み込みのたびに書き出さなくて済む
+type tailBuffer struct {
+	w io.Writer
+	b []byte
+}
+
+func newTailBuffer(w io.Writer) *tailBuffer {
+	return &tailBuffer{w: w, b: make([]byte, 0, tailBufferSize)}
+}
+
+func (t *tailBuffer) Size() int {
+	return tailBufferSize
+}
+
+func (t *tailBuffer) Buffered() int {
+	return len(t.b)
+}
+
+func (t *tailBuffer) Available() int {
+	return tailBufferSize - len(t.b)
+}
+
+// pを溜める。収まらなければ溜めていた分を書き出し、バッファより大きいpはそのまま書き込む。pを分けて書き込むことは無い
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) > t.Available() && len(t.b) > 0 {
+		if err := t.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) >= tailBufferSize {
+		return t.w.Write(p)
+	}
+	t.b = append(t.b, p...)
+	return len(p), nil
+}
+
+// 溜めていた分を書き出す。一部しか書き出せなければ、残りを溜めたままにする
+func (t *tailBuffer) Flush() error {
+	if len(t.b) == 0 {
+		return nil
+	}
+	n, err := t.w.Write(t.b)
+	if n < len(t.b) && err == nil {
+		err = io.ErrShortWrite
+	}
+	t.b = t.b[:copy(t.b, t.b[n:])]
+	return err
 }
 
-// 引数のbyteのサイズ→引数のbyteの順でファイルに書き込む
+// 引数のbyteのサイズ→CRC32C→引数のbyteの順でファイルに書き込む
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	// ヘッダーと本体をプールしたバッファに続けて並べ、一度に書き込む。CRC32Cの計算はロックの外で済ませる
+	buf := getBuf()
+	defer putBuf(buf)
+	if s.aead == nil {
+		*buf = s.appendFrame((*buf)[:0], p)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-
-	// 引数pのサイズを8バイトで表して書き込む。binary.Writeは、数値等を一発でバイナリに変換して書き込めるので便利
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
+	if s.aead != nil {
+		// 暗号文は書き込む位置に結び付けるので、位置が決まってから暗号化する
+		if p, err = s.seal(p, pos); err != nil {
+			return 0, 0, err
+		}
+		*buf = s.appendFrame((*buf)[:0], p)
 	}
 
-	// 引数pの書き込み。wは書き込んだバイトのサイズ
-	w, err := s.buf.Write(p)
+	w, err := s.writeFrames(*buf)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	// pのサイズだけでなく、pの長さのサイズも忘れずに足す
-	w += lenWidth
-
 	// これまでに書き込んだ合計値
 	s.size += uint64(w)
 
 	return uint64(w), pos, nil
 }
 
-func (s *store) Read(pos uint64) ([]byte, error) {
+// ヘッダーを付けたレコードを書き込む。ロックを取っておくこと。
+// バッファに収まらなければ先にバッファを書き出しておき、レコードを分割せずに一度のwriteでファイルへ書き込ませる
+func (s *store) writeFrames(b []byte) (int, error) {
+	if len(b) > s.buf.Available() && s.buf.Buffered() > 0 {
+		if err := s.buf.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return s.buf.Write(b)
+}
+
+// bに、pの長さとCRC32Cのヘッダーを付けたpを足して返す
+func (s *store) appendFrame(b, p []byte) []byte {
+	// 読み込み時に壊れていないか確かめるため、CRC32Cも書き込む
+	b = appendFrameHeader(b, s.varint, frameHeader{
+		n:   uint64(len(p)),
+		crc: crc32.Checksum(p, castagnoli),
+	})
+	return append(b, p...)
+}
+
+// 長さがnのレコードのフレームが、storeで占めるバイト数
+func (s *store) frameSize(n uint64) uint64 {
+	return frameHeaderWidth(s.varint, n) + n
+}
+
+// 複数のbyteを、それぞれAppendと同じ形式で一度に書き込み、それぞれの位置を返す。
+// ロックを取るのもバッファへ書き込むのも一度だけで済む
+func (s *store) AppendBatch(ps [][]byte) (positions []uint64, err error) {
+	if s.aead != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.appendSealedLocked(ps)
+	}
+	var n int
+	for _, p := range ps {
+		n += int(s.frameSize(uint64(len(p))))
+	}
+	buf := getBuf()
+	defer putBuf(buf)
+	b := (*buf)[:0]
+	if cap(b) < n {
+		b = make([]byte, 0, n)
+	}
+	for _, p := range ps {
+		b = s.appendFrame(b, p)
+	}
+	*buf = b
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	// まだ書き込まれていない、バッファにあるログを書き込む
-	if err := s.buf.Flush(); err != nil {
+	pos := s.size
+	positions = make([]uint64, len(ps))
+	for i, p := range ps {
+		positions[i] = pos
+		pos += s.frameSize(uint64(len(p)))
+	}
+	if _, err := s.writeFrames(b); err != nil {
 		return nil, err
 	}
+	s.size = pos
+	return positions, nil
+}
 
-	// まずはエントリを読み込む
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+// 暗号化するstoreに、psをそれぞれ書き込む位置に結び付けて暗号化してから書き込む。ロックを取っておくこと
+func (s *store) appendSealedLocked(ps [][]byte) (positions []uint64, err error) {
+	buf := getBuf()
+	defer putBuf(buf)
+	b := (*buf)[:0]
+	pos := s.size
+	positions = make([]uint64, len(ps))
+	for i, p := range ps {
+		sealed, err := s.seal(p, pos)
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = pos
+		b = s.appendFrame(b, sealed)
+		pos += s.frameSize(uint64(len(sealed)))
+	}
+	*buf = b
+	if _, err := s.writeFrames(b); err != nil {
 		return nil, err
 	}
+	s.size = pos
+	return positions, nil
+}
+
+// posのレコードを読む。storeをマップしている場合は、返すbyteはマップした領域を指すので、
+// storeを閉じた後まで保持してはいけない
+func (s *store) Read(pos uint64) ([]byte, error) {
+	p, _, err := s.readRecord(pos)
+	return p, err
+}
+
+// posのレコードを読み、ヘッダーを含めてstoreの中で占めるバイト数とともに返す。
+// 暗号化している場合、返すbyteの長さとstoreの中での長さは異なる
+func (s *store) readRecord(pos uint64) ([]byte, uint64, error) {
+	var buf []byte
+	return s.readRecordBuf(pos, &buf)
+}
+
+// 読み込みに使い回すバッファ。大きなレコードを読んで育ったバッファはプールに戻さず、メモリを持ち続けないようにする
+const maxPooledBuf = 1 << 20
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) <= maxPooledBuf {
+		bufPool.Put(b)
+	}
+}
+
+// readRecordと同じだが、mmapしていなければ*bufをヘッダーとレコードの読み込みに使い回す。足りなければ大きくして*bufに戻す。
+// 暗号化していなければ返すbyteは*bufを指すので、次に読むまでしか使えない
+func (s *store) readRecordBuf(pos uint64, buf *[]byte) ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readLocked(pos, buf)
+}
 
-	// エントリで受け取ったサイズ分のバイトをログから読み込む
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+// readRecordBufの本体。ロックを取っておくこと
+func (s *store) readLocked(pos uint64, buf *[]byte) ([]byte, uint64, error) {
+	var h frameHeader
+	var b []byte
+	if s.mmap != nil {
+		// マップした領域をそのまま切り出すので、システムコールもコピーも無い
+		if pos >= uint64(len(s.mmap)) {
+			return nil, 0, io.EOF
+		}
+		var ok bool
+		if h, ok = parseFrameHeader(s.mmap[pos:], s.varint); !ok {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		end := pos + h.width + h.n
+		if end > uint64(len(s.mmap)) || end < pos {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if h.hole {
+			return nil, h.width + h.n, errHole
+		}
+		b = s.mmap[pos+h.width : end]
+	} else {
+		// まずはエントリを読み込む
+		var err error
+		if h, err = s.headerLocked(pos, buf); err != nil {
+			return nil, 0, err
+		}
+
+		// エントリで受け取ったサイズ分のバイトをログから読み込む
+		end := h.width + h.n
+		if end < h.width || pos+end > s.size {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if h.hole {
+			return nil, end, errHole
+		}
+		if uint64(cap(*buf)) < h.n {
+			*buf = make([]byte, h.n)
+		}
+		b = (*buf)[:h.n]
+		if _, err := s.readAtLocked(b, int64(pos+h.width)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := verifyFrame(h, b, pos); err != nil {
+		return nil, 0, err
+	}
+	p, err := s.unseal(b, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.mmap == nil {
+		s.adviseRead(h.width + uint64(len(b)))
+	}
+	return p, h.width + uint64(len(b)), nil
+}
+
+// posのフレームのヘッダーを、*bufを使って読む。ロックを取っておくこと
+func (s *store) headerLocked(pos uint64, buf *[]byte) (frameHeader, error) {
+	width := uint64(frameWidth)
+	if s.varint {
+		width = maxFrameWidth
+		// 末尾の小さなレコードでは、最大の幅までは読めない
+		if rest := s.size - pos; pos < s.size && rest < width {
+			width = rest
+		}
+	}
+	if cap(*buf) < int(width) {
+		*buf = make([]byte, width)
+	}
+	header := (*buf)[:width]
+	if _, err := s.readAtLocked(header, int64(pos)); err != nil {
+		return frameHeader{}, err
+	}
+	h, ok := parseFrameHeader(header, s.varint)
+	if !ok {
+		return frameHeader{}, io.ErrUnexpectedEOF
+	}
+	return h, nil
+}
+
+// posのフレームのヘッダーを読む。ヘッダーが途中で切れていればio.ErrUnexpectedEOFを返す
+func (s *store) frameAt(pos uint64) (frameHeader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if pos >= s.size {
+		return frameHeader{}, io.EOF
+	}
+	var buf []byte
+	h, err := s.headerLocked(pos, &buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return h, err
+}
+
+// posからendまでのフレームを、Log.ReaderやReadRawで流す形式で読むio.Readerを返す
+func (s *store) frames(pos, end uint64) io.Reader {
+	r := io.NewSectionReader(s, int64(pos), int64(end-pos))
+	if s.aead == nil && !s.varint {
+		return r
+	}
+	// 受け取る側は鍵を持っているとは限らないので、暗号化したsegmentは復号して渡す
+	return &frameReader{r: bufio.NewReader(r), varint: s.varint, aead: s.aead, aad: s.aad, pos: pos}
+}
+
+// 暗号化するstoreであれば、posに書き込むpを暗号化する
+func (s *store) seal(p []byte, pos uint64) ([]byte, error) {
+	if s.aead == nil {
+		return p, nil
+	}
+	return seal(s.aead, p, additionalData(s.aad, pos))
+}
+
+// 暗号化するstoreであれば、storeのposから読んだpを復号する
+func (s *store) unseal(p []byte, pos uint64) ([]byte, error) {
+	if s.aead == nil {
+		return p, nil
+	}
+	return unseal(s.aead, p, additionalData(s.aad, pos))
+}
+
+// ヘッダーの長さから、フレームの中身のバイト数と、穴かどうかを返す
+func frameLen(header []byte) (uint64, bool) {
+	n := enc.Uint64(header)
+	return n &^ holeFlag, n&holeFlag != 0
+}
+
+// ヘッダーのCRC32Cとbyteが一致するか確かめる
+func verifyFrame(h frameHeader, p []byte, pos uint64) error {
+	if got := crc32.Checksum(p, castagnoli); got != h.crc {
+		return ErrCorrupted{Pos: pos, Expected: h.crc, Actual: got}
+	}
+	return nil
+}
+
+// Log.Readerなどで読んだフレームから、レコードを一つ読み出してCRC32Cを確かめる。
+// これ以上レコードが無ければio.EOFを返す。穴は読み飛ばす
+func readFrame(r io.Reader) ([]byte, error) {
+	b := make([]byte, frameWidth)
+	var h frameHeader
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if h, _ = parseFrameHeader(b, false); !h.hole {
+			break
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(h.n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	p := make([]byte, h.n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	return b, nil
+	if err := verifyFrame(h, p, 0); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, err := s.readAtLocked(p, off)
+	s.adviseRead(uint64(n))
+	return n, err
+}
+
+// offからpを読む。書き出し済みの分はファイルから、まだバッファにある分はバッファから写す。ロックを取っておくこと
+func (s *store) readAtLocked(p []byte, off int64) (int, error) {
+	flushed := s.size - uint64(s.buf.Buffered())
+	n := 0
+	if uint64(off) < flushed {
+		m := len(p)
+		if rest := flushed - uint64(off); uint64(m) > rest {
+			m = int(rest)
+		}
+		var err error
+		if n, err = s.File.ReadAt(p[:m], off); err != nil {
+			return n, err
+		}
+		if n == len(p) {
+			return n, nil
+		}
+	}
+	start := uint64(off) + uint64(n) - flushed
+	if start >= uint64(len(s.buf.b)) {
+		return n, io.EOF
+	}
+	n += copy(p[n:], s.buf.b[start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// storeのposからlengthバイトを読み取り専用でメモリマップする。
+// mmapのオフセットはページ境界に揃える必要があるため、ページ境界から少し多めにマップし、
+// 呼び出し側には要求された範囲だけのスライスを返す
+func (s *store) mapRange(pos, length uint64) (gommap.MMap, []byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	// バッファに残っているログを書き込んでおかないと、マップした領域に含まれない
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return nil, nil, err
+	}
+	if length == 0 || length > s.size || pos > s.size-length {
+		return nil, nil, fmt.Errorf(
+			"map range out of bounds: pos=%d length=%d size=%d",
+			pos, length, s.size,
+		)
 	}
 
-	// 引数pにログのバイトを格納
-	return s.File.ReadAt(p, off)
+	pageSize := uint64(os.Getpagesize())
+	aligned := pos - pos%pageSize
+	delta := pos - aligned
+	mmap, err := gommap.MapRegion(
+		s.File.Fd(),
+		int64(aligned),
+		int64(delta+length),
+		gommap.PROT_READ,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mmap, mmap[delta : delta+length], nil
 }
 
-// 書き込み先のログファイルを閉じる
+// posより後ろを切り詰める。書きかけのまま残ったレコードを捨てるのに使う
+func (s *store) truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
+// これ以上書き込まないstore全体を読み取り専用でマップし、以降の読み込みをマップから行う
+func (s *store) mapSealed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	mmap, err := gommap.MapRegion(s.File.Fd(), 0, int64(s.size), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = mmap
+	return nil
+}
+
+// バッファにあるログをファイルに書き込む
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// バッファにあるログをファイルに書き込み、fsyncでディスクに永続化する
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// 書き込み先のログファイルを閉じる。ReadRawで読んでいる途中なら、読み終えたときに閉じる
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -105,5 +639,45 @@ func (s *store) Close() error {
 	if err != nil {
 		return err
 	}
+	if s.refs > 0 {
+		s.closing = true
+		return nil
+	}
+	return s.closeLocked()
+}
+
+// 読み終えるまでファイルを閉じないようにする
+func (s *store) pin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs++
+}
+
+// pinを外す。読んでいる間に閉じられていれば、ここで閉じる
+func (s *store) unpin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs--
+	if s.refs > 0 || !s.closing {
+		return nil
+	}
+	return s.closeLocked()
+}
+
+// ReadRawで読んでいる途中かどうか
+func (s *store) pinned() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.refs > 0
+}
+
+// muを取っておくこと
+func (s *store) closeLocked() error {
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
 	return s.File.Close()
 }
@@ -1,7 +1,10 @@
 package log
 
 import (
+	"io"
+	"math"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -9,7 +12,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + frameWidth
 )
 
 // 基本的には、hello worldを書き込んで読み込むだけのシンプルなテスト
@@ -25,6 +28,8 @@ func TestStoreAppendRead(t *testing.T) {
 	testRead(t, s)
 	testReadAt(t, s)
 
+	// 読み込みではバッファを書き出さないので、開き直す前に書き出す
+	require.NoError(t, s.flush())
 	s, err = newStore(f)
 	require.NoError(t, err)
 	testRead(t, s)
@@ -53,10 +58,10 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, frameWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, frameWidth, n)
 		off += int64(n)
 
 		size := enc.Uint64(b)
@@ -69,6 +74,167 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+// マップした後も同じ内容が読め、閉じるとマップが解放されることを確認
+func TestStoreMapSealed(t *testing.T) {
+	f, err := os.CreateTemp("", "store_map_sealed_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.mapSealed())
+	require.Len(t, s.mmap, int(width*3))
+	testRead(t, s)
+	_, err = s.Read(width * 3)
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, s.Close())
+	require.Nil(t, s.mmap)
+}
+
+// posとlengthの和が桁あふれする範囲も、範囲外として拒否することを確認
+func TestStoreMapRangeOverflow(t *testing.T) {
+	f, err := os.CreateTemp("", "store_map_range_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+
+	_, _, err = s.mapRange(width, math.MaxUint64)
+	require.Error(t, err)
+	_, _, err = s.mapRange(math.MaxUint64, width)
+	require.Error(t, err)
+
+	mmap, b, err := s.mapRange(width, width*2)
+	require.NoError(t, err)
+	require.Len(t, b, int(width*2))
+	require.NoError(t, mmap.UnsafeUnmap())
+}
+
+// 書き込みと並行して、複数の読み込みが同時に行えることを確認。バッファにあるレコードも読める
+func TestStoreConcurrentRead(t *testing.T) {
+	f, err := os.CreateTemp("", "store_concurrent_read_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, _, err := s.Append(write)
+			require.NoError(t, err)
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				testRead(t, s)
+				b := make([]byte, width)
+				_, err := s.ReadAt(b, int64(width))
+				require.NoError(t, err)
+				require.Equal(t, write, b[frameWidth:])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 最後に書き込んだレコードはまだバッファにあり、書き出さずにバッファから読む
+	require.NotZero(t, s.buf.Buffered())
+	read, err := s.Read(width * 102)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NotZero(t, s.buf.Buffered())
+}
+
+// ファイルとバッファにまたがる範囲も、書き出さずに読めることを確認
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	file := &recordingFile{File: f}
+	s, err := newStore(file)
+	require.NoError(t, err)
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			_, _, err := s.Append(write)
+			require.NoError(t, err)
+		}
+	}
+	appendN(3)
+	require.NoError(t, s.flush())
+	writes := len(file.writes)
+	appendN(3)
+
+	b := make([]byte, width*2)
+	n, err := s.ReadAt(b, int64(width*2))
+	require.NoError(t, err)
+	require.Equal(t, int(width*2), n)
+	require.Equal(t, write, b[frameWidth:width])
+	require.Equal(t, write, b[width+frameWidth:])
+	for pos := uint64(0); pos < width*6; pos += width {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	require.Len(t, file.writes, writes)
+	_, err = s.Read(width * 6)
+	require.Equal(t, io.EOF, err)
+	_, err = s.ReadAt(b, int64(width*5))
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, s.Close())
+}
+
+// ファイルへのwriteを記録するFile
+type recordingFile struct {
+	File
+	writes [][]byte
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	f.writes = append(f.writes, append([]byte(nil), p...))
+	return f.File.Write(p)
+}
+
+// バッファに収まらないレコードも、ヘッダーと本体が分割されずに一度のwriteで書き込まれることを確認
+func TestStoreAppendSingleWrite(t *testing.T) {
+	f, err := os.CreateTemp("", "store_single_write_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	file := &recordingFile{File: f}
+	s, err := newStore(file)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Empty(t, file.writes)
+
+	large := make([]byte, s.buf.Size())
+	_, pos, err := s.Append(large)
+	require.NoError(t, err)
+	// 先に小さいレコードのバッファを書き出し、大きいレコードはそのまま書き込む
+	require.Len(t, file.writes, 2)
+	require.Equal(t, int(width), len(file.writes[0]))
+	require.Equal(t, len(large)+int(frameWidth), len(file.writes[1]))
+
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, large, read)
+	require.NoError(t, s.Close())
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
@@ -106,3 +272,56 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+// storeのbyteが書き換わっていると、CRC32Cが一致せずにErrCorruptedを返すことを確認
+func TestStoreCorruption(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.flush())
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// レコードの本体の1バイトを反転させる
+	_, err = f.WriteAt([]byte{write[0] ^ 0xff}, int64(pos+frameWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	var corrupted ErrCorrupted
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, pos, corrupted.Pos)
+	require.NotEqual(t, corrupted.Expected, corrupted.Actual)
+}
+
+// dropCacheのstoreは、読んだバイト数がdropCacheEveryを超えるたびにページキャッシュから落とし、数え直すことを確認
+func TestStoreDropCache(t *testing.T) {
+	f, err := os.CreateTemp("", "store_drop_cache_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	record := make([]byte, 64<<10)
+	for i := 0; i < 20; i++ {
+		_, _, err := s.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.flush())
+	s.dropCache = true
+
+	var read uint64
+	for pos := uint64(0); pos < s.size; pos += uint64(len(record)) + frameWidth {
+		got, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, record, got)
+		read += uint64(len(record)) + frameWidth
+	}
+	require.Greater(t, read, uint64(dropCacheEvery))
+	require.Less(t, s.unadvised, read-dropCacheEvery)
+}
@@ -0,0 +1,192 @@
+package log
+
+import (
+	"errors"
+	"time"
+
+	api "proglog/api/v1"
+)
+
+// 閉じたLogへの書き込みや購読で返す
+var ErrClosed = errors.New("log is closed")
+
+// Config.CloseTimeoutが0のときに、Closeが購読者を待つ時間
+const defaultCloseTimeout = 5 * time.Second
+
+// 購読者に届けるイベント。Closedがfalseならレコード、trueならLogが閉じられたか、読めずに配信が止まったことを表す最後のイベント
+type Event struct {
+	Record *api.Record
+	Closed bool
+	// Closedのとき、閉じた時点でLogにあった最後のオフセット。これまでに受け取ったレコードと比べれば、取りこぼしが無いことがわかる
+	LastOffset uint64
+	// Closedのとき、配信を止めた読み込みのエラー。Logが閉じられて終わったならnil
+	Err error
+}
+
+// Subscriptionは、指定したオフセット以降のレコードを書き込まれた順に届ける。
+// Logが閉じられると、残りのレコードをすべて届けたあとでClosedのイベントを送り、Cを閉じる。
+// レコードを読めなかったときも、そのエラーを持つClosedのイベントを送ってCを閉じる。
+// Closeが待てる時間までに受け取り終えなければ、Closedのイベントを送らずにCを閉じる
+type Subscription struct {
+	C <-chan Event
+
+	done chan struct{}
+}
+
+// offから購読を始める。bufferはCのバッファの大きさ
+func (l *Log) Subscribe(off uint64, buffer int) (*Subscription, error) {
+	// closedの確認とsubscribersへの追加を同じロックの中で行い、Closeの待ち合わせから漏れないようにする
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, done: make(chan struct{})}
+	l.subscribers.Add(1)
+	go l.deliver(sub, ch, off)
+	return sub, nil
+}
+
+// 購読をやめる。Cは閉じられず、以降イベントは届かない
+func (s *Subscription) Unsubscribe() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+func (l *Log) deliver(sub *Subscription, ch chan<- Event, off uint64) {
+	defer l.subscribers.Done()
+	for {
+		// 読み終えてから待ち始めるまでの書き込みを逃さないよう、読む前に待つチャネルを取っておく
+		l.notifyMu.Lock()
+		appended := l.appended
+		l.notifyMu.Unlock()
+		closing := false
+		select {
+		case <-l.closing:
+			// これ以降は書き込まれないので、末尾まで届ければ終わり
+			closing = true
+		default:
+		}
+
+		next := l.visibleNext()
+		for ; off < next; off++ {
+			record, err := l.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				// 削除やコンパクションで無くなったオフセットは飛ばす
+				continue
+			}
+			if err != nil {
+				// 読めないレコードを飛ばすと取りこぼしに気づけないので、エラーを届けて配信をやめる
+				var last uint64
+				if off > 0 {
+					last = off - 1
+				}
+				select {
+				case ch <- Event{Closed: true, LastOffset: last, Err: err}:
+				case <-sub.done:
+					return
+				case <-l.abandon:
+				}
+				close(ch)
+				return
+			}
+			select {
+			case ch <- Event{Record: record}:
+			case <-sub.done:
+				return
+			case <-l.abandon:
+				close(ch)
+				return
+			}
+		}
+
+		if closing {
+			var last uint64
+			if next > 0 {
+				last = next - 1
+			}
+			select {
+			case ch <- Event{Closed: true, LastOffset: last}:
+			case <-sub.done:
+				return
+			case <-l.abandon:
+			}
+			close(ch)
+			return
+		}
+		select {
+		case <-appended:
+		case <-l.closing:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// 購読者が届け終えるのを、Config.CloseTimeoutまで待つ。過ぎたら残りの配信を打ち切る
+func (l *Log) waitSubscribers() {
+	done := make(chan struct{})
+	go func() {
+		l.subscribers.Wait()
+		close(done)
+	}()
+	timeout := l.Config.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	close(l.abandon)
+	<-done
+}
+
+// 待っている購読者を起こす
+func (l *Log) notifyAppend() {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// fromから、今あるレコードを届けたあと、新しく書き込まれるレコードを待って届けるチャネルを返す。
+// チャネルにはバッファが無く、受け取るまで次のレコードを読まない。返した関数を呼ぶと配信をやめてチャネルを閉じる。
+// Logが閉じられたときも、残りのレコードを届けてからチャネルを閉じる。読めないレコードがあれば、その手前でチャネルを閉じる。
+// 閉じたLogでは、すぐに閉じたチャネルを返す
+func (l *Log) Watch(from uint64) (<-chan *api.Record, func()) {
+	out := make(chan *api.Record)
+	sub, err := l.Subscribe(from, 0)
+	if err != nil {
+		close(out)
+		return out, func() {}
+	}
+	go func() {
+		defer close(out)
+		for {
+			var e Event
+			var ok bool
+			select {
+			case e, ok = <-sub.C:
+			case <-sub.done:
+				return
+			}
+			if !ok || e.Closed {
+				return
+			}
+			select {
+			case out <- e.Record:
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return out, sub.Unsubscribe
+}
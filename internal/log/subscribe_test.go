@@ -0,0 +1,160 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Closeのとき、購読者がバッファに残っていたレコードと、最後のオフセットを持つ終了のイベントを受け取ることを確認
+func TestSubscribeClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "subscribe-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	sub, err := log.Subscribe(1, 1)
+	require.NoError(t, err)
+	for i := 3; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// バッファが小さいので、購読者が読み進めるまでCloseは終わらない
+	closed := make(chan error)
+	go func() { closed <- log.Close() }()
+
+	var got []string
+	var last Event
+	for e := range sub.C {
+		if e.Closed {
+			last = e
+			continue
+		}
+		got = append(got, string(e.Record.Value))
+	}
+	require.NoError(t, <-closed)
+	require.Equal(t, []string{"record 1", "record 2", "record 3", "record 4"}, got)
+	require.True(t, last.Closed)
+	require.Equal(t, uint64(4), last.LastOffset)
+
+	_, err = log.Append(&api.Record{Value: []byte("after close")})
+	require.Equal(t, ErrClosed, err)
+	_, err = log.Subscribe(0, 1)
+	require.Equal(t, ErrClosed, err)
+}
+
+// Watchが今あるレコードを届けたあと新しいレコードを待ち、キャンセルやCloseでチャネルが閉じることを確認
+func TestWatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "watch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	c, cancel := log.Watch(1)
+	require.Equal(t, []byte("record 1"), (<-c).Value)
+	_, err = log.Append(&api.Record{Value: []byte("record 2")})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), (<-c).Value)
+	cancel()
+	cancel()
+	for range c {
+	}
+
+	// Closeでも閉じる
+	c, _ = log.Watch(0)
+	require.Equal(t, []byte("record 0"), (<-c).Value)
+	closed := make(chan error)
+	go func() { closed <- log.Close() }()
+	var got []string
+	for r := range c {
+		got = append(got, string(r.Value))
+	}
+	require.NoError(t, <-closed)
+	require.Equal(t, []string{"record 1", "record 2"}, got)
+
+	c, cancel = log.Watch(0)
+	defer cancel()
+	_, ok := <-c
+	require.False(t, ok)
+}
+
+// 読めないレコードに当たったら、エラーを持つ終了のイベントを届けてチャネルを閉じることを確認
+func TestSubscribeReadError(t *testing.T) {
+	dir, err := os.MkdirTemp("", "subscribe-error-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	s := log.segments[0]
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	writeFileAt(t, s.path(".store"), []byte{0xff}, int64(pos+frameWidth))
+
+	sub, err := log.Subscribe(0, 0)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	e := <-sub.C
+	require.Equal(t, uint64(0), e.Record.Offset)
+	e = <-sub.C
+	require.True(t, e.Closed)
+	require.Error(t, e.Err)
+	require.Equal(t, uint64(0), e.LastOffset)
+	_, ok := <-sub.C
+	require.False(t, ok)
+}
+
+// 読まない購読者がいても、CloseはConfig.CloseTimeoutで配信を打ち切って戻ることを確認
+func TestSubscribeCloseTimeout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "subscribe-timeout-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.CloseTimeout = 50 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	sub, err := log.Subscribe(0, 0)
+	require.NoError(t, err)
+
+	closed := make(chan error)
+	go func() { closed <- log.Close() }()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	// 打ち切った購読はCが閉じる
+	for range sub.C {
+	}
+}
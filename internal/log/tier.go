@@ -0,0 +1,496 @@
+package log
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 階層化ストレージでは、Config.Tiering.MinAgeより古い封印済みのsegmentのファイルをObjectStoreへ移し、
+// ローカルには.tieredファイル(スタブ)だけを残す。スタブにはsegmentの範囲と大きさ、移したファイルを書いておく。
+// 移したsegmentは最初に読み込まれるときにObjectStoreから取ってきて開き、MinAgeを過ぎていれば次の確認でまたローカルから消す。
+// Config.Tiering.CacheBytesを設定すれば、取ってきたsegmentは次の確認では消さず、合計がCacheBytesを超えたときに最も長く読まれていないものから消す
+
+// ObjectStoreは、封印済みのsegmentのファイルを置く外部のストレージ。S3やGCSのクライアントを包んで実装する
+type ObjectStore interface {
+	Put(name string, r io.Reader) error
+	// 無ければos.ErrNotExistを包んだエラーを返す
+	Get(name string) (io.ReadCloser, error)
+	// 無くてもエラーにしない
+	Delete(name string) error
+}
+
+// ローカルのディレクトリをObjectStoreとして使う。ネットワークファイルシステムのマウント先などに置く
+type DirObjectStore struct {
+	Dir string
+}
+
+func (d DirObjectStore) Put(name string, r io.Reader) error {
+	path := filepath.Join(d.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, r, 0600)
+}
+
+func (d DirObjectStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.Dir, name))
+}
+
+func (d DirObjectStore) Delete(name string) error {
+	if err := os.Remove(filepath.Join(d.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 一時ファイルに書き込んでからリネームし、途中で失敗しても書きかけのファイルを残さない
+func writeFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// ObjectStoreに移したsegmentの情報。ローカルの.tieredファイルに書く
+type tieredStub struct {
+	NextOffset uint64    `json:"next_offset"`
+	StoreBytes uint64    `json:"store_bytes"`
+	IndexBytes uint64    `json:"index_bytes"`
+	ModTime    time.Time `json:"mod_time"`
+	// ObjectStoreに置いたファイルの拡張子
+	Files []string `json:"files"`
+}
+
+// ObjectStoreに移すsegmentのファイル。.bloomは、取ってこなくてもキーを持たないとわかるようにローカルに残す
+var tieredExts = []string{".store", ".index", ".timeindex", ".key", ".crc"}
+
+func (s *segment) objectName(ext string) string {
+	return s.config.Tiering.Prefix + fmt.Sprintf("%d%s", s.baseOffset, ext)
+}
+
+// ObjectStoreに移したsegmentを、スタブから開かずに作る
+func newTieredSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	s := &segment{
+		baseOffset: baseOffset,
+		config:     c,
+		dir:        dir,
+		indexDir:   indexDirFor(dir, c),
+		lazy:       true,
+		sealed:     true,
+		tiered:     true,
+	}
+	b, err := os.ReadFile(s.path(".tiered"))
+	if err != nil {
+		return nil, err
+	}
+	var stub tieredStub
+	if err := json.Unmarshal(b, &stub); err != nil {
+		return nil, fmt.Errorf("decode tiered stub of segment %d: %w", baseOffset, err)
+	}
+	s.nextOffset = stub.NextOffset
+	s.lazyStoreSize = stub.StoreBytes
+	s.lazyIndexSize = stub.IndexBytes
+	s.modTime = stub.ModTime
+	s.tieredFiles = stub.Files
+	return s, nil
+}
+
+// ローカルに無いファイルをObjectStoreから取ってくる。openMuを取っておくこと
+func (s *segment) fetch() error {
+	store := s.config.Tiering.Store
+	if store == nil {
+		return fmt.Errorf("segment %d is tiered but no object store is configured", s.baseOffset)
+	}
+	for _, ext := range s.tieredFiles {
+		if _, err := os.Stat(s.path(ext)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if s.config.readOnly {
+			return ErrReadOnly
+		}
+		r, err := store.Get(s.objectName(ext))
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(s.path(ext), r, s.config.fileMode())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObjectStoreに置いたファイルとスタブを消す
+func (s *segment) removeTiered() error {
+	if s.cache != nil {
+		s.cache.remove(s)
+	}
+	if store := s.config.Tiering.Store; store != nil {
+		for _, ext := range s.tieredFiles {
+			if err := store.Delete(s.objectName(ext)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(s.path(".tiered")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ObjectStoreへ送るsegmentのファイルの内容。ロックを解放した後に削除されても読めるよう、ファイルは開いておく
+type tierUpload struct {
+	segment *segment
+	stub    tieredStub
+	files   map[string]io.Reader
+	closers []io.Closer
+	// 送る前に読み直して確かめるstoreのファイルと、.crcファイルの中身。.crcが無ければstoreはnil
+	store    *os.File
+	checksum segmentChecksum
+}
+
+// 送るstoreが、封印したときの.crcファイルと一致するか確かめる
+func (u *tierUpload) verify() error {
+	if u.store == nil {
+		return nil
+	}
+	return verifyStoreFile(u.store, u.segment.baseOffset, u.checksum)
+}
+
+func (u *tierUpload) Close() {
+	for _, c := range u.closers {
+		c.Close()
+	}
+}
+
+// Config.Tiering.MinAgeより古い封印済みのsegmentをObjectStoreへ移し、ローカルのファイルを削除する。
+// ObjectStoreから取ってきていたsegmentも、ローカルのファイルを削除する。ローカルから消したsegmentの数を返す
+func (l *Log) Offload() (int, error) {
+	if l.Config.Tiering.Store == nil {
+		return 0, nil
+	}
+	// コンパクションによるsegmentの置き換えと重ならないようにする
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	uploads, err := l.prepareOffload(time.Now().Add(-l.Config.Tiering.MinAge))
+	defer func() {
+		for _, u := range uploads {
+			u.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+	// 書き込みを止めないよう、ロックを取らずに送る
+	for _, u := range uploads {
+		if u.files == nil {
+			continue
+		}
+		if err := u.verify(); err != nil {
+			return 0, err
+		}
+		for _, ext := range u.stub.Files {
+			if err := l.Config.Tiering.Store.Put(u.segment.objectName(ext), u.files[ext]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	live := make(map[*segment]bool, len(l.segments))
+	for _, s := range l.segments {
+		live[s] = true
+	}
+	evicted := 0
+	for _, u := range uploads {
+		s := u.segment
+		// 送っている間にリテンションで削除されていれば、送ったファイルも消す
+		if !live[s] {
+			if u.files != nil {
+				s.tieredFiles = u.stub.Files
+				if err := s.removeTiered(); err != nil {
+					return evicted, err
+				}
+			}
+			continue
+		}
+		s.cache = l.cache
+		if err := s.evict(u); err != nil {
+			return evicted, err
+		}
+		evicted++
+	}
+	return evicted, nil
+}
+
+// ローカルから消すsegmentを選び、まだObjectStoreに無いものは送る内容を用意する
+func (l *Log) prepareOffload(before time.Time) ([]*tierUpload, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.writable(); err != nil {
+		return nil, err
+	}
+	var uploads []*tierUpload
+	for _, s := range l.segments {
+		if s == l.activeSegment || !s.modTime.Before(before) {
+			continue
+		}
+		u, err := s.prepareUpload()
+		if u != nil {
+			uploads = append(uploads, u)
+		}
+		if err != nil {
+			return uploads, err
+		}
+	}
+	return uploads, nil
+}
+
+// segmentのファイルを開いておく。ObjectStoreにあってローカルにファイルが無ければnilを返す。
+// 開いているsegmentのindexはファイルが書き込みの上限まで伸びているので、メモリマップから書き込んだ分だけを写す
+func (s *segment) prepareUpload() (*tierUpload, error) {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	u := &tierUpload{segment: s}
+	if s.tiered {
+		// 取ってきたsegmentは、キャッシュがあればキャッシュに任せる
+		if s.lazy || s.cache != nil {
+			return nil, nil
+		}
+		u.stub.Files = s.tieredFiles
+		return u, nil
+	}
+	u.files = make(map[string]io.Reader)
+	u.stub = tieredStub{NextOffset: s.nextOffset, ModTime: s.modTime}
+	for _, ext := range tieredExts {
+		if ext == ".index" && !s.lazy {
+			b := append([]byte(nil), s.index.mmap[:s.index.size]...)
+			u.files[ext] = bytes.NewReader(b)
+			u.stub.Files = append(u.stub.Files, ext)
+			continue
+		}
+		f, err := os.Open(s.path(ext))
+		if os.IsNotExist(err) {
+			// timeindexや.keyが無いsegmentもある
+			continue
+		} else if err != nil {
+			return u, err
+		}
+		u.closers = append(u.closers, f)
+		u.files[ext] = f
+		u.stub.Files = append(u.stub.Files, ext)
+		if ext == ".store" {
+			u.store = f
+		}
+	}
+	if want, ok, err := s.readChecksumFile(); err != nil {
+		return u, err
+	} else if !ok {
+		u.store = nil
+	} else {
+		u.checksum = want
+	}
+	if s.lazy {
+		u.stub.StoreBytes, u.stub.IndexBytes = s.lazyStoreSize, s.lazyIndexSize
+	} else {
+		u.stub.StoreBytes, u.stub.IndexBytes = s.store.size, s.index.size
+	}
+	return u, nil
+}
+
+// 送り終えたsegmentのスタブを書いて閉じ、ローカルのファイルを削除する。Logのロックを取っておくこと
+func (s *segment) evict(u *tierUpload) error {
+	s.pins.Lock()
+	defer s.pins.Unlock()
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if !s.tiered {
+		b, err := json.Marshal(u.stub)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path(".tiered"), bytes.NewReader(b), s.config.fileMode()); err != nil {
+			return err
+		}
+		s.tiered = true
+		s.tieredFiles = u.stub.Files
+		s.lazyStoreSize, s.lazyIndexSize = u.stub.StoreBytes, u.stub.IndexBytes
+	}
+	if s.cache != nil {
+		s.cache.remove(s)
+	}
+	return s.dropLocal()
+}
+
+// ObjectStoreに置いたsegmentを閉じ、ローカルのファイルを消す。次に読まれるときにまた取ってくる。
+// Logのロックとs.openMuを取っておくこと
+func (s *segment) dropLocal() error {
+	if !s.lazy {
+		s.lazyStoreSize, s.lazyIndexSize = s.store.size, s.index.size
+		if err := s.closeFiles(); err != nil {
+			return err
+		}
+		s.lazy = true
+	}
+	for _, ext := range tieredExts {
+		if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Config.Tiering.CheckIntervalごとに、古い封印済みのsegmentをObjectStoreへ移す
+func (l *Log) startTiering() {
+	if l.Config.Tiering.Store == nil {
+		return
+	}
+	interval := l.Config.Tiering.CheckInterval
+	if interval <= 0 {
+		interval = l.Config.Tiering.MinAge / 10
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	closing := l.closing
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+				if _, err := l.Offload(); err != nil && err != ErrClosed {
+					zap.L().Named("tiering").Error(
+						"failed to offload segments",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// ObjectStoreから取ってきたsegmentの、ローカルのディスクのキャッシュ。最も長く読まれていないものから消す
+type tierCache struct {
+	mu    sync.Mutex
+	max   uint64
+	size  uint64
+	lru   *list.List
+	elems map[*segment]*list.Element
+}
+
+type tierCacheEntry struct {
+	segment *segment
+	size    uint64
+}
+
+func newTierCache(max uint64) *tierCache {
+	return &tierCache{
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[*segment]*list.Element),
+	}
+}
+
+// 取ってきたsegmentを加えるか、読まれたsegmentを最近読まれたものにする
+func (c *tierCache) touch(s *segment, size uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elems[s]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.elems[s] = c.lru.PushFront(&tierCacheEntry{segment: s, size: size})
+	c.size += size
+}
+
+func (c *tierCache) remove(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elems[s]; ok {
+		c.size -= e.Value.(*tierCacheEntry).size
+		c.lru.Remove(e)
+		delete(c.elems, s)
+	}
+}
+
+func (c *tierCache) over() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size > c.max
+}
+
+// 上限を超えていれば、最も長く読まれていないsegmentを返す。最後の一つは、読んでいる途中のこともあるので残す
+func (c *tierCache) victim() *segment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= c.max || c.lru.Len() <= 1 {
+		return nil
+	}
+	return c.lru.Back().Value.(*tierCacheEntry).segment
+}
+
+// キャッシュが上限を超えていれば、古いものからローカルのファイルを消す。
+// segmentを閉じるので、読み込みのロックを解放してから呼ぶ
+func (l *Log) trimCache() {
+	if l.cache == nil || !l.cache.over() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s := l.cache.victim(); s != nil; s = l.cache.victim() {
+		l.cache.remove(s)
+		s.pins.Lock()
+		s.openMu.Lock()
+		err := s.dropLocal()
+		s.openMu.Unlock()
+		s.pins.Unlock()
+		if err != nil {
+			zap.L().Named("tiering").Error(
+				"failed to drop cached segment",
+				zap.String("dir", l.Dir),
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 古い封印済みのsegmentがObjectStoreへ移ってローカルから消え、読むときに取ってこられることを確認
+func TestLogOffload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := os.MkdirTemp("", "tier-remote-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tiering.Store = DirObjectStore{Dir: remote}
+	c.Tiering.CheckInterval = time.Hour
+	c.Tiering.Prefix = "topic/"
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	size := log.Size()
+
+	evicted, err := log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 2, evicted)
+	for _, base := range []string{"0", "2"} {
+		require.NoFileExists(t, filepath.Join(dir, base+".store"))
+		require.FileExists(t, filepath.Join(dir, base+".tiered"))
+		require.FileExists(t, filepath.Join(remote, "topic", base+".store"))
+		require.FileExists(t, filepath.Join(remote, "topic", base+".index"))
+	}
+	// アクティブなsegmentは残る
+	require.FileExists(t, filepath.Join(dir, "4.store"))
+	require.Equal(t, size, log.Size())
+
+	check := func(log *Log) {
+		for i := 0; i < 5; i++ {
+			got, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+		}
+	}
+	check(log)
+	require.FileExists(t, filepath.Join(dir, "0.store"))
+
+	// 取ってきたsegmentは、送り直さずにローカルから消す
+	evicted, err = log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 2, evicted)
+	require.NoFileExists(t, filepath.Join(dir, "0.store"))
+
+	// 開き直しても、スタブから読める
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// 削除したsegmentは、ObjectStoreからも消える
+	removed, err := log.removeExpired(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	entries, err := os.ReadDir(filepath.Join(remote, "topic"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoFileExists(t, filepath.Join(dir, "0.tiered"))
+}
+
+// キャッシュの上限を超えると、最も長く読まれていないsegmentからローカルのファイルが消え、読むときにまた取ってくることを確認
+func TestLogTierCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tier-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := os.MkdirTemp("", "tier-cache-remote-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(remote)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tiering.Store = DirObjectStore{Dir: remote}
+	c.Tiering.CheckInterval = time.Hour
+	// 最後に読んだsegmentしか残さない
+	c.Tiering.CacheBytes = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	evicted, err := log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 2, evicted)
+
+	read := func(off uint64) {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), got.Value)
+	}
+	read(0)
+	require.FileExists(t, filepath.Join(dir, "0.store"))
+	read(2)
+	require.NoFileExists(t, filepath.Join(dir, "0.store"))
+	require.FileExists(t, filepath.Join(dir, "2.store"))
+	read(1)
+	require.FileExists(t, filepath.Join(dir, "0.store"))
+	require.NoFileExists(t, filepath.Join(dir, "2.store"))
+
+	// 走査の途中で読んでいたsegmentが消されても、取ってきて読み進める
+	it, err := log.Scan(0)
+	require.NoError(t, err)
+	defer it.Close()
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Record().Value))
+	}
+	require.NoError(t, it.Err())
+	require.Len(t, got, 5)
+
+	// キャッシュに任せるので、取ってきたsegmentはOffloadで消さない
+	evicted, err = log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 0, evicted)
+	require.FileExists(t, filepath.Join(dir, "2.store"))
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"bufio"
+	"sort"
+)
+
+// timeindexは、8バイトの時刻(UNIXエポックからのナノ秒)と、indexと同じ幅の相対オフセットが並ぶ。
+// それまでで最も新しい時刻のレコードが書き込まれたときだけエントリを追加するので、時刻は必ず昇順になる。
+// そのため、ある時刻以降に書き込まれた最初のレコードは、二分探索で見つけられる
+
+const tsWidth uint64 = 8
+
+type timeEntry struct {
+	timestamp int64
+	relOff    uint64
+}
+
+type timeIndex struct {
+	file    File
+	buf     *bufio.Writer
+	entries []timeEntry
+	// 相対オフセットの幅と、エントリ全体の幅
+	offWidth uint64
+	entWidth uint64
+	// 読み取り専用のログのtimeindex。エントリはメモリにだけ持ち、ファイルに書かない
+	readOnly bool
+}
+
+func newTimeIndex(f File, offWidth uint64) (*timeIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := &timeIndex{
+		file:     f,
+		buf:      bufio.NewWriter(f),
+		offWidth: offWidth,
+		entWidth: tsWidth + offWidth,
+	}
+	// 書きかけのエントリがあれば無視する
+	size := uint64(fi.Size()) / t.entWidth * t.entWidth
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil && size > 0 {
+		return nil, err
+	}
+	for at := uint64(0); at < size; at += t.entWidth {
+		t.entries = append(t.entries, timeEntry{
+			timestamp: int64(enc.Uint64(b[at : at+tsWidth])),
+			relOff:    getUint(b[at+tsWidth : at+t.entWidth]),
+		})
+	}
+	return t, nil
+}
+
+// レコードの時刻を記録する。これまでで最も新しい時刻のときだけエントリを追加する
+func (t *timeIndex) observe(timestamp int64, relOff uint64) error {
+	if n := len(t.entries); n > 0 && timestamp <= t.entries[n-1].timestamp {
+		return nil
+	}
+	b := make([]byte, t.entWidth)
+	enc.PutUint64(b, uint64(timestamp))
+	putUint(b[tsWidth:], relOff)
+	if !t.readOnly {
+		if _, err := t.buf.Write(b); err != nil {
+			return err
+		}
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: timestamp, relOff: relOff})
+	return nil
+}
+
+// timestamp以降に書き込まれた最初のレコードの相対オフセットを返す。無ければfalse
+func (t *timeIndex) lookup(timestamp int64) (uint64, bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == len(t.entries) {
+		return 0, false
+	}
+	return t.entries[i].relOff, true
+}
+
+// 相対オフセットがrelOffまでのレコードの、最も新しい時刻を返す。relOffより前のエントリが無ければfalse
+func (t *timeIndex) timeAt(relOff uint64) (int64, bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].relOff > relOff
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return t.entries[i-1].timestamp, true
+}
+
+// 相対オフセットがrelOff以降のエントリを捨てる
+func (t *timeIndex) truncate(relOff uint64) error {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].relOff >= relOff
+	})
+	if i == len(t.entries) {
+		return nil
+	}
+	if t.readOnly {
+		t.entries = t.entries[:i]
+		return nil
+	}
+	if err := t.buf.Flush(); err != nil {
+		return err
+	}
+	if err := t.file.Truncate(int64(uint64(i) * t.entWidth)); err != nil {
+		return err
+	}
+	t.entries = t.entries[:i]
+	return nil
+}
+
+func (t *timeIndex) flush() error {
+	return t.buf.Flush()
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.buf.Flush(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
@@ -0,0 +1,333 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "proglog/api/v1"
+)
+
+var (
+	ErrTopicNotFound     = errors.New("topic not found")
+	ErrPartitionNotFound = errors.New("partition not found")
+	ErrTooManyTopics     = errors.New("too many topics")
+	ErrInvalidTopic      = errors.New("invalid topic name")
+	// トピック名は、ディレクトリ名としてそのまま使える文字に限る
+	validTopic = regexp.MustCompile(`^[A-Za-z0-9._-]{1,255}$`)
+)
+
+// LogManagerは、一つのデータディレクトリの下で、名前の付いた複数のトピックを管理する。
+// トピックごとにDirの下に同じ名前のディレクトリを持ち、その下にパーティションの番号のディレクトリを持つ。
+// segmentはパーティションごと、設定はトピックごとに別になる
+type LogManager struct {
+	mu sync.Mutex
+
+	Dir string
+	// トピックの設定。TopicConfigsにあるトピックは、これにトピックごとの設定を重ねる
+	Config       Config
+	TopicConfigs map[string]TopicConfig
+	// Createでパーティション数を指定しなかったときのパーティション数。0なら1
+	Partitions int
+	// 書き込むパーティションの選び方。nilなら、トピックごとのHashPartitioner
+	Partitioner Partitioner
+	// Createで作れるトピックの数の上限。0なら制限しない
+	MaxTopics int
+
+	topics map[string]*Topic
+	closed bool
+	// nilでなければ、トピックへの書き込みをパーティションのLogに直接行わずにこれに渡す
+	replicate topicReplicator
+}
+
+// トピックへの書き込みを複製する。DistributedLogが満たし、raftでコミットしてからパーティションのLogに書き込む
+type topicReplicator interface {
+	appendTopic(topic string, partition int, record *api.Record) (uint64, error)
+	deleteTopicRecords(topic string, partition int, before uint64) (uint64, error)
+}
+
+// トピックごとに変える設定。0やnilの項目は、LogManager.Configの設定を引き継ぐ
+type TopicConfig struct {
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	// nilでなければ、LogManager.Configのものと置き換える
+	Retention   *RetentionConfig
+	Compression *CompressionConfig
+	Flush       *FlushConfig
+	// トピックの合計サイズの上限。nilなら制限しない
+	Quota *QuotaConfig
+}
+
+// cにトピックの設定を重ねる
+func (t TopicConfig) apply(c Config) Config {
+	if t.MaxStoreBytes != 0 {
+		c.Segment.MaxStoreBytes = t.MaxStoreBytes
+	}
+	if t.MaxIndexBytes != 0 {
+		c.Segment.MaxIndexBytes = t.MaxIndexBytes
+	}
+	if t.Retention != nil {
+		c.Retention = *t.Retention
+	}
+	if t.Compression != nil {
+		c.Compression = *t.Compression
+	}
+	if t.Flush != nil {
+		c.Segment.Flush = *t.Flush
+	}
+	return c
+}
+
+// dirの下にある既存のトピックを開く。topicsはトピックごとの設定で、nilでもよい
+func NewLogManager(dir string, c Config, topics map[string]TopicConfig) (*LogManager, error) {
+	if err := os.MkdirAll(dir, c.dirMode()); err != nil {
+		return nil, err
+	}
+	m := &LogManager{
+		Dir:          dir,
+		Config:       c,
+		TopicConfigs: topics,
+		topics:       make(map[string]*Topic),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validTopic.MatchString(entry.Name()) {
+			continue
+		}
+		if _, err := m.open(entry.Name(), 0); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// 既存のトピックを返す。無ければErrTopicNotFound
+func (m *LogManager) Get(topic string) (*Topic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	t, ok := m.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTopicNotFound, topic)
+	}
+	return t, nil
+}
+
+// トピックを返す。無ければpartitions個のパーティションで作る。0ならLogManager.Partitions。
+// 既存のトピックのパーティション数は変えない。MaxTopicsに達していればErrTooManyTopics
+func (m *LogManager) Create(topic string, partitions int) (*Topic, error) {
+	return m.create(topic, partitions, true)
+}
+
+// limitなら、MaxTopicsに達していれば作らない。raftでコミット済みの作成は、ノードの設定によらず作る
+func (m *LogManager) create(topic string, partitions int, limit bool) (*Topic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if t, ok := m.topics[topic]; ok {
+		return t, nil
+	}
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+	if limit && m.MaxTopics > 0 && len(m.topics) >= m.MaxTopics {
+		return nil, fmt.Errorf("%w: %d", ErrTooManyTopics, m.MaxTopics)
+	}
+	if partitions == 0 {
+		partitions = m.Partitions
+	}
+	if partitions <= 0 {
+		partitions = 1
+	}
+	return m.open(topic, partitions)
+}
+
+func validateTopic(topic string) error {
+	if !validTopic.MatchString(topic) || topic == "." || topic == ".." {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// トピックのディレクトリにあるパーティションを開く。一つも無ければpartitions個作る。
+// 呼び出し側でロックを取っておくこと
+func (m *LogManager) open(topic string, partitions int) (*Topic, error) {
+	dir := filepath.Join(m.Dir, topic)
+	// 既存のパーティションは、0から連番のディレクトリ
+	existing := 0
+	for {
+		fi, err := os.Stat(filepath.Join(dir, strconv.Itoa(existing)))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			break
+		}
+		existing++
+	}
+	if existing > 0 {
+		partitions = existing
+	}
+	if partitions == 0 {
+		return nil, fmt.Errorf("topic %q has no partitions", topic)
+	}
+	c := m.TopicConfigs[topic].apply(m.Config)
+	t := &Topic{Name: topic, dir: dir, partitioner: m.Partitioner, replicate: m.replicate}
+	if t.partitioner == nil {
+		t.partitioner = &HashPartitioner{}
+	}
+	for i := 0; i < partitions; i++ {
+		partitionDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.MkdirAll(partitionDir, c.dirMode()); err != nil {
+			t.Close()
+			return nil, err
+		}
+		pc := c
+		if pc.Segment.IndexDir != "" {
+			// パーティションごとに別のディレクトリにする
+			pc.Segment.IndexDir = filepath.Join(pc.Segment.IndexDir, topic, strconv.Itoa(i))
+		}
+		l, err := NewLog(partitionDir, pc)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.partitions = append(t.partitions, l)
+	}
+	if quota := m.TopicConfigs[topic].Quota; quota != nil {
+		t.setupQuota(*quota)
+	}
+	m.topics[topic] = t
+	return t, nil
+}
+
+// トピックへの書き込みをrに渡すようにする
+func (m *LogManager) setReplicator(r topicReplicator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replicate = r
+	for _, t := range m.topics {
+		t.replicate = r
+	}
+}
+
+// トピックの名前を昇順で返す
+func (m *LogManager) Topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	topics := make([]string, 0, len(m.topics))
+	for topic := range m.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// トピックを閉じ、ディレクトリごと削除する
+func (m *LogManager) Delete(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[topic]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrTopicNotFound, topic)
+	}
+	delete(m.topics, topic)
+	if err := t.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.dir)
+}
+
+// すべてのトピックを閉じる
+func (m *LogManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	var first error
+	for _, t := range m.topics {
+		if err := t.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Topicは、一つ以上のパーティションからなる名前の付いたログ。パーティションごとに別のLogを持ち、
+// オフセットはパーティションごとに0から数える。パーティションをまたいだ順序は保たれない
+type Topic struct {
+	Name string
+
+	dir         string
+	partitions  []*Log
+	partitioner Partitioner
+	quota       QuotaConfig
+	replicate   topicReplicator
+}
+
+// Partitionerが選んだパーティションにrecordを書き込み、パーティションとオフセットを返す。
+// QuotaRejectのクォータに達していればErrQuotaExceededを返す
+func (t *Topic) Append(record *api.Record) (partition int, off uint64, err error) {
+	partition = t.partitioner.Partition(record, len(t.partitions))
+	if partition < 0 || partition >= len(t.partitions) {
+		return 0, 0, fmt.Errorf("partitioner chose partition %d of %d", partition, len(t.partitions))
+	}
+	if t.replicate != nil {
+		off, err = t.replicate.appendTopic(t.Name, partition, record)
+	} else {
+		off, err = t.partitions[partition].Append(record)
+	}
+	return partition, off, err
+}
+
+// パーティションの、オフセットがbeforeより小さいレコードを削除し、新しい開始オフセットを返す
+func (t *Topic) DeleteRecords(partition int, before uint64) (uint64, error) {
+	l, err := t.Partition(partition)
+	if err != nil {
+		return 0, err
+	}
+	if t.replicate != nil {
+		return t.replicate.deleteTopicRecords(t.Name, partition, before)
+	}
+	return l.DeleteRecords(before)
+}
+
+// パーティションのLogを返す。無ければErrPartitionNotFound。
+// 読むためのもので、書き込みと削除はレプリカへ複製されるようTopicのメソッドを通すこと
+func (t *Topic) Partition(partition int) (*Log, error) {
+	if partition < 0 || partition >= len(t.partitions) {
+		return nil, fmt.Errorf("%w: %d of topic %q", ErrPartitionNotFound, partition, t.Name)
+	}
+	return t.partitions[partition], nil
+}
+
+// パーティションの数
+func (t *Topic) Partitions() int {
+	return len(t.partitions)
+}
+
+// すべてのパーティションを閉じる
+func (t *Topic) Close() error {
+	var first error
+	for _, l := range t.partitions {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
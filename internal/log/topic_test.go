@@ -0,0 +1,208 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// トピックごとに別のディレクトリと設定でLogを持ち、開き直すと既存のトピックを開くことを確認
+func TestLogManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	topics := map[string]TopicConfig{"small": {MaxStoreBytes: 32}}
+	m, err := NewLogManager(dir, c, topics)
+	require.NoError(t, err)
+
+	_, err = m.Get("orders")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+	for _, name := range []string{"", ".", "..", "a/b", "../escape"} {
+		_, err = m.Create(name, 0)
+		require.Error(t, err, name)
+	}
+
+	for _, name := range []string{"orders", "small"} {
+		topic, err := m.Create(name, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, topic.Partitions())
+		for i := 0; i < 3; i++ {
+			_, _, err := topic.Append(&api.Record{Value: []byte(name)})
+			require.NoError(t, err)
+		}
+	}
+	orders, err := m.Get("orders")
+	require.NoError(t, err)
+	l, err := orders.Partition(0)
+	require.NoError(t, err)
+	require.Len(t, l.segments, 1)
+	sized, err := m.Get("small")
+	require.NoError(t, err)
+	l, err = sized.Partition(0)
+	require.NoError(t, err)
+	require.Greater(t, len(l.segments), 1)
+	require.Equal(t, []string{"orders", "small"}, m.Topics())
+	require.NoError(t, m.Close())
+
+	_, err = m.Create("orders", 0)
+	require.Equal(t, ErrClosed, err)
+
+	m, err = NewLogManager(dir, c, topics)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, []string{"orders", "small"}, m.Topics())
+	orders, err = m.Get("orders")
+	require.NoError(t, err)
+	l, err = orders.Partition(0)
+	require.NoError(t, err)
+	record, err := l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders"), record.Value)
+
+	require.NoError(t, m.Delete("orders"))
+	require.Equal(t, []string{"small"}, m.Topics())
+	_, err = os.Stat(filepath.Join(dir, "orders"))
+	require.True(t, os.IsNotExist(err))
+	require.ErrorIs(t, m.Delete("orders"), ErrTopicNotFound)
+}
+
+// MaxTopicsに達したら新しいトピックを作らず、既存のトピックは返すことを確認
+func TestLogManagerMaxTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-manager-max-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{}, nil)
+	require.NoError(t, err)
+	defer m.Close()
+	m.MaxTopics = 2
+	for _, name := range []string{"a", "b", "a"} {
+		_, err := m.Create(name, 0)
+		require.NoError(t, err)
+	}
+	_, err = m.Create("c", 0)
+	require.ErrorIs(t, err, ErrTooManyTopics)
+	_, err = m.Create("bad/name", 0)
+	require.ErrorIs(t, err, ErrInvalidTopic)
+	require.Equal(t, []string{"a", "b"}, m.Topics())
+
+	require.NoError(t, m.Delete("b"))
+	_, err = m.Create("c", 0)
+	require.NoError(t, err)
+}
+
+// パーティションごとにオフセットを数え、開き直してもパーティション数が変わらないことを確認
+func TestTopicPartitions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "topic-partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{}, nil)
+	require.NoError(t, err)
+	m.Partitions = 3
+	topic, err := m.Create("events", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, topic.Partitions())
+
+	// キーの無いレコードは順番に振り分けられる
+	for i := 0; i < 6; i++ {
+		partition, off, err := topic.Append(&api.Record{Value: []byte("x")})
+		require.NoError(t, err)
+		require.Equal(t, i%3, partition)
+		require.Equal(t, uint64(i/3), off)
+	}
+	// 同じキーは同じパーティションに書き込まれる
+	first, _, err := topic.Append(&api.Record{Key: []byte("user-1")})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		partition, _, err := topic.Append(&api.Record{Key: []byte("user-1")})
+		require.NoError(t, err)
+		require.Equal(t, first, partition)
+	}
+	_, err = topic.Partition(3)
+	require.ErrorIs(t, err, ErrPartitionNotFound)
+	require.NoError(t, m.Close())
+
+	m, err = NewLogManager(dir, Config{}, nil)
+	require.NoError(t, err)
+	defer m.Close()
+	topic, err = m.Create("events", 5)
+	require.NoError(t, err)
+	require.Equal(t, 3, topic.Partitions())
+	l, err := topic.Partition(2)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, off, uint64(1))
+}
+
+func TestPartitioner(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"round robin ignores keys": func(t *testing.T) {
+			p := &RoundRobinPartitioner{}
+			for i := 0; i < 8; i++ {
+				require.Equal(t, i%4, p.Partition(&api.Record{Key: []byte("k")}, 4))
+			}
+		},
+		"hash spreads keys": func(t *testing.T) {
+			p := &HashPartitioner{}
+			seen := map[int]bool{}
+			for i := 0; i < 100; i++ {
+				partition := p.Partition(&api.Record{Key: []byte{byte(i)}}, 4)
+				require.GreaterOrEqual(t, partition, 0)
+				require.Less(t, partition, 4)
+				seen[partition] = true
+			}
+			require.Len(t, seen, 4)
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// トピックの設定で指定した項目だけを置き換え、残りはLogManager.Configを引き継ぐことを確認
+func TestTopicConfigOverride(t *testing.T) {
+	dir, err := os.MkdirTemp("", "topic-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.Flush.EveryRecords = 1
+	c.Retention.MaxBytes = 1 << 20
+	c.Compression.MinBytes = 64
+	m, err := NewLogManager(dir, c, map[string]TopicConfig{
+		"busy": {
+			MaxStoreBytes: 1 << 20,
+			Retention:     &RetentionConfig{MaxBytes: 1 << 30},
+			Flush:         &FlushConfig{Interval: time.Second},
+		},
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	quiet, err := m.Create("quiet", 0)
+	require.NoError(t, err)
+	l, err := quiet.Partition(0)
+	require.NoError(t, err)
+	require.Equal(t, c.Segment, l.Config.Segment)
+	require.Equal(t, c.Retention, l.Config.Retention)
+
+	busy, err := m.Create("busy", 0)
+	require.NoError(t, err)
+	l, err = busy.Partition(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<20), l.Config.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1024), l.Config.Segment.MaxIndexBytes)
+	require.Equal(t, RetentionConfig{MaxBytes: 1 << 30}, l.Config.Retention)
+	require.Equal(t, FlushConfig{Interval: time.Second}, l.Config.Segment.Flush)
+	require.Equal(t, c.Compression, l.Config.Compression)
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// TruncateAfterは、末尾のレコードを捨てて書き込みを巻き戻す。合意の取れていない末尾のエントリを取り消すのに使う。
+// offより後ろから始まるsegmentは削除し、offを持つsegmentのstore、index、timeindexを切り詰めてアクティブなsegmentにする。
+// 封印済みのsegmentを切り詰めるときは、書き込めるように開き直し、キーのブルームフィルタと.crcも作り直させる
+
+// offより後ろのレコードを捨て、次の書き込みをoff+1から始める。
+// offが保持されている最小のオフセットより前であればapi.ErrOffsetOutOfRangeを返す
+func (l *Log) TruncateAfter(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		return err
+	}
+	next := off + 1
+	end := l.activeSegment.nextOffset
+	if next >= end {
+		return nil
+	}
+	if next < l.lowestOffset() || next < l.segments[0].baseOffset {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	// 切り詰めた後の末尾を持つsegment。直前のsegmentの終わりと同じなら、そのsegmentを残す
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return next <= l.segments[i].nextOffset
+	})
+	s := l.segments[i]
+	if s.tiered {
+		return fmt.Errorf("cannot truncate segment %d in the object store", s.baseOffset)
+	}
+	for _, old := range l.segments[i+1:] {
+		if err := old.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:i+1]
+	if s != l.activeSegment {
+		// 封印したsegmentは、書き込めるように開き直す
+		if err := s.Close(); err != nil {
+			return err
+		}
+		for _, ext := range []string{".bloom", ".crc"} {
+			if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		reopened, err := newSegment(s.dir, s.baseOffset, s.config)
+		if err != nil {
+			return err
+		}
+		reopened.stats = l.stats
+		l.segments[i] = reopened
+		s = reopened
+	}
+	l.activeSegment = s
+	if err := s.truncateAfter(off); err != nil {
+		return err
+	}
+	l.resetSize()
+	// 捨てた後に書き込むオフセットを、グループコミットでfsync済みと見なさないようにする
+	l.commits.rewind(next)
+	// 捨てたレコードを、キャッシュから読めないようにする
+	if l.records != nil {
+		l.records.removeRange(next, end)
+	}
+	if err := l.loadProducers(); err != nil {
+		return err
+	}
+	// 捨てたレコードの状態を含むスナップショットを、開き直したときに使わないよう書き直す
+	return l.saveProducers()
+}
+
+// offより後ろのレコードを、store、index、timeindexから捨てる。封印していないsegmentで呼ぶこと
+func (s *segment) truncateAfter(off uint64) error {
+	next := off + 1
+	if next >= s.nextOffset {
+		return nil
+	}
+	// 残すレコードの終わりの位置を、手前のエントリからstoreを読み進めて探す
+	from, err := s.seek(next)
+	if err != nil {
+		return err
+	}
+	cut := from
+	if err := s.walk(from, func(pos uint64, p []byte, size uint64) error {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if record.Offset > off {
+			return errStopWalk
+		}
+		cut = pos + size
+		return nil
+	}); err != nil && err != errStopWalk {
+		return err
+	}
+	if err := s.store.truncate(cut); err != nil {
+		return err
+	}
+
+	// 捨てたレコードを指すエントリを捨てる
+	entries := s.index.count()
+	for entries > 0 {
+		_, pos, err := s.index.Read(int64(entries) - 1)
+		if err != nil {
+			return err
+		}
+		if pos < cut {
+			break
+		}
+		entries--
+	}
+	s.index.truncate(entries)
+	if err := s.timeIndex.truncate(next - s.baseOffset); err != nil {
+		return err
+	}
+	s.nextOffset = next
+	if next == s.baseOffset {
+		s.created = time.Time{}
+	}
+	if atomic.LoadUint64(&s.synced) > next {
+		atomic.StoreUint64(&s.synced, next)
+	}
+
+	// indexを間引いている場合に備え、末尾のエントリから後ろのレコードを数え直す
+	s.sinceIndexed, s.indexedPos = 0, 0
+	if _, pos, err := s.index.Read(-1); err == nil {
+		s.indexedPos = pos
+		if err := s.walk(pos, func(uint64, []byte, uint64) error {
+			s.sinceIndexed++
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
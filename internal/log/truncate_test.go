@@ -0,0 +1,109 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TruncateAfterで末尾のレコードを捨て、捨てたオフセットから書き込みを続けられることを確認。
+// 封印済みのsegmentまで巻き戻しても、開き直しても同じ内容が読める
+func TestLogTruncateAfter(t *testing.T) {
+	for scenario, off := range map[string]uint64{
+		"active segment": 8,
+		"sealed segment": 5,
+		"segment end":    3,
+		"first record":   0,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "truncate-after-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 120
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.SparseIndex.EveryRecords = 2
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := uint64(0); i < 10; i++ {
+				_, err := l.Append(&api.Record{
+					Value:      []byte("hello world"),
+					Timestamp:  int64(i + 1),
+					ProducerId: "p",
+					Sequence:   i + 1,
+				})
+				require.NoError(t, err)
+			}
+			// [0, 4), [4, 8), [8, 10)のsegmentに分かれる
+			require.Len(t, l.segments, 3)
+			require.Equal(t, uint64(8), l.activeSegment.baseOffset)
+
+			require.NoError(t, l.TruncateAfter(off))
+			highest, err := l.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, off, highest)
+			_, err = l.Read(off + 1)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off + 1}, err)
+			_, err = l.OffsetForTime(time.Unix(0, int64(off+2)))
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off + 1}, err)
+
+			// 捨てたレコードのシーケンス番号は、重複ではなく新しい書き込みになる
+			next, err := l.Append(&api.Record{
+				Value:      []byte("rewritten"),
+				Timestamp:  100,
+				ProducerId: "p",
+				Sequence:   off + 2,
+			})
+			require.NoError(t, err)
+			require.Equal(t, off+1, next)
+			require.NoError(t, l.Close())
+
+			l, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+			for o := uint64(0); o <= off; o++ {
+				record, err := l.Read(o)
+				require.NoError(t, err)
+				require.Equal(t, o, record.Offset)
+				require.Equal(t, []byte("hello world"), record.Value)
+			}
+			record, err := l.Read(off + 1)
+			require.NoError(t, err)
+			require.Equal(t, []byte("rewritten"), record.Value)
+			problems, err := l.Verify()
+			require.NoError(t, err)
+			require.Empty(t, problems)
+		})
+	}
+}
+
+// 保持しているオフセットより前には巻き戻せないことを確認
+func TestLogTruncateAfterOutOfRange(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-after-range-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = l.DeleteRecords(3)
+	require.NoError(t, err)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, l.TruncateAfter(1))
+	// 末尾より後ろを指定しても何もしない
+	require.NoError(t, l.TruncateAfter(10))
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Verifyで見つかる問題の種類
+type ProblemKind string
+
+const (
+	// レコードのヘッダーか本体が、storeの末尾で途切れている
+	ProblemTruncatedRecord ProblemKind = "truncated record"
+	// CRC32Cが一致しないか、復号やデコードに失敗した
+	ProblemCorruptRecord ProblemKind = "corrupt record"
+	// segmentの中のレコードのオフセットが、増えていないか、segmentの範囲に無い
+	ProblemOffsetOrder ProblemKind = "offset out of order"
+	// 隣り合うsegmentの間で、オフセットが途切れているか重なっている
+	ProblemOffsetGap ProblemKind = "offset gap"
+	// indexのエントリが、レコードの境目を指していない
+	ProblemIndexPosition ProblemKind = "index position"
+	// indexのエントリのオフセットが、指しているレコードのオフセットと異なる
+	ProblemIndexOffset ProblemKind = "index offset"
+	// indexのエントリが、オフセットかポジションの昇順になっていない
+	ProblemIndexOrder ProblemKind = "index order"
+	// storeの最初のレコードを指すエントリが無い
+	ProblemIndexMissing ProblemKind = "index missing"
+)
+
+// Problemは、Verifyで見つかったstoreとindexの不整合の一つ
+type Problem struct {
+	Kind ProblemKind
+	// 問題のあったsegment
+	BaseOffset uint64
+	// 問題のあったレコードか、indexのエントリが指すレコードのオフセットとstoreの中での位置
+	Offset   uint64
+	Position uint64
+	Detail   string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf(
+		"segment %d: %s at offset %d, position %d: %s",
+		p.BaseOffset, p.Kind, p.Offset, p.Position, p.Detail,
+	)
+}
+
+// 全segmentのstoreとindexを読み、レコードの境目、長さ、オフセットの並び、indexのエントリが正しいかを確かめ、
+// 見つかった問題を返す。問題があっても直さない。ファイルを読めないなどで確かめられなければエラーを返す。
+// 書き込みを長く止めないよう、ロックはsegmentを一つ確かめるごとに放す。
+// そのため、確かめている間にコンパクションなどで置き換えられたsegmentは確かめないことがある
+func (l *Log) Verify() ([]Problem, error) {
+	var problems []Problem
+	for from := uint64(0); ; {
+		found, next, ok, err := l.verifyFrom(from)
+		problems = append(problems, found...)
+		if err != nil || !ok {
+			return problems, err
+		}
+		from = next
+	}
+}
+
+// baseOffsetがfrom以上の最初のsegmentを確かめ、次に確かめるsegmentを探すためのfromを返す。
+// そのようなsegmentが無ければfalse
+func (l *Log) verifyFrom(from uint64) (problems []Problem, next uint64, ok bool, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset >= from
+	})
+	if i == len(l.segments) {
+		return nil, 0, false, nil
+	}
+	s := l.segments[i]
+	if err := s.open(); err != nil {
+		return nil, 0, false, err
+	}
+	if i > 0 {
+		if prev := l.segments[i-1]; s.baseOffset != prev.nextOffset {
+			problems = append(problems, Problem{
+				Kind:       ProblemOffsetGap,
+				BaseOffset: s.baseOffset,
+				Offset:     s.baseOffset,
+				Detail:     fmt.Sprintf("previous segment ends at offset %d", prev.nextOffset),
+			})
+		}
+	}
+	found, err := s.verify()
+	problems = append(problems, found...)
+	return problems, s.baseOffset + 1, true, err
+}
+
+// segmentのstoreを先頭から読み、indexのエントリと突き合わせる。segmentは開いておくこと
+func (s *segment) verify() ([]Problem, error) {
+	var problems []Problem
+	report := func(kind ProblemKind, off, pos uint64, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Kind:       kind,
+			BaseOffset: s.baseOffset,
+			Offset:     off,
+			Position:   pos,
+			Detail:     fmt.Sprintf(format, args...),
+		})
+	}
+
+	// レコードの境目と、そこにあるレコードのオフセット
+	offsets := make(map[uint64]uint64)
+	var last uint64
+	var seen bool
+	for pos := s.store.start; pos < s.store.size; {
+		h, err := s.store.frameAt(pos)
+		if err == io.ErrUnexpectedEOF {
+			report(ProblemTruncatedRecord, 0, pos, "header is cut off, %d bytes left", s.store.size-pos)
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+		end := pos + h.width + h.n
+		if end > s.store.size || end < pos {
+			report(ProblemTruncatedRecord, 0, pos, "record ends at %d beyond store size %d", end, s.store.size)
+			break
+		}
+		if h.hole {
+			pos = end
+			continue
+		}
+		p, _, err := s.store.readRecord(pos)
+		record := &api.Record{}
+		if err == nil {
+			err = proto.Unmarshal(p, record)
+		}
+		if err != nil {
+			// 長さはわかっているので、次のレコードから確かめ続ける
+			report(ProblemCorruptRecord, 0, pos, "%v", err)
+			pos = end
+			continue
+		}
+		off := record.Offset
+		switch {
+		case off < s.baseOffset || off >= s.nextOffset:
+			report(ProblemOffsetOrder, off, pos, "outside segment range [%d, %d)", s.baseOffset, s.nextOffset)
+		case seen && off <= last:
+			report(ProblemOffsetOrder, off, pos, "follows offset %d", last)
+		}
+		offsets[pos] = off
+		last, seen = off, true
+		pos = end
+	}
+
+	n := s.index.count()
+	first, err := s.firstRecordPos()
+	if err != nil {
+		return problems, err
+	}
+	if first < s.store.size {
+		if _, pos, err := s.index.Read(0); err != nil || pos != first {
+			report(ProblemIndexMissing, s.baseOffset, 0, "first record has no index entry")
+		}
+	}
+	var lastRel, lastPos uint64
+	for i := uint64(0); i < n; i++ {
+		rel, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return problems, err
+		}
+		off := s.baseOffset + rel
+		if i > 0 && (rel <= lastRel || pos <= lastPos) {
+			report(ProblemIndexOrder, off, pos, "entry %d follows offset %d at position %d", i, s.baseOffset+lastRel, lastPos)
+		}
+		lastRel, lastPos = rel, pos
+		got, ok := offsets[pos]
+		if !ok {
+			report(ProblemIndexPosition, off, pos, "entry %d does not point to a record", i)
+			continue
+		}
+		if got != off {
+			report(ProblemIndexOffset, off, pos, "entry %d points to offset %d", i, got)
+		}
+	}
+	return problems, nil
+}
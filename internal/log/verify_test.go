@@ -0,0 +1,111 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 開いたままのログのファイルを壊し、Verifyがその問題を報告することを確認
+func TestVerify(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		damage func(t *testing.T, log *Log)
+		want   ProblemKind
+	}{
+		"healthy log": {
+			damage: func(t *testing.T, log *Log) {},
+		},
+		"corrupt record": {
+			damage: func(t *testing.T, log *Log) {
+				s := log.segments[0]
+				_, pos, err := s.index.Read(1)
+				require.NoError(t, err)
+				writeFileAt(t, s.path(".store"), []byte{0xff}, int64(pos+frameWidth))
+			},
+			want: ProblemCorruptRecord,
+		},
+		"truncated record": {
+			damage: func(t *testing.T, log *Log) {
+				s := log.activeSegment
+				require.NoError(t, s.store.flush())
+				header := make([]byte, frameWidth)
+				enc.PutUint64(header, 100)
+				appendFile(t, s.path(".store"), header)
+				s.store.size += frameWidth
+			},
+			want: ProblemTruncatedRecord,
+		},
+		"index points inside a record": {
+			damage: func(t *testing.T, log *Log) {
+				s := log.segments[0]
+				_, pos, err := s.index.Read(1)
+				require.NoError(t, err)
+				require.NoError(t, s.index.rewrite(1, 1, pos+1))
+			},
+			want: ProblemIndexPosition,
+		},
+		"index points to another record": {
+			damage: func(t *testing.T, log *Log) {
+				s := log.segments[0]
+				_, pos, err := s.index.Read(0)
+				require.NoError(t, err)
+				require.NoError(t, s.index.rewrite(1, 1, pos))
+			},
+			want: ProblemIndexOrder,
+		},
+		"index offset mismatch": {
+			damage: func(t *testing.T, log *Log) {
+				s := log.segments[0]
+				_, pos, err := s.index.Read(1)
+				require.NoError(t, err)
+				require.NoError(t, s.index.rewrite(1, 2, pos))
+			},
+			want: ProblemIndexOffset,
+		},
+		"gap between segments": {
+			damage: func(t *testing.T, log *Log) {
+				log.segments[1].baseOffset++
+			},
+			want: ProblemOffsetGap,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "verify-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			require.Greater(t, len(log.segments), 2)
+
+			tc.damage(t, log)
+			problems, err := log.Verify()
+			require.NoError(t, err)
+			if tc.want == "" {
+				require.Empty(t, problems)
+				return
+			}
+			require.NotEmpty(t, problems)
+			require.Equal(t, tc.want, problems[0].Kind, problems)
+		})
+	}
+}
+
+func writeFileAt(t *testing.T, name string, b []byte, off int64) {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt(b, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
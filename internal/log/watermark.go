@@ -0,0 +1,65 @@
+package log
+
+import (
+	"sync/atomic"
+)
+
+// ログには二つのウォーターマークがある。NextOffsetは次に書き込まれるオフセットで、書き込んだレコードはすべてその前にある。
+// CommittedOffsetはstoreをfsyncし終えたレコードの次のオフセット(ハイウォーターマーク)で、これより前のレコードは
+// 電源が落ちても失われない。封印するsegmentはfsyncするので、アクティブなsegmentより前のレコードはすべてコミット済み。
+// Config.Segment.HideUncommittedなら、読み手にはCommittedOffsetより前のレコードだけを見せ、
+// 落ちたときに消えるかもしれないレコードを読ませない
+
+// コミット済みのレコードの次のオフセットを返す
+func (l *Log) CommittedOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.committedOffset(), nil
+}
+
+// 呼び出し側でロックを取っておくこと
+func (l *Log) committedOffset() uint64 {
+	s := l.activeSegment
+	if l.Config.readOnly {
+		// 書き込まないので、開いたときにファイルにあったレコードはすべてコミット済み
+		return s.nextOffset
+	}
+	return atomic.LoadUint64(&s.synced)
+}
+
+// 読み手に見せるレコードの次のオフセット。呼び出し側でロックを取っておくこと
+func (l *Log) visibleOffset() uint64 {
+	if l.Config.Segment.HideUncommitted {
+		return l.committedOffset()
+	}
+	return l.activeSegment.nextOffset
+}
+
+// offのレコードを読み手に見せるかどうか。呼び出し側でロックを取っておくこと
+func (l *Log) visible(off uint64) bool {
+	return !l.Config.Segment.HideUncommitted || off < l.committedOffset()
+}
+
+// 読み手に見せるレコードの次のオフセットを、ロックを取って返す
+func (l *Log) visibleNext() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.visibleOffset()
+}
+
+// storeをfsyncし終えたときに、その時点のnextOffsetまでをコミット済みにする。fsyncが並行しても戻さない
+func (s *segment) markSynced(next uint64) {
+	for {
+		synced := atomic.LoadUint64(&s.synced)
+		if next <= synced || atomic.CompareAndSwapUint64(&s.synced, synced, next) {
+			return
+		}
+	}
+}
+
+// コミット済みになったレコードを、HideUncommittedで待っている購読者に届ける
+func (l *Log) notifyCommitted() {
+	if l.Config.Segment.HideUncommitted {
+		l.notifyAppend()
+	}
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// HideUncommittedでは、fsyncしていないレコードは読めず、SyncでCommittedOffsetが進むと読めるようになることを確認
+func TestLogHideUncommitted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-hide-uncommitted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.HideUncommitted = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	sub, err := log.Subscribe(0, 10)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	committed, err := log.CommittedOffset()
+	require.NoError(t, err)
+	require.Zero(t, committed)
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), next)
+
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	_, err = log.ReadKey([]byte("a"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	it, err := log.Scan(0)
+	require.NoError(t, err)
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	select {
+	case e := <-sub.C:
+		t.Fatalf("received uncommitted record %d", e.Record.Offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, log.Sync())
+	committed, err = log.CommittedOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), committed)
+	got, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got.Offset)
+	// 止まっていたIteratorも、コミットされた分から読み進める
+	for off := uint64(0); off < 3; off++ {
+		require.True(t, it.Next())
+		require.Equal(t, off, it.Record().Offset)
+	}
+	for off := uint64(0); off < 3; off++ {
+		e := <-sub.C
+		require.Equal(t, off, e.Record.Offset)
+	}
+
+	// ロールで封印するsegmentはfsyncするので、コミット済みになる
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Roll()
+	require.NoError(t, err)
+	committed, err = log.CommittedOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), committed)
+}
+
+// GroupCommitでは、書き込みが戻った時点でコミット済みになっていることを確認
+func TestLogCommittedOffsetGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-committed-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.HideUncommitted = true
+	c.Segment.Flush.GroupCommit = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	committed, err := log.CommittedOffset()
+	require.NoError(t, err)
+	require.Equal(t, off+1, committed)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+}
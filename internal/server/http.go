@@ -1,33 +1,121 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
 )
 
-func NetHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
-	r := mux.NewRouter()
-	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+// validateがnilでなければ、書き込む前にレコードを検証し、エラーを返したレコードは書き込まずに400を返す
+func NetHTTPServer(addr string, log CommitLog, validate func(*api.Record) error) *http.Server {
+	httpsrv := newHTTPServer(log)
+	httpsrv.Validate = validate
+	// /streamや/wsのように終わらないリクエストはShutdownで待っても終わらないので、
+	// Shutdownが始まったらリクエストのContextを取り消して終わらせる
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     httpsrv.router(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
+	srv.RegisterOnShutdown(cancel)
+	return srv
 }
 
 type httpServer struct {
-	Log *Log
+	Log CommitLog
+	// 書き込み前にレコードを検証する。Config.Validateと同じで、nilなら検証しない
+	Validate func(*api.Record) error
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(log CommitLog) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log: log,
 	}
 }
 
+func (s *httpServer) router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/", s.handleProduce).Methods("POST")
+	r.HandleFunc("/produce/batch", s.handleProduceBatch).Methods("POST")
+	r.HandleFunc("/", s.handleConsume).Methods("GET")
+	r.HandleFunc("/consume", s.handleConsumePage).Methods("GET")
+	r.HandleFunc("/consume/export", s.handleExport).Methods("GET")
+	r.HandleFunc("/consume/{offset:[0-9]+}", s.handleStat).Methods("HEAD")
+	r.HandleFunc("/log", s.handleLog).Methods("GET")
+	r.HandleFunc("/stream", s.handleStream).Methods("GET")
+	r.HandleFunc("/ws", s.handleWebSocket).Methods("GET")
+	r.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+	return r
+}
+
+// HTTPでやり取りするレコードの形式
+type Record struct {
+	Key     []byte   `json:"key,omitempty"`
+	Value   []byte   `json:"value"`
+	Offset  uint64   `json:"offset"`
+	Headers []Header `json:"headers,omitempty"`
+	// 冪等な書き込みのための、producerのIDとシーケンス番号
+	ProducerID string `json:"producer_id,omitempty"`
+	Sequence   uint64 `json:"sequence,omitempty"`
+	// 有効期間(ナノ秒)。過ぎたレコードはコンパクションで取り除かれる。0なら期限は無い
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newRecord(record *api.Record) Record {
+	r := Record{
+		Key:    record.Key,
+		Value:  record.Value,
+		Offset: record.Offset,
+
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		TTL:        record.Ttl,
+	}
+	for _, h := range record.Headers {
+		r.Headers = append(r.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return r
+}
+
+func (r Record) apiRecord() *api.Record {
+	return &api.Record{
+		Key:     r.Key,
+		Value:   r.Value,
+		Headers: r.apiHeaders(),
+
+		ProducerId: r.ProducerID,
+		Sequence:   r.Sequence,
+		Ttl:        r.TTL,
+	}
+}
+
+func (r Record) apiHeaders() []*api.Header {
+	var headers []*api.Header
+	for _, h := range r.Headers {
+		headers = append(headers, &api.Header{Key: h.Key, Value: h.Value})
+	}
+	return headers
+}
+
 type ProduceRequest struct {
 	Record Record `json:"record"`
 }
@@ -36,6 +124,16 @@ type ProduceResponse struct {
 	Offset uint64 `json:"offset"`
 }
 
+// /produce/batchの応答。リクエストの配列と同じ順に、書き込んだオフセットを返す
+type ProduceBatchResponse struct {
+	Offsets []uint64 `json:"offsets"`
+}
+
+// 複数のレコードを、ロックを一度だけ取って続けて書き込めるログ。log.Logが満たす
+type batchAppender interface {
+	AppendBatch(records []*api.Record) (first, last uint64, err error)
+}
+
 type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
 }
@@ -44,6 +142,52 @@ type ConsumeResponse struct {
 	Record Record `json:"record"`
 }
 
+// /consumeの応答。NextOffsetから次のページを読めばよい
+type ConsumePageResponse struct {
+	Records    []Record `json:"records"`
+	NextOffset uint64   `json:"next_offset"`
+}
+
+// ログのエラーに対応するHTTPのステータスコード。知らないエラーは500にする
+func httpStatus(err error) int {
+	switch err.(type) {
+	case api.ErrOffsetOutOfRange:
+		return http.StatusNotFound
+	case api.ErrRecordTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case api.ErrBackpressure:
+		return http.StatusTooManyRequests
+	case api.ErrSegmentFull:
+		return http.StatusServiceUnavailable
+	case api.ErrStaleSequence:
+		return http.StatusConflict
+	case api.ErrRecordRejected:
+		return http.StatusBadRequest
+	case api.ErrQuotaExceeded:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// Validateで検証できなかったレコードを、ErrRecordRejectedにして返す
+func (s *httpServer) validate(record *api.Record) error {
+	if s.Validate == nil {
+		return nil
+	}
+	if err := s.Validate(record); err != nil {
+		return api.ErrRecordRejected{Reason: err.Error()}
+	}
+	return nil
+}
+
+// 検証してから書き込む
+func (s *httpServer) append(record *api.Record) (uint64, error) {
+	if err := s.validate(record); err != nil {
+		return 0, err
+	}
+	return s.Log.Append(record)
+}
+
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -54,9 +198,12 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	off, err := s.Log.Append(req.Record)
+	off, err := s.append(req.Record.apiRecord())
+	if _, ok := err.(api.ErrBackpressure); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(api.BackpressureRetryAfterSeconds))
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
@@ -68,6 +215,63 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// JSONの配列で受け取ったレコードを、まとめて書き込む。ログがAppendBatchを持てばロックを一度だけ取り、
+// 一つでも書き込めないレコードがあれば、どれも書き込まずにエラーを返す。
+// 持たなければ一つずつ書き込むので、途中で失敗するとそれより前のレコードは書き込まれたまま残る
+func (s *httpServer) handleProduceBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req []Record
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req) == 0 {
+		http.Error(w, "batch has no records", http.StatusBadRequest)
+		return
+	}
+	records := make([]*api.Record, len(req))
+	for i, record := range req {
+		records[i] = record.apiRecord()
+		// 一部だけ書き込まないように、書き込む前にすべてのレコードを検証する
+		if err := s.validate(records[i]); err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+	}
+
+	res := ProduceBatchResponse{Offsets: make([]uint64, 0, len(records))}
+	var err error
+	if b, ok := s.Log.(batchAppender); ok {
+		// producerの再送のレコードは書き込まれず、オフセットは連続しないので、レコードごとのOffsetを返す
+		if _, _, err = b.AppendBatch(records); err == nil {
+			for _, record := range records {
+				res.Offsets = append(res.Offsets, record.Offset)
+			}
+		}
+	} else {
+		for _, record := range records {
+			var off uint64
+			if off, err = s.Log.Append(record); err != nil {
+				break
+			}
+			res.Offsets = append(res.Offsets, off)
+		}
+	}
+	if _, ok := err.(api.ErrBackpressure); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(api.BackpressureRetryAfterSeconds))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -79,19 +283,596 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	}
 
 	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
+
+	res := ConsumeResponse{Record: newRecord(record)}
+	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
 
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+// /consumeで一度に返すレコードの数の、既定値と上限
+const (
+	defaultConsumePageSize = 100
+	maxConsumePageSize     = 1000
+	// Scanを持たないログで、一度のリクエストで飛ばす無くなったオフセットの上限。超えたらそこまでを返す
+	maxConsumePageSkips = 10000
+)
+
+// レコードを順に読み進められるログ。log.Logが満たす
+type scanner interface {
+	Scan(from uint64) (*log.Iterator, error)
+}
+
+// offsetから最大max件のレコードと、次に読むオフセットを返す。offsetはearliestとlatestも指定できる。
+// コンパクションなどで無くなったオフセットは飛ばし、コミット済みのレコードの末尾で止まる。
+// Scanを持つログはIteratorで読み、無くなったオフセットを一つずつ引かない
+func (s *httpServer) handleConsumePage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	off, err := s.startOffset(query.Get("offset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	max, err := parseOffsetParam(query.Get("max"), defaultConsumePageSize)
+	if err != nil || max == 0 {
+		http.Error(w, "max must be a positive number", http.StatusBadRequest)
+		return
+	}
+	if max > maxConsumePageSize {
+		max = maxConsumePageSize
+	}
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	committed, err := s.Log.CommittedOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 保持されていないオフセットを一つずつ飛ばさない
+	if off < lowest {
+		off = lowest
+	}
+
+	res := ConsumePageResponse{Records: []Record{}}
+	if sc, ok := s.Log.(scanner); ok {
+		res.NextOffset, err = scanPage(sc, off, max, committed, &res)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	skips := 0
+	for uint64(len(res.Records)) < max {
+		record, err := s.Log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// コミット済みの範囲にあれば取り除かれたオフセットで、そうでなければ末尾に到達した
+			if off < committed && skips < maxConsumePageSkips {
+				off++
+				skips++
+				continue
+			}
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		res.Records = append(res.Records, newRecord(record))
+		off++
+	}
+	res.NextOffset = off
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// offからのレコードを最大max件resに入れ、次に読むオフセットを返す
+func scanPage(sc scanner, off, max, committed uint64, res *ConsumePageResponse) (uint64, error) {
+	it, err := sc.Scan(off)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		// 末尾より先から読もうとした
+		return off, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	for uint64(len(res.Records)) < max && it.Next() {
+		record := it.Record()
+		res.Records = append(res.Records, newRecord(record))
+		off = record.Offset + 1
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	// 末尾まで読んだなら、コミット済みの範囲で無くなったオフセットも飛ばしておく
+	if uint64(len(res.Records)) < max && off < committed {
+		off = committed
+	}
+	return off, nil
+}
+
+// /streamで、何も届けるものが無いときにコメントを送る間隔。途中のプロキシに接続を切られないようにする
+const streamKeepAliveInterval = 15 * time.Second
+
+// offsetからのレコードを、Server-Sent Eventsで届け続ける。offsetはearliestとlatestも指定できる。
+// 各イベントのidはレコードのオフセットで、再接続のLast-Event-IDがあればその次から届ける。
+// ログが閉じられたら、残りを届けてからclosedのイベントを送って終える。読めないレコードに当たったら、errorのイベントを送って終える
+func (s *httpServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	sub, ok := s.Log.(subscriber)
+	if !ok {
+		http.Error(w, "log does not support streaming", http.StatusNotImplemented)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	off, err := s.startOffset(r.URL.Query().Get("offset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		off = last + 1
+	}
+	subscription, err := sub.Subscribe(off, consumeStreamBuffer)
+	if err == log.ErrClosed {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer subscription.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-subscription.C:
+			if ok && e.Err != nil {
+				// 読めないレコードで配信が止まった。再接続しても同じところで止まるので、closedとは分けて知らせる
+				data, _ := json.Marshal(map[string]string{"error": e.Err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+				return
+			}
+			if !ok || e.Closed {
+				io.WriteString(w, "event: closed\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			data, err := json.Marshal(newRecord(e.Record))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: record\ndata: %s\n\n", e.Record.Offset, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// エクスポート中に、何レコードごとにクライアントへフラッシュするか
+const exportFlushInterval = 100
+
+// dedup=keyで、一度に走査するレコードの数。maxを指定しなかったときと、maxの上限
+const (
+	defaultExportDedupBatch = 10000
+	maxExportDedupBatch     = 100000
+)
+
+// fromからtoまで(toが無ければコミット済みの末尾まで)のレコードを、1行1レコードのJSON(NDJSON)で書き出す。
+// 1レコードずつ読み出して書き込むため、範囲の大きさに関わらずメモリ使用量は一定になる。
+// 保持されていない先頭や、コンパクションなどで無くなったオフセットは飛ばす。
+// dedup=keyの場合は、範囲のうち最大max件(既定はdefaultExportDedupBatch)を走査して溜め、その中でキーごとに最新のレコードだけを返す。
+// 溜めるのは1回の走査の分だけなので、続きはX-Next-Offsetから読む。maxはdedupでなくても走査する件数の上限になる。
+// 最後に走査したオフセットの次をトレーラーのX-Next-Offsetで返す
+func (s *httpServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := s.startOffset(query.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseOffsetParam(query.Get("to"), ^uint64(0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dedup := false
+	switch query.Get("dedup") {
+	case "":
+	case "key":
+		dedup = true
+	default:
+		http.Error(w, "unknown dedup mode", http.StatusBadRequest)
+		return
+	}
+	var def uint64
+	if dedup {
+		def = defaultExportDedupBatch
+	}
+	max, err := parseOffsetParam(query.Get("max"), def)
+	if err != nil || (dedup && max == 0) {
+		http.Error(w, "max must be a positive number", http.StatusBadRequest)
+		return
+	}
+	if dedup && max > maxExportDedupBatch {
+		max = maxExportDedupBatch
+	}
+
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	end, err := s.Log.NextOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	committed, err := s.Log.CommittedOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if from < lowest {
+		from = lowest
+	}
+	// 書き出し始めた後に書き込まれたレコードは含めず、toか書き出し始めたときの末尾で止める
+	if to < end {
+		end = to + 1
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Next-Offset")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var scanned []*api.Record
+	written := 0
+	next, err := exportRange(s.Log, from, end, committed, max, func(record *api.Record) error {
+		if dedup {
+			scanned = append(scanned, record)
+			return nil
+		}
+		if err := enc.Encode(newRecord(record)); err != nil {
+			return err
+		}
+		if written++; flusher != nil && written%exportFlushInterval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	for _, record := range dedupByKey(scanned) {
+		if err = enc.Encode(newRecord(record)); err != nil {
+			return
+		}
+	}
+	w.Header().Set("X-Next-Offset", strconv.FormatUint(next, 10))
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// fromからendの手前までのレコードを順に最大max件(0なら制限しない)fnに渡し、次に走査するオフセットを返す。
+// コミット済みの範囲で無くなったオフセットは飛ばし、まだ読めないレコードの手前で止まる。
+// Scanを持つログはIteratorで読み、持たなければ一つずつ読んで、飛ばす数をmaxConsumePageSkipsまでにする
+func exportRange(l CommitLog, from, end, committed, max uint64, fn func(*api.Record) error) (uint64, error) {
+	if from >= end {
+		return from, nil
+	}
+	if committed > end {
+		committed = end
+	}
+	sc, ok := l.(scanner)
+	if !ok {
+		skips := 0
+		var n uint64
+		for off := from; off < end; off++ {
+			if max > 0 && n == max {
+				return off, nil
+			}
+			record, err := l.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				if off < committed && skips < maxConsumePageSkips {
+					skips++
+					continue
+				}
+				return off, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			if err := fn(record); err != nil {
+				return 0, err
+			}
+			n++
+		}
+		return end, nil
+	}
+	it, err := sc.Scan(from)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return from, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	next := from
+	var n uint64
+	for (max == 0 || n < max) && it.Next() {
+		record := it.Record()
+		if record.Offset >= end {
+			return end, nil
+		}
+		if err := fn(record); err != nil {
+			return 0, err
+		}
+		next = record.Offset + 1
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if max > 0 && n == max {
+		// 上限まで走査したので、最後に渡したレコードの次から再開させる
+		return next, nil
+	}
+	// 読めるところまで読んだので、コミット済みの範囲で無くなったオフセットも飛ばしておく
+	if next < committed {
+		next = committed
+	}
+	return next, nil
+}
+
+// キーごとに最後のレコードだけを残す。順序は各キーの最後の出現順で、キーの無いレコードはすべて残す
+func dedupByKey(records []*api.Record) []*api.Record {
+	last := make(map[string]int)
+	for i, record := range records {
+		if len(record.Key) > 0 {
+			last[string(record.Key)] = i
+		}
+	}
+	var deduped []*api.Record
+	for i, record := range records {
+		if len(record.Key) > 0 && last[string(record.Key)] != i {
+			continue
+		}
+		deduped = append(deduped, record)
+	}
+	return deduped
+}
+
+// ストレージのメトリクスをPrometheusのテキスト形式で書き出せるログ
+type metricsWriter interface {
+	WriteMetrics(w io.Writer) error
+}
+
+// ログの書き込み・読み込みの回数やsegmentの数などを、Prometheusが収集できる形式で返す
+func (s *httpServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.Log.(metricsWriter)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var buf bytes.Buffer
+	if err := m.WriteMetrics(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = buf.WriteTo(w)
+}
+
+// レコードのメタデータを返せるログ
+type recordStatter interface {
+	Stat(off uint64) (log.RecordStat, error)
+}
+
+// レコードの中身は返さず、サイズなどのメタデータをヘッダーで返す
+func (s *httpServer) handleStat(w http.ResponseWriter, r *http.Request) {
+	statter, ok := s.Log.(recordStatter)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	off, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	stat, err := statter.Stat(off)
+	if err != nil {
+		w.WriteHeader(httpStatus(err))
+		return
+	}
+	h := w.Header()
+	h.Set("X-Record-Offset", strconv.FormatUint(stat.Offset, 10))
+	h.Set("X-Record-Size", strconv.FormatUint(stat.Size, 10))
+	h.Set("X-Record-Stored-Size", strconv.FormatUint(stat.StoredSize, 10))
+	h.Set("X-Record-Disk-Size", strconv.FormatUint(stat.DiskSize, 10))
+	h.Set("X-Record-Timestamp", stat.Timestamp.UTC().Format(time.RFC3339Nano))
+	h.Set("X-Record-Checksum", fmt.Sprintf("%08x", stat.Checksum))
+	h.Set("X-Record-Segment", strconv.FormatUint(stat.BaseOffset, 10))
+	h.Set("X-Record-Position", strconv.FormatUint(stat.Position, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// 範囲のレコードが封印済みかどうかと、そのチェックサムを返せるログ
+type rangeChecksummer interface {
+	RangeChecksum(from, to uint64) (sum uint32, sealed bool, err error)
+}
+
+// Rangeヘッダーの単位。バイトではなくオフセットの範囲を表す
+const offsetsUnit = "offsets"
+
+// 封印済みの範囲は書き換わらないので、キャッシュに長く保持させる
+const sealedCacheControl = "public, max-age=31536000, immutable"
+
+// Range: offsets=from-to で指定されたオフセットの範囲を、NDJSONで返す。toを省略すると末尾まで。
+// 範囲がすべて封印済みのsegmentにあれば、segmentのチェックサムから求めたETagを付けてキャッシュさせ、
+// アクティブなsegmentにかかる場合はno-cacheにする。Rangeヘッダーが無ければログ全体を返す
+func (s *httpServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	lowest, err := s.Log.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	next, err := s.Log.NextOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Accept-Ranges", offsetsUnit)
+
+	from, to, partial := lowest, next-1, false
+	if v := r.Header.Get("Range"); strings.HasPrefix(v, offsetsUnit+"=") {
+		from, to, err = parseOffsetRange(strings.TrimPrefix(v, offsetsUnit+"="))
+		if err == nil && from >= next {
+			err = errors.New("range starts beyond the end of the log")
+		}
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("%s */%d", offsetsUnit, next))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if to >= next {
+			to = next - 1
+		}
+		partial = true
+	}
+	if next == 0 {
+		// 空のログ
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return
+	}
+
+	cacheControl := "no-cache"
+	if c, ok := s.Log.(rangeChecksummer); ok {
+		sum, sealed, err := c.RangeChecksum(from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sealed {
+			etag := fmt.Sprintf(`"%d-%d-%08x"`, from, to, sum)
+			cacheControl = sealedCacheControl
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", cacheControl)
+			if etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("%s %d-%d/%d", offsetsUnit, from, to, next))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	enc := json.NewEncoder(w)
+	for off := from; off <= to; off++ {
+		record, err := s.Log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// コンパクションで取り除かれたオフセットは飛ばす
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if err = enc.Encode(newRecord(record)); err != nil {
+			return
+		}
+	}
+}
+
+// Rangeヘッダーの"from-to"または"from-"を解析する
+func parseOffsetRange(v string) (from, to uint64, err error) {
+	i := strings.Index(v, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid offset range %q", v)
+	}
+	if from, err = strconv.ParseUint(v[:i], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if to, err = parseOffsetParam(v[i+1:], ^uint64(0)); err != nil {
+		return 0, 0, err
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("invalid offset range %q", v)
+	}
+	return from, to, nil
+}
+
+// If-None-MatchのいずれかのETagがetagと一致するかどうか
+func etagMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// 読み始めるオフセットを決める。earliestは保持されている最小のオフセット、latestは次に書き込まれるオフセット
+func (s *httpServer) startOffset(v string) (uint64, error) {
+	switch v {
+	case "earliest":
+		return s.Log.LowestOffset()
+	case "latest":
+		return s.Log.NextOffset()
+	default:
+		return parseOffsetParam(v, 0)
+	}
+}
+
+// クエリパラメータのオフセットを解析する。空の場合はdefを返す
+func parseOffsetParam(v string, def uint64) (uint64, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
 }
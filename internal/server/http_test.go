@@ -0,0 +1,693 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+)
+
+func TestHTTPServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		srv *httpServer,
+		h http.Handler,
+	){
+		"export streams a range as ndjson": testExport,
+		"head returns record stats":        testStat,
+		"export dedups by key":             testExportDedup,
+		"export skips removed offsets":     testExportGaps,
+		"log range caches sealed segments": testLogRange,
+		"produce and consume keep headers": testHeaders,
+		"batch produce returns offsets":    testProduceBatch,
+		"consume pages through records":    testConsumePage,
+		"stream pushes records as sse":     testStream,
+		"websocket produces and consumes":  testWebSocket,
+		"metrics are exposed":              testMetrics,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "http-server-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			clog, err := log.NewLog(dir, log.Config{})
+			require.NoError(t, err)
+			defer clog.Close()
+
+			srv := newHTTPServer(clog)
+			fn(t, srv, srv.router())
+		})
+	}
+}
+
+// Shutdownで、終わらない/streamのリクエストも打ち切られ、期限までに止まることを確認
+func TestNetHTTPServerShutdown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-shutdown-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NetHTTPServer(ln.Addr().String(), clog, nil)
+	go srv.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+}
+
+// ログのエラーが、対応するHTTPのステータスコードになることを確認
+func TestHTTPStatus(t *testing.T) {
+	for err, want := range map[error]int{
+		api.ErrOffsetOutOfRange{Offset: 1}:     http.StatusNotFound,
+		api.ErrRecordTooLarge{Size: 2, Max: 1}: http.StatusRequestEntityTooLarge,
+		api.ErrBackpressure{Pending: 1}:        http.StatusTooManyRequests,
+		api.ErrSegmentFull{}:                   http.StatusServiceUnavailable,
+		api.ErrStaleSequence{ProducerID: "p"}:  http.StatusConflict,
+		api.ErrRecordRejected{Reason: "r"}:     http.StatusBadRequest,
+		api.ErrQuotaExceeded{Topic: "t"}:       http.StatusInsufficientStorage,
+		fmt.Errorf("disk failure"):             http.StatusInternalServerError,
+	} {
+		require.Equal(t, want, httpStatus(err), err.Error())
+	}
+
+	// 読み込めないオフセットはNotFoundになる
+	dir, err := os.MkdirTemp("", "http-status-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	body, err := json.Marshal(ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	newHTTPServer(clog).router().ServeHTTP(rec, httptest.NewRequest("GET", "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// 指定範囲のレコードが1行ずつ、フラッシュされながら書き出されることを確認
+func testExport(t *testing.T, srv *httpServer, h http.Handler) {
+	for i := 0; i < 1000; i++ {
+		_, err := srv.Log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest("GET", "/consume/export?from=10&to=509", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	require.True(t, rec.Flushed)
+
+	scanner := bufio.NewScanner(rec.Body)
+	want := uint64(10)
+	for scanner.Scan() {
+		var record Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		require.Equal(t, want, record.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", want), string(record.Value))
+		want++
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, uint64(510), want)
+
+	// toを省略した場合は末尾まで
+	req = httptest.NewRequest("GET", "/consume/export?from=990", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	lines := 0
+	scanner = bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		lines++
+	}
+	require.Equal(t, 10, lines)
+
+	// latestから読み始めると、既存のレコードは書き出されない
+	req = httptest.NewRequest("GET", "/consume/export?from=latest", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Zero(t, rec.Body.Len())
+}
+
+// 書き込んだキーとヘッダーが、書き込んだ順に読み込めることを確認
+func testHeaders(t *testing.T, srv *httpServer, h http.Handler) {
+	want := Record{
+		Key:   []byte("user"),
+		Value: []byte("hello world"),
+		Headers: []Header{
+			{Key: "trace", Value: []byte("1")},
+			{Key: "trace", Value: []byte("2")},
+		},
+	}
+	body, err := json.Marshal(ProduceRequest{Record: want})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body, err = json.Marshal(ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res ConsumeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Equal(t, want, res.Record)
+}
+
+// 配列で送ったレコードがまとめて書き込まれ、送った順のオフセットが返ることを確認
+func testProduceBatch(t *testing.T, srv *httpServer, h http.Handler) {
+	records := []Record{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Value: []byte("3")},
+	}
+	body, err := json.Marshal(records)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/produce/batch", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res ProduceBatchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Equal(t, []uint64{0, 1, 2}, res.Offsets)
+	for i, want := range records {
+		got, err := srv.Log.Read(res.Offsets[i])
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/produce/batch", bytes.NewReader([]byte("[]"))))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// /consumeが最大max件のレコードと次に読むオフセットを返し、次のページを続けて読めることを確認
+func testConsumePage(t *testing.T, srv *httpServer, h http.Handler) {
+	for i := 0; i < 10; i++ {
+		_, err := srv.Log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	page := func(query string) ConsumePageResponse {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/consume?"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var res ConsumePageResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+
+	var got []uint64
+	next := "earliest"
+	for {
+		res := page("offset=" + next + "&max=4")
+		if len(res.Records) == 0 {
+			require.Equal(t, uint64(10), res.NextOffset)
+			break
+		}
+		require.LessOrEqual(t, len(res.Records), 4)
+		for _, record := range res.Records {
+			require.Equal(t, fmt.Sprintf("record %d", record.Offset), string(record.Value))
+			got = append(got, record.Offset)
+		}
+		next = strconv.FormatUint(res.NextOffset, 10)
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got)
+	require.Len(t, page("offset=3").Records, 7)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/consume?offset=0&max=0", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// Validateに失敗したレコードは、POST /と/produce/batchでは400に、/wsではerrorのメッセージになり、書き込まれないことを確認
+func TestHTTPValidate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-validate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	srv := newHTTPServer(clog)
+	srv.Validate = func(record *api.Record) error {
+		if len(record.Value) > 5 {
+			return fmt.Errorf("value too large: %d", len(record.Value))
+		}
+		return nil
+	}
+	h := srv.router()
+
+	post := func(path string, body interface{}) int {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", path, bytes.NewReader(b)))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusBadRequest, post("/", ProduceRequest{Record: Record{Value: []byte("hello world")}}))
+	// 一つでも検証に失敗すれば、バッチのどのレコードも書き込まない
+	require.Equal(t, http.StatusBadRequest, post("/produce/batch", []Record{
+		{Value: []byte("hello")},
+		{Value: []byte("hello world")},
+	}))
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(WSMessage{
+		Type:   wsProduce,
+		ID:     "large",
+		Record: &Record{Value: []byte("hello world")},
+	}))
+	var msg WSMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, wsError, msg.Type)
+	require.Equal(t, "large", msg.ID)
+
+	next, err := clog.NextOffset()
+	require.NoError(t, err)
+	require.Zero(t, next)
+
+	require.Equal(t, http.StatusOK, post("/", ProduceRequest{Record: Record{Value: []byte("hello")}}))
+	got, err := clog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), got.Value)
+}
+
+// コミット済みの範囲がすべて取り除かれていて、Scanを持たないログ
+type gapLog struct {
+	CommitLog
+	committed uint64
+}
+
+func (l gapLog) Read(off uint64) (*api.Record, error) {
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+func (l gapLog) LowestOffset() (uint64, error) { return 0, nil }
+
+func (l gapLog) CommittedOffset() (uint64, error) { return l.committed, nil }
+
+// Scanを持たないログでは、無くなったオフセットを飛ばす数に上限があり、そこまでを次に読むオフセットとして返すことを確認
+func TestHTTPConsumePageGap(t *testing.T) {
+	srv := newHTTPServer(gapLog{committed: 1 << 40})
+	rec := httptest.NewRecorder()
+	srv.router().ServeHTTP(rec, httptest.NewRequest("GET", "/consume?offset=0", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res ConsumePageResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(maxConsumePageSkips), res.NextOffset)
+}
+
+// /streamが、既存のレコードに続いて新しく書き込まれたレコードをSSEのイベントで届けることを確認
+func testStream(t *testing.T, srv *httpServer, h http.Handler) {
+	for i := 0; i < 3; i++ {
+		_, err := srv.Log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/stream?offset=1", nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	next := func() (string, Record) {
+		var id string
+		var record Record
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return id, record
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &record))
+			}
+		}
+	}
+	for off := uint64(1); off < 3; off++ {
+		id, record := next()
+		require.Equal(t, strconv.FormatUint(off, 10), id)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+	_, err = srv.Log.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	id, record := next()
+	require.Equal(t, "3", id)
+	require.Equal(t, "record 3", string(record.Value))
+}
+
+// 一つのWebSocketの接続で書き込みと購読ができ、再接続では受け取ったオフセットの次から読み直せることを確認
+func testWebSocket(t *testing.T, srv *httpServer, h http.Handler) {
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.WriteJSON(WSMessage{
+			Type:   wsProduce,
+			ID:     strconv.Itoa(i),
+			Record: &Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		}))
+		var msg WSMessage
+		require.NoError(t, conn.ReadJSON(&msg))
+		require.Equal(t, WSMessage{Type: wsProduced, ID: strconv.Itoa(i), Offset: uint64(i)}, msg)
+	}
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: wsProduce, ID: "bad"}))
+	var msg WSMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, wsError, msg.Type)
+	require.Equal(t, "bad", msg.ID)
+
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: wsSubscribe, From: "earliest"}))
+	for off := uint64(0); off < 2; off++ {
+		require.NoError(t, conn.ReadJSON(&msg))
+		require.Equal(t, wsRecord, msg.Type)
+		require.Equal(t, off, msg.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(msg.Record.Value))
+	}
+	require.NoError(t, conn.Close())
+
+	// 切れている間に書き込まれたレコードも、再接続すれば受け取れる
+	_, err = srv.Log.Append(&api.Record{Value: []byte("record 2")})
+	require.NoError(t, err)
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(WSMessage{Type: wsSubscribe, Offset: 2}))
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, wsRecord, msg.Type)
+	require.Equal(t, uint64(2), msg.Offset)
+	require.Equal(t, "record 2", string(msg.Record.Value))
+}
+
+// ストレージのメトリクスがPrometheusの形式で返ることを確認
+func testMetrics(t *testing.T, srv *httpServer, h http.Handler) {
+	_, err := srv.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "proglog_appends_total 1\n")
+	require.Contains(t, rec.Body.String(), "proglog_segments 1\n")
+}
+
+// HEADでレコードのメタデータがヘッダーに返ることを確認
+func testStat(t *testing.T, srv *httpServer, h http.Handler) {
+	off, err := srv.Log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("HEAD", fmt.Sprintf("/consume/%d", off), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Zero(t, rec.Body.Len())
+
+	stat, err := srv.Log.(*log.Log).Stat(off)
+	require.NoError(t, err)
+	require.Equal(t, strconv.FormatUint(stat.Size, 10), rec.Header().Get("X-Record-Size"))
+	require.Equal(t, strconv.FormatUint(stat.StoredSize, 10), rec.Header().Get("X-Record-Stored-Size"))
+	require.Equal(t, strconv.FormatUint(stat.DiskSize, 10), rec.Header().Get("X-Record-Disk-Size"))
+	require.Equal(t, stat.Timestamp.UTC().Format(time.RFC3339Nano), rec.Header().Get("X-Record-Timestamp"))
+	require.Equal(t, fmt.Sprintf("%08x", stat.Checksum), rec.Header().Get("X-Record-Checksum"))
+	require.Equal(t, "0", rec.Header().Get("X-Record-Segment"))
+
+	req = httptest.NewRequest("HEAD", fmt.Sprintf("/consume/%d", off+1), nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// 書き出した分を捨てるResponseWriter。一定の回数の書き込みとフラッシュのたびにGCしてヒープの使用量を測り、最大値を覚える
+type heapSamplingWriter struct {
+	header  http.Header
+	written int
+	writes  int
+	maxHeap uint64
+}
+
+func (w *heapSamplingWriter) Header() http.Header { return w.header }
+
+func (w *heapSamplingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	if w.writes++; w.writes%1000 == 0 {
+		w.sample()
+	}
+	return len(p), nil
+}
+
+func (w *heapSamplingWriter) WriteHeader(int) {}
+
+func (w *heapSamplingWriter) Flush() {
+	w.sample()
+}
+
+func (w *heapSamplingWriter) sample() {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > w.maxHeap {
+		w.maxHeap = m.HeapAlloc
+	}
+}
+
+// 大きな範囲を書き出しても、サーバーのヒープが書き出すバイト数に比例して増えないことを確認
+func TestHTTPExportMemory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-export-memory-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	value := bytes.Repeat([]byte("x"), 1024)
+	const n = 20000
+	for i := 0; i < n; i++ {
+		_, err := clog.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	h := newHTTPServer(clog).router()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	w := &heapSamplingWriter{header: make(http.Header)}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/consume/export?from=0", nil))
+	// 値はbase64になるので、書き出したのはレコードの合計より大きい
+	require.Greater(t, w.written, n*len(value))
+	// すべてのレコードを溜め込めば書き出したバイト数ほどヒープが増えるが、1回のフラッシュの分しか持たない
+	require.Less(t, w.maxHeap, before.HeapAlloc+uint64(w.written)/8)
+}
+
+// dedup=keyの場合、キーごとに最新のレコードだけが最後の出現順で返ることを確認
+func testExportDedup(t *testing.T, srv *httpServer, h http.Handler) {
+	for _, kv := range [][2]string{
+		{"a", "a1"}, {"b", "b1"}, {"a", "a2"}, {"c", "c1"}, {"b", "b2"}, {"", "no key"},
+	} {
+		_, err := srv.Log.Append(&api.Record{Key: []byte(kv[0]), Value: []byte(kv[1])})
+		require.NoError(t, err)
+	}
+
+	srv2 := httptest.NewServer(h)
+	defer srv2.Close()
+	export := func(query string) ([]string, string) {
+		res, err := http.Get(srv2.URL + "/consume/export?" + query)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var got []string
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var record Record
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			got = append(got, string(record.Value))
+		}
+		require.NoError(t, scanner.Err())
+		return got, res.Trailer.Get("X-Next-Offset")
+	}
+
+	got, next := export("from=0&to=4&dedup=key")
+	require.Equal(t, []string{"a2", "c1", "b2"}, got)
+	// 重複を取り除いたレコードも含めて、走査した範囲の次から再開できる
+	require.Equal(t, "5", next)
+
+	// maxで走査する件数を区切ると、その中だけで重複を取り除き、最後に走査したレコードの次から再開させる
+	got, next = export("from=0&dedup=key&max=3")
+	require.Equal(t, []string{"b1", "a2"}, got)
+	require.Equal(t, "3", next)
+	got, next = export("from=" + next + "&dedup=key&max=3")
+	require.Equal(t, []string{"c1", "b2", "no key"}, got)
+	require.Equal(t, "6", next)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/consume/export?dedup=key&max=0", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// 先頭が削除されていても、コンパクションでオフセットが抜けていても、残っているレコードを最後まで書き出すことを確認
+func testExportGaps(t *testing.T, srv *httpServer, h http.Handler) {
+	clog := srv.Log.(*log.Log)
+	for i, key := range []string{"", "", "", "k", "k", ""} {
+		if i == 3 {
+			_, err := clog.Roll()
+			require.NoError(t, err)
+		}
+		_, err := clog.Append(&api.Record{Key: []byte(key), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, err := clog.Roll()
+	require.NoError(t, err)
+	_, err = clog.Append(&api.Record{Value: []byte("record 6")})
+	require.NoError(t, err)
+
+	// 先頭の0と1を削除し、キーkの古いレコード3をコンパクションで取り除く
+	_, err = clog.DeleteRecords(2)
+	require.NoError(t, err)
+	_, err = clog.Compact()
+	require.NoError(t, err)
+	_, err = clog.Read(3)
+	require.Error(t, err)
+
+	export := func(query string) ([]uint64, string) {
+		srv2 := httptest.NewServer(h)
+		defer srv2.Close()
+		res, err := http.Get(srv2.URL + "/consume/export?" + query)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var got []uint64
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var record Record
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			require.Equal(t, fmt.Sprintf("record %d", record.Offset), string(record.Value))
+			got = append(got, record.Offset)
+		}
+		require.NoError(t, scanner.Err())
+		return got, res.Trailer.Get("X-Next-Offset")
+	}
+
+	got, next := export("")
+	require.Equal(t, []uint64{2, 4, 5, 6}, got)
+	require.Equal(t, "7", next)
+	got, next = export("from=3&to=4")
+	require.Equal(t, []uint64{4}, got)
+	require.Equal(t, "5", next)
+	// 抜けたオフセットだけの範囲でも、その先から再開できる
+	got, next = export("from=3&to=3")
+	require.Empty(t, got)
+	require.Equal(t, "4", next)
+}
+
+// 封印済みの範囲は安定したETagで返り、If-None-Matchが一致すれば304になることを確認
+func testLogRange(t *testing.T, srv *httpServer, h http.Handler) {
+	clog := srv.Log.(*log.Log)
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			_, err := clog.Roll()
+			require.NoError(t, err)
+		}
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	get := func(rng, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/log", nil)
+		req.Header.Set("Range", rng)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	res := get("offsets=0-2", "")
+	require.Equal(t, http.StatusPartialContent, res.Code)
+	require.Equal(t, "offsets 0-2/5", res.Header().Get("Content-Range"))
+	require.Equal(t, sealedCacheControl, res.Header().Get("Cache-Control"))
+	etag := res.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	var got []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var record Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		got = append(got, string(record.Value))
+	}
+	require.Equal(t, []string{"record 0", "record 1", "record 2"}, got)
+
+	// 後から書き込んでも、封印済みの範囲のETagは変わらない
+	_, err := clog.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	res = get("offsets=0-2", "")
+	require.Equal(t, etag, res.Header().Get("ETag"))
+
+	res = get("offsets=0-2", etag)
+	require.Equal(t, http.StatusNotModified, res.Code)
+	require.Zero(t, res.Body.Len())
+
+	// アクティブなsegmentにかかる範囲はキャッシュさせない
+	res = get("offsets=2-", "")
+	require.Equal(t, http.StatusPartialContent, res.Code)
+	require.Equal(t, "offsets 2-5/6", res.Header().Get("Content-Range"))
+	require.Equal(t, "no-cache", res.Header().Get("Cache-Control"))
+	require.Empty(t, res.Header().Get("ETag"))
+
+	res = get("offsets=10-", "")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.Code)
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
 	"time"
 
 	api "proglog/api/v1"
+	"proglog/internal/log"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -28,14 +31,32 @@ type Config struct {
 	CommitLog   CommitLog
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	// 書き込み前にレコードを検証する。エラーを返したレコードは書き込まれず、InvalidArgumentとなる
+	Validate func(*api.Record) error
+	// トピックごとのログ。nilなら、トピックを指定したリクエストはInvalidArgumentとなる
+	Topics TopicManager
 }
 
+// トピックを指定したリクエストはトピックの名前を、指定しないリクエストはobjectWildcardを対象にして認可する。
+// ポリシーの対象はcasbinのkeyMatchで照合するので、"*"はすべてのトピックと元のログに当てはまる
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	// レコードを消す操作。書き込めるだけのクライアントには消させない
+	deleteAction = "delete"
+	// 無いトピックへの書き込みで、トピックを作る操作
+	createAction = "create"
 )
 
+// topicへのリクエストを認可するときの対象
+func object(topic string) string {
+	if topic == "" {
+		return objectWildcard
+	}
+	return topic
+}
+
 var _ api.LogServer = (*grpcServer)(nil)
 
 type grpcServer struct {
@@ -46,6 +67,17 @@ type grpcServer struct {
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	CommittedOffset() (uint64, error)
+}
+
+// トピックごとのログを管理する。log.LogManagerとlog.DistributedLogが満たす
+type TopicManager interface {
+	Get(topic string) (*log.Topic, error)
+	Create(topic string, partitions int) (*log.Topic, error)
+	Topics() []string
 }
 
 type Authorizer interface {
@@ -109,43 +141,164 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
-		objectWildcard,
+		object(req.Topic),
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Validate != nil {
+		if err := s.Validate(req.Record); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	offset, partition, err := s.append(ctx, req.Topic, req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+// keyのトゥームストーンを書き込む。値を持たないので、Validateは通さない
+func (s *grpcServer) Delete(ctx context.Context, req *api.DeleteRequest) (
+	*api.DeleteResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	offset, partition, err := s.append(ctx, req.Topic, &api.Record{Key: req.Key, Tombstone: true})
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.DeleteResponse{Offset: offset, Partition: partition}, nil
+}
+
+// 開始オフセットを進められるCommitLog。log.Logとlog.DistributedLogが満たす
+type recordsDeleter interface {
+	DeleteRecords(before uint64) (uint64, error)
+}
+
+// パーティションの、オフセットがreq.Offsetより小さいレコードを削除する
+func (s *grpcServer) DeleteRecords(ctx context.Context, req *api.DeleteRecordsRequest) (
+	*api.DeleteRecordsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		deleteAction,
+	); err != nil {
+		return nil, err
+	}
+	var lowest uint64
+	if req.Topic != "" {
+		// トピックのパーティションは、レプリカへ複製されるようTopicを通して削除する
+		topic, err := s.topic(req.Topic)
+		if err != nil {
+			return nil, err
+		}
+		lowest, err = topic.DeleteRecords(int(req.Partition), req.Offset)
+		if errors.Is(err, log.ErrPartitionNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &api.DeleteRecordsResponse{Lowest: lowest}, nil
+	}
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	deleter, ok := commitLog.(recordsDeleter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log does not support deleting records")
+	}
+	lowest, err = deleter.DeleteRecords(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DeleteRecordsResponse{Lowest: lowest}, nil
+}
+
+// topicが空ならCommitLogに、そうでなければトピックのパーティションに書き込む。
+// トピックが無ければ、createの権限があれば作る
+func (s *grpcServer) append(ctx context.Context, topicName string, record *api.Record) (
+	offset uint64, partition uint32, err error) {
+	if topicName == "" {
+		offset, err = s.CommitLog.Append(record)
+		return offset, 0, err
+	}
+	topic, err := s.topic(topicName)
+	if status.Code(err) == codes.NotFound {
+		topic, err = s.createTopic(ctx, topicName)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	n, offset, err := topic.Append(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset, uint32(n), nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
-		objectWildcard,
+		object(req.Topic),
 		consumeAction,
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := startOffset(commitLog, req)
+	if err != nil {
+		return nil, err
+	}
+	record, err := commitLog.Read(offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// 受信したリクエストを、書き込みを待たずに溜めておける数
+const produceStreamBuffer = 64
+
+// 受信と書き込みを別のgoroutineで行い、クライアントが応答を待たずにリクエストを送り続けられるようにする。
+// 応答はリクエストの順に返る。クライアントが送信を終えると、残りを書き込んでからストリームを終える
 func (s *grpcServer) ProduceStream(
 	stream api.Log_ProduceStreamServer,
 ) error {
-	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+	ctx := stream.Context()
+	reqs := make(chan *api.ProduceRequest, produceStreamBuffer)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
 		}
-		res, err := s.Produce(stream.Context(), req)
+	}()
+
+	for req := range reqs {
+		res, err := s.Produce(ctx, req)
 		if err != nil {
 			return err
 		}
@@ -153,12 +306,41 @@ func (s *grpcServer) ProduceStream(
 			return err
 		}
 	}
+	select {
+	case err := <-recvErr:
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	default:
+		return ctx.Err()
+	}
 }
 
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	// 読み始める位置は最初に一度だけ決め、以降はそのオフセットから順に送る
+	offset, err := startOffset(commitLog, req)
+	if err != nil {
+		return err
+	}
+	if sub, ok := commitLog.(subscriber); ok {
+		return s.consumeSubscription(sub, offset, stream)
+	}
+	req = &api.ConsumeRequest{Offset: offset, Topic: req.Topic, Partition: req.Partition}
 	for {
 		select {
 		// sync.Mutexのように、contextパッケージを持ったオブジェクトについての操作は、contextから行える
@@ -169,6 +351,12 @@ func (s *grpcServer) ConsumeStream(
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// 書き込まれるまで少し待ってから読み直す
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-time.After(consumeStreamPollInterval):
+				}
 				continue
 			default:
 				return err
@@ -181,6 +369,61 @@ func (s *grpcServer) ConsumeStream(
 	}
 }
 
+// 購読できないログで、末尾に達したときに読み直すまでの間隔
+const consumeStreamPollInterval = 10 * time.Millisecond
+
+// 購読のバッファの大きさ。クライアントへの送信が遅れても、この数までは書き込みを待たせずに溜めておける
+const consumeStreamBuffer = 64
+
+// 書き込みを待って順に届けられるログ
+type subscriber interface {
+	Subscribe(off uint64, buffer int) (*log.Subscription, error)
+}
+
+// ログを購読し、書き込まれたレコードを待ってから送る。ログが閉じられたら、残りを送り終えてからストリームを終える
+func (s *grpcServer) consumeSubscription(
+	sub subscriber,
+	offset uint64,
+	stream api.Log_ConsumeStreamServer,
+) error {
+	ctx := stream.Context()
+	subscription, err := sub.Subscribe(offset, consumeStreamBuffer)
+	if err == log.ErrClosed {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-subscription.C:
+			if !ok || e.Closed {
+				// 読めないレコードで配信が止まったなら、そのエラーでストリームを終える
+				return e.Err
+			}
+			if err := stream.Send(&api.ConsumeResponse{Record: e.Record}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// リクエストから読み始めるオフセットを決める。
+// LATESTは次に書き込まれるオフセット、EARLIESTは保持されている最小のオフセット
+func startOffset(commitLog CommitLog, req *api.ConsumeRequest) (uint64, error) {
+	switch req.From {
+	case api.StartPosition_EARLIEST:
+		return commitLog.LowestOffset()
+	case api.StartPosition_LATEST:
+		return commitLog.NextOffset()
+	default:
+		return req.Offset, nil
+	}
+}
+
 func (s *grpcServer) GetServers(
 	ctx context.Context, req *api.GetServersRequest,
 ) (*api.GetServersResponse, error) {
@@ -191,6 +434,179 @@ func (s *grpcServer) GetServers(
 	return &api.GetServersResponse{Servers: servers}, nil
 }
 
+// ログに保持されているオフセットの範囲を返す。クライアントが読める範囲を試し読みせずに知るために使う
+func (s *grpcServer) GetOffsets(
+	ctx context.Context, req *api.GetOffsetsRequest,
+) (*api.GetOffsetsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	lowest, err := commitLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := commitLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	committed, err := commitLog.CommittedOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := commitLog.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{Lowest: lowest, Highest: highest, Committed: committed, Next: next}, nil
+}
+
+// 読む権限のあるトピックの名前を昇順で返す。トピックを使っていなければ空
+func (s *grpcServer) ListTopics(
+	ctx context.Context, req *api.ListTopicsRequest,
+) (*api.ListTopicsResponse, error) {
+	res := &api.ListTopicsResponse{Partitions: map[string]uint32{}}
+	if s.Topics == nil {
+		return res, nil
+	}
+	for _, name := range s.Topics.Topics() {
+		if err := s.Authorizer.Authorize(subject(ctx), name, consumeAction); err != nil {
+			continue
+		}
+		topic, err := s.Topics.Get(name)
+		if errors.Is(err, log.ErrTopicNotFound) {
+			// 一覧を取った後で削除された
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Topics = append(res.Topics, name)
+		res.Partitions[name] = uint32(topic.Partitions())
+	}
+	return res, nil
+}
+
+// 既存のtopicを返す。無ければNotFound
+func (s *grpcServer) topic(name string) (*log.Topic, error) {
+	if s.Topics == nil {
+		return nil, status.Error(codes.InvalidArgument, "topics are not enabled on this server")
+	}
+	topic, err := s.Topics.Get(name)
+	if errors.Is(err, log.ErrTopicNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return topic, nil
+}
+
+// topicをサーバーの決めたパーティション数で作る。書き込む権限とは別に、createの権限が要る
+func (s *grpcServer) createTopic(ctx context.Context, name string) (*log.Topic, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(name),
+		createAction,
+	); err != nil {
+		return nil, err
+	}
+	topic, err := s.Topics.Create(name, 0)
+	if errors.Is(err, log.ErrTooManyTopics) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if errors.Is(err, log.ErrInvalidTopic) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return topic, nil
+}
+
+// topicのpartitionのログを返す。topicが空ならトピックの無い元のログで、partitionは0でなければならない
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, status.Error(codes.InvalidArgument, "partition requires a topic")
+		}
+		return s.CommitLog, nil
+	}
+	t, err := s.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.Partition(int(partition))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return l, nil
+}
+
+// storeのフレームのまま読めるログ。log.Logとlog.DistributedLogが満たす
+type rawReader interface {
+	ReadRaw(from, to uint64) (io.ReadCloser, error)
+}
+
+// 一度に送るフレームのバイト数
+const consumeRawChunk = 64 << 10
+
+// req.Offsetからコミット済みのレコードまでをフレームのまま送り、送り終えたらストリームを終える
+func (s *grpcServer) ConsumeRaw(
+	req *api.ConsumeRawRequest,
+	stream api.Log_ConsumeRawServer,
+) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	raw, ok := commitLog.(rawReader)
+	if !ok {
+		return status.Error(codes.Unimplemented, "log does not support raw reads")
+	}
+	committed, err := commitLog.CommittedOffset()
+	if err != nil {
+		return err
+	}
+	if req.Offset >= committed {
+		return nil
+	}
+	r, err := raw.ReadRaw(req.Offset, committed-1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	buf := make([]byte, consumeRawChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&api.ConsumeRawResponse{Frames: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
@@ -208,7 +624,14 @@ func authenticate(ctx context.Context) (context.Context, error) {
 		return context.WithValue(ctx, subjectContextKey{}, ""), nil
 	}
 
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
+	// クライアント証明書を検証できた接続だけ、証明書のCNを認可の主体にする
+	tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ctx, status.New(
+			codes.Unauthenticated,
+			"no verified client certificate",
+		).Err()
+	}
 	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
 	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
 
@@ -1,8 +1,14 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"flag"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"testing"
@@ -19,6 +25,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -47,6 +54,14 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                  testUnauthorized,
+		"consume stream from latest skips existing records":   testConsumeStreamFromLatest,
+		"consume stream waits for appends until log closes":   testConsumeStreamTail,
+		"produce stream pipelines requests":                   testProduceStreamPipeline,
+		"get offsets reports the log bounds":                  testGetOffsets,
+		"topics fail when not enabled":                        testTopicsDisabled,
+		"delete appends a tombstone for the key":              testDelete,
+		"delete records advances the lowest offset":           testDeleteRecords,
+		"consume raw streams committed frames":                testConsumeRaw,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient,
@@ -59,6 +74,197 @@ func TestServer(t *testing.T) {
 	}
 }
 
+// 検証済みのクライアント証明書のCNが主体になり、証明書の無いTLSの接続は拒否されることを確認
+func TestAuthenticate(t *testing.T) {
+	ctx, err := authenticate(peer.NewContext(context.Background(), &peer.Peer{}))
+	require.NoError(t, err)
+	require.Equal(t, "", subject(ctx))
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	ctx, err = authenticate(peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject(ctx))
+
+	_, err = authenticate(peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{},
+	}))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServerValidate(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Validate = func(record *api.Record) error {
+			if len(record.Value) > 5 {
+				return fmt.Errorf("value too large: %d", len(record.Value))
+			}
+			return nil
+		}
+	})
+	defer teardown()
+
+	// 検証に失敗したレコードは書き込まれない
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Nil(t, produce)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+}
+
+// トピックとパーティションごとに別のログへ読み書きでき、トピックの一覧を取得できることを確認
+func TestServerTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewLogManager(dir, log.Config{}, nil)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("x")},
+		Topic:  "../escape",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	for i, topic := range []string{"orders", "payments", "orders", ""} {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("%s %d", topic, i))},
+			Topic:  topic,
+		})
+		require.NoError(t, err)
+		// オフセットはトピックごとに0から数える
+		want := map[int]uint64{0: 0, 1: 0, 2: 1, 3: 0}[i]
+		require.Equal(t, want, produce.Offset)
+	}
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders 2"), consume.Record.Value)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "payments", Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("payments 1"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "payments", Offset: 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offsets.Highest)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	for _, want := range []string{"orders 0", "orders 2"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), res.Record.Value)
+	}
+
+	// パーティションの分かれたトピックでは、パーティションごとに読む
+	_, err = topics.Create("events", 2)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("event %d", i))},
+			Topic:  "events",
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint32(i), produce.Partition)
+		require.Equal(t, uint64(0), produce.Offset)
+	}
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("event 1"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"events", "orders", "payments"}, list.Topics)
+	require.Equal(t, map[string]uint32{"events": 2, "orders": 1, "payments": 1}, list.Partitions)
+}
+
+// 指定した対象と操作の組だけを拒否し、それ以外はAuthorizerに任せる
+type denyAuthorizer struct {
+	Authorizer
+	denied map[[2]string]bool
+}
+
+func (a denyAuthorizer) Authorize(subject, object, action string) error {
+	if a.denied[[2]string{object, action}] {
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	return a.Authorizer.Authorize(subject, object, action)
+}
+
+// トピックごとに認可し、書き込みで無いトピックを作るにはcreateの権限が要り、作れる数に上限があることを確認
+func TestServerTopicAuthorization(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-topic-auth-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewLogManager(dir, log.Config{}, nil)
+	require.NoError(t, err)
+	defer topics.Close()
+	topics.MaxTopics = 2
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+		c.Authorizer = denyAuthorizer{Authorizer: c.Authorizer, denied: map[[2]string]bool{
+			{"orders", createAction}:  true,
+			{"secret", consumeAction}: true,
+		}}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("x")}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Topic: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Empty(t, topics.Topics())
+
+	// 作られたトピックには、createの権限が無くても書き込める
+	_, err = topics.Create("orders", 0)
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Topic: "orders"})
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Topic: "secret"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "secret"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "secret"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, list.Topics)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, Topic: "payments"})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
 func setupTest(t *testing.T, fn func(*Config)) (
 	rootClient api.LogClient,
 	nobodyClient api.LogClient,
@@ -221,6 +427,110 @@ func testConsumePastBoundary(
 	}
 }
 
+func testGetOffsets(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// ログに保持されているオフセットの範囲が返ることを確認するテスト
+	ctx := context.Background()
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(0), offsets.Highest)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	offsets, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(2), offsets.Highest)
+	require.Equal(t, uint64(3), offsets.Next)
+	require.LessOrEqual(t, offsets.Committed, offsets.Next)
+}
+
+func testDelete(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// キーのトゥームストーンが書き込まれ、キーの無い削除は失敗することを確認するテスト
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Key: []byte("user"), Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	res, err := client.Delete(ctx, &api.DeleteRequest{Key: []byte("user")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.True(t, consume.Record.Tombstone)
+	require.Equal(t, []byte("user"), consume.Record.Key)
+
+	_, err = client.Delete(ctx, &api.DeleteRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testDeleteRecords(
+	t *testing.T,
+	client, nobody api.LogClient,
+	config *Config,
+) {
+	// 開始オフセットより前のレコードは読めなくなり、GetOffsetsの最小のオフセットが進むことを確認するテスト
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	res, err := client.DeleteRecords(ctx, &api.DeleteRecordsRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Lowest)
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offsets.Lowest)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}.GRPCStatus().Code(), status.Code(err))
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), consume.Record.Value)
+
+	_, err = client.DeleteRecords(ctx, &api.DeleteRecordsRequest{Offset: 10})
+	require.Error(t, err)
+
+	// deleteの権限が無ければ消せない
+	_, err = nobody.DeleteRecords(ctx, &api.DeleteRecordsRequest{Offset: 3})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testTopicsDisabled(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// トピックのログが設定されていなければ、トピックを指定したリクエストは失敗する
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, list.Topics)
+}
+
 func testProduceConsumeStream(
 	t *testing.T,
 	client, _ api.LogClient,
@@ -270,14 +580,154 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// 時刻は書き込んだときにサーバーが決める
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
 }
 
+// ConsumeRawで受け取ったフレームを別のログに書き込むと、同じオフセットのレコードになることを確認
+func testConsumeRaw(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, config.CommitLog.(*log.Log).Sync())
+
+	stream, err := client.ConsumeRaw(ctx, &api.ConsumeRawRequest{Offset: 1})
+	require.NoError(t, err)
+	var frames bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		frames.Write(res.Frames)
+	}
+
+	dir, err := os.MkdirTemp("", "consume-raw-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.InitialOffset = 1
+	follower, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+	n, err := follower.AppendRaw(&frames)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	for i := uint64(1); i < 3; i++ {
+		got, err := follower.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+	}
+}
+
+func testConsumeStreamFromLatest(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// latestから読み始めた場合、既存のレコードは届かず、次に書き込まれたレコードが届くことを確認
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("existing")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		From: api.StartPosition_LATEST,
+	})
+	require.NoError(t, err)
+
+	// サーバー側で読み始める位置が決まるのを待ってから書き込む
+	time.Sleep(50 * time.Millisecond)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("new")},
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, res.Record.Offset)
+	require.Equal(t, []byte("new"), res.Record.Value)
+}
+
+func testConsumeStreamTail(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// 末尾に達したストリームはエラーを返さずに書き込みを待ち、ログが閉じられると終わることを確認
+	ctx := context.Background()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value},
+		})
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, value, res.Record.Value)
+	}
+
+	require.NoError(t, config.CommitLog.(*log.Log).Close())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testProduceStreamPipeline(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	// 応答を待たずに送り続けても、すべてのオフセットがリクエストの順に返ることを確認
+	ctx := context.Background()
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		err := stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
 func testUnauthorized(
 	t *testing.T,
 	_,
@@ -311,4 +761,20 @@ func testUnauthorized(
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if offsets != nil {
+		t.Fatalf("offsets response should be nil")
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
+	deleted, err := client.Delete(ctx, &api.DeleteRequest{Key: []byte("user")})
+	if deleted != nil {
+		t.Fatalf("delete response should be nil")
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
 }
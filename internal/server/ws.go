@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /wsは、一つのWebSocketの接続でレコードの書き込みと購読を行う。gRPCのストリームを使えないブラウザなどのためのもの。
+// フレームはどちらの向きもJSONのテキストメッセージで、typeで種類を表す。
+// produceにはproducedかerrorを同じidで返し、subscribeの後は書き込まれたレコードをrecordで届け続ける。
+// 届けるレコードにはオフセットが入っているので、再接続したら最後に受け取ったオフセットの次からsubscribeし直せばよい
+
+// WebSocketでやり取りするメッセージの種類
+const (
+	// クライアントから。recordを書き込む
+	wsProduce = "produce"
+	// クライアントから。offset(fromがあればearliestかlatest)からのレコードを購読する。購読中なら前の購読をやめる
+	wsSubscribe = "subscribe"
+	// クライアントから。購読をやめる
+	wsUnsubscribe = "unsubscribe"
+	// サーバーから。produceで書き込んだレコードのオフセット
+	wsProduced = "produced"
+	// サーバーから。購読しているレコード
+	wsRecord = "record"
+	// サーバーから。ログが閉じられ、購読が終わった
+	wsClosed = "closed"
+	// サーバーから。idのリクエストを処理できなかったか、idが無ければ読めないレコードに当たって購読が終わった
+	wsError = "error"
+)
+
+// WebSocketでやり取りするメッセージ
+type WSMessage struct {
+	Type string `json:"type"`
+	// produceとその応答を対応付けるための、クライアントが決めるID
+	ID     string  `json:"id,omitempty"`
+	Record *Record `json:"record,omitempty"`
+	Offset uint64  `json:"offset"`
+	// subscribeで、offsetの代わりにearliestかlatestから読む
+	From  string `json:"from,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// 一つのメッセージの書き込みを待つ時間。読まないクライアントのために購読が止まり続けないようにする
+const wsWriteTimeout = 10 * time.Second
+
+// 購読できないログでsubscribeされた
+var errStreamingUnsupported = errors.New("log does not support streaming")
+
+// Originの確認はgorilla/websocketの既定のまま、同じオリジンからの接続だけを受け付ける
+var wsUpgrader = websocket.Upgrader{}
+
+// 購読のゴルーチンと応答が同時に書き込まないよう、書き込みをロックで順に行う接続
+type wsConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *wsConn) send(msg WSMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(msg)
+}
+
+// 接続をWebSocketに切り替え、クライアントが閉じるまでメッセージを処理する。
+// produceは受け取った順に書き込んで応答し、購読はその間も別のゴルーチンで届け続ける
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// 失敗した場合は、Upgradeがエラーの応答を返している
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// サーバーが止まるときは、クライアントに閉じることを伝えてから接続を切り、読み込みを終わらせる
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+		case <-r.Context().Done():
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"),
+				time.Now().Add(wsWriteTimeout),
+			)
+			conn.Close()
+		}
+	}()
+	c := &wsConn{conn: conn}
+	stop := func() {}
+	defer func() { stop() }()
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case wsProduce:
+			if msg.Record == nil {
+				err = c.send(WSMessage{Type: wsError, ID: msg.ID, Error: "produce requires a record"})
+				break
+			}
+			off, appendErr := s.append(msg.Record.apiRecord())
+			if appendErr != nil {
+				err = c.send(WSMessage{Type: wsError, ID: msg.ID, Error: appendErr.Error()})
+			} else {
+				err = c.send(WSMessage{Type: wsProduced, ID: msg.ID, Offset: off})
+			}
+		case wsSubscribe:
+			stop()
+			stop = func() {}
+			off := msg.Offset
+			if msg.From != "" {
+				off, err = s.startOffset(msg.From)
+			}
+			if err == nil {
+				stop, err = s.wsSubscribe(c, off)
+			}
+			if err != nil {
+				stop = func() {}
+				err = c.send(WSMessage{Type: wsError, ID: msg.ID, Error: err.Error()})
+			}
+		case wsUnsubscribe:
+			stop()
+			stop = func() {}
+		default:
+			err = c.send(WSMessage{Type: wsError, ID: msg.ID, Error: "unknown message type " + msg.Type})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// offからのレコードをcへ届けるゴルーチンを始め、止めて終わるのを待つ関数を返す
+func (s *httpServer) wsSubscribe(c *wsConn, off uint64) (stop func(), err error) {
+	sub, ok := s.Log.(subscriber)
+	if !ok {
+		return nil, errStreamingUnsupported
+	}
+	subscription, err := sub.Subscribe(off, consumeStreamBuffer)
+	if err != nil {
+		return nil, err
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			case e, ok := <-subscription.C:
+				if ok && e.Err != nil {
+					c.send(WSMessage{Type: wsError, Offset: e.LastOffset, Error: e.Err.Error()})
+					return
+				}
+				if !ok || e.Closed {
+					c.send(WSMessage{Type: wsClosed, Offset: e.LastOffset})
+					return
+				}
+				record := newRecord(e.Record)
+				if err := c.send(WSMessage{Type: wsRecord, Record: &record, Offset: record.Offset}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		subscription.Unsubscribe()
+		close(quit)
+		<-done
+	}, nil
+}